@@ -0,0 +1,571 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/01org/ciao/ssntp"
+)
+
+// The CA directory layout. The CA certificate and CRL are meant to be
+// distributed to all SSNTP nodes, through their CAcert and CRL
+// configuration fields. The CA private key must never leave the
+// directory. Every issued certificate is kept in the issued
+// sub-directory, named after its serial number.
+const (
+	caCertFile = "ca_cert.pem"
+	caKeyFile  = "ca_key.pem"
+	crlFile    = "crl.pem"
+	issuedDir  = "issued"
+)
+
+type command struct {
+	usage string
+	run   func(args []string)
+}
+
+var commands = map[string]command{
+	"init-ca": {"Create a new certification authority", initCA},
+	"sign":    {"Sign a certificate signing request", sign},
+	"revoke":  {"Revoke a certificate and update the CRL", revoke},
+	"list":    {"List issued certificates", list},
+	"renew":   {"Renew an issued certificate", renew},
+}
+
+func commandsUsage() {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "Usage: ciao-cert <command> [options]\n\n")
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s%s\n", name, commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun ciao-cert <command> -help for the command options.\n")
+	fmt.Fprintf(os.Stderr, "Without a command, ciao-cert generates self signed certificates:\n\n")
+	flag.PrintDefaults()
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet("ciao-cert "+name, flag.ExitOnError)
+}
+
+func caPath(dir, file string) string {
+	return path.Join(dir, file)
+}
+
+func generateKey(isElliptic bool) interface{} {
+	var priv interface{}
+	var err error
+
+	if isElliptic == false {
+		priv, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		priv, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	}
+	if err != nil {
+		log.Fatalf("failed to generate private key: %s", err)
+	}
+
+	return priv
+}
+
+func newSerialNumber() *big.Int {
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		log.Fatalf("failed to generate serial number: %s", err)
+	}
+
+	return serialNumber
+}
+
+func writePEM(file string, perm os.FileMode, blocks ...*pem.Block) {
+	out, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		log.Fatalf("failed to open %s for writing: %s", file, err)
+	}
+	defer out.Close()
+
+	for _, block := range blocks {
+		err = pem.Encode(out, block)
+		if err != nil {
+			log.Fatalf("failed to write %s: %s", file, err)
+		}
+	}
+}
+
+func readPEM(file string, blockType string) *pem.Block {
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Fatalf("Could not load %s: %s", file, err)
+	}
+
+	for {
+		var block *pem.Block
+
+		block, bytes = pem.Decode(bytes)
+		if block == nil {
+			log.Fatalf("No %s found in %s", blockType, file)
+		}
+
+		if block.Type == blockType {
+			return block
+		}
+	}
+}
+
+func readCertificate(file string) *x509.Certificate {
+	block := readPEM(file, "CERTIFICATE")
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		log.Fatalf("Could not parse %s: %s", file, err)
+	}
+
+	return cert
+}
+
+func parsePrivateKey(block *pem.Block) (interface{}, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	return nil, fmt.Errorf("Unsupported private key type %s", block.Type)
+}
+
+func loadCA(dir string) (*x509.Certificate, interface{}) {
+	cert := readCertificate(caPath(dir, caCertFile))
+
+	keyFile := caPath(dir, caKeyFile)
+	keyBytes, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		log.Fatalf("Could not load %s: %s", keyFile, err)
+	}
+
+	keyBlock, _ := pem.Decode(keyBytes)
+	if keyBlock == nil {
+		log.Fatalf("Invalid CA private key %s", keyFile)
+	}
+
+	key, err := parsePrivateKey(keyBlock)
+	if err != nil {
+		log.Fatalf("Could not get CA private key %s", err)
+	}
+
+	return cert, key
+}
+
+// issue signs template with the CA key and keeps a copy of the new
+// certificate in the CA issued directory.
+func issue(dir string, template *x509.Certificate, pub interface{}) []byte {
+	ca, caKey := loadCA(dir)
+
+	if template.NotAfter.After(ca.NotAfter) {
+		log.Printf("WARNING: Certificate expires after the CA, on %s", ca.NotAfter)
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, ca, pub, caKey)
+	if err != nil {
+		log.Fatalf("Failed to create certificate: %s", err)
+	}
+
+	issued := caPath(dir, issuedDir)
+	err = os.MkdirAll(issued, 0755)
+	if err != nil {
+		log.Fatalf("Could not create %s: %s", issued, err)
+	}
+
+	writePEM(path.Join(issued, template.SerialNumber.String()+".pem"), 0644,
+		&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+
+	return derBytes
+}
+
+func nodeTemplate(subject pkix.Name, role ssntp.Role, days int) *x509.Certificate {
+	notBefore := time.Now()
+
+	return &x509.Certificate{
+		SerialNumber: newSerialNumber(),
+		Subject:      subject,
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(time.Duration(days) * 24 * time.Hour),
+
+		KeyUsage:           x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		UnknownExtKeyUsage: addOIDs(role, nil),
+	}
+}
+
+func addHosts(template *x509.Certificate, hosts string, ips string) {
+	for _, h := range strings.Split(hosts, ",") {
+		if len(h) == 0 || net.ParseIP(h) != nil {
+			continue
+		}
+		template.DNSNames = append(template.DNSNames, h)
+	}
+
+	for _, i := range strings.Split(ips, ",") {
+		if ip := net.ParseIP(i); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		}
+	}
+}
+
+// getRole is the addOIDs reverse operation.
+func getRole(oids []asn1.ObjectIdentifier) ssntp.Role {
+	role := (ssntp.Role)(ssntp.UNKNOWN)
+
+	for _, r := range []ssntp.Role{ssntp.AGENT, ssntp.SCHEDULER, ssntp.Controller,
+		ssntp.NETAGENT, ssntp.SERVER, ssntp.CNCIAGENT} {
+		roleOIDs := addOIDs(r, nil)
+		for _, oid := range oids {
+			if oid.Equal(roleOIDs[0]) {
+				role |= r
+			}
+		}
+	}
+
+	return role
+}
+
+func loadRevoked(dir string) []pkix.RevokedCertificate {
+	crlBytes, err := ioutil.ReadFile(caPath(dir, crlFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		log.Fatalf("Could not load CRL: %s", err)
+	}
+
+	crl, err := x509.ParseCRL(crlBytes)
+	if err != nil {
+		log.Fatalf("Could not parse CRL: %s", err)
+	}
+
+	return crl.TBSCertList.RevokedCertificates
+}
+
+func writeCRL(dir string, revoked []pkix.RevokedCertificate, days int) {
+	ca, caKey := loadCA(dir)
+
+	now := time.Now()
+	crlBytes, err := ca.CreateCRL(rand.Reader, caKey, revoked, now,
+		now.Add(time.Duration(days)*24*time.Hour))
+	if err != nil {
+		log.Fatalf("Failed to create CRL: %s", err)
+	}
+
+	writePEM(caPath(dir, crlFile), 0644, &pem.Block{Type: "X509 CRL", Bytes: crlBytes})
+}
+
+func isRevoked(revoked []pkix.RevokedCertificate, serial *big.Int) bool {
+	for _, r := range revoked {
+		if r.SerialNumber.Cmp(serial) == 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// expiryWarning returns a warning if cert has expired or expires within
+// warnDays days, and an empty string otherwise.
+func expiryWarning(cert *x509.Certificate, warnDays int) string {
+	left := cert.NotAfter.Sub(time.Now())
+
+	if left <= 0 {
+		return fmt.Sprintf("expired on %s", cert.NotAfter.Format(time.RFC3339))
+	}
+
+	if left < time.Duration(warnDays)*24*time.Hour {
+		return fmt.Sprintf("expires in %d days", int(left.Hours()/24))
+	}
+
+	return ""
+}
+
+func initCA(args []string) {
+	fs := newFlagSet("init-ca")
+	dir := fs.String("directory", ".", "CA directory")
+	hosts := fs.String("host", "", "Comma-separated hostnames SSNTP clients can connect to")
+	ips := fs.String("ip", "", "Comma-separated IPs SSNTP clients can connect to")
+	isElliptic := fs.Bool("elliptic-key", false, "Use elliptic curve algorithms")
+	email := fs.String("email", "ciao-devel@lists.clearlinux.org", "Certificate email address")
+	organization := fs.String("organization", "", "Certificates organization")
+	days := fs.Int("days", 3650, "CA certificate validity, in days")
+	crlDays := fs.Int("crl-days", 30, "CRL validity, in days")
+	fs.Parse(args)
+
+	keyFile := caPath(*dir, caKeyFile)
+	if _, err := os.Stat(keyFile); err == nil {
+		log.Fatalf("%s already exists", keyFile)
+	}
+
+	err := os.MkdirAll(*dir, 0700)
+	if err != nil {
+		log.Fatalf("Could not create %s: %s", *dir, err)
+	}
+
+	priv := generateKey(*isElliptic)
+	notBefore := time.Now()
+	template := x509.Certificate{
+		SerialNumber: newSerialNumber(),
+		Subject: pkix.Name{
+			Organization: []string{*organization},
+			CommonName:   "ciao CA",
+		},
+		NotBefore: notBefore,
+		NotAfter:  notBefore.Add(time.Duration(*days) * 24 * time.Hour),
+
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		EmailAddresses:        []string{*email},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	addHosts(&template, *hosts, *ips)
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, publicKey(priv), priv)
+	if err != nil {
+		log.Fatalf("Failed to create certificate: %s", err)
+	}
+
+	writePEM(keyFile, 0600, pemBlockForKey(priv))
+	writePEM(caPath(*dir, caCertFile), 0644, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	writeCRL(*dir, nil, *crlDays)
+
+	fmt.Printf("--------------------------------------------------------\n")
+	fmt.Printf("CA certificate: [%s]\n", caPath(*dir, caCertFile))
+	fmt.Printf("CA private key: [%s]\n", keyFile)
+	fmt.Printf("CRL:            [%s]\n", caPath(*dir, crlFile))
+	fmt.Printf("--------------------------------------------------------\n")
+	fmt.Printf("You should now copy \"%s\" and \"%s\" ", caPath(*dir, caCertFile), caPath(*dir, crlFile))
+	fmt.Printf("to all SSNTP clients and servers, and pass them through their ")
+	fmt.Printf("Config CAcert and CRL fields. \"%s\" must not leave this directory.\n", keyFile)
+}
+
+func sign(args []string) {
+	var role ssntp.Role
+
+	fs := newFlagSet("sign")
+	dir := fs.String("directory", ".", "CA directory")
+	csrFile := fs.String("csr", "", "PEM encoded certificate signing request")
+	out := fs.String("out", "", "Signed certificate path")
+	hosts := fs.String("host", "", "Additional comma-separated hostnames")
+	ips := fs.String("ip", "", "Additional comma-separated IPs")
+	days := fs.Int("days", 365, "Certificate validity, in days")
+	fs.Var(&role, "role", "Comma separated list of SSNTP role [agent, scheduler, controller, netagent, server, cnciagent]")
+	fs.Parse(args)
+
+	if len(*csrFile) == 0 {
+		log.Fatalf("Missing required --csr parameter")
+	}
+
+	if role == ssntp.UNKNOWN {
+		log.Fatalf("Missing required --role parameter")
+	}
+
+	block := readPEM(*csrFile, "CERTIFICATE REQUEST")
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		log.Fatalf("Could not parse %s: %s", *csrFile, err)
+	}
+
+	err = csr.CheckSignature()
+	if err != nil {
+		log.Fatalf("Invalid CSR signature: %s", err)
+	}
+
+	template := nodeTemplate(csr.Subject, role, *days)
+	template.EmailAddresses = csr.EmailAddresses
+	template.DNSNames = csr.DNSNames
+	template.IPAddresses = csr.IPAddresses
+	addHosts(template, *hosts, *ips)
+
+	derBytes := issue(*dir, template, csr.PublicKey)
+
+	certName := *out
+	if len(certName) == 0 {
+		certName = fmt.Sprintf("cert-%s%s.pem", role.String(), csr.Subject.CommonName)
+	}
+	writePEM(certName, 0644, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+
+	fmt.Printf("--------------------------------------------------------\n")
+	fmt.Printf("Certificate: [%s]\n", certName)
+	fmt.Printf("Serial:      [%s]\n", template.SerialNumber)
+	fmt.Printf("--------------------------------------------------------\n")
+	fmt.Printf("You should now copy \"%s\" back to the node and append ", certName)
+	fmt.Printf("it with the CSR private key, before passing it to SSNTP ")
+	fmt.Printf("through its Config Cert field.\n")
+}
+
+func revoke(args []string) {
+	fs := newFlagSet("revoke")
+	dir := fs.String("directory", ".", "CA directory")
+	serialString := fs.String("serial", "", "Serial number of the certificate to revoke")
+	certFile := fs.String("cert", "", "Certificate to revoke, instead of its serial number")
+	crlDays := fs.Int("crl-days", 30, "CRL validity, in days")
+	fs.Parse(args)
+
+	var serial *big.Int
+	if len(*certFile) != 0 {
+		serial = readCertificate(*certFile).SerialNumber
+	} else if len(*serialString) != 0 {
+		var ok bool
+		serial, ok = new(big.Int).SetString(*serialString, 10)
+		if !ok {
+			log.Fatalf("Invalid serial number %s", *serialString)
+		}
+	} else {
+		log.Fatalf("Missing required --serial or --cert parameter")
+	}
+
+	revoked := loadRevoked(*dir)
+	if isRevoked(revoked, serial) {
+		log.Fatalf("Certificate %s is already revoked", serial)
+	}
+
+	revoked = append(revoked, pkix.RevokedCertificate{
+		SerialNumber:   serial,
+		RevocationTime: time.Now(),
+	})
+	writeCRL(*dir, revoked, *crlDays)
+
+	fmt.Printf("Certificate %s revoked\n", serial)
+	fmt.Printf("You should now copy \"%s\" to all SSNTP clients and servers, ", caPath(*dir, crlFile))
+	fmt.Printf("they will reload it automatically.\n")
+}
+
+func list(args []string) {
+	fs := newFlagSet("list")
+	dir := fs.String("directory", ".", "CA directory")
+	warnDays := fs.Int("warn-days", 30, "Warn about certificates expiring within that many days")
+	fs.Parse(args)
+
+	issued := caPath(*dir, issuedDir)
+	files, err := ioutil.ReadDir(issued)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatalf("Could not read %s: %s", issued, err)
+	}
+
+	revoked := loadRevoked(*dir)
+
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintln(w, "Serial\tSubject\tRoles\tExpires\tStatus")
+
+	for _, file := range files {
+		if path.Ext(file.Name()) != ".pem" {
+			continue
+		}
+
+		cert := readCertificate(path.Join(issued, file.Name()))
+		role := getRole(cert.UnknownExtKeyUsage)
+
+		status := "valid"
+		if isRevoked(revoked, cert.SerialNumber) {
+			status = "revoked"
+		} else if warning := expiryWarning(cert, *warnDays); warning != "" {
+			status = "WARNING: " + warning
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", cert.SerialNumber, cert.Subject.CommonName,
+			strings.TrimSuffix(role.String(), "-"), cert.NotAfter.Format(time.RFC3339), status)
+	}
+
+	w.Flush()
+
+	ca := readCertificate(caPath(*dir, caCertFile))
+	if warning := expiryWarning(ca, *warnDays); warning != "" {
+		fmt.Printf("WARNING: CA certificate %s\n", warning)
+	}
+}
+
+func renew(args []string) {
+	fs := newFlagSet("renew")
+	dir := fs.String("directory", ".", "CA directory")
+	certFile := fs.String("cert", "", "Certificate to renew")
+	out := fs.String("out", "", "Renewed certificate path")
+	days := fs.Int("days", 365, "Renewed certificate validity, in days")
+	warnDays := fs.Int("warn-days", 30, "Warn about certificates expiring within that many days")
+	fs.Parse(args)
+
+	if len(*certFile) == 0 {
+		log.Fatalf("Missing required --cert parameter")
+	}
+
+	cert := readCertificate(*certFile)
+	if warning := expiryWarning(cert, *warnDays); warning != "" {
+		log.Printf("WARNING: Certificate %s %s", cert.SerialNumber, warning)
+	} else {
+		log.Printf("Certificate %s is valid until %s", cert.SerialNumber,
+			cert.NotAfter.Format(time.RFC3339))
+	}
+
+	if isRevoked(loadRevoked(*dir), cert.SerialNumber) {
+		log.Fatalf("Certificate %s is revoked", cert.SerialNumber)
+	}
+
+	// The renewed certificate keeps the node public key, its
+	// subject and its SSNTP roles.
+	template := nodeTemplate(cert.Subject, getRole(cert.UnknownExtKeyUsage), *days)
+	template.EmailAddresses = cert.EmailAddresses
+	template.DNSNames = cert.DNSNames
+	template.IPAddresses = cert.IPAddresses
+
+	derBytes := issue(*dir, template, cert.PublicKey)
+
+	// Node certificate files also contain their private key, we do
+	// not overwrite them.
+	certName := *out
+	if len(certName) == 0 {
+		certName = path.Join(path.Dir(*certFile), "renewed-"+path.Base(*certFile))
+	}
+	writePEM(certName, 0644, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+
+	fmt.Printf("Certificate %s renewed as %s in [%s], valid until %s\n",
+		cert.SerialNumber, template.SerialNumber, certName,
+		template.NotAfter.Format(time.RFC3339))
+	fmt.Printf("You should now copy \"%s\" back to the node and append ", certName)
+	fmt.Printf("it with the node private key. The previous certificate ")
+	fmt.Printf("remains valid until it expires, unless it gets revoked.\n")
+}
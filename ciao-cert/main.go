@@ -27,7 +27,6 @@ package main
 
 import (
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -39,7 +38,6 @@ import (
 	"github.com/01org/ciao/ssntp"
 	"io/ioutil"
 	"log"
-	"math/big"
 	"net"
 	"os"
 	"strings"
@@ -172,6 +170,18 @@ func main() {
 	var parentCert x509.Certificate
 	var role ssntp.Role
 
+	if len(os.Args) > 1 && strings.HasPrefix(os.Args[1], "-") == false {
+		cmd, ok := commands[os.Args[1]]
+		if !ok {
+			commandsUsage()
+			os.Exit(2)
+		}
+
+		cmd.run(os.Args[2:])
+		return
+	}
+
+	flag.Usage = commandsUsage
 	flag.Var(&role, "role", "Comma separated list of SSNTP role [agent, scheduler, controller, netagent, server, cnciagent]")
 	flag.Parse()
 
@@ -185,26 +195,13 @@ func main() {
 		log.Fatalf("Missing required --server-cert parameter")
 	}
 
-	if *isElliptic == false {
-		priv, err = rsa.GenerateKey(rand.Reader, 2048)
-	} else {
-		priv, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
-	}
-	if err != nil {
-		log.Fatalf("failed to generate private key: %s", err)
-	}
+	priv = generateKey(*isElliptic)
 
 	notBefore := time.Now()
 	notAfter := notBefore.Add(365 * 24 * time.Hour)
 
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
-	if err != nil {
-		log.Fatalf("failed to generate serial number: %s", err)
-	}
-
 	template := x509.Certificate{
-		SerialNumber: serialNumber,
+		SerialNumber: newSerialNumber(),
 		Subject: pkix.Name{
 			Organization: []string{*organization},
 		},
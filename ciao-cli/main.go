@@ -596,6 +596,18 @@ func actionAllTenantInstance(tenant string, osAction string) {
 		fatalf("Action %s on all instances failed: %s", osAction, resp.Status)
 	}
 
+	var results payloads.CiaoServersActionResults
+	err = unmarshalHTTPResponse(resp, &results)
+	if err != nil {
+		fatalf(err.Error())
+	}
+
+	for _, r := range results.Results {
+		if r.Status != payloads.ServerActionAccepted {
+			fmt.Printf("%s %s failed: %s (%s)\n", osAction, r.ID, r.Status, r.Message)
+		}
+	}
+
 	fmt.Printf("%s all instances for tenant %s\n", osAction, tenant)
 }
 
@@ -679,11 +691,13 @@ func startStopInstance(tenant, instance string, stop bool) {
 		fatalf("Missing required -instance parameter")
 	}
 
-	actionBytes := []byte(osStart)
+	action := osStart
 	if stop == true {
-		actionBytes = []byte(osStop)
+		action = osStop
 	}
 
+	actionBytes := []byte(fmt.Sprintf("{\"%s\":null}", action))
+
 	body := bytes.NewReader(actionBytes)
 
 	url := buildComputeURL("%s/servers/%s/action", tenant, instance)
@@ -976,6 +990,11 @@ func main() {
 		fatalf(err.Error())
 	}
 
+	if flag.Arg(0) == "workload" {
+		cliWorkload(flag.Args()[1:])
+		return
+	}
+
 	cliList()
 	cliDump()
 	cliActionInstances()
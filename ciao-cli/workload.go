@@ -0,0 +1,299 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/01org/ciao/payloads"
+)
+
+const workloadUsage = `usage: ciao-cli [options] workload <command> [arguments]
+
+The workload commands require admin credentials:
+
+	list
+	show <workload>
+	create [workload options]
+	update [workload options] <workload>
+	delete <workload>
+
+Workload options:
+`
+
+// workloadOptions are the workload create and update command options.
+type workloadOptions struct {
+	flags       *flag.FlagSet
+	description string
+	fwType      string
+	vmType      string
+	imageID     string
+	imageName   string
+	config      string
+	vcpus       int
+	memMB       int
+	diskMB      int
+}
+
+func newWorkloadOptions(command string) *workloadOptions {
+	opts := &workloadOptions{
+		flags: flag.NewFlagSet("workload "+command, flag.ExitOnError),
+	}
+
+	opts.flags.StringVar(&opts.description, "description", "", "Workload description")
+	opts.flags.StringVar(&opts.fwType, "fw-type", string(payloads.Legacy), "Firmware type (legacy or efi)")
+	opts.flags.StringVar(&opts.vmType, "vm-type", string(payloads.QEMU), "VM type (qemu or docker)")
+	opts.flags.StringVar(&opts.imageID, "image-id", "", "Image UUID, for qemu workloads")
+	opts.flags.StringVar(&opts.imageName, "image-name", "", "Image name, for docker workloads")
+	opts.flags.StringVar(&opts.config, "config", "", "Path to the cloud-init configuration file")
+	opts.flags.IntVar(&opts.vcpus, "vcpus", 1, "Default number of VCPUs")
+	opts.flags.IntVar(&opts.memMB, "mem-mb", 256, "Default memory in MB")
+	opts.flags.IntVar(&opts.diskMB, "disk-mb", 0, "Default disk space in MB")
+	opts.flags.Usage = workloadHelp
+
+	return opts
+}
+
+func workloadHelp() {
+	fmt.Fprintf(os.Stderr, workloadUsage)
+	newWorkloadOptions("").flags.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(os.Stderr, "  -%s\n\t%s (default %q)\n", f.Name, f.Usage, f.DefValue)
+	})
+	os.Exit(2)
+}
+
+func setWorkloadResource(wl *payloads.CiaoWorkload, resource payloads.Resource, value int) {
+	for i := range wl.Defaults {
+		if wl.Defaults[i].Type == resource {
+			wl.Defaults[i].Value = value
+			return
+		}
+	}
+
+	wl.Defaults = append(wl.Defaults, payloads.CiaoWorkloadResource{
+		Type:      resource,
+		Value:     value,
+		Mandatory: true,
+	})
+}
+
+// apply sets the options given on the command line into wl.  All
+// options are applied to a new workload, only the ones explicitly
+// set to an existing one.
+func (opts *workloadOptions) apply(wl *payloads.CiaoWorkload, all bool) {
+	set := func(f *flag.Flag) {
+		switch f.Name {
+		case "description":
+			wl.Description = opts.description
+		case "fw-type":
+			wl.FWType = payloads.Firmware(opts.fwType)
+		case "vm-type":
+			wl.VMType = payloads.Hypervisor(opts.vmType)
+		case "image-id":
+			wl.ImageID = opts.imageID
+		case "image-name":
+			wl.ImageName = opts.imageName
+		case "config":
+			if opts.config == "" {
+				return
+			}
+			config, err := ioutil.ReadFile(opts.config)
+			if err != nil {
+				fatalf("Could not read cloud-init configuration: %s", err)
+			}
+			wl.Config = string(config)
+		case "vcpus":
+			setWorkloadResource(wl, payloads.VCPUs, opts.vcpus)
+		case "mem-mb":
+			setWorkloadResource(wl, payloads.MemMB, opts.memMB)
+		case "disk-mb":
+			if opts.diskMB > 0 || !all {
+				setWorkloadResource(wl, payloads.DiskMB, opts.diskMB)
+			}
+		}
+	}
+
+	if all == true {
+		opts.flags.VisitAll(set)
+	} else {
+		opts.flags.Visit(set)
+	}
+}
+
+func dumpWorkload(wl payloads.CiaoWorkload) {
+	fmt.Printf("\tName: %s\n\tUUID: %s\n\tVM type: %s\n", wl.Description, wl.ID, wl.VMType)
+
+	if wl.VMType == payloads.Docker {
+		fmt.Printf("\tImage name: %s\n", wl.ImageName)
+	} else {
+		fmt.Printf("\tFirmware type: %s\n\tImage UUID: %s\n", wl.FWType, wl.ImageID)
+	}
+
+	for _, r := range wl.Defaults {
+		fmt.Printf("\t%s: %d\n", r.Type, r.Value)
+	}
+}
+
+func getWorkload(workloadID string) payloads.CiaoWorkload {
+	var resp payloads.CiaoWorkloadRequest
+
+	url := buildComputeURL("workloads/%s", workloadID)
+
+	httpResp, err := sendHTTPRequest("GET", url, nil, nil)
+	if err != nil {
+		fatalf(err.Error())
+	}
+
+	err = unmarshalHTTPResponse(httpResp, &resp)
+	if err != nil {
+		fatalf(err.Error())
+	}
+
+	return resp.Workload
+}
+
+func listAllWorkloads() {
+	var workloads payloads.CiaoWorkloads
+
+	url := buildComputeURL("workloads")
+
+	resp, err := sendHTTPRequest("GET", url, nil, nil)
+	if err != nil {
+		fatalf(err.Error())
+	}
+
+	err = unmarshalHTTPResponse(resp, &workloads)
+	if err != nil {
+		fatalf(err.Error())
+	}
+
+	for i, wl := range workloads.Workloads {
+		fmt.Printf("Workload %d\n", i+1)
+		dumpWorkload(wl)
+	}
+}
+
+func showWorkload(workloadID string) {
+	wl := getWorkload(workloadID)
+
+	dumpWorkload(wl)
+	fmt.Printf("\tConfiguration:\n%s\n", wl.Config)
+}
+
+func sendWorkload(method string, url string, wl payloads.CiaoWorkload) payloads.CiaoWorkload {
+	var resp payloads.CiaoWorkloadRequest
+
+	b, err := json.Marshal(payloads.CiaoWorkloadRequest{Workload: wl})
+	if err != nil {
+		fatalf(err.Error())
+	}
+
+	httpResp, err := sendHTTPRequest(method, url, nil, bytes.NewReader(b))
+	if err != nil {
+		fatalf(err.Error())
+	}
+
+	err = unmarshalHTTPResponse(httpResp, &resp)
+	if err != nil {
+		fatalf(err.Error())
+	}
+
+	return resp.Workload
+}
+
+func createWorkload(args []string) {
+	var wl payloads.CiaoWorkload
+
+	opts := newWorkloadOptions("create")
+	opts.flags.Parse(args)
+
+	opts.apply(&wl, true)
+
+	wl = sendWorkload("POST", buildComputeURL("workloads"), wl)
+
+	fmt.Printf("Created workload:\n")
+	dumpWorkload(wl)
+}
+
+func updateWorkload(args []string) {
+	opts := newWorkloadOptions("update")
+	opts.flags.Parse(args)
+
+	if opts.flags.NArg() != 1 {
+		workloadHelp()
+	}
+
+	workloadID := opts.flags.Arg(0)
+	wl := getWorkload(workloadID)
+
+	opts.apply(&wl, false)
+
+	wl = sendWorkload("PUT", buildComputeURL("workloads/%s", workloadID), wl)
+
+	fmt.Printf("Updated workload:\n")
+	dumpWorkload(wl)
+}
+
+func deleteWorkload(workloadID string) {
+	url := buildComputeURL("workloads/%s", workloadID)
+
+	resp, err := sendHTTPRequest("DELETE", url, nil, nil)
+	if err != nil {
+		fatalf(err.Error())
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		fatalf("Workload deletion failed: %s", resp.Status)
+	}
+
+	fmt.Printf("Deleted workload %s\n", workloadID)
+}
+
+func cliWorkload(args []string) {
+	if len(args) == 0 {
+		workloadHelp()
+	}
+
+	switch args[0] {
+	case "list":
+		listAllWorkloads()
+	case "show":
+		if len(args) != 2 {
+			workloadHelp()
+		}
+		showWorkload(args[1])
+	case "delete":
+		if len(args) != 2 {
+			workloadHelp()
+		}
+		deleteWorkload(args[1])
+	case "create":
+		createWorkload(args[1:])
+	case "update":
+		updateWorkload(args[1:])
+	default:
+		workloadHelp()
+	}
+}
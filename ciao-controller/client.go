@@ -17,13 +17,20 @@
 package main
 
 import (
+	"fmt"
+	"github.com/01org/ciao/ciao-controller/types"
 	"github.com/01org/ciao/payloads"
 	"github.com/01org/ciao/ssntp"
 	"github.com/golang/glog"
+	netcontext "golang.org/x/net/context"
 	"gopkg.in/yaml.v2"
 	"time"
 )
 
+// commandTimeout is how long we wait for an agent to process the
+// commands we send through sendCommandAndWait.
+var commandTimeout = 30 * time.Second
+
 type ssntpClient struct {
 	context *controller
 	ssntp   ssntp.Client
@@ -111,6 +118,34 @@ func (client *ssntpClient) EventNotify(event ssntp.Event, frame *ssntp.Frame) {
 		glog.Infof("Node %s disconnected", nodeDisconnected.Disconnected.NodeUUID)
 		client.context.ds.DeleteNode(nodeDisconnected.Disconnected.NodeUUID)
 
+	case ssntp.InstanceEvacuated:
+		var event payloads.EventInstanceEvacuated
+		err := yaml.Unmarshal(payload, &event)
+		if err != nil {
+			glog.Warning("error unmarshalling InstanceEvacuated")
+			return
+		}
+
+		evacuated := event.InstanceEvacuated
+		glog.Infof("Instance %s evacuated from node %s, %d instances left",
+			evacuated.InstanceUUID, evacuated.NodeUUID, evacuated.Remaining)
+		err = client.context.restartEvacuatedInstance(evacuated.InstanceUUID, evacuated.NodeUUID,
+			evacuated.ImageUUID)
+		if err != nil {
+			glog.Warningf("Unable to restart evacuated instance %s: %v", evacuated.InstanceUUID, err)
+		}
+
+	case ssntp.NodeEvacuated:
+		var event payloads.EventNodeEvacuated
+		err := yaml.Unmarshal(payload, &event)
+		if err != nil {
+			glog.Warning("error unmarshalling NodeEvacuated")
+			return
+		}
+
+		glog.Infof("Node %s evacuated, next state %s",
+			event.NodeEvacuated.NodeUUID, event.NodeEvacuated.NextState)
+
 	}
 	glog.V(1).Info(string(payload))
 }
@@ -144,6 +179,38 @@ func (client *ssntpClient) ErrorNotify(err ssntp.Error, frame *ssntp.Frame) {
 			return
 		}
 		client.context.ds.RestartFailure(failure.InstanceUUID, failure.Reason)
+	case ssntp.AttachVolumeFailure:
+		var failure payloads.ErrorAttachVolumeFailure
+		err := yaml.Unmarshal(payload, &failure)
+		if err != nil {
+			glog.Warning("Error unmarshalling AttachVolumeFailure")
+			return
+		}
+		client.context.ds.AttachVolumeFailure(failure.InstanceUUID, failure.VolumeUUID, failure.Reason)
+	case ssntp.DetachVolumeFailure:
+		var failure payloads.ErrorDetachVolumeFailure
+		err := yaml.Unmarshal(payload, &failure)
+		if err != nil {
+			glog.Warning("Error unmarshalling DetachVolumeFailure")
+			return
+		}
+		client.context.ds.DetachVolumeFailure(failure.InstanceUUID, failure.VolumeUUID, failure.Reason)
+	case ssntp.SnapshotFailure:
+		var failure payloads.ErrorSnapshotFailure
+		err := yaml.Unmarshal(payload, &failure)
+		if err != nil {
+			glog.Warning("Error unmarshalling SnapshotFailure")
+			return
+		}
+		client.context.snapshotFailure(failure.InstanceUUID, failure.ImageUUID, failure.Reason)
+	case ssntp.ResizeFailure:
+		var failure payloads.ErrorResizeFailure
+		err := yaml.Unmarshal(payload, &failure)
+		if err != nil {
+			glog.Warning("Error unmarshalling ResizeFailure")
+			return
+		}
+		client.context.resizeFailure(failure.InstanceUUID, failure.Reason, failure.Resources)
 	}
 	glog.V(1).Info(string(payload))
 }
@@ -220,9 +287,7 @@ func (client *ssntpClient) StopInstance(instanceID string, nodeID string) error
 	glog.Info("STOP instance_id: ", instanceID, "node_id ", nodeID)
 	glog.V(1).Info(string(y))
 
-	_, err = client.ssntp.SendCommand(ssntp.STOP, y)
-
-	return err
+	return client.sendCommandAndWait(ssntp.STOP, y)
 }
 
 func (client *ssntpClient) RestartInstance(instanceID string, nodeID string) error {
@@ -243,14 +308,85 @@ func (client *ssntpClient) RestartInstance(instanceID string, nodeID string) err
 	glog.Info("RESTART instance: ", instanceID)
 	glog.V(1).Info(string(y))
 
-	_, err = client.ssntp.SendCommand(ssntp.RESTART, y)
+	return client.sendCommandAndWait(ssntp.RESTART, y)
+}
 
-	return err
+// sendCommandAndWait sends cmd to its agent and waits for the agent to
+// process it. The agent failure, if any, is returned as an error.
+func (client *ssntpClient) sendCommandAndWait(cmd ssntp.Command, payload []byte) error {
+	ctx, cancel := netcontext.WithTimeout(netcontext.Background(), commandTimeout)
+	defer cancel()
+
+	reply, err := client.ssntp.SendCommandAndWait(ctx, cmd, payload)
+	if err != nil {
+		msg := fmt.Sprintf("No %s reply: %v", cmd, err)
+		if ctx.Err() != nil {
+			return commandError{commandTimedOut, msg}
+		}
+		return commandError{commandUnavailable, msg}
+	}
+
+	if reply.Type != ssntp.ERROR {
+		return nil
+	}
+
+	return replyError(reply)
 }
 
-func (client *ssntpClient) EvacuateNode(nodeID string) error {
+func replyError(reply *ssntp.Frame) error {
+	payload := reply.Payload
+
+	switch (ssntp.Error)(reply.Operand) {
+	case ssntp.StopFailure:
+		var failure payloads.ErrorStopFailure
+		err := yaml.Unmarshal(payload, &failure)
+		if err != nil {
+			return err
+		}
+		msg := fmt.Sprintf("Stop Failure %s: %s", failure.InstanceUUID, failure.Reason.String())
+		return commandError{stopFailure(failure.Reason), msg}
+	case ssntp.RestartFailure:
+		var failure payloads.ErrorRestartFailure
+		err := yaml.Unmarshal(payload, &failure)
+		if err != nil {
+			return err
+		}
+		msg := fmt.Sprintf("Restart Failure %s: %s", failure.InstanceUUID, failure.Reason.String())
+		return commandError{restartFailure(failure.Reason), msg}
+	}
+
+	return commandError{commandFailed, (ssntp.Error)(reply.Operand).String()}
+}
+
+func stopFailure(reason payloads.StopFailureReason) commandFailure {
+	switch reason {
+	case payloads.StopNoInstance, payloads.StopAlreadyStopped:
+		return commandInvalidState
+	case payloads.StopNodeUnavailable:
+		return commandUnavailable
+	}
+
+	return commandFailed
+}
+
+func restartFailure(reason payloads.RestartFailureReason) commandFailure {
+	switch reason {
+	case payloads.RestartNoInstance, payloads.RestartAlreadyRunning:
+		return commandInvalidState
+	case payloads.RestartNodeUnavailable:
+		return commandUnavailable
+	}
+
+	return commandFailed
+}
+
+func (client *ssntpClient) EvacuateNode(nodeID string, nextState payloads.EvacuateNextState,
+	migrations []payloads.InstanceMigration, force bool) error {
 	evacuateCmd := payloads.EvacuateCmd{
 		WorkloadAgentUUID: nodeID,
+		NextState:         nextState,
+		Migrations:        migrations,
+		Force:             force,
 	}
 
 	payload := payloads.Evacuate{
@@ -270,6 +406,106 @@ func (client *ssntpClient) EvacuateNode(nodeID string) error {
 	return err
 }
 
+func (client *ssntpClient) AttachVolume(volume *types.Volume, instanceID string, nodeID string) error {
+	attachCmd := payloads.AttachVolumeCmd{
+		InstanceUUID:      instanceID,
+		VolumeUUID:        volume.ID,
+		WorkloadAgentUUID: nodeID,
+		Path:              volume.Path,
+		Format:            volume.Format,
+	}
+
+	payload := payloads.AttachVolume{
+		Attach: attachCmd,
+	}
+
+	y, err := yaml.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	glog.Info("ATTACH_VOLUME volume: ", volume.ID, " instance: ", instanceID)
+	glog.V(1).Info(string(y))
+
+	_, err = client.ssntp.SendCommand(ssntp.AttachVolume, y)
+
+	return err
+}
+
+func (client *ssntpClient) Snapshot(instanceID string, imageID string, uploadToken string, nodeID string) error {
+	snapshotCmd := payloads.SnapshotCmd{
+		InstanceUUID:      instanceID,
+		ImageUUID:         imageID,
+		UploadToken:       uploadToken,
+		WorkloadAgentUUID: nodeID,
+	}
+
+	payload := payloads.Snapshot{
+		Snapshot: snapshotCmd,
+	}
+
+	y, err := yaml.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	glog.Info("SNAPSHOT instance: ", instanceID, " image: ", imageID)
+	glog.V(1).Info(string(y))
+
+	_, err = client.ssntp.SendCommand(ssntp.Snapshot, y)
+
+	return err
+}
+
+func (client *ssntpClient) ResizeInstance(instanceID string, nodeID string, requested []payloads.RequestedResource, current []payloads.RequestedResource) error {
+	resizeCmd := payloads.ResizeCmd{
+		InstanceUUID:       instanceID,
+		WorkloadAgentUUID:  nodeID,
+		RequestedResources: requested,
+		CurrentResources:   current,
+	}
+
+	payload := payloads.Resize{
+		Resize: resizeCmd,
+	}
+
+	y, err := yaml.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	glog.Info("RESIZE instance: ", instanceID)
+	glog.V(1).Info(string(y))
+
+	_, err = client.ssntp.SendCommand(ssntp.Resize, y)
+
+	return err
+}
+
+func (client *ssntpClient) DetachVolume(volumeID string, instanceID string, nodeID string) error {
+	detachCmd := payloads.DetachVolumeCmd{
+		InstanceUUID:      instanceID,
+		VolumeUUID:        volumeID,
+		WorkloadAgentUUID: nodeID,
+	}
+
+	payload := payloads.DetachVolume{
+		Detach: detachCmd,
+	}
+
+	y, err := yaml.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	glog.Info("DETACH_VOLUME volume: ", volumeID, " instance: ", instanceID)
+	glog.V(1).Info(string(y))
+
+	_, err = client.ssntp.SendCommand(ssntp.DetachVolume, y)
+
+	return err
+}
+
 func (client *ssntpClient) Disconnect() {
 	client.ssntp.Close()
 }
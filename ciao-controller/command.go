@@ -20,13 +20,176 @@ import (
 	"errors"
 	"fmt"
 	"github.com/01org/ciao/ciao-controller/types"
+	"github.com/01org/ciao/payloads"
+	"github.com/docker/distribution/uuid"
 	"github.com/golang/glog"
+	"net"
 	"time"
 )
 
-func (c *controller) evacuateNode(nodeID string) error {
+var errEvacuationLosesDisks = errors.New("Containers lose their root disks when evacuated, evacuation must be forced")
+
+var errWorkloadNotAvailable = errors.New("Workload not available")
+
+// commandFailure tells why an instance command failed.
+type commandFailure uint8
+
+const (
+	// commandInvalidState means that the instance state does not
+	// allow the command.
+	commandInvalidState commandFailure = iota
+
+	// commandFailed means that the instance node could not process
+	// the command.
+	commandFailed
+
+	// commandUnavailable means that the command could not be
+	// delivered to the instance node.
+	commandUnavailable
+
+	// commandTimedOut means that the instance node did not answer the
+	// command in time.
+	commandTimedOut
+)
+
+// commandError is returned when an instance command, e.g. STOP, fails.
+type commandError struct {
+	failure commandFailure
+	msg     string
+}
+
+func (e commandError) Error() string {
+	return e.msg
+}
+
+// workloadAvailable returns true if tenantID may start instances of wl.
+// Workloads booting from a snapshot are only available to the tenant
+// owning the snapshotted instance.
+func workloadAvailable(wl *types.Workload, tenantID string) bool {
+	return wl.TenantID == "" || wl.TenantID == tenantID
+}
+
+// evacuateNode has all the instances of nodeID restarted on other nodes.
+// The root disk of each VM is uploaded to a new image, which the VM is
+// then restarted from.  Container root disks cannot be migrated, so nodes
+// hosting containers are only evacuated when force is set, the containers
+// restarting from their images.  CNCIs hold no state and are restarted
+// from the CNCI image.
+func (c *controller) evacuateNode(nodeID string, nextState payloads.EvacuateNextState, force bool) error {
+	instances, err := c.ds.GetAllInstancesByNode(nodeID)
+	if err != nil {
+		return err
+	}
+
+	var vms []*types.Instance
+	for _, i := range instances {
+		wl, err := c.ds.GetWorkload(i.WorkloadID)
+		if err != nil {
+			return err
+		}
+
+		if wl.VMType != payloads.Docker {
+			vms = append(vms, i)
+		} else if !force {
+			return errEvacuationLosesDisks
+		}
+	}
+
+	migrations := make([]payloads.InstanceMigration, 0, len(vms))
+	for _, i := range vms {
+		image, err := c.queueImage(&types.Image{
+			Name:        "evacuated-" + i.ID,
+			TenantID:    i.TenantID,
+			UploadToken: uuid.Generate().String(),
+		})
+		if err != nil {
+			return err
+		}
+
+		migrations = append(migrations, payloads.InstanceMigration{
+			InstanceUUID: i.ID,
+			ImageUUID:    image.ID,
+			UploadToken:  image.UploadToken,
+		})
+	}
+
 	// should I bother to see if nodeID is valid?
-	go c.client.EvacuateNode(nodeID)
+	go c.client.EvacuateNode(nodeID, nextState, migrations, force)
+	return nil
+}
+
+// restartEvacuatedInstance restarts an instance which has just been
+// evacuated from nodeID.  The new START command reuses the instance
+// UUID and IP address, and thus its MAC address too, so that the
+// instance keeps its identity on its new node.  If imageID is set, the
+// instance boots from this copy of its root disk rather than from the
+// image of its workload.
+func (c *controller) restartEvacuatedInstance(instanceID string, nodeID string, imageID string) error {
+	tenant, err := c.ds.CNCIEvacuated(instanceID, nodeID)
+	if err == nil {
+		return c.restartEvacuatedCNCI(tenant)
+	}
+
+	err = c.ds.InstanceEvacuated(instanceID, nodeID)
+	if err != nil {
+		return err
+	}
+
+	i, err := c.ds.GetInstance(instanceID)
+	if err != nil {
+		return err
+	}
+
+	wl, err := c.ds.GetWorkload(i.WorkloadID)
+	if err != nil {
+		return err
+	}
+
+	ipAddress := net.ParseIP(i.IPAddress)
+	if ipAddress == nil {
+		return fmt.Errorf("Invalid IP address %s for instance %s", i.IPAddress, instanceID)
+	}
+
+	// resized instances no longer match their workload
+	resized := *wl
+	resized.Defaults = instanceResources(wl.Defaults, i.Usage)
+	if imageID != "" {
+		resized.ImageID = imageID
+	}
+
+	config, err := newConfigWithIP(c, &resized, instanceID, i.TenantID, ipAddress)
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("Restarting evacuated instance %s", instanceID)
+
+	go c.client.StartWorkload(config.config)
+	return nil
+}
+
+// restartEvacuatedCNCI restarts the CNCI of tenant, which is not kept
+// with the tenant instances.  The CNCI reuses its UUID and MAC address,
+// which the tenant record holds.
+func (c *controller) restartEvacuatedCNCI(tenant *types.Tenant) error {
+	workloadID, err := c.ds.GetCNCIWorkloadID()
+	if err != nil {
+		return err
+	}
+
+	wl, err := c.ds.GetWorkload(workloadID)
+	if err != nil {
+		return err
+	}
+
+	config, err := newConfigWithIP(c, wl, tenant.CNCIID, tenant.ID, nil)
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("Restarting evacuated CNCI %s of tenant %s", tenant.CNCIID, tenant.ID)
+
+	go c.client.StartWorkload(config.config)
 	return nil
 }
 
@@ -39,15 +202,14 @@ func (c *controller) restartInstance(instanceID string) error {
 	}
 
 	if i.NodeID == "" {
-		return errors.New("Instance Not Assigned to Node")
+		return commandError{commandInvalidState, "Instance Not Assigned to Node"}
 	}
 
 	if i.State != "exited" {
-		return errors.New("You may only restart paused instances")
+		return commandError{commandInvalidState, "You may only restart paused instances"}
 	}
 
-	go c.client.RestartInstance(instanceID, i.NodeID)
-	return nil
+	return c.client.RestartInstance(instanceID, i.NodeID)
 }
 
 func (c *controller) stopInstance(instanceID string) error {
@@ -58,15 +220,14 @@ func (c *controller) stopInstance(instanceID string) error {
 	}
 
 	if i.NodeID == "" {
-		return errors.New("Instance Not Assigned to Node")
+		return commandError{commandInvalidState, "Instance Not Assigned to Node"}
 	}
 
 	if i.State == "pending" {
-		return errors.New("You may not stop a pending instance")
+		return commandError{commandInvalidState, "You may not stop a pending instance"}
 	}
 
-	go c.client.StopInstance(instanceID, i.NodeID)
-	return nil
+	return c.client.StopInstance(instanceID, i.NodeID)
 }
 
 func (c *controller) deleteInstance(instanceID string) error {
@@ -77,7 +238,7 @@ func (c *controller) deleteInstance(instanceID string) error {
 	}
 
 	if i.NodeID == "" {
-		return errors.New("Instance Not Assigned to Node")
+		return commandError{commandInvalidState, "Instance Not Assigned to Node"}
 	}
 
 	go c.client.DeleteInstance(instanceID, i.NodeID)
@@ -132,6 +293,10 @@ func (c *controller) startWorkload(workloadID string, tenantID string, instances
 		return nil, err
 	}
 
+	if !workloadAvailable(wl, tenantID) {
+		return nil, errWorkloadNotAvailable
+	}
+
 	if !isCNCIWorkload(wl) {
 		err := c.confirmTenant(tenantID)
 		if err != nil {
@@ -174,7 +339,7 @@ func (c *controller) startWorkload(workloadID string, tenantID string, instances
 				continue
 			} else {
 				// stop if we are over limits
-				return nil, errors.New("Over Tenant Limits")
+				return nil, errOverTenantLimits
 			}
 		}
 	}
@@ -18,14 +18,16 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"sort"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/01org/ciao/ciao-controller/types"
@@ -43,6 +45,8 @@ const (
 	computeActionStart action = iota
 	computeActionStop
 	computeActionDelete
+	computeActionCreateImage
+	computeActionResize
 )
 
 type pagerFilterType uint8
@@ -78,6 +82,120 @@ func dumpRequest(r *http.Request) {
 	dumpRequestBody(r, false)
 }
 
+// maxRequestBodySize is the size of the largest request body accepted by
+// the compute API.
+const maxRequestBodySize = 1 << 20
+
+var errMarkerNotFound = errors.New("Marker not found")
+
+// faultNames maps HTTP error statuses to Nova fault names.
+var faultNames = map[int]string{
+	http.StatusBadRequest:            "badRequest",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "itemNotFound",
+	http.StatusConflict:              "conflictingRequest",
+	http.StatusRequestEntityTooLarge: "overLimit",
+	http.StatusServiceUnavailable:    "serviceUnavailable",
+}
+
+// commandErrorCode returns the HTTP status reporting an instance command
+// error.
+func commandErrorCode(err error) int {
+	cmdErr, ok := err.(commandError)
+	if !ok {
+		return http.StatusInternalServerError
+	}
+
+	switch cmdErr.failure {
+	case commandInvalidState:
+		return http.StatusConflict
+	case commandUnavailable:
+		return http.StatusServiceUnavailable
+	case commandTimedOut:
+		return http.StatusGatewayTimeout
+	}
+
+	return http.StatusInternalServerError
+}
+
+// commandErrorStatus returns the bulk server action status reporting an
+// instance command error.
+func commandErrorStatus(err error) payloads.ServerActionStatus {
+	cmdErr, ok := err.(commandError)
+	if !ok {
+		return payloads.ServerActionFailed
+	}
+
+	switch cmdErr.failure {
+	case commandInvalidState:
+		return payloads.ServerActionInvalidState
+	case commandUnavailable:
+		return payloads.ServerActionUnavailable
+	case commandTimedOut:
+		return payloads.ServerActionTimedOut
+	}
+
+	return payloads.ServerActionFailed
+}
+
+// returnErrorCode replies to a request with a Nova compatible JSON error.
+func returnErrorCode(w http.ResponseWriter, message string, code int) {
+	name, ok := faultNames[code]
+	if !ok {
+		name = "computeFault"
+	}
+
+	resp := payloads.HTTPErrorResponse{
+		name: {
+			Code:    code,
+			Message: message,
+		},
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, message, code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+// invalidToken replies to a request which token failed validation.
+// Missing, expired or unknown tokens are unauthorized, while valid tokens
+// lacking the privileges needed by the request are forbidden.
+func invalidToken(w http.ResponseWriter, r *http.Request, context *controller) {
+	token := r.Header.Get("X-Auth-Token")
+	if token == "" || context.id.validateAuthToken(token) == false {
+		returnErrorCode(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	returnErrorCode(w, "Token not authorized for this request", http.StatusForbidden)
+}
+
+// readRequestBody reads the body of a request. It replies with an error
+// and returns false if the body cannot be read or is too large.
+func readRequestBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	defer r.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestBodySize+1))
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	if len(body) > maxRequestBodySize {
+		returnErrorCode(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+
+	return body, true
+}
+
 func pagerQueryParse(r *http.Request) (int, int, string) {
 	values := r.URL.Query()
 	limit := 0
@@ -183,7 +301,7 @@ func (pager *serverPager) nextPage(filterType pagerFilterType, filter string, r
 		}
 	}
 
-	return nil, fmt.Errorf("Item %s not found", lastSeen)
+	return nil, errMarkerNotFound
 }
 
 type nodePager struct {
@@ -251,7 +369,7 @@ func (pager *nodePager) nextPage(filterType pagerFilterType, filter string, r *h
 		}
 	}
 
-	return nil, fmt.Errorf("Item %s not found", lastSeen)
+	return nil, errMarkerNotFound
 }
 
 type nodeServerPager struct {
@@ -321,7 +439,7 @@ func (pager *nodeServerPager) nextPage(filterType pagerFilterType, filter string
 		}
 	}
 
-	return nil, fmt.Errorf("Item %s not found", lastSeen)
+	return nil, errMarkerNotFound
 }
 
 func tenantToken(context *controller, r *http.Request, tenant string) bool {
@@ -343,9 +461,13 @@ func tenantToken(context *controller, r *http.Request, tenant string) bool {
 		return false
 	}
 
-	/* TODO Caching or PKI */
+	if context.tokens.valid(token[0], tenant, false) == true {
+		return true
+	}
+
 	for _, s := range validServices {
 		if context.id.validateService(token[0], tenant, s.serviceType, s.serviceName) == true {
+			context.tokens.add(token[0], tenant, false)
 			return true
 		}
 
@@ -353,6 +475,7 @@ func tenantToken(context *controller, r *http.Request, tenant string) bool {
 
 	for _, s := range validServices {
 		if context.id.validateService(token[0], tenant, s.serviceType, "") == true {
+			context.tokens.add(token[0], tenant, false)
 			return true
 		}
 
@@ -381,9 +504,13 @@ func adminToken(context *controller, r *http.Request) bool {
 		return false
 	}
 
-	/* TODO Caching or PKI */
+	if context.tokens.valid(token[0], "", true) == true {
+		return true
+	}
+
 	for _, a := range validAdmins {
 		if context.id.validateProjectRole(token[0], a.project, a.role) == true {
+			context.tokens.add(token[0], "", true)
 			return true
 		}
 	}
@@ -461,30 +588,30 @@ func showServerDetails(w http.ResponseWriter, r *http.Request, context *controll
 	dumpRequest(r)
 
 	if validateToken(context, r) == false {
-		http.Error(w, "Invalid token", http.StatusInternalServerError)
+		invalidToken(w, r, context)
 		return
 	}
 
 	instance, err := context.ds.GetInstance(instanceID)
 	if err != nil {
-		http.Error(w, "Instance not available", http.StatusInternalServerError)
+		returnErrorCode(w, "Instance not available", http.StatusNotFound)
 		return
 	}
 
 	if instance.TenantID != tenant {
-		http.Error(w, "Instance not available", http.StatusInternalServerError)
+		returnErrorCode(w, "Instance not available", http.StatusNotFound)
 		return
 	}
 
 	server.Server, err = instanceToServer(context, instance)
 	if err != nil {
-		http.Error(w, "Instance not available", http.StatusInternalServerError)
+		returnErrorCode(w, "Instance not available", http.StatusInternalServerError)
 		return
 	}
 
 	b, err := json.Marshal(server)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -500,25 +627,25 @@ func deleteServer(w http.ResponseWriter, r *http.Request, context *controller) {
 	dumpRequest(r)
 
 	if validateToken(context, r) == false {
-		http.Error(w, "Invalid token", http.StatusInternalServerError)
+		invalidToken(w, r, context)
 		return
 	}
 
 	/* First check that the instance belongs to this tenant */
 	i, err := context.ds.GetInstance(instance)
 	if err != nil {
-		http.Error(w, "Instance not available", http.StatusInternalServerError)
+		returnErrorCode(w, "Instance not available", http.StatusNotFound)
 		return
 	}
 
 	if i.TenantID != tenant {
-		http.Error(w, "Instance not available", http.StatusInternalServerError)
+		returnErrorCode(w, "Instance not available", http.StatusNotFound)
 		return
 	}
 
 	err = context.deleteInstance(instance)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), commandErrorCode(err))
 		return
 	}
 
@@ -526,22 +653,28 @@ func deleteServer(w http.ResponseWriter, r *http.Request, context *controller) {
 }
 
 func listFlavors(w http.ResponseWriter, r *http.Request, context *controller) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
 	var flavors payloads.ComputeFlavors
 
 	dumpRequest(r)
 
 	if validateToken(context, r) == false {
-		http.Error(w, "Invalid token", http.StatusInternalServerError)
+		invalidToken(w, r, context)
 		return
 	}
 
 	workloads, err := context.ds.GetWorkloads()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	for _, workload := range workloads {
+		if !workloadAvailable(workload, tenant) {
+			continue
+		}
+
 		flavors.Flavors = append(flavors.Flavors,
 			struct {
 				ID    string          `json:"id"`
@@ -556,7 +689,7 @@ func listFlavors(w http.ResponseWriter, r *http.Request, context *controller) {
 
 	b, err := json.Marshal(flavors)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -579,13 +712,13 @@ func listTenantQuotas(w http.ResponseWriter, r *http.Request, context *controlle
 	dumpRequest(r)
 
 	if validateToken(context, r) == false {
-		http.Error(w, "Invalid token", http.StatusInternalServerError)
+		invalidToken(w, r, context)
 		return
 	}
 
 	t, err := context.ds.GetTenant(tenant)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -593,51 +726,29 @@ func listTenantQuotas(w http.ResponseWriter, r *http.Request, context *controlle
 		if *noNetwork {
 			_, err := context.ds.AddTenant(tenant)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 		} else {
 			err = context.addTenant(tenant)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 		}
 
 		t, err = context.ds.GetTenant(tenant)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 	}
 
-	resources := t.Resources
-
-	tenantResource.ID = t.ID
-
-	for _, resource := range resources {
-		switch resource.Rtype {
-		case instances:
-			tenantResource.InstanceLimit = resource.Limit
-			tenantResource.InstanceUsage = resource.Usage
-
-		case vcpu:
-			tenantResource.VCPULimit = resource.Limit
-			tenantResource.VCPUUsage = resource.Usage
-
-		case memory:
-			tenantResource.MemLimit = resource.Limit
-			tenantResource.MemUsage = resource.Usage
-
-		case disk:
-			tenantResource.DiskLimit = resource.Limit
-			tenantResource.DiskUsage = resource.Usage
-		}
-	}
+	tenantResource = tenantResources(t)
 
 	b, err := json.Marshal(tenantResource)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -674,13 +785,13 @@ func listTenantResources(w http.ResponseWriter, r *http.Request, context *contro
 	dumpRequest(r)
 
 	if validateToken(context, r) == false {
-		http.Error(w, "Invalid token", http.StatusInternalServerError)
+		invalidToken(w, r, context)
 		return
 	}
 
 	start, end, err := tenantQueryParse(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -689,13 +800,13 @@ func listTenantResources(w http.ResponseWriter, r *http.Request, context *contro
 
 	usage.Usages, err = context.ds.GetTenantUsage(tenant, start, end)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	b, err := json.Marshal(usage)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -711,19 +822,22 @@ func showFlavorDetails(w http.ResponseWriter, r *http.Request, context *controll
 	dumpRequest(r)
 
 	if validateToken(context, r) == false {
-		http.Error(w, "Invalid token", http.StatusInternalServerError)
+		invalidToken(w, r, context)
 		return
 	}
 
 	workload, err := context.ds.GetWorkload(workloadID)
+	if err == nil && !workloadAvailable(workload, vars["tenant"]) {
+		err = errWorkloadNotAvailable
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
 	defaults := workload.Defaults
 	if len(defaults) == 0 {
-		http.Error(w, "Workload resources not set", http.StatusInternalServerError)
+		returnErrorCode(w, "Workload resources not set", http.StatusInternalServerError)
 		return
 	}
 
@@ -747,7 +861,7 @@ func showFlavorDetails(w http.ResponseWriter, r *http.Request, context *controll
 
 	b, err := json.Marshal(flavor)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -765,7 +879,7 @@ func listServerDetails(w http.ResponseWriter, r *http.Request, context *controll
 	dumpRequest(r)
 
 	if validateToken(context, r) == false {
-		http.Error(w, "Invalid token", http.StatusInternalServerError)
+		invalidToken(w, r, context)
 		return
 	}
 
@@ -776,7 +890,7 @@ func listServerDetails(w http.ResponseWriter, r *http.Request, context *controll
 	}
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -795,8 +909,11 @@ func listServerDetails(w http.ResponseWriter, r *http.Request, context *controll
 	}
 
 	b, err := pager.nextPage(filterType, filter, r)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err == errMarkerNotFound {
+		returnErrorCode(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -813,21 +930,18 @@ func createServer(w http.ResponseWriter, r *http.Request, context *controller) {
 	dumpRequestBody(r, true)
 
 	if validateToken(context, r) == false {
-		http.Error(w, "Invalid token", http.StatusInternalServerError)
+		invalidToken(w, r, context)
 		return
 	}
 
-	defer r.Body.Close()
-
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	body, ok := readRequestBody(w, r)
+	if !ok {
 		return
 	}
 
-	err = json.Unmarshal(body, &server)
+	err := json.Unmarshal(body, &server)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -839,6 +953,20 @@ func createServer(w http.ResponseWriter, r *http.Request, context *controller) {
 		nInstances = server.Server.MinInstances
 	}
 
+	if nInstances < 1 {
+		returnErrorCode(w, "Invalid number of instances", http.StatusBadRequest)
+		return
+	}
+
+	wl, err := context.ds.GetWorkload(server.Server.Workload)
+	if err == nil && !workloadAvailable(wl, tenant) {
+		err = errWorkloadNotAvailable
+	}
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	trace := false
 	label := ""
 	if server.Server.Name != "" {
@@ -846,15 +974,18 @@ func createServer(w http.ResponseWriter, r *http.Request, context *controller) {
 		label = server.Server.Name
 	}
 	instances, err := context.startWorkload(server.Server.Workload, tenant, nInstances, trace, label)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err == errOverTenantLimits {
+		returnErrorCode(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	for _, instance := range instances {
 		server, err := instanceToServer(context, instance)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		servers.Servers = append(servers.Servers, server)
@@ -863,7 +994,7 @@ func createServer(w http.ResponseWriter, r *http.Request, context *controller) {
 
 	b, err := json.Marshal(servers)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -874,29 +1005,83 @@ func createServer(w http.ResponseWriter, r *http.Request, context *controller) {
 
 type instanceAction func(string) error
 
+// tenantServerAction runs a bulk action on a single instance of tenant and
+// records the outcome in the tenant event log.
+func tenantServerAction(context *controller, tenant string, action string, instanceID string, actionFunc instanceAction) payloads.CiaoServerActionResult {
+	result := payloads.CiaoServerActionResult{
+		ID: instanceID,
+	}
+
+	i, err := context.ds.GetInstance(instanceID)
+	if err != nil {
+		result.Status = payloads.ServerActionNotFound
+		result.Message = "Instance not available"
+	} else if i.TenantID != tenant {
+		result.Status = payloads.ServerActionForbidden
+		result.Message = "Instance belongs to another tenant"
+	} else {
+		err = actionFunc(instanceID)
+		if err != nil {
+			result.Status = commandErrorStatus(err)
+			result.Message = err.Error()
+		} else {
+			result.Status = payloads.ServerActionAccepted
+		}
+	}
+
+	msg := fmt.Sprintf("%s on instance %s: %s", action, instanceID, result.Status)
+	if result.Status == payloads.ServerActionAccepted {
+		err = context.ds.LogEvent(tenant, msg)
+	} else {
+		err = context.ds.LogWarning(tenant, msg+" ("+result.Message+")")
+	}
+	if err != nil {
+		glog.Warningf("Unable to log %s: %v", action, err)
+	}
+
+	return result
+}
+
+// tenantServerActions runs actionFunc on all instanceIDs concurrently, as
+// starting and stopping an instance waits for its node to process the
+// command. Results are returned in the instanceIDs order.
+func tenantServerActions(context *controller, tenant string, action string, instanceIDs []string, actionFunc instanceAction) []payloads.CiaoServerActionResult {
+	results := make([]payloads.CiaoServerActionResult, len(instanceIDs))
+
+	var wg sync.WaitGroup
+	for i, instanceID := range instanceIDs {
+		wg.Add(1)
+		go func(i int, instanceID string) {
+			defer wg.Done()
+			results[i] = tenantServerAction(context, tenant, action, instanceID, actionFunc)
+		}(i, instanceID)
+	}
+	wg.Wait()
+
+	return results
+}
+
 func tenantServersAction(w http.ResponseWriter, r *http.Request, context *controller) {
 	var servers payloads.CiaoServersAction
+	var results payloads.CiaoServersActionResults
 	var actionFunc instanceAction
 	var statusFilter string
 
 	dumpRequestBody(r, true)
 
 	if validateToken(context, r) == false {
-		http.Error(w, "Invalid token", http.StatusInternalServerError)
+		invalidToken(w, r, context)
 		return
 	}
 
-	defer r.Body.Close()
-
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	body, ok := readRequestBody(w, r)
+	if !ok {
 		return
 	}
 
-	err = json.Unmarshal(body, &servers)
+	err := json.Unmarshal(body, &servers)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -910,82 +1095,111 @@ func tenantServersAction(w http.ResponseWriter, r *http.Request, context *contro
 		actionFunc = context.deleteInstance
 		statusFilter = ""
 	} else {
-		http.Error(w, "Unsupported action", http.StatusServiceUnavailable)
+		returnErrorCode(w, "Unsupported action", http.StatusBadRequest)
 		return
 	}
 
-	if len(servers.ServerIDs) > 0 {
-		/* TODO Check that instance belongs to the right tenant */
-		for _, instance := range servers.ServerIDs {
-			actionFunc(instance)
-		}
-	} else {
-		vars := mux.Vars(r)
-		tenant := vars["tenant"]
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+	instanceIDs := servers.ServerIDs
 
+	if len(instanceIDs) == 0 {
 		/* We want to act on all relevant instances */
 		instances, err := context.ds.GetAllInstancesFromTenant(tenant)
 		if err != nil {
-			http.Error(w, "No instances for tenant", http.StatusInternalServerError)
+			returnErrorCode(w, "No instances for tenant", http.StatusInternalServerError)
 			return
 		}
 
-		fmt.Printf("Tenant %s has %d instances\n", tenant, len(instances))
+		glog.V(2).Infof("Tenant %s has %d instances", tenant, len(instances))
 
 		for _, instance := range instances {
 			if statusFilter != "" && instance.State != statusFilter {
 				continue
 			}
 
-			fmt.Printf("Action on %s\n", instance.ID)
-			actionFunc(instance.ID)
+			instanceIDs = append(instanceIDs, instance.ID)
 		}
 	}
 
+	results.Results = tenantServerActions(context, tenant, servers.Action, instanceIDs, actionFunc)
+
+	b, err := json.Marshal(results)
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
+	w.Write(b)
+}
+
+// serverActions maps the names of the supported server actions to their
+// action.
+var serverActions = map[string]action{
+	"os-start":    computeActionStart,
+	"os-stop":     computeActionStop,
+	"createImage": computeActionCreateImage,
+	"resize":      computeActionResize,
+}
+
+// parseServerAction returns the action requested by a server action
+// request body, which must be a JSON object with a single member named
+// after a supported action.
+func parseServerAction(body []byte) (action, error) {
+	var req map[string]json.RawMessage
+
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(req) != 1 {
+		return 0, errors.New("A single action must be requested")
+	}
+
+	for name, a := range serverActions {
+		if _, ok := req[name]; ok {
+			return a, nil
+		}
+	}
+
+	return 0, errors.New("Unsupported action")
 }
 
 func serverAction(w http.ResponseWriter, r *http.Request, context *controller) {
 	vars := mux.Vars(r)
 	tenant := vars["tenant"]
 	instance := vars["server"]
-	var action action
 
 	dumpRequestBody(r, true)
 
 	if validateToken(context, r) == false {
-		http.Error(w, "Invalid token", http.StatusInternalServerError)
+		invalidToken(w, r, context)
 		return
 	}
 
 	/* First check that the instance belongs to this tenant */
 	i, err := context.ds.GetInstance(instance)
 	if err != nil {
-		http.Error(w, "Instance not available", http.StatusInternalServerError)
+		returnErrorCode(w, "Instance not available", http.StatusNotFound)
 		return
 	}
 
 	if i.TenantID != tenant {
-		http.Error(w, "Instance not available", http.StatusInternalServerError)
+		returnErrorCode(w, "Instance not available", http.StatusNotFound)
 		return
 	}
 
-	defer r.Body.Close()
-
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	body, ok := readRequestBody(w, r)
+	if !ok {
 		return
 	}
 
-	bodyString := string(body)
-
-	if strings.Contains(bodyString, "os-start") {
-		action = computeActionStart
-	} else if strings.Contains(bodyString, "os-stop") {
-		action = computeActionStop
-	} else {
-		http.Error(w, "Unsupported action", http.StatusServiceUnavailable)
+	action, err := parseServerAction(body)
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -994,10 +1208,69 @@ func serverAction(w http.ResponseWriter, r *http.Request, context *controller) {
 		err = context.restartInstance(instance)
 	case computeActionStop:
 		err = context.stopInstance(instance)
+	case computeActionCreateImage:
+		createServerImage(w, body, instance, context)
+		return
+	case computeActionResize:
+		resizeServer(w, body, instance, context)
+		return
 	}
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), commandErrorCode(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func createServerImage(w http.ResponseWriter, body []byte, instance string, context *controller) {
+	var req payloads.CiaoCreateServerImage
+
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.CreateImage.Name == "" {
+		returnErrorCode(w, "Missing image name", http.StatusBadRequest)
+		return
+	}
+
+	image, err := context.snapshotInstance(instance, req.CreateImage.Name)
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	b, err := json.Marshal(payloads.CiaoServerImage{ImageID: image.ID})
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(b)
+}
+
+func resizeServer(w http.ResponseWriter, body []byte, instance string, context *controller) {
+	var req payloads.CiaoResizeServer
+
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resize := req.Resize
+	err = context.resizeInstance(instance, resize.VCPUs, resize.MemMB, resize.DiskMB)
+	if err == errOverTenantLimits {
+		returnErrorCode(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusConflict)
 		return
 	}
 
@@ -1010,13 +1283,13 @@ func listTenants(w http.ResponseWriter, r *http.Request, context *controller) {
 	dumpRequest(r)
 
 	if validateToken(context, r) == false {
-		http.Error(w, "Unauthorized token", http.StatusInternalServerError)
+		invalidToken(w, r, context)
 		return
 	}
 
 	tenants, err := context.ds.GetAllTenants()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -1034,7 +1307,7 @@ func listTenants(w http.ResponseWriter, r *http.Request, context *controller) {
 
 	b, err := json.Marshal(computeTenants)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -1042,154 +1315,320 @@ func listTenants(w http.ResponseWriter, r *http.Request, context *controller) {
 	w.Write(b)
 }
 
-func listNodes(w http.ResponseWriter, r *http.Request, context *controller) {
-	dumpRequest(r)
-
-	if validateToken(context, r) == false {
-		http.Error(w, "Invalid token", http.StatusInternalServerError)
-		return
-	}
-
-	computeNodes := context.ds.GetNodeLastStats()
-
-	nodeSummary, err := context.ds.GetNodeSummary()
+func writeTenantQuotas(w http.ResponseWriter, context *controller, tenantID string, status int) {
+	t, err := context.ds.GetTenant(tenantID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	for _, node := range nodeSummary {
-		for i := range computeNodes.Nodes {
-			if computeNodes.Nodes[i].ID != node.NodeID {
-				continue
-			}
-
-			computeNodes.Nodes[i].TotalInstances = node.TotalInstances
-			computeNodes.Nodes[i].TotalRunningInstances = node.TotalRunningInstances
-			computeNodes.Nodes[i].TotalPendingInstances = node.TotalPendingInstances
-			computeNodes.Nodes[i].TotalPausedInstances = node.TotalPausedInstances
-		}
-	}
-
-	sort.Sort(types.SortedComputeNodesByID(computeNodes.Nodes))
-
-	pager := nodePager{
-		context: context,
-		nodes:   computeNodes.Nodes,
+	if t == nil {
+		returnErrorCode(w, "Tenant not available", http.StatusNotFound)
+		return
 	}
 
-	b, err := pager.nextPage(none, "", r)
+	b, err := json.Marshal(tenantResources(t))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	w.Write(b)
 }
 
-func nodesSummary(w http.ResponseWriter, r *http.Request, context *controller) {
-	var nodesStatus payloads.CiaoClusterStatus
+func createTenant(w http.ResponseWriter, r *http.Request, context *controller) {
+	var req payloads.CiaoCreateTenant
 
-	dumpRequest(r)
+	dumpRequestBody(r, true)
 
 	if validateToken(context, r) == false {
-		http.Error(w, "Invalid token", http.StatusInternalServerError)
+		invalidToken(w, r, context)
 		return
 	}
 
-	computeNodes := context.ds.GetNodeLastStats()
-
-	glog.V(2).Infof("nodesSummary %d nodes", len(computeNodes.Nodes))
-
-	nodesStatus.Status.TotalNodes = len(computeNodes.Nodes)
-	for _, node := range computeNodes.Nodes {
-		if node.Status == ssntp.READY.String() {
-			nodesStatus.Status.TotalNodesReady++
-		} else if node.Status == ssntp.FULL.String() {
-			nodesStatus.Status.TotalNodesFull++
-		} else if node.Status == ssntp.OFFLINE.String() {
-			nodesStatus.Status.TotalNodesOffline++
-		} else if node.Status == ssntp.MAINTENANCE.String() {
-			nodesStatus.Status.TotalNodesMaintenance++
-		}
+	body, ok := readRequestBody(w, r)
+	if !ok {
+		return
 	}
 
-	b, err := json.Marshal(nodesStatus)
+	err := json.Unmarshal(body, &req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(b)
-}
-
-func listNodeServers(w http.ResponseWriter, r *http.Request, context *controller) {
-	vars := mux.Vars(r)
-	nodeID := vars["node"]
-
-	dumpRequest(r)
-
-	if validateToken(context, r) == false {
-		http.Error(w, "Invalid token", http.StatusInternalServerError)
+	tenantID := req.Tenant.ID
+	if tenantID == "" {
+		returnErrorCode(w, "Missing tenant ID", http.StatusBadRequest)
 		return
 	}
 
-	serversStats := context.ds.GetInstanceLastStats(nodeID)
-
-	instances, err := context.ds.GetAllInstancesByNode(nodeID)
+	err = validateQuotas(req.Tenant.Quotas)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	for _, instance := range instances {
-		for i := range serversStats.Servers {
-			if serversStats.Servers[i].ID != instance.ID {
-				continue
-			}
-
-			serversStats.Servers[i].TenantID = instance.TenantID
-			serversStats.Servers[i].IPv4 = instance.IPAddress
-		}
+	t, err := context.ds.GetTenant(tenantID)
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	pager := nodeServerPager{
-		context:   context,
-		instances: serversStats.Servers,
+	if t != nil {
+		returnErrorCode(w, "Tenant already exists", http.StatusConflict)
+		return
 	}
 
-	b, err := pager.nextPage(none, "", r)
+	err = context.createTenant(tenantID, req.Tenant.Quotas)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(b)
+	writeTenantQuotas(w, context, tenantID, http.StatusCreated)
 }
 
-func listCNCIs(w http.ResponseWriter, r *http.Request, context *controller) {
-	var ciaoCNCIs payloads.CiaoCNCIs
+func deleteTenant(w http.ResponseWriter, r *http.Request, context *controller) {
+	vars := mux.Vars(r)
+	tenantID := vars["tenant_id"]
 
 	dumpRequest(r)
 
 	if validateToken(context, r) == false {
-		http.Error(w, "Invalid token", http.StatusInternalServerError)
+		invalidToken(w, r, context)
 		return
 	}
 
-	cncis, err := context.ds.GetTenantCNCISummary("")
+	t, err := context.ds.GetTenant(tenantID)
+	if err != nil || t == nil {
+		returnErrorCode(w, "Tenant not available", http.StatusNotFound)
+		return
+	}
+
+	err = context.deleteTenant(tenantID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusConflict)
 		return
 	}
 
-	var subnets []payloads.CiaoCNCISubnet
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	for _, cnci := range cncis {
-		if cnci.InstanceID == "" {
+func showTenantQuotas(w http.ResponseWriter, r *http.Request, context *controller) {
+	vars := mux.Vars(r)
+	tenantID := vars["tenant_id"]
+
+	dumpRequest(r)
+
+	if validateToken(context, r) == false {
+		invalidToken(w, r, context)
+		return
+	}
+
+	writeTenantQuotas(w, context, tenantID, http.StatusOK)
+}
+
+func updateTenantQuotas(w http.ResponseWriter, r *http.Request, context *controller) {
+	vars := mux.Vars(r)
+	tenantID := vars["tenant_id"]
+	var req payloads.CiaoTenantQuotas
+
+	dumpRequestBody(r, true)
+
+	if validateToken(context, r) == false {
+		invalidToken(w, r, context)
+		return
+	}
+
+	body, ok := readRequestBody(w, r)
+	if !ok {
+		return
+	}
+
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = validateQuotas(req.Quotas)
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t, err := context.ds.GetTenant(tenantID)
+	if err != nil || t == nil {
+		returnErrorCode(w, "Tenant not available", http.StatusNotFound)
+		return
+	}
+
+	err = context.setTenantQuotas(tenantID, req.Quotas)
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeTenantQuotas(w, context, tenantID, http.StatusOK)
+}
+
+func listNodes(w http.ResponseWriter, r *http.Request, context *controller) {
+	dumpRequest(r)
+
+	if validateToken(context, r) == false {
+		invalidToken(w, r, context)
+		return
+	}
+
+	computeNodes := context.ds.GetNodeLastStats()
+
+	nodeSummary, err := context.ds.GetNodeSummary()
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for _, node := range nodeSummary {
+		for i := range computeNodes.Nodes {
+			if computeNodes.Nodes[i].ID != node.NodeID {
+				continue
+			}
+
+			computeNodes.Nodes[i].TotalInstances = node.TotalInstances
+			computeNodes.Nodes[i].TotalRunningInstances = node.TotalRunningInstances
+			computeNodes.Nodes[i].TotalPendingInstances = node.TotalPendingInstances
+			computeNodes.Nodes[i].TotalPausedInstances = node.TotalPausedInstances
+		}
+	}
+
+	sort.Sort(types.SortedComputeNodesByID(computeNodes.Nodes))
+
+	pager := nodePager{
+		context: context,
+		nodes:   computeNodes.Nodes,
+	}
+
+	b, err := pager.nextPage(none, "", r)
+	if err == errMarkerNotFound {
+		returnErrorCode(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func nodesSummary(w http.ResponseWriter, r *http.Request, context *controller) {
+	var nodesStatus payloads.CiaoClusterStatus
+
+	dumpRequest(r)
+
+	if validateToken(context, r) == false {
+		invalidToken(w, r, context)
+		return
+	}
+
+	computeNodes := context.ds.GetNodeLastStats()
+
+	glog.V(2).Infof("nodesSummary %d nodes", len(computeNodes.Nodes))
+
+	nodesStatus.Status.TotalNodes = len(computeNodes.Nodes)
+	for _, node := range computeNodes.Nodes {
+		if node.Status == ssntp.READY.String() {
+			nodesStatus.Status.TotalNodesReady++
+		} else if node.Status == ssntp.FULL.String() {
+			nodesStatus.Status.TotalNodesFull++
+		} else if node.Status == ssntp.OFFLINE.String() {
+			nodesStatus.Status.TotalNodesOffline++
+		} else if node.Status == ssntp.MAINTENANCE.String() {
+			nodesStatus.Status.TotalNodesMaintenance++
+		}
+	}
+
+	b, err := json.Marshal(nodesStatus)
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func listNodeServers(w http.ResponseWriter, r *http.Request, context *controller) {
+	vars := mux.Vars(r)
+	nodeID := vars["node"]
+
+	dumpRequest(r)
+
+	if validateToken(context, r) == false {
+		invalidToken(w, r, context)
+		return
+	}
+
+	serversStats := context.ds.GetInstanceLastStats(nodeID)
+
+	instances, err := context.ds.GetAllInstancesByNode(nodeID)
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for _, instance := range instances {
+		for i := range serversStats.Servers {
+			if serversStats.Servers[i].ID != instance.ID {
+				continue
+			}
+
+			serversStats.Servers[i].TenantID = instance.TenantID
+			serversStats.Servers[i].IPv4 = instance.IPAddress
+		}
+	}
+
+	pager := nodeServerPager{
+		context:   context,
+		instances: serversStats.Servers,
+	}
+
+	b, err := pager.nextPage(none, "", r)
+	if err == errMarkerNotFound {
+		returnErrorCode(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func listCNCIs(w http.ResponseWriter, r *http.Request, context *controller) {
+	var ciaoCNCIs payloads.CiaoCNCIs
+
+	dumpRequest(r)
+
+	if validateToken(context, r) == false {
+		invalidToken(w, r, context)
+		return
+	}
+
+	cncis, err := context.ds.GetTenantCNCISummary("")
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var subnets []payloads.CiaoCNCISubnet
+
+	for _, cnci := range cncis {
+		if cnci.InstanceID == "" {
 			continue
 		}
 
@@ -1213,7 +1652,7 @@ func listCNCIs(w http.ResponseWriter, r *http.Request, context *controller) {
 
 	b, err := json.Marshal(ciaoCNCIs)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -1229,13 +1668,13 @@ func listCNCIDetails(w http.ResponseWriter, r *http.Request, context *controller
 	dumpRequest(r)
 
 	if validateToken(context, r) == false {
-		http.Error(w, "Invalid token", http.StatusInternalServerError)
+		invalidToken(w, r, context)
 		return
 	}
 
 	cncis, err := context.ds.GetTenantCNCISummary(cnciID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -1261,7 +1700,7 @@ func listCNCIDetails(w http.ResponseWriter, r *http.Request, context *controller
 
 	b, err := json.Marshal(ciaoCNCI)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -1273,13 +1712,13 @@ func listTraces(w http.ResponseWriter, r *http.Request, context *controller) {
 	var traces payloads.CiaoTracesSummary
 
 	if validateToken(context, r) == false {
-		http.Error(w, "Invalid token", http.StatusInternalServerError)
+		invalidToken(w, r, context)
 		return
 	}
 
 	summaries, err := context.ds.GetBatchFrameSummary()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -1293,7 +1732,7 @@ func listTraces(w http.ResponseWriter, r *http.Request, context *controller) {
 
 	b, err := json.Marshal(traces)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -1308,13 +1747,13 @@ func listEvents(w http.ResponseWriter, r *http.Request, context *controller) {
 	var events payloads.CiaoEvents
 
 	if validateToken(context, r) == false {
-		http.Error(w, "Invalid token", http.StatusInternalServerError)
+		invalidToken(w, r, context)
 		return
 	}
 
 	logs, err := context.ds.GetEventLog()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -1334,7 +1773,7 @@ func listEvents(w http.ResponseWriter, r *http.Request, context *controller) {
 
 	b, err := json.Marshal(events)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -1344,13 +1783,13 @@ func listEvents(w http.ResponseWriter, r *http.Request, context *controller) {
 
 func clearEvents(w http.ResponseWriter, r *http.Request, context *controller) {
 	if validateToken(context, r) == false {
-		http.Error(w, "Invalid token", http.StatusInternalServerError)
+		invalidToken(w, r, context)
 		return
 	}
 
 	err := context.ds.ClearLog()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -1363,13 +1802,18 @@ func traceData(w http.ResponseWriter, r *http.Request, context *controller) {
 	var traceData payloads.CiaoTraceData
 
 	if validateToken(context, r) == false {
-		http.Error(w, "Invalid token", http.StatusInternalServerError)
+		invalidToken(w, r, context)
 		return
 	}
 
 	batchStats, err := context.ds.GetBatchFrameStatistics(label)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if len(batchStats) == 0 {
+		returnErrorCode(w, "Trace not available", http.StatusNotFound)
 		return
 	}
 
@@ -1387,7 +1831,266 @@ func traceData(w http.ResponseWriter, r *http.Request, context *controller) {
 
 	b, err := json.Marshal(traceData)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func volumeToCiaoVolume(volume *types.Volume) payloads.CiaoVolume {
+	return payloads.CiaoVolume{
+		ID:         volume.ID,
+		TenantID:   volume.TenantID,
+		Size:       volume.Size,
+		Format:     volume.Format,
+		Status:     volume.State,
+		InstanceID: volume.InstanceID,
+	}
+}
+
+func listTenantVolumes(w http.ResponseWriter, r *http.Request, context *controller) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+	var volumes payloads.CiaoVolumes
+
+	dumpRequest(r)
+
+	if validateToken(context, r) == false {
+		invalidToken(w, r, context)
+		return
+	}
+
+	tenantVolumes, err := context.ds.GetAllVolumesFromTenant(tenant)
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	volumes.Volumes = []payloads.CiaoVolume{}
+	for _, volume := range tenantVolumes {
+		volumes.Volumes = append(volumes.Volumes, volumeToCiaoVolume(volume))
+	}
+
+	b, err := json.Marshal(volumes)
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func createTenantVolume(w http.ResponseWriter, r *http.Request, context *controller) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+	var req payloads.CiaoCreateVolume
+
+	dumpRequestBody(r, true)
+
+	if validateToken(context, r) == false {
+		invalidToken(w, r, context)
+		return
+	}
+
+	body, ok := readRequestBody(w, r)
+	if !ok {
+		return
+	}
+
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Volume.Size <= 0 {
+		returnErrorCode(w, "Invalid volume size", http.StatusBadRequest)
+		return
+	}
+
+	switch req.Volume.Format {
+	case "", payloads.RawVolume, payloads.Qcow2Volume:
+	default:
+		returnErrorCode(w, fmt.Sprintf("Unsupported volume format %s", req.Volume.Format), http.StatusBadRequest)
+		return
+	}
+
+	volume, err := context.createVolume(tenant, req.Volume.Size, req.Volume.Format)
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := payloads.CiaoVolumeResponse{
+		Volume: volumeToCiaoVolume(volume),
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(b)
+}
+
+func deleteTenantVolume(w http.ResponseWriter, r *http.Request, context *controller) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+	volumeID := vars["volume"]
+
+	dumpRequest(r)
+
+	if validateToken(context, r) == false {
+		invalidToken(w, r, context)
+		return
+	}
+
+	/* First check that the volume belongs to this tenant */
+	volume, err := context.ds.GetVolume(volumeID)
+	if err != nil || volume.TenantID != tenant {
+		returnErrorCode(w, "Volume not available", http.StatusNotFound)
+		return
+	}
+
+	err = context.deleteVolume(volumeID)
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func attachServerVolume(w http.ResponseWriter, r *http.Request, context *controller) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+	instance := vars["server"]
+	var req payloads.CiaoVolumeAttachment
+
+	dumpRequestBody(r, true)
+
+	if validateToken(context, r) == false {
+		invalidToken(w, r, context)
+		return
+	}
+
+	/* First check that the instance belongs to this tenant */
+	i, err := context.ds.GetInstance(instance)
+	if err != nil || i.TenantID != tenant {
+		returnErrorCode(w, "Instance not available", http.StatusNotFound)
+		return
+	}
+
+	body, ok := readRequestBody(w, r)
+	if !ok {
+		return
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = context.attachVolume(req.VolumeAttachment.VolumeID, instance)
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func detachServerVolume(w http.ResponseWriter, r *http.Request, context *controller) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+	instance := vars["server"]
+	volumeID := vars["volume"]
+
+	dumpRequest(r)
+
+	if validateToken(context, r) == false {
+		invalidToken(w, r, context)
+		return
+	}
+
+	/* First check that the instance belongs to this tenant */
+	i, err := context.ds.GetInstance(instance)
+	if err != nil || i.TenantID != tenant {
+		returnErrorCode(w, "Instance not available", http.StatusNotFound)
+		return
+	}
+
+	err = context.detachVolume(volumeID, instance)
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func listWorkloads(w http.ResponseWriter, r *http.Request, context *controller) {
+	var workloads payloads.CiaoWorkloads
+
+	dumpRequest(r)
+
+	if validateToken(context, r) == false {
+		invalidToken(w, r, context)
+		return
+	}
+
+	wls, err := context.ds.GetWorkloads()
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	workloads.Workloads = []payloads.CiaoWorkload{}
+	for _, wl := range wls {
+		workloads.Workloads = append(workloads.Workloads, workloadToCiaoWorkload(wl))
+	}
+
+	b, err := json.Marshal(workloads)
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func showWorkload(w http.ResponseWriter, r *http.Request, context *controller) {
+	vars := mux.Vars(r)
+	workloadID := vars["workload"]
+
+	dumpRequest(r)
+
+	if validateToken(context, r) == false {
+		invalidToken(w, r, context)
+		return
+	}
+
+	wl, err := context.ds.GetWorkload(workloadID)
+	if err != nil || wl.Description == cnciDescription {
+		returnErrorCode(w, "Workload not available", http.StatusNotFound)
+		return
+	}
+
+	resp := payloads.CiaoWorkloadRequest{
+		Workload: workloadToCiaoWorkload(wl),
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -1395,6 +2098,130 @@ func traceData(w http.ResponseWriter, r *http.Request, context *controller) {
 	w.Write(b)
 }
 
+func readWorkloadRequest(w http.ResponseWriter, r *http.Request) (*types.Workload, bool) {
+	var req payloads.CiaoWorkloadRequest
+
+	body, ok := readRequestBody(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	wl := ciaoWorkloadToWorkload(req.Workload)
+	err = validateWorkload(&wl)
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	return &wl, true
+}
+
+func writeWorkloadResponse(w http.ResponseWriter, wl *types.Workload, status int) {
+	resp := payloads.CiaoWorkloadRequest{
+		Workload: workloadToCiaoWorkload(wl),
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+func createWorkload(w http.ResponseWriter, r *http.Request, context *controller) {
+	dumpRequestBody(r, true)
+
+	if validateToken(context, r) == false {
+		invalidToken(w, r, context)
+		return
+	}
+
+	wl, ok := readWorkloadRequest(w, r)
+	if !ok {
+		return
+	}
+
+	/* Workload IDs are always generated by the controller */
+	wl.ID = ""
+
+	wl, err := context.ds.AddWorkload(*wl)
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeWorkloadResponse(w, wl, http.StatusCreated)
+}
+
+func updateWorkload(w http.ResponseWriter, r *http.Request, context *controller) {
+	vars := mux.Vars(r)
+	workloadID := vars["workload"]
+
+	dumpRequestBody(r, true)
+
+	if validateToken(context, r) == false {
+		invalidToken(w, r, context)
+		return
+	}
+
+	current, err := context.ds.GetWorkload(workloadID)
+	if err != nil || current.Description == cnciDescription {
+		returnErrorCode(w, "Workload not available", http.StatusNotFound)
+		return
+	}
+
+	wl, ok := readWorkloadRequest(w, r)
+	if !ok {
+		return
+	}
+
+	wl.ID = workloadID
+
+	wl, err = context.ds.UpdateWorkload(*wl)
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeWorkloadResponse(w, wl, http.StatusOK)
+}
+
+func deleteWorkload(w http.ResponseWriter, r *http.Request, context *controller) {
+	vars := mux.Vars(r)
+	workloadID := vars["workload"]
+
+	dumpRequest(r)
+
+	if validateToken(context, r) == false {
+		invalidToken(w, r, context)
+		return
+	}
+
+	wl, err := context.ds.GetWorkload(workloadID)
+	if err != nil || wl.Description == cnciDescription {
+		returnErrorCode(w, "Workload not available", http.StatusNotFound)
+		return
+	}
+
+	err = context.ds.DeleteWorkload(workloadID)
+	if err != nil {
+		returnErrorCode(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func createComputeAPI(context *controller) {
 	r := mux.NewRouter()
 
@@ -1422,6 +2249,26 @@ func createComputeAPI(context *controller) {
 		serverAction(w, r, context)
 	}).Methods("POST")
 
+	r.HandleFunc("/v2.1/{tenant}/servers/{server}/os-volume_attachments", func(w http.ResponseWriter, r *http.Request) {
+		attachServerVolume(w, r, context)
+	}).Methods("POST")
+
+	r.HandleFunc("/v2.1/{tenant}/servers/{server}/os-volume_attachments/{volume}", func(w http.ResponseWriter, r *http.Request) {
+		detachServerVolume(w, r, context)
+	}).Methods("DELETE")
+
+	r.HandleFunc("/v2.1/{tenant}/volumes", func(w http.ResponseWriter, r *http.Request) {
+		listTenantVolumes(w, r, context)
+	}).Methods("GET")
+
+	r.HandleFunc("/v2.1/{tenant}/volumes", func(w http.ResponseWriter, r *http.Request) {
+		createTenantVolume(w, r, context)
+	}).Methods("POST")
+
+	r.HandleFunc("/v2.1/{tenant}/volumes/{volume}", func(w http.ResponseWriter, r *http.Request) {
+		deleteTenantVolume(w, r, context)
+	}).Methods("DELETE")
+
 	r.HandleFunc("/v2.1/{tenant}/flavors", func(w http.ResponseWriter, r *http.Request) {
 		listFlavors(w, r, context)
 	}).Methods("GET")
@@ -1455,6 +2302,26 @@ func createComputeAPI(context *controller) {
 		listTenants(w, r, context)
 	}).Methods("GET")
 
+	/*
+	 * Tenant administration uses {tenant_id} rather than {tenant}
+	 * for validateToken to require an admin token.
+	 */
+	r.HandleFunc("/v2.1/tenants", func(w http.ResponseWriter, r *http.Request) {
+		createTenant(w, r, context)
+	}).Methods("POST")
+
+	r.HandleFunc("/v2.1/tenants/{tenant_id}", func(w http.ResponseWriter, r *http.Request) {
+		deleteTenant(w, r, context)
+	}).Methods("DELETE")
+
+	r.HandleFunc("/v2.1/tenants/{tenant_id}/quotas", func(w http.ResponseWriter, r *http.Request) {
+		showTenantQuotas(w, r, context)
+	}).Methods("GET")
+
+	r.HandleFunc("/v2.1/tenants/{tenant_id}/quotas", func(w http.ResponseWriter, r *http.Request) {
+		updateTenantQuotas(w, r, context)
+	}).Methods("PUT")
+
 	r.HandleFunc("/v2.1/nodes", func(w http.ResponseWriter, r *http.Request) {
 		listNodes(w, r, context)
 	}).Methods("GET")
@@ -1487,6 +2354,56 @@ func createComputeAPI(context *controller) {
 		traceData(w, r, context)
 	}).Methods("GET")
 
+	r.HandleFunc("/v2.1/workloads", func(w http.ResponseWriter, r *http.Request) {
+		listWorkloads(w, r, context)
+	}).Methods("GET")
+
+	r.HandleFunc("/v2.1/workloads", func(w http.ResponseWriter, r *http.Request) {
+		createWorkload(w, r, context)
+	}).Methods("POST")
+
+	r.HandleFunc("/v2.1/workloads/{workload}", func(w http.ResponseWriter, r *http.Request) {
+		showWorkload(w, r, context)
+	}).Methods("GET")
+
+	r.HandleFunc("/v2.1/workloads/{workload}", func(w http.ResponseWriter, r *http.Request) {
+		updateWorkload(w, r, context)
+	}).Methods("PUT")
+
+	r.HandleFunc("/v2.1/workloads/{workload}", func(w http.ResponseWriter, r *http.Request) {
+		deleteWorkload(w, r, context)
+	}).Methods("DELETE")
+
+	if id, ok := context.id.(*localIdentity); ok {
+		r.HandleFunc("/v3/auth/tokens", func(w http.ResponseWriter, r *http.Request) {
+			createIdentityToken(w, r, id)
+		}).Methods("POST")
+
+		r.HandleFunc("/v3/auth/tokens", func(w http.ResponseWriter, r *http.Request) {
+			showIdentityToken(w, r, id)
+		}).Methods("GET")
+
+		r.HandleFunc("/v3/users", func(w http.ResponseWriter, r *http.Request) {
+			createIdentityUser(w, r, context, id)
+		}).Methods("POST")
+
+		r.HandleFunc("/v3/users/{user}/projects", func(w http.ResponseWriter, r *http.Request) {
+			listIdentityUserProjects(w, r, context, id)
+		}).Methods("GET")
+
+		r.HandleFunc("/v3/projects", func(w http.ResponseWriter, r *http.Request) {
+			listIdentityProjects(w, r, context, id)
+		}).Methods("GET")
+
+		r.HandleFunc("/v3/projects", func(w http.ResponseWriter, r *http.Request) {
+			createIdentityProject(w, r, context, id)
+		}).Methods("POST")
+
+		r.HandleFunc("/v3/projects/{project}/users/{user}/roles/{role}", func(w http.ResponseWriter, r *http.Request) {
+			grantIdentityRole(w, r, context, id)
+		}).Methods("PUT")
+	}
+
 	service := fmt.Sprintf(":%d", *computeAPIPort)
 	log.Fatal(http.ListenAndServeTLS(service, *httpsCAcert, *httpsKey, r))
 }
@@ -20,18 +20,26 @@ import (
 	"github.com/01org/ciao/ciao-controller/types"
 	"github.com/01org/ciao/payloads"
 	"github.com/01org/ciao/ssntp"
+	"github.com/docker/distribution/uuid"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"reflect"
 	"sort"
+	"sync"
 	"testing"
 	"time"
 )
 
 func testHTTPRequest(t *testing.T, method string, URL string, expectedResponse int, data []byte) []byte {
+	return testHTTPRequestToken(t, method, URL, "imavalidtoken", expectedResponse, data)
+}
+
+func testHTTPRequestToken(t *testing.T, method string, URL string, token string, expectedResponse int, data []byte) []byte {
 	req, err := http.NewRequest(method, URL, bytes.NewBuffer(data))
-	req.Header.Set("X-Auth-Token", "imavalidtoken")
+	if token != "" {
+		req.Header.Set("X-Auth-Token", token)
+	}
 	if data != nil {
 		req.Header.Set("Content-Type", "application/json")
 	}
@@ -242,7 +250,7 @@ func TestDeleteServer(t *testing.T) {
 		if s1.HostID != "" {
 			_ = testHTTPRequest(t, "DELETE", url, http.StatusAccepted, nil)
 		} else {
-			_ = testHTTPRequest(t, "DELETE", url, http.StatusInternalServerError, nil)
+			_ = testHTTPRequest(t, "DELETE", url, http.StatusConflict, nil)
 		}
 
 	}
@@ -329,11 +337,138 @@ func TestServersActionStop(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_ = testHTTPRequest(t, "POST", url, http.StatusAccepted, b)
+	body := testHTTPRequest(t, "POST", url, http.StatusAccepted, b)
+
+	var results payloads.CiaoServersActionResults
+	err = json.Unmarshal(body, &results)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results.Results) != 1 ||
+		results.Results[0].ID != servers.Servers[0].ID ||
+		results.Results[0].Status != payloads.ServerActionAccepted {
+		t.Fatalf("Unexpected results %s", string(body))
+	}
+}
+
+func TestServersActionConcurrent(t *testing.T) {
+	tenant, err := context.ds.GetTenant(computeTestUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	servers := testCreateServer(t, 3)
+
+	var ids []string
+	for _, server := range servers.Servers {
+		ids = append(ids, server.ID)
+	}
+
+	// Each action only completes once all of them were started.
+	var started sync.WaitGroup
+	started.Add(len(ids))
+	actionFunc := func(instanceID string) error {
+		started.Done()
+		started.Wait()
+		return nil
+	}
+
+	done := make(chan []payloads.CiaoServerActionResult)
+	go func() {
+		done <- tenantServerActions(context, tenant.ID, "os-stop", ids, actionFunc)
+	}()
+
+	select {
+	case results := <-done:
+		for i, result := range results {
+			if result.ID != ids[i] || result.Status != payloads.ServerActionAccepted {
+				t.Errorf("Unexpected result %v for %s", result, ids[i])
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Server actions were not run concurrently")
+	}
+}
+
+func TestServersActionOwnership(t *testing.T) {
+	nn := true
+	saved := noNetwork
+	noNetwork = &nn
+	defer func() { noNetwork = saved }()
+
+	tenant, err := context.ds.AddTenant(uuid.Generate().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer context.ds.DeleteTenant(tenant.ID)
+
+	servers := testCreateServer(t, 1)
+	if servers.TotalServers != 1 {
+		t.Fatal("Not enough servers returned")
+	}
+
+	instanceID := servers.Servers[0].ID
+	unknownID := uuid.Generate().String()
+
+	cmd := payloads.CiaoServersAction{
+		Action:    "os-delete",
+		ServerIDs: []string{instanceID, unknownID},
+	}
+
+	b, err := json.Marshal(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := computeURL + "/v2.1/" + tenant.ID + "/servers/action"
+	body := testHTTPRequest(t, "POST", url, http.StatusAccepted, b)
+
+	var results payloads.CiaoServersActionResults
+	err = json.Unmarshal(body, &results)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []payloads.ServerActionStatus{
+		payloads.ServerActionForbidden,
+		payloads.ServerActionNotFound,
+	}
+
+	if len(results.Results) != len(expected) {
+		t.Fatalf("Unexpected results %s", string(body))
+	}
+
+	for i, result := range results.Results {
+		if result.ID != cmd.ServerIDs[i] || result.Status != expected[i] {
+			t.Errorf("Expected %s for %s got %s", expected[i], cmd.ServerIDs[i], result.Status)
+		}
+	}
+
+	_, err = context.ds.GetInstance(instanceID)
+	if err != nil {
+		t.Fatal("Instance of another tenant was deleted")
+	}
+
+	logs, err := context.ds.GetEventLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	warnings := 0
+	for _, l := range logs {
+		if l.TenantID == tenant.ID && l.EventType == "warn" {
+			warnings++
+		}
+	}
+
+	if warnings != len(expected) {
+		t.Fatalf("Expected %d audit events got %d", len(expected), warnings)
+	}
 }
 
 func TestServerActionStop(t *testing.T) {
-	action := "os-stop"
+	action := `{"os-stop":null}`
 
 	tenant, err := context.ds.GetTenant(computeTestUser)
 	if err != nil {
@@ -358,8 +493,63 @@ func TestServerActionStop(t *testing.T) {
 	_ = testHTTPRequest(t, "POST", url, http.StatusAccepted, []byte(action))
 }
 
+func TestServerActionStopErrors(t *testing.T) {
+	action := `{"os-stop":null}`
+
+	tenant, err := context.ds.GetTenant(computeTestUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := newTestClient(0, ssntp.AGENT)
+	defer client.ssntp.Close()
+
+	servers := testCreateServer(t, 1)
+	if servers.TotalServers != 1 {
+		t.Fatal(err)
+	}
+
+	time.Sleep(2 * time.Second)
+
+	client.sendStats()
+
+	time.Sleep(1 * time.Second)
+
+	saved := commandTimeout
+	commandTimeout = time.Second
+	defer func() { commandTimeout = saved }()
+
+	instanceID := servers.Servers[0].ID
+	url := computeURL + "/v2.1/" + tenant.ID + "/servers/" + instanceID + "/action"
+
+	var tests = []struct {
+		reason  payloads.StopFailureReason
+		noReply bool
+		code    int
+		status  payloads.ServerActionStatus
+	}{
+		{payloads.StopAlreadyStopped, false, http.StatusConflict, payloads.ServerActionInvalidState},
+		{payloads.StopNodeUnavailable, false, http.StatusServiceUnavailable, payloads.ServerActionUnavailable},
+		{payloads.StopInvalidData, false, http.StatusInternalServerError, payloads.ServerActionFailed},
+		{"", true, http.StatusGatewayTimeout, payloads.ServerActionTimedOut},
+	}
+
+	client.stopFail = true
+	for _, test := range tests {
+		client.stopFailReason = test.reason
+		client.stopNoReply = test.noReply
+
+		_ = testHTTPRequest(t, "POST", url, test.code, []byte(action))
+
+		result := tenantServerAction(context, tenant.ID, "os-stop", instanceID, context.stopInstance)
+		if result.Status != test.status {
+			t.Errorf("Expected %s bulk status, got %s", test.status, result.Status)
+		}
+	}
+}
+
 func TestServerActionStart(t *testing.T) {
-	action := "os-start"
+	action := `{"os-start":null}`
 
 	tenant, err := context.ds.GetTenant(computeTestUser)
 	if err != nil {
@@ -430,7 +620,14 @@ func TestListFlavors(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if len(flavors.Flavors) != len(wls) {
+	var available int
+	for _, w := range wls {
+		if workloadAvailable(w, tenant.ID) {
+			available++
+		}
+	}
+
+	if len(flavors.Flavors) != available {
 		t.Fatal("Incorrect number of flavors returned")
 	}
 
@@ -438,17 +635,79 @@ func TestListFlavors(t *testing.T) {
 
 	for _, f := range flavors.Flavors {
 		for _, w := range wls {
-			if w.ID == f.ID && w.Description == f.Name {
+			if w.ID == f.ID && w.Description == f.Name && workloadAvailable(w, tenant.ID) {
 				matched++
 			}
 		}
 	}
 
-	if matched != len(wls) {
+	if matched != available {
 		t.Fatal("Flavor information didn't match workload information")
 	}
 }
 
+func TestTenantFlavors(t *testing.T) {
+	tenant, err := context.ds.GetTenant(computeTestUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err := context.ds.GetWorkloads()
+	if err != nil || len(wls) == 0 {
+		t.Fatal(err)
+	}
+
+	imageID := uuid.Generate().String()
+
+	owned, err := context.ds.CloneWorkload(wls[0].ID, "owned", imageID, "owned", tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer context.ds.DeleteWorkload(owned.ID)
+
+	private, err := context.ds.CloneWorkload(wls[0].ID, "private", imageID, "private", uuid.Generate().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer context.ds.DeleteWorkload(private.ID)
+
+	url := computeURL + "/v2.1/" + tenant.ID + "/flavors"
+
+	body := testHTTPRequest(t, "GET", url, http.StatusOK, nil)
+
+	var flavors payloads.ComputeFlavors
+	err = json.Unmarshal(body, &flavors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ownedListed bool
+	for _, f := range flavors.Flavors {
+		if f.ID == private.ID {
+			t.Fatal("Flavor of another tenant listed")
+		}
+		ownedListed = ownedListed || f.ID == owned.ID
+	}
+
+	if !ownedListed {
+		t.Fatal("Flavor of the tenant not listed")
+	}
+
+	_ = testHTTPRequest(t, "GET", url+"/"+owned.ID, http.StatusOK, nil)
+	_ = testHTTPRequest(t, "GET", url+"/"+private.ID, http.StatusNotFound, nil)
+
+	var server payloads.ComputeCreateServer
+	server.Server.MaxInstances = 1
+	server.Server.Workload = private.ID
+
+	b, err := json.Marshal(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = testHTTPRequest(t, "POST", computeURL+"/v2.1/"+tenant.ID+"/servers", http.StatusBadRequest, b)
+}
+
 func TestShowFlavorDetails(t *testing.T) {
 	tenant, err := context.ds.GetTenant(computeTestUser)
 	if err != nil {
@@ -463,6 +722,10 @@ func TestShowFlavorDetails(t *testing.T) {
 	}
 
 	for _, w := range wls {
+		if !workloadAvailable(w, tenant.ID) {
+			continue
+		}
+
 		details := payloads.FlavorDetails{
 			OsFlavorAccessIsPublic: true,
 			ID:   w.ID,
@@ -1006,3 +1269,446 @@ func TestTraceData(t *testing.T) {
 		}
 	}
 }
+
+func testWorkloadRequest() payloads.CiaoWorkloadRequest {
+	return payloads.CiaoWorkloadRequest{
+		Workload: payloads.CiaoWorkload{
+			Description: "test workload",
+			FWType:      payloads.Legacy,
+			VMType:      payloads.QEMU,
+			ImageID:     "73a86d7e-93c0-480e-9c41-ab42f69b7799",
+			Config:      "---\n#cloud-config\n...\n",
+			Defaults: []payloads.CiaoWorkloadResource{
+				{Type: payloads.VCPUs, Value: 2, Mandatory: true},
+				{Type: payloads.MemMB, Value: 256, Mandatory: true},
+			},
+		},
+	}
+}
+
+func testCreateWorkload(t *testing.T) payloads.CiaoWorkload {
+	b, err := json.Marshal(testWorkloadRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := testHTTPRequest(t, "POST", computeURL+"/v2.1/workloads", http.StatusCreated, b)
+
+	var resp payloads.CiaoWorkloadRequest
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.Workload
+}
+
+func TestCreateWorkload(t *testing.T) {
+	wl := testCreateWorkload(t)
+	defer context.ds.DeleteWorkload(wl.ID)
+
+	expected := testWorkloadRequest().Workload
+	expected.ID = wl.ID
+	if reflect.DeepEqual(expected, wl) == false {
+		t.Fatalf("expected: \n%+v\n result: \n%+v\n", expected, wl)
+	}
+
+	// the new workload is available as a flavor
+	tenant, err := context.ds.GetTenant(computeTestUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := computeURL + "/v2.1/" + tenant.ID + "/flavors/" + wl.ID
+	_ = testHTTPRequest(t, "GET", url, http.StatusOK, nil)
+
+	body := testHTTPRequest(t, "GET", computeURL+"/v2.1/workloads/"+wl.ID, http.StatusOK, nil)
+
+	var resp payloads.CiaoWorkloadRequest
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reflect.DeepEqual(expected, resp.Workload) == false {
+		t.Fatalf("expected: \n%+v\n result: \n%+v\n", expected, resp.Workload)
+	}
+
+	// docker workloads need an image name, not an image ID
+	req := testWorkloadRequest()
+	req.Workload.VMType = payloads.Docker
+	req.Workload.ImageID = ""
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = testHTTPRequest(t, "POST", computeURL+"/v2.1/workloads", http.StatusBadRequest, b)
+}
+
+func TestListWorkloads(t *testing.T) {
+	wl := testCreateWorkload(t)
+	defer context.ds.DeleteWorkload(wl.ID)
+
+	wls, err := context.ds.GetWorkloads()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := testHTTPRequest(t, "GET", computeURL+"/v2.1/workloads", http.StatusOK, nil)
+
+	var workloads payloads.CiaoWorkloads
+	err = json.Unmarshal(body, &workloads)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(workloads.Workloads) != len(wls) {
+		t.Fatal("Incorrect number of workloads returned")
+	}
+
+	for _, w := range workloads.Workloads {
+		if w.ID == wl.ID {
+			return
+		}
+	}
+
+	t.Fatal("New workload not listed")
+}
+
+func TestUpdateWorkload(t *testing.T) {
+	wl := testCreateWorkload(t)
+	defer context.ds.DeleteWorkload(wl.ID)
+
+	req := testWorkloadRequest()
+	req.Workload.Description = "updated workload"
+	req.Workload.Defaults[1].Value = 512
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := computeURL + "/v2.1/workloads/" + wl.ID
+	_ = testHTTPRequest(t, "PUT", url, http.StatusOK, b)
+
+	updated, err := context.ds.GetWorkload(wl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if updated.Description != "updated workload" || updated.Defaults[1].Value != 512 {
+		t.Fatalf("Workload not updated: %+v", updated)
+	}
+
+	url = computeURL + "/v2.1/workloads/" + uuid.Generate().String()
+	_ = testHTTPRequest(t, "PUT", url, http.StatusNotFound, b)
+}
+
+func TestDeleteWorkload(t *testing.T) {
+	wl := testCreateWorkload(t)
+
+	url := computeURL + "/v2.1/workloads/" + wl.ID
+	_ = testHTTPRequest(t, "DELETE", url, http.StatusNoContent, nil)
+	_ = testHTTPRequest(t, "GET", url, http.StatusNotFound, nil)
+	_ = testHTTPRequest(t, "DELETE", url, http.StatusNotFound, nil)
+}
+
+func TestCreateTenant(t *testing.T) {
+	nn := true
+	saved := noNetwork
+	noNetwork = &nn
+	defer func() { noNetwork = saved }()
+
+	var req payloads.CiaoCreateTenant
+	req.Tenant.ID = uuid.Generate().String()
+	defer context.ds.DeleteTenant(req.Tenant.ID)
+	req.Tenant.Quotas = []payloads.CiaoQuota{
+		{Resource: "instances", Limit: 5},
+		{Resource: "vcpus", Limit: 10},
+	}
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := computeURL + "/v2.1/tenants"
+	body := testHTTPRequest(t, "POST", url, http.StatusCreated, b)
+
+	var resources payloads.CiaoTenantResources
+	err = json.Unmarshal(body, &resources)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resources.ID != req.Tenant.ID || resources.InstanceLimit != 5 ||
+		resources.VCPULimit != 10 || resources.MemLimit != -1 {
+		t.Fatalf("Unexpected tenant quotas %+v", resources)
+	}
+
+	_ = testHTTPRequest(t, "POST", url, http.StatusConflict, b)
+
+	req.Tenant.ID = uuid.Generate().String()
+	req.Tenant.Quotas = []payloads.CiaoQuota{{Resource: "network_node", Limit: 1}}
+
+	b, err = json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = testHTTPRequest(t, "POST", url, http.StatusBadRequest, b)
+}
+
+func TestUpdateTenantQuotas(t *testing.T) {
+	tenant, err := context.ds.AddTenant(uuid.Generate().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer context.ds.DeleteTenant(tenant.ID)
+
+	req := payloads.CiaoTenantQuotas{
+		Quotas: []payloads.CiaoQuota{
+			{Resource: "mem_mb", Limit: 4096},
+			{Resource: "disk_mb", Limit: 8192},
+		},
+	}
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := computeURL + "/v2.1/tenants/" + tenant.ID + "/quotas"
+	_ = testHTTPRequest(t, "PUT", url, http.StatusOK, b)
+
+	body := testHTTPRequest(t, "GET", url, http.StatusOK, nil)
+
+	var resources payloads.CiaoTenantResources
+	err = json.Unmarshal(body, &resources)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resources.MemLimit != 4096 || resources.DiskLimit != 8192 ||
+		resources.InstanceLimit != -1 {
+		t.Fatalf("Tenant quotas not updated %+v", resources)
+	}
+
+	url = computeURL + "/v2.1/tenants/" + uuid.Generate().String() + "/quotas"
+	_ = testHTTPRequest(t, "PUT", url, http.StatusNotFound, b)
+}
+
+func TestDeleteTenant(t *testing.T) {
+	tenant, err := context.ds.AddTenant(uuid.Generate().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := computeURL + "/v2.1/tenants/" + tenant.ID
+	_ = testHTTPRequest(t, "DELETE", url, http.StatusNoContent, nil)
+	_ = testHTTPRequest(t, "GET", url+"/quotas", http.StatusNotFound, nil)
+	_ = testHTTPRequest(t, "DELETE", url, http.StatusNotFound, nil)
+}
+
+func TestDeleteTenantCNCI(t *testing.T) {
+	tenant, err := context.ds.AddTenant(uuid.Generate().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cnciID := uuid.Generate().String()
+	err = context.ds.AddTenantCNCI(tenant.ID, cnciID, tenant.CNCIMAC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodeID := uuid.Generate().String()
+	stat := payloads.Stat{
+		NodeUUID: nodeID,
+		Load:     -1,
+		Instances: []payloads.InstanceStat{
+			{
+				InstanceUUID: cnciID,
+				State:        payloads.Running,
+			},
+		},
+	}
+
+	err = context.ds.HandleStats(stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := make(chan cmdResult)
+	server.addCmdChan(ssntp.DELETE, c)
+
+	url := computeURL + "/v2.1/tenants/" + tenant.ID
+	_ = testHTTPRequest(t, "DELETE", url, http.StatusNoContent, nil)
+
+	select {
+	case result := <-c:
+		if result.err != nil {
+			t.Fatal(result.err)
+		}
+
+		if result.instanceUUID != cnciID || result.nodeUUID != nodeID {
+			t.Fatalf("Expected CNCI %s on node %s to be deleted, got %s on node %s",
+				cnciID, nodeID, result.instanceUUID, result.nodeUUID)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for DELETE command")
+	}
+}
+
+// testHTTPError checks that a request fails with the given status and a
+// Nova compatible error body.
+func testHTTPError(t *testing.T, method string, URL string, token string, data []byte, code int, fault string) {
+	body := testHTTPRequestToken(t, method, URL, token, code, data)
+
+	var resp payloads.HTTPErrorResponse
+	err := json.Unmarshal(body, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, ok := resp[fault]
+	if len(resp) != 1 || !ok || e.Code != code || e.Message == "" {
+		t.Fatalf("Expected a %s error, got %s", fault, string(body))
+	}
+}
+
+func TestHTTPErrorUnauthorized(t *testing.T) {
+	url := computeURL + "/v2.1/" + computeTestUser + "/servers/detail"
+
+	testHTTPError(t, "GET", url, "", nil, http.StatusUnauthorized, "unauthorized")
+	testHTTPError(t, "GET", url, "imaninvalidtoken", nil, http.StatusUnauthorized, "unauthorized")
+
+	url = computeURL + "/v2.1/tenants"
+	testHTTPError(t, "GET", url, "imaninvalidtoken", nil, http.StatusUnauthorized, "unauthorized")
+}
+
+func TestHTTPErrorForbidden(t *testing.T) {
+	url := computeURL + "/v2.1/" + computeTestUser + "/servers/detail"
+	testHTTPError(t, "GET", url, "imausertoken", nil, http.StatusForbidden, "forbidden")
+
+	url = computeURL + "/v2.1/tenants"
+	testHTTPError(t, "GET", url, "imausertoken", nil, http.StatusForbidden, "forbidden")
+}
+
+func TestHTTPErrorNotFound(t *testing.T) {
+	tenantURL := computeURL + "/v2.1/" + computeTestUser
+	id := uuid.Generate().String()
+
+	var tests = []struct {
+		method string
+		url    string
+		data   []byte
+	}{
+		{"GET", tenantURL + "/servers/" + id, nil},
+		{"DELETE", tenantURL + "/servers/" + id, nil},
+		{"POST", tenantURL + "/servers/" + id + "/action", []byte(`{"os-start":null}`)},
+		{"GET", tenantURL + "/flavors/" + id, nil},
+		{"DELETE", tenantURL + "/volumes/" + id, nil},
+	}
+
+	for _, test := range tests {
+		testHTTPError(t, test.method, test.url, "imavalidtoken", test.data, http.StatusNotFound, "itemNotFound")
+	}
+}
+
+func TestHTTPErrorBadRequest(t *testing.T) {
+	tenantURL := computeURL + "/v2.1/" + computeTestUser
+
+	wls, err := context.ds.GetWorkloads()
+	if err != nil || len(wls) == 0 {
+		t.Fatal("No valid workloads")
+	}
+
+	var tests = []struct {
+		method string
+		url    string
+		data   string
+	}{
+		{"POST", tenantURL + "/servers", `{"server":`},
+		{"POST", tenantURL + "/servers", `{"server":{"flavorRef":"` + uuid.Generate().String() + `"}}`},
+		{"POST", tenantURL + "/servers", `{"server":{"flavorRef":"` + wls[0].ID + `","max_count":-1}}`},
+		{"GET", tenantURL + "/servers/detail?marker=" + uuid.Generate().String(), ""},
+		{"GET", tenantURL + "/resources", ""},
+		{"POST", tenantURL + "/servers/action", `{"action":"os-reboot"}`},
+		{"POST", tenantURL + "/volumes", `{"volume":{"size":0}}`},
+		{"POST", tenantURL + "/volumes", `{"volume":{"size":1,"format":"vmdk"}}`},
+	}
+
+	for _, test := range tests {
+		var data []byte
+		if test.data != "" {
+			data = []byte(test.data)
+		}
+
+		testHTTPError(t, test.method, test.url, "imavalidtoken", data, http.StatusBadRequest, "badRequest")
+	}
+}
+
+func TestServerActionBadRequest(t *testing.T) {
+	servers := testCreateServer(t, 1)
+
+	url := computeURL + "/v2.1/" + computeTestUser + "/servers/" + servers.Servers[0].ID + "/action"
+
+	var actions = []string{
+		"os-start",
+		`{"server":"os-start"}`,
+		`{"os-reboot":null}`,
+		`{"os-start":null,"os-stop":null}`,
+		`{}`,
+		`null`,
+	}
+
+	for _, action := range actions {
+		testHTTPError(t, "POST", url, "imavalidtoken", []byte(action), http.StatusBadRequest, "badRequest")
+	}
+}
+
+func TestHTTPErrorOverLimits(t *testing.T) {
+	nn := true
+	saved := noNetwork
+	noNetwork = &nn
+	defer func() { noNetwork = saved }()
+
+	tenant, err := context.ds.AddTenant(uuid.Generate().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer context.ds.DeleteTenant(tenant.ID)
+
+	// limit the tenant memory to 1MB
+	err = context.ds.AddLimit(tenant.ID, memory, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err := context.ds.GetWorkloads()
+	if err != nil || len(wls) == 0 {
+		t.Fatal("No valid workloads")
+	}
+
+	var server payloads.ComputeCreateServer
+	server.Server.Workload = wls[0].ID
+
+	b, err := json.Marshal(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := computeURL + "/v2.1/" + tenant.ID + "/servers"
+	testHTTPError(t, "POST", url, "imavalidtoken", b, http.StatusForbidden, "forbidden")
+}
+
+func TestHTTPErrorRequestTooLarge(t *testing.T) {
+	url := computeURL + "/v2.1/" + computeTestUser + "/servers"
+	data := bytes.Repeat([]byte(" "), maxRequestBodySize+1)
+
+	testHTTPError(t, "POST", url, "imavalidtoken", data, http.StatusRequestEntityTooLarge, "overLimit")
+}
@@ -17,6 +17,9 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
 	"flag"
 	"fmt"
 	datastore "github.com/01org/ciao/ciao-controller/internal/datastore"
@@ -25,10 +28,14 @@ import (
 	"github.com/01org/ciao/ssntp"
 	"github.com/docker/distribution/uuid"
 	"gopkg.in/yaml.v2"
+	"io/ioutil"
 	"math/rand"
 	"net"
+	"net/http"
 	"os"
+	"path"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -42,6 +49,9 @@ type ssntpTestServer struct {
 
 	netClients     map[string]bool
 	netClientsLock *sync.RWMutex
+
+	connected     map[string]chan struct{}
+	connectedLock *sync.Mutex
 }
 
 type cmdResult struct {
@@ -50,6 +60,15 @@ type cmdResult struct {
 	nodeUUID     string
 	tenantUUID   string
 	cnci         bool
+	privateIP    string
+	vnicMAC      string
+	volumeUUID   string
+	volumePath   string
+	imageUUID    string
+	uploadToken  string
+	resources    []payloads.RequestedResource
+	volumes      []payloads.VolumeResource
+	migrations   []payloads.InstanceMigration
 }
 
 func (server *ssntpTestServer) addCmdChan(cmd ssntp.Command, c chan cmdResult) {
@@ -58,7 +77,31 @@ func (server *ssntpTestServer) addCmdChan(cmd ssntp.Command, c chan cmdResult) {
 	server.cmdChansLock.Unlock()
 }
 
+// connectedChan returns a channel that is closed once the server has
+// been notified of the uuid client connection.
+func (server *ssntpTestServer) connectedChan(uuid string) chan struct{} {
+	server.connectedLock.Lock()
+	defer server.connectedLock.Unlock()
+
+	c, ok := server.connected[uuid]
+	if !ok {
+		c = make(chan struct{})
+		server.connected[uuid] = c
+	}
+
+	return c
+}
+
 func (server *ssntpTestServer) ConnectNotify(uuid string, role uint32) {
+	defer func() {
+		c := server.connectedChan(uuid)
+		select {
+		case <-c:
+		default:
+			close(c)
+		}
+	}()
+
 	switch role {
 	case ssntp.AGENT:
 		server.clients = append(server.clients, uuid)
@@ -115,6 +158,10 @@ func (server *ssntpTestServer) CommandNotify(uuid string, command ssntp.Command,
 			result.instanceUUID = startCmd.Start.InstanceUUID
 			result.tenantUUID = startCmd.Start.TenantUUID
 			result.cnci = nn
+			result.privateIP = startCmd.Start.Networking.PrivateIP
+			result.vnicMAC = startCmd.Start.Networking.VnicMAC
+			result.volumes = startCmd.Start.Volumes
+			result.imageUUID = startCmd.Start.ImageUUID
 		}
 		result.err = err
 
@@ -125,6 +172,7 @@ func (server *ssntpTestServer) CommandNotify(uuid string, command ssntp.Command,
 		result.err = err
 		if err == nil {
 			result.instanceUUID = delCmd.Delete.InstanceUUID
+			result.nodeUUID = delCmd.Delete.WorkloadAgentUUID
 		}
 
 	case ssntp.STOP:
@@ -136,7 +184,6 @@ func (server *ssntpTestServer) CommandNotify(uuid string, command ssntp.Command,
 
 		if err == nil {
 			result.instanceUUID = stopCmd.Stop.InstanceUUID
-			server.ssntp.SendCommand(stopCmd.Stop.WorkloadAgentUUID, command, frame.Payload)
 		}
 
 	case ssntp.RESTART:
@@ -148,7 +195,6 @@ func (server *ssntpTestServer) CommandNotify(uuid string, command ssntp.Command,
 
 		if err == nil {
 			result.instanceUUID = restartCmd.Restart.InstanceUUID
-			server.ssntp.SendCommand(restartCmd.Restart.WorkloadAgentUUID, command, frame.Payload)
 		}
 
 	case ssntp.EVACUATE:
@@ -160,6 +206,64 @@ func (server *ssntpTestServer) CommandNotify(uuid string, command ssntp.Command,
 
 		if err == nil {
 			result.nodeUUID = evacCmd.Evacuate.WorkloadAgentUUID
+			result.migrations = evacCmd.Evacuate.Migrations
+			if evacCmd.Evacuate.NextState != payloads.EvacuateUpdate {
+				result.err = fmt.Errorf("Wrong next state %s", evacCmd.Evacuate.NextState)
+			}
+		}
+
+	case ssntp.AttachVolume:
+		var attachCmd payloads.AttachVolume
+
+		err := yaml.Unmarshal(payload, &attachCmd)
+
+		result.err = err
+
+		if err == nil {
+			result.instanceUUID = attachCmd.Attach.InstanceUUID
+			result.nodeUUID = attachCmd.Attach.WorkloadAgentUUID
+			result.volumeUUID = attachCmd.Attach.VolumeUUID
+			result.volumePath = attachCmd.Attach.Path
+		}
+
+	case ssntp.DetachVolume:
+		var detachCmd payloads.DetachVolume
+
+		err := yaml.Unmarshal(payload, &detachCmd)
+
+		result.err = err
+
+		if err == nil {
+			result.instanceUUID = detachCmd.Detach.InstanceUUID
+			result.nodeUUID = detachCmd.Detach.WorkloadAgentUUID
+			result.volumeUUID = detachCmd.Detach.VolumeUUID
+		}
+
+	case ssntp.Snapshot:
+		var snapshotCmd payloads.Snapshot
+
+		err := yaml.Unmarshal(payload, &snapshotCmd)
+
+		result.err = err
+
+		if err == nil {
+			result.instanceUUID = snapshotCmd.Snapshot.InstanceUUID
+			result.nodeUUID = snapshotCmd.Snapshot.WorkloadAgentUUID
+			result.imageUUID = snapshotCmd.Snapshot.ImageUUID
+			result.uploadToken = snapshotCmd.Snapshot.UploadToken
+		}
+
+	case ssntp.Resize:
+		var resizeCmd payloads.Resize
+
+		err := yaml.Unmarshal(payload, &resizeCmd)
+
+		result.err = err
+
+		if err == nil {
+			result.instanceUUID = resizeCmd.Resize.InstanceUUID
+			result.nodeUUID = resizeCmd.Resize.WorkloadAgentUUID
+			result.resources = resizeCmd.Resize.RequestedResources
 		}
 	}
 
@@ -186,6 +290,21 @@ func (server *ssntpTestServer) CommandForward(uuid string, command ssntp.Command
 
 	payload := frame.Payload
 
+	switch command {
+	case ssntp.STOP:
+		var stopCmd payloads.Stop
+		if yaml.Unmarshal(payload, &stopCmd) == nil {
+			dest.AddRecipient(stopCmd.Stop.WorkloadAgentUUID)
+		}
+		return
+	case ssntp.RESTART:
+		var restartCmd payloads.Restart
+		if yaml.Unmarshal(payload, &restartCmd) == nil {
+			dest.AddRecipient(restartCmd.Restart.WorkloadAgentUUID)
+		}
+		return
+	}
+
 	err := yaml.Unmarshal(payload, &startCmd)
 
 	if err != nil {
@@ -227,6 +346,7 @@ type ssntpTestClient struct {
 	startFailReason   payloads.StartFailureReason
 	stopFail          bool
 	stopFailReason    payloads.StopFailureReason
+	stopNoReply       bool
 	restartFail       bool
 	restartFailReason payloads.RestartFailureReason
 	traces            []*ssntp.Frame
@@ -288,7 +408,7 @@ func (client *ssntpTestClient) handleStart(payload []byte) cmdResult {
 	return result
 }
 
-func (client *ssntpTestClient) handleStop(payload []byte) cmdResult {
+func (client *ssntpTestClient) handleStop(payload []byte, requestID uint64) cmdResult {
 	var result cmdResult
 	var stopCmd payloads.Stop
 
@@ -298,6 +418,10 @@ func (client *ssntpTestClient) handleStop(payload []byte) cmdResult {
 		return result
 	}
 
+	if client.stopNoReply {
+		return result
+	}
+
 	if !client.stopFail {
 		for i := range client.instances {
 			istat := client.instances[i]
@@ -305,14 +429,15 @@ func (client *ssntpTestClient) handleStop(payload []byte) cmdResult {
 				client.instances[i].State = payloads.Exited
 			}
 		}
+		client.ssntp.SendAck(requestID)
 	} else {
-		client.sendStopFailure(stopCmd.Stop.InstanceUUID, client.stopFailReason)
+		client.sendStopFailure(stopCmd.Stop.InstanceUUID, client.stopFailReason, requestID)
 	}
 
 	return result
 }
 
-func (client *ssntpTestClient) handleRestart(payload []byte) cmdResult {
+func (client *ssntpTestClient) handleRestart(payload []byte, requestID uint64) cmdResult {
 	var result cmdResult
 	var restartCmd payloads.Restart
 
@@ -329,8 +454,9 @@ func (client *ssntpTestClient) handleRestart(payload []byte) cmdResult {
 				client.instances[i].State = payloads.Running
 			}
 		}
+		client.ssntp.SendAck(requestID)
 	} else {
-		client.sendRestartFailure(restartCmd.Restart.InstanceUUID, client.restartFailReason)
+		client.sendRestartFailure(restartCmd.Restart.InstanceUUID, client.restartFailReason, requestID)
 	}
 
 	return result
@@ -355,10 +481,10 @@ func (client *ssntpTestClient) CommandNotify(command ssntp.Command, frame *ssntp
 		result = client.handleStart(payload)
 
 	case ssntp.STOP:
-		result = client.handleStop(payload)
+		result = client.handleStop(payload, frame.RequestID)
 
 	case ssntp.RESTART:
-		result = client.handleRestart(payload)
+		result = client.handleRestart(payload, frame.RequestID)
 	}
 
 	if ok {
@@ -391,17 +517,28 @@ func newTestClient(num int, role ssntp.Role) *ssntpTestClient {
 	client.cmdChansLock = &sync.Mutex{}
 
 	config := &ssntp.Config{
-		Role:   uint32(role),
-		CAcert: *caCert,
-		Cert:   *cert,
-		Log:    ssntp.Log,
-		UUID:   client.uuid,
+		Role:            uint32(role),
+		CAcert:          *caCert,
+		Cert:            *cert,
+		Log:             ssntp.Log,
+		UUID:            client.uuid,
+		CustomTransport: testTransport,
 	}
 
+	// Dial may return before the server is notified of our
+	// connection, e.g. with the in-memory transport.
+	connected := server.connectedChan(client.uuid)
+
 	if client.ssntp.Dial(config, client) != nil {
 		return nil
 	}
 
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		return nil
+	}
+
 	return client
 }
 
@@ -476,6 +613,29 @@ func (client *ssntpTestClient) sendDeleteEvent(uuid string) {
 
 }
 
+func (client *ssntpTestClient) sendEvacuatedEvent(uuid string, remaining int, image string) {
+	evt := payloads.InstanceEvacuatedEvent{
+		InstanceUUID: uuid,
+		NodeUUID:     client.uuid,
+		Remaining:    remaining,
+		ImageUUID:    image,
+	}
+
+	event := payloads.EventInstanceEvacuated{
+		InstanceEvacuated: evt,
+	}
+
+	y, err := yaml.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	_, err = client.ssntp.SendEvent(ssntp.InstanceEvacuated, y)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
 func (client *ssntpTestClient) sendConcentratorAddedEvent(instanceUUID string, tenantUUID string, vnicMAC string) {
 	evt := payloads.ConcentratorInstanceAddedEvent{
 		InstanceUUID:    instanceUUID,
@@ -516,7 +676,7 @@ func (client *ssntpTestClient) sendStartFailure(instanceUUID string, reason payl
 	}
 }
 
-func (client *ssntpTestClient) sendStopFailure(instanceUUID string, reason payloads.StopFailureReason) {
+func (client *ssntpTestClient) sendStopFailure(instanceUUID string, reason payloads.StopFailureReason, requestID uint64) {
 	e := payloads.ErrorStopFailure{
 		InstanceUUID: instanceUUID,
 		Reason:       reason,
@@ -527,13 +687,13 @@ func (client *ssntpTestClient) sendStopFailure(instanceUUID string, reason paylo
 		return
 	}
 
-	_, err = client.ssntp.SendError(ssntp.StopFailure, y)
+	_, err = client.ssntp.SendErrorReply(requestID, ssntp.StopFailure, y)
 	if err != nil {
 		fmt.Println(err)
 	}
 }
 
-func (client *ssntpTestClient) sendRestartFailure(instanceUUID string, reason payloads.RestartFailureReason) {
+func (client *ssntpTestClient) sendRestartFailure(instanceUUID string, reason payloads.RestartFailureReason, requestID uint64) {
 	e := payloads.ErrorRestartFailure{
 		InstanceUUID: instanceUUID,
 		Reason:       reason,
@@ -544,7 +704,43 @@ func (client *ssntpTestClient) sendRestartFailure(instanceUUID string, reason pa
 		return
 	}
 
-	_, err = client.ssntp.SendError(ssntp.RestartFailure, y)
+	_, err = client.ssntp.SendErrorReply(requestID, ssntp.RestartFailure, y)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func (client *ssntpTestClient) sendSnapshotFailure(instanceUUID string, imageUUID string, reason payloads.SnapshotFailureReason) {
+	e := payloads.ErrorSnapshotFailure{
+		InstanceUUID: instanceUUID,
+		ImageUUID:    imageUUID,
+		Reason:       reason,
+	}
+
+	y, err := yaml.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	_, err = client.ssntp.SendError(ssntp.SnapshotFailure, y)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func (client *ssntpTestClient) sendResizeFailure(instanceUUID string, reason payloads.ResizeFailureReason, resources []payloads.RequestedResource) {
+	e := payloads.ErrorResizeFailure{
+		InstanceUUID: instanceUUID,
+		Reason:       reason,
+		Resources:    resources,
+	}
+
+	y, err := yaml.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	_, err = client.ssntp.SendError(ssntp.ResizeFailure, y)
 	if err != nil {
 		fmt.Println(err)
 	}
@@ -557,11 +753,15 @@ func startTestServer(server *ssntpTestServer) {
 	server.netClients = make(map[string]bool)
 	server.netClientsLock = &sync.RWMutex{}
 
+	server.connected = make(map[string]chan struct{})
+	server.connectedLock = &sync.Mutex{}
+
 	serverConfig := ssntp.Config{
-		Role:   ssntp.SERVER,
-		CAcert: *caCert,
-		Cert:   *cert,
-		Log:    ssntp.Log,
+		Role:            ssntp.SERVER,
+		CAcert:          *caCert,
+		Cert:            *cert,
+		Log:             ssntp.Log,
+		CustomTransport: testTransport,
 		ForwardRules: []ssntp.FrameForwardRule{
 			{
 				Operand: ssntp.STATS,
@@ -571,6 +771,10 @@ func startTestServer(server *ssntpTestServer) {
 				Operand: ssntp.InstanceDeleted,
 				Dest:    ssntp.Controller,
 			},
+			{
+				Operand: ssntp.InstanceEvacuated,
+				Dest:    ssntp.Controller,
+			},
 			{
 				Operand: ssntp.ConcentratorInstanceAdded,
 				Dest:    ssntp.Controller,
@@ -587,10 +791,30 @@ func startTestServer(server *ssntpTestServer) {
 				Operand: ssntp.RestartFailure,
 				Dest:    ssntp.Controller,
 			},
+			{
+				Operand: ssntp.SnapshotFailure,
+				Dest:    ssntp.Controller,
+			},
+			{
+				Operand: ssntp.ResizeFailure,
+				Dest:    ssntp.Controller,
+			},
+			{
+				Operand: ssntp.ACK,
+				Dest:    ssntp.Controller,
+			},
 			{
 				Operand:        ssntp.START,
 				CommandForward: server,
 			},
+			{
+				Operand:        ssntp.STOP,
+				CommandForward: server,
+			},
+			{
+				Operand:        ssntp.RESTART,
+				CommandForward: server,
+			},
 			{
 				Operand: ssntp.TraceReport,
 				Dest:    ssntp.Controller,
@@ -977,7 +1201,7 @@ func TestEvacuateNode(t *testing.T) {
 
 	// ok to not send workload first?
 
-	err := context.evacuateNode(client.uuid)
+	err := context.evacuateNode(client.uuid, payloads.EvacuateUpdate, false)
 	if err != nil {
 		t.Error(err)
 	}
@@ -999,114 +1223,109 @@ func TestEvacuateNode(t *testing.T) {
 	client.ssntp.Close()
 }
 
-func TestInstanceDeletedEvent(t *testing.T) {
+func TestEvacuateNodeInstances(t *testing.T) {
 	var reason payloads.StartFailureReason
 
 	client, instances := testStartWorkload(t, 1, false, reason)
 	defer client.ssntp.Close()
 
-	time.Sleep(1 * time.Second)
-
 	client.sendStats()
 
 	time.Sleep(1 * time.Second)
 
-	err := context.deleteInstance(instances[0].ID)
+	c := make(chan cmdResult)
+	server.addCmdChan(ssntp.EVACUATE, c)
+
+	// VM root disks are migrated, no need to force the evacuation
+	err := context.evacuateNode(client.uuid, payloads.EvacuateUpdate, false)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	time.Sleep(1 * time.Second)
-
-	client.sendDeleteEvent(instances[0].ID)
-
-	time.Sleep(1 * time.Second)
-
-	// try to get instance info
-	_, err = context.ds.GetInstance(instances[0].ID)
-	if err == nil {
-		t.Error("Instance not deleted")
-	}
-
-	client.ssntp.Close()
-}
-
-func TestLaunchCNCI(t *testing.T) {
-	netClient := newTestClient(0, ssntp.NETAGENT)
-
-	c := make(chan cmdResult)
-	server.addCmdChan(ssntp.START, c)
-
-	id := uuid.Generate().String()
-
-	// this blocks till it get success or failure
-	go context.addTenant(id)
+	var migration payloads.InstanceMigration
 
 	select {
 	case result := <-c:
 		if result.err != nil {
-			t.Fatal("Error parsing command yaml")
+			t.Fatal(result.err)
 		}
 
-		if result.tenantUUID != id {
-			t.Fatal("Did not get correct tenant ID")
+		if result.nodeUUID != client.uuid {
+			t.Fatal("Did not get node ID")
 		}
 
-		if !result.cnci {
-			t.Fatal("this is not a CNCI launch request")
+		if len(result.migrations) != 1 || result.migrations[0].InstanceUUID != instances[0].ID {
+			t.Fatalf("Expected a migration for %s, got %v", instances[0].ID, result.migrations)
 		}
+		migration = result.migrations[0]
 
 	case <-time.After(5 * time.Second):
-		t.Fatal("Timeout waiting for START command")
+		t.Fatal("Timeout waiting for EVACUATE command")
 	}
 
-	time.Sleep(2 * time.Second)
+	image, err := context.ds.GetImage(migration.ImageUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	tenant, err := context.ds.GetTenant(id)
-	if err != nil || tenant == nil {
+	if image.State != payloads.ImageStatusQueued || image.TenantID != instances[0].TenantID ||
+		image.UploadToken != migration.UploadToken || image.SourceWorkload != "" {
+		t.Fatalf("Unexpected migration image %v", image)
+	}
+}
+
+func TestCreateVolume(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
 		t.Fatal(err)
 	}
 
-	if tenant.CNCIIP == "" {
-		t.Fatal("CNCI Info not updated")
+	volume, err := context.createVolume(tenant.ID, 1, "")
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	netClient.ssntp.Close()
-}
+	info, err := os.Stat(volume.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-func TestStartFailure(t *testing.T) {
-	reason := payloads.FullCloud
+	if volume.Format != payloads.RawVolume || info.Size() != 1<<30 {
+		t.Fatalf("Unexpected volume %s of size %d", volume.Format, info.Size())
+	}
 
-	client, _ := testStartWorkload(t, 1, true, reason)
-	defer client.ssntp.Close()
+	err = context.deleteVolume(volume.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	// since we had a start failure, we should confirm that the
-	// instance is no longer pending in the database
+	_, err = os.Stat(volume.Path)
+	if !os.IsNotExist(err) {
+		t.Fatal("Volume file not deleted")
+	}
 }
 
-func TestStopFailure(t *testing.T) {
-	context.ds.ClearLog()
-
+func TestAttachDetachVolume(t *testing.T) {
 	var reason payloads.StartFailureReason
 
 	client, instances := testStartWorkload(t, 1, false, reason)
 	defer client.ssntp.Close()
 
-	client.stopFail = true
-	client.stopFailReason = payloads.StopNoInstance
-
 	time.Sleep(1 * time.Second)
 
 	client.sendStats()
 
 	time.Sleep(1 * time.Second)
 
-	c := make(chan cmdResult)
-	server.addCmdChan(ssntp.STOP, c)
+	volume, err := context.createVolume(instances[0].TenantID, 1, payloads.RawVolume)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	time.Sleep(1 * time.Second)
+	c := make(chan cmdResult)
+	server.addCmdChan(ssntp.AttachVolume, c)
 
-	err := context.stopInstance(instances[0].ID)
+	err = context.attachVolume(volume.ID, instances[0].ID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1117,55 +1336,702 @@ func TestStopFailure(t *testing.T) {
 			t.Fatal("Error parsing command yaml")
 		}
 
-		if result.instanceUUID != instances[0].ID {
-			t.Fatal("Did not get correct Instance ID")
+		if result.instanceUUID != instances[0].ID || result.volumeUUID != volume.ID ||
+			result.volumePath != volume.Path || result.nodeUUID != client.uuid {
+			t.Fatal("Did not get correct ATTACH_VOLUME payload")
 		}
 
 	case <-time.After(5 * time.Second):
-		t.Fatal("Timeout waiting for STOP command")
+		t.Fatal("Timeout waiting for ATTACH_VOLUME command")
 	}
 
-	time.Sleep(1 * time.Second)
+	err = context.deleteVolume(volume.ID)
+	if err == nil {
+		t.Fatal("Deleted attached volume")
+	}
 
-	client.ssntp.Close()
+	c = make(chan cmdResult)
+	server.addCmdChan(ssntp.DetachVolume, c)
 
-	// the response to a stop failure is to log the failure
-	entries, err := context.ds.GetEventLog()
+	err = context.detachVolume(volume.ID, instances[0].ID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	expectedMsg := fmt.Sprintf("Stop Failure %s: %s", instances[0].ID, client.stopFailReason.String())
-
-	for i := range entries {
-		if entries[i].Message == expectedMsg {
-			return
+	select {
+	case result := <-c:
+		if result.err != nil {
+			t.Fatal("Error parsing command yaml")
 		}
-	}
-	t.Error("Did not find failure message in Log")
-}
 
-func TestRestartFailure(t *testing.T) {
-	context.ds.ClearLog()
-
-	var reason payloads.StartFailureReason
+		if result.instanceUUID != instances[0].ID || result.volumeUUID != volume.ID {
+			t.Fatal("Did not get correct DETACH_VOLUME payload")
+		}
 
-	client, instances := testStartWorkload(t, 1, false, reason)
-	defer client.ssntp.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for DETACH_VOLUME command")
+	}
 
-	client.restartFail = true
-	client.restartFailReason = payloads.RestartLaunchFailure
+	err = context.deleteVolume(volume.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
 
-	time.Sleep(1 * time.Second)
+func TestImageUpload(t *testing.T) {
+	id := uuid.Generate().String()
 
-	client.sendStats()
+	image, err := context.createImage(id, "test image")
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	time.Sleep(1 * time.Second)
+	if image.State != payloads.ImageStatusQueued {
+		t.Fatalf("Unexpected image state %s", image.State)
+	}
 
-	c := make(chan cmdResult)
-	server.addCmdChan(ssntp.STOP, c)
+	_, err = context.createImage(id, "duplicate")
+	if err == nil {
+		t.Fatal("Created image twice")
+	}
 
-	err := context.stopInstance(instances[0].ID)
+	image, err = context.uploadImage(id, strings.NewReader("ciao"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sha256sum of "ciao"
+	checksum := "b133a0c0e9bee3be20163d2ad31d6248db292aa6dcb1ee087a2aa50e0fc75ae2"
+	if image.State != payloads.ImageStatusActive || image.Size != 4 {
+		t.Fatalf("Unexpected image %s of size %d", image.State, image.Size)
+	}
+
+	stored, err := context.ds.GetImage(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored.Checksum != checksum {
+		t.Fatalf("Unexpected image checksum %s", stored.Checksum)
+	}
+
+	_, err = context.uploadImage(id, strings.NewReader("ciao"))
+	if err == nil {
+		t.Fatal("Uploaded image data twice")
+	}
+
+	err = context.deleteImage(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(context.images.imagePath(id))
+	if !os.IsNotExist(err) {
+		t.Fatal("Image file not deleted")
+	}
+}
+
+func TestImageUploadLimits(t *testing.T) {
+	id := uuid.Generate().String()
+
+	_, err := context.createImage(id, "test image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer context.deleteImage(id)
+
+	context.images.maxSize = 2
+	_, err = context.uploadImage(id, strings.NewReader("ciao"))
+	context.images.maxSize = 0
+	if err != errImageTooLarge {
+		t.Fatalf("Expected %v, got %v", errImageTooLarge, err)
+	}
+
+	err = context.ds.TransitionImageState(id, payloads.ImageStatusQueued, payloads.ImageStatusSaving)
+	if err != nil {
+		t.Fatalf("Image not requeued after failed upload: %v", err)
+	}
+
+	_, err = context.uploadImage(id, strings.NewReader("ciao"))
+	if err == nil {
+		t.Fatal("Uploaded image data while an upload was in progress")
+	}
+}
+
+func testImageRequest(oid asn1.ObjectIdentifier, token string) *http.Request {
+	r, _ := http.NewRequest("PUT", "https://localhost/v2/images/id/file", nil)
+	r.TLS = &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{
+			{&x509.Certificate{UnknownExtKeyUsage: []asn1.ObjectIdentifier{oid}}},
+		},
+	}
+	if token != "" {
+		r.Header.Set(payloads.ImageUploadTokenHeader, token)
+	}
+
+	return r
+}
+
+func TestImageWriter(t *testing.T) {
+	image, err := context.queueImage(&types.Image{
+		Name:           "snapshot",
+		SourceWorkload: uuid.Generate().String(),
+		UploadToken:    uuid.Generate().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer context.deleteImage(image.ID)
+
+	tests := []struct {
+		oid      asn1.ObjectIdentifier
+		token    string
+		reader   bool
+		writer   bool
+		scenario string
+	}{
+		{ssntp.RoleAgentOID, image.UploadToken, true, true, "agent with token"},
+		{ssntp.RoleAgentOID, "", true, false, "agent without token"},
+		{ssntp.RoleAgentOID, uuid.Generate().String(), true, false, "agent with wrong token"},
+		{ssntp.RoleCNCIAgentOID, image.UploadToken, false, false, "CNCI agent"},
+	}
+
+	for _, test := range tests {
+		r := testImageRequest(test.oid, test.token)
+		if imageReader(context, r) != test.reader {
+			t.Errorf("Unexpected read access for %s", test.scenario)
+		}
+		if imageWriter(context, r, image.ID) != test.writer {
+			t.Errorf("Unexpected write access for %s", test.scenario)
+		}
+	}
+}
+
+func testSnapshotInstance(t *testing.T, client *ssntpTestClient, instance *types.Instance, name string) *types.Image {
+	c := make(chan cmdResult)
+	server.addCmdChan(ssntp.Snapshot, c)
+
+	image, err := context.snapshotInstance(instance.ID, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if image.State != payloads.ImageStatusQueued || image.SourceWorkload != instance.WorkloadID {
+		t.Fatalf("Unexpected snapshot image %v", image)
+	}
+
+	select {
+	case result := <-c:
+		if result.err != nil {
+			t.Fatal("Error parsing command yaml")
+		}
+
+		if result.instanceUUID != instance.ID || result.imageUUID != image.ID ||
+			result.nodeUUID != client.uuid || result.uploadToken == "" ||
+			result.uploadToken != image.UploadToken {
+			t.Fatal("Did not get correct SNAPSHOT payload")
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for SNAPSHOT command")
+	}
+
+	return image
+}
+
+func TestSnapshotInstance(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.ssntp.Close()
+
+	time.Sleep(1 * time.Second)
+
+	client.sendStats()
+
+	time.Sleep(1 * time.Second)
+
+	image := testSnapshotInstance(t, client, instances[0], "snapshot")
+
+	_, err := context.uploadImage(image.ID, strings.NewReader("ciao"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source, err := context.ds.GetWorkload(instances[0].WorkloadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err := context.ds.GetWorkloads()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wl *types.Workload
+	for _, w := range wls {
+		if w.ImageID == image.ID {
+			wl = w
+		}
+	}
+
+	if wl == nil {
+		t.Fatal("No workload registered for snapshot")
+	}
+
+	if wl.ID == source.ID || wl.Description != "snapshot" || wl.Config != source.Config ||
+		len(wl.Defaults) != len(source.Defaults) || wl.TenantID != instances[0].TenantID {
+		t.Fatalf("Unexpected snapshot workload %v", wl)
+	}
+	defer context.ds.DeleteWorkload(wl.ID)
+
+	_, err = context.startWorkload(wl.ID, uuid.Generate().String(), 1, false, "")
+	if err != errWorkloadNotAvailable {
+		t.Fatalf("Snapshot workload started by another tenant: %v", err)
+	}
+
+	image = testSnapshotInstance(t, client, instances[0], "failed snapshot")
+
+	client.sendSnapshotFailure(instances[0].ID, image.ID, payloads.SnapshotUploadFailure)
+
+	time.Sleep(1 * time.Second)
+
+	_, err = context.ds.GetImage(image.ID)
+	if err == nil {
+		t.Fatal("Image of failed snapshot not deleted")
+	}
+}
+
+func TestResizeInstance(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.ssntp.Close()
+
+	time.Sleep(1 * time.Second)
+
+	client.sendStats()
+
+	time.Sleep(1 * time.Second)
+
+	instance := instances[0]
+	mem := instance.Usage[string(payloads.MemMB)]
+
+	err := context.resizeInstance(instance.ID, 0, mem+64, 0)
+	if err == nil {
+		t.Fatal("Resized a running instance")
+	}
+
+	c := make(chan cmdResult)
+	server.addCmdChan(ssntp.STOP, c)
+
+	err = context.stopInstance(instance.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-c:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for STOP command")
+	}
+
+	time.Sleep(1 * time.Second)
+
+	client.sendStats()
+
+	time.Sleep(1 * time.Second)
+
+	// mem_mb is resource 3
+	err = context.ds.AddLimit(instance.TenantID, 3, mem+128)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = context.resizeInstance(instance.ID, 0, mem+256, 0)
+	if err != errOverTenantLimits {
+		t.Fatalf("Resize over tenant limits not rejected: %v", err)
+	}
+
+	c = make(chan cmdResult)
+	server.addCmdChan(ssntp.Resize, c)
+
+	err = context.resizeInstance(instance.ID, 0, mem+64, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var current []payloads.RequestedResource
+
+	select {
+	case result := <-c:
+		if result.err != nil {
+			t.Fatal("Error parsing command yaml")
+		}
+
+		if result.instanceUUID != instance.ID || result.nodeUUID != client.uuid {
+			t.Fatal("Did not get correct RESIZE payload")
+		}
+
+		for _, r := range result.resources {
+			if r.Type == payloads.MemMB && r.Value != mem+64 {
+				t.Fatalf("Unexpected mem_mb %d in RESIZE payload", r.Value)
+			}
+			if r.Type == payloads.MemMB {
+				r.Value = mem
+			}
+			current = append(current, r)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for RESIZE command")
+	}
+
+	i, err := context.ds.GetInstance(instance.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if i.Usage[string(payloads.MemMB)] != mem+64 {
+		t.Fatalf("Instance usage not updated: %v", i.Usage)
+	}
+
+	state := i.State
+
+	client.sendResizeFailure(instance.ID, payloads.ResizeNoCapacity, current)
+
+	time.Sleep(1 * time.Second)
+
+	if i.Usage[string(payloads.MemMB)] != mem {
+		t.Fatalf("Instance usage not restored: %v", i.Usage)
+	}
+
+	if i.NodeID != client.uuid || i.State != state {
+		t.Fatalf("Instance moved or restarted by failed resize: %s %s", i.NodeID, i.State)
+	}
+}
+
+func TestInstanceDeletedEvent(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.ssntp.Close()
+
+	time.Sleep(1 * time.Second)
+
+	client.sendStats()
+
+	time.Sleep(1 * time.Second)
+
+	err := context.deleteInstance(instances[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(1 * time.Second)
+
+	client.sendDeleteEvent(instances[0].ID)
+
+	time.Sleep(1 * time.Second)
+
+	// try to get instance info
+	_, err = context.ds.GetInstance(instances[0].ID)
+	if err == nil {
+		t.Error("Instance not deleted")
+	}
+
+	client.ssntp.Close()
+}
+
+func TestInstanceEvacuatedEvent(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.ssntp.Close()
+
+	client.sendStats()
+
+	time.Sleep(1 * time.Second)
+
+	volume, err := context.createVolume(instances[0].TenantID, 1, payloads.RawVolume)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = context.ds.AttachVolume(volume.ID, instances[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := make(chan cmdResult)
+	server.addCmdChan(ssntp.START, c)
+
+	client.sendEvacuatedEvent(instances[0].ID, 0, "")
+
+	select {
+	case result := <-c:
+		if result.err != nil {
+			t.Fatal("Error parsing command yaml")
+		}
+
+		if result.instanceUUID != instances[0].ID {
+			t.Fatal("Did not get correct Instance ID")
+		}
+
+		if result.privateIP != instances[0].IPAddress {
+			t.Fatalf("Expected IP %s, got %s", instances[0].IPAddress, result.privateIP)
+		}
+
+		if result.vnicMAC != instances[0].MACAddress {
+			t.Fatalf("Expected MAC %s, got %s", instances[0].MACAddress, result.vnicMAC)
+		}
+
+		if len(result.volumes) != 1 || result.volumes[0].VolumeUUID != volume.ID ||
+			result.volumes[0].Path != volume.Path {
+			t.Fatalf("Expected volume %s to be attached, got %v", volume.ID, result.volumes)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for START command")
+	}
+
+	instance, err := context.ds.GetInstance(instances[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if instance.NodeID == client.uuid {
+		t.Error("Instance still assigned to evacuated node")
+	}
+}
+
+func TestInstanceEvacuatedEventImage(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.ssntp.Close()
+
+	client.sendStats()
+
+	time.Sleep(1 * time.Second)
+
+	c := make(chan cmdResult)
+	server.addCmdChan(ssntp.START, c)
+
+	imageID := uuid.Generate().String()
+	client.sendEvacuatedEvent(instances[0].ID, 0, imageID)
+
+	select {
+	case result := <-c:
+		if result.err != nil {
+			t.Fatal("Error parsing command yaml")
+		}
+
+		if result.instanceUUID != instances[0].ID {
+			t.Fatal("Did not get correct Instance ID")
+		}
+
+		if result.imageUUID != imageID {
+			t.Fatalf("Expected image %s, got %s", imageID, result.imageUUID)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for START command")
+	}
+}
+
+func TestCNCIEvacuatedEvent(t *testing.T) {
+	netClient := newTestClient(0, ssntp.NETAGENT)
+	defer netClient.ssntp.Close()
+
+	c := make(chan cmdResult)
+	server.addCmdChan(ssntp.START, c)
+
+	id := uuid.Generate().String()
+
+	// this blocks till it get success or failure
+	go context.addTenant(id)
+
+	select {
+	case result := <-c:
+		if result.err != nil {
+			t.Fatal("Error parsing command yaml")
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for START command")
+	}
+
+	time.Sleep(2 * time.Second)
+
+	tenant, err := context.ds.GetTenant(id)
+	if err != nil || tenant == nil {
+		t.Fatal(err)
+	}
+
+	c = make(chan cmdResult)
+	server.addCmdChan(ssntp.START, c)
+
+	netClient.sendEvacuatedEvent(tenant.CNCIID, 0, "")
+
+	select {
+	case result := <-c:
+		if result.err != nil {
+			t.Fatal("Error parsing command yaml")
+		}
+
+		if !result.cnci || result.tenantUUID != id {
+			t.Fatal("this is not a CNCI launch request")
+		}
+
+		if result.instanceUUID != tenant.CNCIID {
+			t.Fatalf("Expected CNCI %s, got %s", tenant.CNCIID, result.instanceUUID)
+		}
+
+		if result.vnicMAC != tenant.CNCIMAC {
+			t.Fatalf("Expected MAC %s, got %s", tenant.CNCIMAC, result.vnicMAC)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for START command")
+	}
+}
+
+func TestLaunchCNCI(t *testing.T) {
+	netClient := newTestClient(0, ssntp.NETAGENT)
+
+	c := make(chan cmdResult)
+	server.addCmdChan(ssntp.START, c)
+
+	id := uuid.Generate().String()
+
+	// this blocks till it get success or failure
+	go context.addTenant(id)
+
+	select {
+	case result := <-c:
+		if result.err != nil {
+			t.Fatal("Error parsing command yaml")
+		}
+
+		if result.tenantUUID != id {
+			t.Fatal("Did not get correct tenant ID")
+		}
+
+		if !result.cnci {
+			t.Fatal("this is not a CNCI launch request")
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for START command")
+	}
+
+	time.Sleep(2 * time.Second)
+
+	tenant, err := context.ds.GetTenant(id)
+	if err != nil || tenant == nil {
+		t.Fatal(err)
+	}
+
+	if tenant.CNCIIP == "" {
+		t.Fatal("CNCI Info not updated")
+	}
+
+	netClient.ssntp.Close()
+}
+
+func TestStartFailure(t *testing.T) {
+	reason := payloads.FullCloud
+
+	client, _ := testStartWorkload(t, 1, true, reason)
+	defer client.ssntp.Close()
+
+	// since we had a start failure, we should confirm that the
+	// instance is no longer pending in the database
+}
+
+func TestStopFailure(t *testing.T) {
+	context.ds.ClearLog()
+
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.ssntp.Close()
+
+	client.stopFail = true
+	client.stopFailReason = payloads.StopNoInstance
+
+	time.Sleep(1 * time.Second)
+
+	client.sendStats()
+
+	time.Sleep(1 * time.Second)
+
+	c := make(chan cmdResult)
+	server.addCmdChan(ssntp.STOP, c)
+
+	time.Sleep(1 * time.Second)
+
+	err := context.stopInstance(instances[0].ID)
+	if err == nil {
+		t.Fatal("Stop failure not reported")
+	}
+
+	select {
+	case result := <-c:
+		if result.err != nil {
+			t.Fatal("Error parsing command yaml")
+		}
+
+		if result.instanceUUID != instances[0].ID {
+			t.Fatal("Did not get correct Instance ID")
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for STOP command")
+	}
+
+	time.Sleep(1 * time.Second)
+
+	client.ssntp.Close()
+
+	// the response to a stop failure is to log the failure
+	entries, err := context.ds.GetEventLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedMsg := fmt.Sprintf("Stop Failure %s: %s", instances[0].ID, client.stopFailReason.String())
+
+	for i := range entries {
+		if entries[i].Message == expectedMsg {
+			return
+		}
+	}
+	t.Error("Did not find failure message in Log")
+}
+
+func TestRestartFailure(t *testing.T) {
+	context.ds.ClearLog()
+
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.ssntp.Close()
+
+	client.restartFail = true
+	client.restartFailReason = payloads.RestartLaunchFailure
+
+	time.Sleep(1 * time.Second)
+
+	client.sendStats()
+
+	time.Sleep(1 * time.Second)
+
+	c := make(chan cmdResult)
+	server.addCmdChan(ssntp.STOP, c)
+
+	err := context.stopInstance(instances[0].ID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1194,8 +2060,8 @@ func TestRestartFailure(t *testing.T) {
 	server.addCmdChan(ssntp.RESTART, c)
 
 	err = context.restartInstance(instances[0].ID)
-	if err != nil {
-		t.Fatal(err)
+	if err == nil {
+		t.Fatal("Restart failure not reported")
 	}
 
 	select {
@@ -1284,6 +2150,25 @@ func testStartTracedWorkload(t *testing.T) *ssntpTestClient {
 	return client
 }
 
+// testVMWorkload returns a VM workload available to all tenants.  The
+// workloads are not returned in any particular order, so tests picking
+// the first one would randomly start containers.
+func testVMWorkload(t *testing.T) *types.Workload {
+	wls, err := context.ds.GetWorkloads()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, wl := range wls {
+		if wl.VMType != payloads.Docker && wl.TenantID == "" {
+			return wl
+		}
+	}
+
+	t.Fatal("No VM workload")
+	return nil
+}
+
 func testStartWorkload(t *testing.T, num int, fail bool, reason payloads.StartFailureReason) (*ssntpTestClient, []*types.Instance) {
 	tenant, err := addTestTenant()
 	if err != nil {
@@ -1292,17 +2177,14 @@ func testStartWorkload(t *testing.T, num int, fail bool, reason payloads.StartFa
 
 	client := newTestClient(0, ssntp.AGENT)
 
-	wls, err := context.ds.GetWorkloads()
-	if err != nil || len(wls) == 0 {
-		t.Fatal(err)
-	}
+	wl := testVMWorkload(t)
 
 	c := make(chan cmdResult)
 	client.addCmdChan(ssntp.START, c)
 	client.startFail = fail
 	client.startFailReason = reason
 
-	instances, err := context.startWorkload(wls[0].ID, tenant.ID, num, false, "")
+	instances, err := context.startWorkload(wl.ID, tenant.ID, num, false, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1398,8 +2280,15 @@ var server ssntpTestServer
 var computeURL string
 var testIdentityURL string
 
+// testTransport connects the controller, the test server and the test
+// agents in process.
+var testTransport = ssntp.NewMemoryTransport()
+
 const computeTestUser = "f452bbc7-5076-44d5-922c-3b9d2ce1503f"
 
+// computeUserTestTenant is the tenant of the non admin "imausertoken" token.
+const computeUserTestTenant = "5ad4d8d6-5f7e-4b9b-8f7c-7d1b1b2c1e42"
+
 func TestMain(m *testing.M) {
 	flag.Parse()
 
@@ -1409,8 +2298,16 @@ func TestMain(m *testing.M) {
 	startTestServer(&server)
 	defer server.ssntp.Stop()
 
+	volumesDir, err := ioutil.TempDir("", "ciao-controller-volumes")
+	if err != nil {
+		os.Exit(1)
+	}
+	defer os.RemoveAll(volumesDir)
+
 	context = new(controller)
 	context.ds = new(datastore.Datastore)
+	context.volumes = &localVolumeDriver{dir: volumesDir}
+	context.images = &imageStore{dir: path.Join(volumesDir, "images")}
 
 	dsConfig := datastore.Config{
 		PersistentURI:     "./ciao-controller-test.db",
@@ -1419,16 +2316,17 @@ func TestMain(m *testing.M) {
 		InitWorkloadsPath: *workloadsPath,
 	}
 
-	err := context.ds.Init(dsConfig)
+	err = context.ds.Init(dsConfig)
 	if err != nil {
 		os.Exit(1)
 	}
 
 	config := &ssntp.Config{
-		URI:    "localhost",
-		CAcert: *caCert,
-		Cert:   *cert,
-		Role:   ssntp.Controller,
+		URI:             "localhost",
+		CAcert:          *caCert,
+		Cert:            *cert,
+		Role:            ssntp.Controller,
+		CustomTransport: testTransport,
 	}
 
 	context.client, err = newSSNTPClient(context, config)
@@ -23,8 +23,82 @@ import (
 	"github.com/rackspace/gophercloud"
 	"github.com/rackspace/gophercloud/openstack"
 	v3tokens "github.com/rackspace/gophercloud/openstack/identity/v3/tokens"
+	"sync"
+	"time"
 )
 
+// identityProvider validates the tokens presented to the compute API,
+// either against keystone or against the local identity service.
+type identityProvider interface {
+	validateService(token string, tenantID string, serviceType string, serviceName string) bool
+	validateProjectRole(token string, project string, role string) bool
+	validateAuthToken(token string) bool
+}
+
+type tokenCacheKey struct {
+	token  string
+	tenant string
+	admin  bool
+}
+
+// tokenCache remembers the successfully validated tokens for ttl, so
+// that the identity service is not queried on every request. A nil
+// tokenCache or a non positive ttl disables caching.
+type tokenCache struct {
+	sync.Mutex
+	ttl    time.Duration
+	tokens map[tokenCacheKey]time.Time
+}
+
+func newTokenCache(ttl time.Duration) *tokenCache {
+	return &tokenCache{
+		ttl:    ttl,
+		tokens: make(map[tokenCacheKey]time.Time),
+	}
+}
+
+func (c *tokenCache) valid(token string, tenant string, admin bool) bool {
+	if c == nil || c.ttl <= 0 {
+		return false
+	}
+
+	key := tokenCacheKey{token, tenant, admin}
+
+	c.Lock()
+	defer c.Unlock()
+
+	expiry, ok := c.tokens[key]
+	if !ok {
+		return false
+	}
+
+	if time.Now().After(expiry) {
+		delete(c.tokens, key)
+		return false
+	}
+
+	return true
+}
+
+func (c *tokenCache) add(token string, tenant string, admin bool) {
+	if c == nil || c.ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+
+	c.Lock()
+	defer c.Unlock()
+
+	for key, expiry := range c.tokens {
+		if now.After(expiry) {
+			delete(c.tokens, key)
+		}
+	}
+
+	c.tokens[tokenCacheKey{token, tenant, admin}] = now.Add(c.ttl)
+}
+
 type identity struct {
 	scV3 *gophercloud.ServiceClient
 }
@@ -191,6 +265,12 @@ func (i *identity) validateService(token string, tenantID string, serviceType st
 	return false
 }
 
+// validateAuthToken checks that a token is valid, whatever its scope.
+func (i *identity) validateAuthToken(token string) bool {
+	r := v3tokens.Get(i.scV3, token)
+	return r.Err == nil
+}
+
 func (i *identity) validateProjectRole(token string, project string, role string) bool {
 	r := v3tokens.Get(i.scV3, token)
 	result := getResult{r}
@@ -20,6 +20,7 @@ import (
 	"github.com/rackspace/gophercloud"
 	"net/http"
 	"net/http/httptest"
+	"testing"
 	"time"
 )
 
@@ -100,8 +101,25 @@ func authHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(t)
 }
 
+// Only the admin "imavalidtoken" token and the "imausertoken" token, a
+// member of the computeUserTestTenant project, are valid.
 func validateHandler(w http.ResponseWriter, r *http.Request) {
-	tenantURL := computeURL + "/v2.1/" + computeTestUser
+	role := "admin"
+	project := computeTestUser
+	projectName := "admin"
+
+	switch r.Header.Get("X-Subject-Token") {
+	case "imavalidtoken":
+	case "imausertoken":
+		role = "user"
+		project = computeUserTestTenant
+		projectName = "user"
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	tenantURL := computeURL + "/v2.1/" + project
 	token := `
 	{
 		"token": {
@@ -121,7 +139,7 @@ func validateHandler(w http.ResponseWriter, r *http.Request) {
 			"roles": [
 				{
 					"id" : "12345",
-					"name" : "admin"
+					"name" : "%s"
 				}
 			],
 			"project": {
@@ -130,7 +148,7 @@ func validateHandler(w http.ResponseWriter, r *http.Request) {
 					"name": "Default"
 				},
 				"id": "%s",
-				"name": "admin"
+				"name": "%s"
 			},
 			"catalog": [
 				{
@@ -199,7 +217,7 @@ func validateHandler(w http.ResponseWriter, r *http.Request) {
 
 	t := []byte(fmt.Sprintf(token,
 		time.Now().Add(1*time.Hour).Format(gophercloud.RFC3339Milli),
-		computeTestUser, testIdentityURL, testIdentityURL,
+		role, project, projectName, testIdentityURL, testIdentityURL,
 		testIdentityURL, tenantURL, tenantURL,
 		tenantURL, time.Now().Format(gophercloud.RFC3339Milli)))
 	w.WriteHeader(http.StatusOK)
@@ -218,3 +236,43 @@ func identityHandlers() *mux.Router {
 func startIdentityTestServer() *httptest.Server {
 	return httptest.NewServer(identityHandlers())
 }
+
+func TestTokenCache(t *testing.T) {
+	cache := newTokenCache(50 * time.Millisecond)
+
+	if cache.valid("token", "tenant", false) == true {
+		t.Fatal("Empty cache has a valid token")
+	}
+
+	cache.add("token", "tenant", false)
+
+	if cache.valid("token", "tenant", false) == false {
+		t.Fatal("Cached token is not valid")
+	}
+
+	if cache.valid("token", "other", false) == true {
+		t.Fatal("Cached token valid for another tenant")
+	}
+
+	if cache.valid("token", "", true) == true {
+		t.Fatal("Cached tenant token valid as an admin token")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if cache.valid("token", "tenant", false) == true {
+		t.Fatal("Expired token is valid")
+	}
+
+	var disabled *tokenCache
+	disabled.add("token", "tenant", false)
+	if disabled.valid("token", "tenant", false) == true {
+		t.Fatal("Disabled cache has a valid token")
+	}
+
+	disabled = newTokenCache(0)
+	disabled.add("token", "tenant", false)
+	if disabled.valid("token", "tenant", false) == true {
+		t.Fatal("Disabled cache has a valid token")
+	}
+}
@@ -0,0 +1,464 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/01org/ciao/ciao-controller/types"
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"github.com/docker/distribution/uuid"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"time"
+)
+
+const imageServicePort = 9292
+
+var errImageTooLarge = errors.New("Image data exceeds the maximum image size")
+
+// imageStore keeps the data of the image service images as files named
+// after the image IDs in a local directory.  Uploads larger than maxSize
+// bytes are rejected, unless maxSize is 0.
+type imageStore struct {
+	dir     string
+	maxSize int64
+}
+
+func (s *imageStore) imagePath(id string) string {
+	return path.Join(s.dir, id)
+}
+
+// upload stores the image data read from r and returns its size and
+// SHA-256 checksum.  The data is written to a temporary file which only
+// replaces the image once it has been fully received.
+func (s *imageStore) upload(id string, r io.Reader) (int64, string, error) {
+	err := os.MkdirAll(s.dir, 0755)
+	if err != nil {
+		return 0, "", err
+	}
+
+	tmp, err := ioutil.TempFile(s.dir, ".upload-")
+	if err != nil {
+		return 0, "", err
+	}
+
+	if s.maxSize > 0 {
+		r = io.LimitReader(r, s.maxSize+1)
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && s.maxSize > 0 && size > s.maxSize {
+		err = errImageTooLarge
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, "", err
+	}
+
+	err = os.Rename(tmp.Name(), s.imagePath(id))
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, "", err
+	}
+
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (s *imageStore) remove(id string) error {
+	err := os.Remove(s.imagePath(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+func imageToCiaoImage(image *types.Image) payloads.CiaoImage {
+	return payloads.CiaoImage{
+		ID:        image.ID,
+		Name:      image.Name,
+		Status:    image.State,
+		Size:      image.Size,
+		Checksum:  image.Checksum,
+		CreatedAt: image.CreatedAt,
+	}
+}
+
+func (c *controller) createImage(id string, name string) (*types.Image, error) {
+	return c.queueImage(&types.Image{ID: id, Name: name})
+}
+
+// queueImage adds a new image, waiting for its data to be uploaded.
+// A random ID is generated for the image if it has none.  The state and
+// creation time of the image are set here.
+func (c *controller) queueImage(image *types.Image) (*types.Image, error) {
+	if image.ID == "" {
+		image.ID = uuid.Generate().String()
+	} else if _, err := uuid.Parse(image.ID); err != nil {
+		return nil, fmt.Errorf("Invalid image ID %s", image.ID)
+	}
+
+	if _, err := c.ds.GetImage(image.ID); err == nil {
+		return nil, fmt.Errorf("Image %s already exists", image.ID)
+	}
+
+	image.State = payloads.ImageStatusQueued
+	image.CreatedAt = time.Now().UTC()
+
+	err := c.ds.AddImage(image)
+	if err != nil {
+		return nil, err
+	}
+
+	return image, nil
+}
+
+func (c *controller) uploadImage(id string, r io.Reader) (*types.Image, error) {
+	image, err := c.ds.GetImage(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only one upload may be in progress for an image
+	err = c.ds.TransitionImageState(id, payloads.ImageStatusQueued, payloads.ImageStatusSaving)
+	if err != nil {
+		return nil, errors.New("Image data already uploaded")
+	}
+
+	image.Size, image.Checksum, err = c.images.upload(id, r)
+	if err != nil {
+		stateErr := c.ds.TransitionImageState(id, payloads.ImageStatusSaving, payloads.ImageStatusQueued)
+		if stateErr != nil {
+			glog.Warningf("Unable to requeue image %s: %v", id, stateErr)
+		}
+		return nil, err
+	}
+
+	image.State = payloads.ImageStatusActive
+	err = c.ds.UpdateImage(image)
+	if err != nil {
+		return nil, err
+	}
+
+	if image.SourceWorkload != "" {
+		c.registerSnapshotWorkload(image)
+	}
+
+	return image, nil
+}
+
+func (c *controller) deleteImage(id string) error {
+	_, err := c.ds.GetImage(id)
+	if err != nil {
+		return err
+	}
+
+	err = c.images.remove(id)
+	if err != nil {
+		return err
+	}
+
+	return c.ds.DeleteImage(id)
+}
+
+// agentCertificate returns true if the client presented an SSNTP
+// certificate with the agent role, i.e. if it is a launcher.  Other SSNTP
+// certificates, such as the CNCI agent ones, are not trusted.
+func agentCertificate(r *http.Request) bool {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return false
+	}
+
+	for _, oid := range r.TLS.VerifiedChains[0][0].UnknownExtKeyUsage {
+		if oid.Equal(ssntp.RoleAgentOID) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Compute nodes fetch images with the SSNTP certificate they use to talk
+// to the scheduler, rather than with a keystone token.
+func imageReader(context *controller, r *http.Request) bool {
+	if agentCertificate(r) {
+		return true
+	}
+
+	return adminToken(context, r)
+}
+
+// The launchers upload the snapshots they take to images that are
+// still queued, authenticating with their SSNTP certificate.  The upload
+// token proves the launcher is the one the SNAPSHOT command was sent to.
+func imageWriter(context *controller, r *http.Request, id string) bool {
+	if adminToken(context, r) {
+		return true
+	}
+
+	if !agentCertificate(r) {
+		return false
+	}
+
+	image, err := context.ds.GetImage(id)
+	if err != nil || image.UploadToken == "" || image.State != payloads.ImageStatusQueued {
+		return false
+	}
+
+	token := r.Header.Get(payloads.ImageUploadTokenHeader)
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(image.UploadToken)) == 1
+}
+
+func listImages(w http.ResponseWriter, r *http.Request, context *controller) {
+	var images payloads.CiaoImages
+
+	dumpRequest(r)
+
+	if imageReader(context, r) == false {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	stored, err := context.ds.GetImages()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	images.Images = []payloads.CiaoImage{}
+	for _, image := range stored {
+		images.Images = append(images.Images, imageToCiaoImage(image))
+	}
+
+	b, err := json.Marshal(images)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func showImage(w http.ResponseWriter, r *http.Request, context *controller) {
+	vars := mux.Vars(r)
+
+	dumpRequest(r)
+
+	if imageReader(context, r) == false {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	image, err := context.ds.GetImage(vars["image"])
+	if err != nil {
+		http.Error(w, "Image not available", http.StatusNotFound)
+		return
+	}
+
+	b, err := json.Marshal(imageToCiaoImage(image))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func downloadImage(w http.ResponseWriter, r *http.Request, context *controller) {
+	vars := mux.Vars(r)
+
+	dumpRequest(r)
+
+	if imageReader(context, r) == false {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	image, err := context.ds.GetImage(vars["image"])
+	if err != nil || image.State != payloads.ImageStatusActive {
+		http.Error(w, "Image not available", http.StatusNotFound)
+		return
+	}
+
+	f, err := os.Open(context.images.imagePath(image.ID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, image.ID, image.CreatedAt, f)
+}
+
+func createImageHandler(w http.ResponseWriter, r *http.Request, context *controller) {
+	var req payloads.CiaoCreateImage
+
+	dumpRequestBody(r, true)
+
+	if adminToken(context, r) == false {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	defer r.Body.Close()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	image, err := context.createImage(req.ID, req.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	b, err := json.Marshal(imageToCiaoImage(image))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(b)
+}
+
+func uploadImageHandler(w http.ResponseWriter, r *http.Request, context *controller) {
+	vars := mux.Vars(r)
+
+	dumpRequest(r)
+
+	if imageWriter(context, r, vars["image"]) == false {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	defer r.Body.Close()
+
+	if context.images.maxSize > 0 && r.ContentLength > context.images.maxSize {
+		http.Error(w, errImageTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	_, err := context.uploadImage(vars["image"], r.Body)
+	if err == errImageTooLarge {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func deleteImageHandler(w http.ResponseWriter, r *http.Request, context *controller) {
+	vars := mux.Vars(r)
+
+	dumpRequest(r)
+
+	if adminToken(context, r) == false {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	err := context.deleteImage(vars["image"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// createImageAPI serves the image service.  Clients presenting an agent
+// certificate signed by the SSNTP CA can read images without a token.
+func createImageAPI(context *controller) {
+	r := mux.NewRouter()
+
+	r.HandleFunc("/v2/images", func(w http.ResponseWriter, r *http.Request) {
+		listImages(w, r, context)
+	}).Methods("GET")
+
+	r.HandleFunc("/v2/images", func(w http.ResponseWriter, r *http.Request) {
+		createImageHandler(w, r, context)
+	}).Methods("POST")
+
+	r.HandleFunc("/v2/images/{image}", func(w http.ResponseWriter, r *http.Request) {
+		showImage(w, r, context)
+	}).Methods("GET")
+
+	r.HandleFunc("/v2/images/{image}", func(w http.ResponseWriter, r *http.Request) {
+		deleteImageHandler(w, r, context)
+	}).Methods("DELETE")
+
+	r.HandleFunc("/v2/images/{image}/file", func(w http.ResponseWriter, r *http.Request) {
+		downloadImage(w, r, context)
+	}).Methods("GET")
+
+	r.HandleFunc("/v2/images/{image}/file", func(w http.ResponseWriter, r *http.Request) {
+		uploadImageHandler(w, r, context)
+	}).Methods("PUT")
+
+	caPEM, err := ioutil.ReadFile(*caCert)
+	if err != nil {
+		glog.Fatalf("Unable to read SSNTP CA certificate: %v", err)
+	}
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(caPEM)
+
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", *imageAPIPort),
+		Handler: r,
+		TLSConfig: &tls.Config{
+			ClientAuth: tls.VerifyClientCertIfGiven,
+			ClientCAs:  clientCAs,
+		},
+	}
+
+	glog.Fatal(server.ListenAndServeTLS(*httpsCAcert, *httpsKey))
+}
@@ -103,6 +103,12 @@ func (i *instance) Clean() error {
 }
 
 func (i *instance) Allowed() (bool, error) {
+	return i.allowed(i.Usage, 1)
+}
+
+// allowed checks whether the tenant of the instance can use the extra
+// resources in usage along with the given number of extra instances.
+func (i *instance) allowed(usage map[string]int, instances int) (bool, error) {
 	if i.CNCI == true {
 		// should I bother to check the tenant id exists?
 		return true, nil
@@ -118,12 +124,12 @@ func (i *instance) Allowed() (bool, error) {
 	for _, res := range tenant.Resources {
 		// check instance count separately
 		if res.Rtype == 1 {
-			if res.OverLimit(1) {
+			if res.OverLimit(instances) {
 				return false, nil
 			}
 			continue
 		}
-		if res.OverLimit(i.Usage[res.Rname]) {
+		if res.OverLimit(usage[res.Rname]) {
 			return false, nil
 		}
 	}
@@ -144,6 +150,39 @@ func (c *config) GetResources() map[string]int {
 }
 
 func newConfig(context *controller, wl *types.Workload, instanceID string, tenantID string) (config, error) {
+	var ipAddress net.IP
+
+	if isCNCIWorkload(wl) == false {
+		ip, err := context.ds.AllocateTenantIP(tenantID)
+		if err != nil {
+			fmt.Println("Unable to allocate IP address: ", err)
+			return config{}, err
+		}
+		ipAddress = ip
+	}
+
+	return newConfigWithIP(context, wl, instanceID, tenantID, ipAddress)
+}
+
+// workloadConstraints returns the placement constraints of the instances
+// of wl owned by tenantID.  Anti-affinity groups are scoped to a tenant
+// and a workload.
+func workloadConstraints(wl *types.Workload, tenantID string) payloads.PlacementConstraints {
+	constraints := payloads.PlacementConstraints{
+		RequiredLabels:  wl.RequiredLabels,
+		PreferredLabels: wl.PreferredLabels,
+	}
+
+	if wl.AntiAffinity {
+		constraints.AntiAffinityGroup = tenantID + "/" + wl.ID
+	}
+
+	return constraints
+}
+
+// newConfigWithIP builds the START payload for an instance using an
+// already allocated IP address.  The address is ignored for CNCIs.
+func newConfigWithIP(context *controller, wl *types.Workload, instanceID string, tenantID string, ipAddress net.IP) (config, error) {
 	type UserData struct {
 		UUID     string `json:"uuid"`
 		Hostname string `json:"hostname"`
@@ -170,12 +209,6 @@ func newConfig(context *controller, wl *types.Workload, instanceID string, tenan
 	networking.VnicUUID = uuid.Generate().String()
 
 	if config.cnci == false {
-		ipAddress, err := context.ds.AllocateTenantIP(tenantID)
-		if err != nil {
-			fmt.Println("Unable to allocate IP address: ", err)
-			return config, err
-		}
-
 		networking.VnicMAC = newTenantHardwareAddr(ipAddress).String()
 
 		// send in CIDR notation?
@@ -222,6 +255,24 @@ func newConfig(context *controller, wl *types.Workload, instanceID string, tenan
 		startCmd.DockerImage = wl.ImageName
 	}
 
+	if config.cnci == false {
+		startCmd.Constraints = workloadConstraints(wl, tenantID)
+
+		// instances restarted on another node keep their volumes
+		volumes, err := context.ds.GetInstanceVolumes(instanceID)
+		if err != nil {
+			return config, err
+		}
+
+		for _, v := range volumes {
+			startCmd.Volumes = append(startCmd.Volumes, payloads.VolumeResource{
+				VolumeUUID: v.ID,
+				Path:       v.Path,
+				Format:     v.Format,
+			})
+		}
+	}
+
 	cmd := payloads.Start{
 		Start: startCmd,
 	}
@@ -26,8 +26,10 @@ import (
 	"fmt"
 	"github.com/01org/ciao/ciao-controller/types"
 	"github.com/01org/ciao/payloads"
+	"github.com/docker/distribution/uuid"
 	"github.com/golang/glog"
 	"net"
+	"reflect"
 	"sort"
 	"sync"
 	"time"
@@ -78,10 +80,14 @@ type persistentStore interface {
 	getCNCIWorkloadID() (id string, err error)
 	getWorkloadNoCache(id string) (*workload, error)
 	getWorkloadsNoCache() ([]*workload, error)
+	addWorkload(wl *workload) (err error)
+	updateWorkload(wl *workload) (err error)
+	deleteWorkload(id string) (err error)
 
 	// interfaces related to tenants
 	addLimit(tenantID string, resourceID int, limit int) (err error)
 	addTenant(id string, MAC string) (err error)
+	deleteTenant(id string) (err error)
 	getTenantNoCache(id string) (t *tenant, err error)
 	getTenantsNoCache() ([]*tenant, error)
 	updateTenant(t *tenant) (err error)
@@ -92,6 +98,29 @@ type persistentStore interface {
 	getInstances() (instances []*types.Instance, err error)
 	addInstance(instance *types.Instance) (err error)
 	removeInstance(instanceID string) (err error)
+	updateInstanceUsage(instanceID string, usage map[string]int) (err error)
+
+	// interfaces related to volumes
+	getVolumes() (volumes []*types.Volume, err error)
+	addVolume(volume *types.Volume) (err error)
+	updateVolume(volume *types.Volume) (err error)
+	removeVolume(volumeID string) (err error)
+
+	// interfaces related to images
+	getImages() (images []*types.Image, err error)
+	addImage(image *types.Image) (err error)
+	updateImage(image *types.Image) (err error)
+	updateImageState(imageID string, from string, to string) (updated bool, err error)
+	removeImage(imageID string) (err error)
+
+	// interfaces related to the local identity service
+	getIdentityProjects() (projects []*types.IdentityProject, err error)
+	addIdentityProject(project *types.IdentityProject) (err error)
+	getIdentityUsers() (users []*types.IdentityUser, err error)
+	addIdentityUser(user *types.IdentityUser) (err error)
+	getIdentityRoles(userID string) (roles []*types.IdentityRole, err error)
+	addIdentityRole(role *types.IdentityRole) (err error)
+	getIdentityKey() (key []byte, err error)
 
 	// interfaces related to statistics
 	addNodeStatDB(stat payloads.Stat) (err error)
@@ -131,6 +160,9 @@ type Datastore struct {
 
 	tenantUsage     map[string][]payloads.CiaoUsage
 	tenantUsageLock *sync.RWMutex
+
+	volumes     map[string]*types.Volume
+	volumesLock *sync.RWMutex
 }
 
 // Init initializes the private data for the Datastore object.
@@ -223,6 +255,18 @@ func (ds *Datastore) Init(config Config) error {
 	ds.tenantUsage = make(map[string][]payloads.CiaoUsage)
 	ds.tenantUsageLock = &sync.RWMutex{}
 
+	ds.volumesLock = &sync.RWMutex{}
+	ds.volumes = make(map[string]*types.Volume)
+
+	volumes, verr := ds.db.getVolumes()
+	if verr != nil {
+		glog.Warning(verr)
+	} else {
+		for i := range volumes {
+			ds.volumes[volumes[i].ID] = volumes[i]
+		}
+	}
+
 	return err
 }
 
@@ -242,6 +286,7 @@ func (ds *Datastore) AddTenantChan(c chan bool, tenantID string) {
 }
 
 // AddLimit allows the caller to store a limt for a specific resource for a tenant.
+// The new limit replaces any previous one, and a negative limit removes it.
 func (ds *Datastore) AddLimit(tenantID string, resourceID int, limit int) error {
 	err := ds.db.addLimit(tenantID, resourceID, limit)
 	if err != nil {
@@ -255,6 +300,10 @@ func (ds *Datastore) AddLimit(tenantID string, resourceID int, limit int) error
 	if tenant != nil {
 		resources := tenant.Resources
 
+		if limit < 0 {
+			limit = -1
+		}
+
 		for i := range resources {
 			if resources[i].Rtype == resourceID {
 				resources[i].Limit = limit
@@ -314,6 +363,67 @@ func (ds *Datastore) AddTenant(id string) (*types.Tenant, error) {
 	return &t.Tenant, err
 }
 
+// DeleteTenant removes a tenant, its limits, its subnets and its CNCI
+// instance from the datastore.  Tenants which still have instances or
+// volumes cannot be deleted.
+func (ds *Datastore) DeleteTenant(id string) error {
+	t, err := ds.getTenant(id)
+	if err != nil {
+		return err
+	}
+
+	if t == nil {
+		return errors.New("Tenant Not Found")
+	}
+
+	ds.instancesLock.RLock()
+	for _, i := range ds.instances {
+		if i.TenantID == id {
+			ds.instancesLock.RUnlock()
+			return errors.New("Tenant has instances")
+		}
+	}
+	ds.instancesLock.RUnlock()
+
+	ds.volumesLock.RLock()
+	for _, v := range ds.volumes {
+		if v.TenantID == id {
+			ds.volumesLock.RUnlock()
+			return errors.New("Tenant has volumes")
+		}
+	}
+	ds.volumesLock.RUnlock()
+
+	err = ds.db.deleteTenant(id)
+	if err != nil {
+		return err
+	}
+
+	// CNCIs are not tracked as instances, only their statistics are.
+	if t.CNCIID != "" {
+		ds.instanceLastStatLock.Lock()
+		delete(ds.instanceLastStat, t.CNCIID)
+		ds.instanceLastStatLock.Unlock()
+	}
+
+	ds.tenantsLock.Lock()
+	delete(ds.tenants, id)
+	ds.tenantsLock.Unlock()
+
+	ds.tenantUsageLock.Lock()
+	delete(ds.tenantUsage, id)
+	ds.tenantUsageLock.Unlock()
+
+	ds.cnciAddedLock.Lock()
+	delete(ds.cnciAddedChans, id)
+	ds.cnciAddedLock.Unlock()
+
+	msg := fmt.Sprintf("Deleted tenant %s", id)
+	ds.db.logEvent(id, string(userInfo), msg)
+
+	return nil
+}
+
 func (ds *Datastore) getTenant(id string) (*tenant, error) {
 	// check cache first
 	ds.tenantsLock.RLock()
@@ -399,6 +509,171 @@ func (ds *Datastore) GetWorkloads() ([]*types.Workload, error) {
 	return workloads, nil
 }
 
+// CloneWorkload adds a new workload template identical to the workload
+// sourceID but for its description and the image it boots from.  The
+// new workload shares the cloud-init configuration file of sourceID and
+// is only available to tenantID.
+func (ds *Datastore) CloneWorkload(sourceID string, description string, imageID string, imageName string, tenantID string) (*types.Workload, error) {
+	source, err := ds.getWorkload(sourceID)
+	if err != nil {
+		return nil, err
+	}
+
+	wl := &workload{
+		Workload: source.Workload,
+		filename: source.filename,
+	}
+	wl.ID = uuid.Generate().String()
+	wl.Description = description
+	wl.ImageID = imageID
+	wl.ImageName = imageName
+	wl.TenantID = tenantID
+
+	wl.Defaults = make([]payloads.RequestedResource, len(source.Defaults))
+	copy(wl.Defaults, source.Defaults)
+
+	wl.RequiredLabels = copyLabels(source.RequiredLabels)
+	wl.PreferredLabels = copyLabels(source.PreferredLabels)
+
+	err = ds.db.addWorkload(wl)
+	if err != nil {
+		return nil, err
+	}
+
+	ds.workloadsLock.Lock()
+	ds.workloads[wl.ID] = wl
+	ds.workloadsLock.Unlock()
+
+	return &wl.Workload, nil
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+
+	c := make(map[string]string, len(labels))
+	for k, v := range labels {
+		c[k] = v
+	}
+
+	return c
+}
+
+func copyWorkload(w types.Workload) *workload {
+	wl := &workload{Workload: w}
+
+	wl.Defaults = make([]payloads.RequestedResource, len(w.Defaults))
+	copy(wl.Defaults, w.Defaults)
+
+	wl.RequiredLabels = copyLabels(w.RequiredLabels)
+	wl.PreferredLabels = copyLabels(w.PreferredLabels)
+
+	return wl
+}
+
+// AddWorkload adds a new tenant workload template.  Its cloud-init
+// configuration is written to a new file in the workloads directory.
+// A workload ID is generated if w does not have one.
+func (ds *Datastore) AddWorkload(w types.Workload) (*types.Workload, error) {
+	wl := copyWorkload(w)
+	if wl.ID == "" {
+		wl.ID = uuid.Generate().String()
+	}
+
+	err := ds.db.addWorkload(wl)
+	if err != nil {
+		return nil, err
+	}
+
+	ds.workloadsLock.Lock()
+	ds.workloads[wl.ID] = wl
+	ds.workloadsLock.Unlock()
+
+	msg := fmt.Sprintf("Created workload %s (%s)", wl.ID, wl.Description)
+	ds.db.logEvent("", string(userInfo), msg)
+
+	return &wl.Workload, nil
+}
+
+// UpdateWorkload replaces the definition of the tenant workload w.ID.
+// Instances already running the workload keep the resources they
+// were started with.
+func (ds *Datastore) UpdateWorkload(w types.Workload) (*types.Workload, error) {
+	ds.workloadsLock.Lock()
+	defer ds.workloadsLock.Unlock()
+
+	current, ok := ds.workloads[w.ID]
+	if !ok {
+		return nil, errors.New("Workload Not Found")
+	}
+
+	wl := copyWorkload(w)
+	wl.filename = current.filename
+	wl.TenantID = current.TenantID
+
+	if !reflect.DeepEqual(current.Defaults, wl.Defaults) {
+		ds.instancesLock.RLock()
+		for _, i := range ds.instances {
+			if i.WorkloadID != w.ID {
+				continue
+			}
+
+			err := ds.db.updateInstanceUsage(i.ID, i.Usage)
+			if err != nil {
+				ds.instancesLock.RUnlock()
+				return nil, err
+			}
+		}
+		ds.instancesLock.RUnlock()
+	}
+
+	err := ds.db.updateWorkload(wl)
+	if err != nil {
+		return nil, err
+	}
+
+	ds.workloads[wl.ID] = wl
+
+	msg := fmt.Sprintf("Updated workload %s (%s)", wl.ID, wl.Description)
+	ds.db.logEvent("", string(userInfo), msg)
+
+	return &wl.Workload, nil
+}
+
+// DeleteWorkload removes the tenant workload id.  Workloads used by
+// instances cannot be deleted.
+func (ds *Datastore) DeleteWorkload(id string) error {
+	ds.workloadsLock.Lock()
+	defer ds.workloadsLock.Unlock()
+
+	wl, ok := ds.workloads[id]
+	if !ok {
+		return errors.New("Workload Not Found")
+	}
+
+	ds.instancesLock.RLock()
+	for _, i := range ds.instances {
+		if i.WorkloadID == id {
+			ds.instancesLock.RUnlock()
+			return errors.New("Workload is in use")
+		}
+	}
+	ds.instancesLock.RUnlock()
+
+	err := ds.db.deleteWorkload(id)
+	if err != nil {
+		return err
+	}
+
+	delete(ds.workloads, id)
+
+	msg := fmt.Sprintf("Deleted workload %s (%s)", id, wl.Description)
+	ds.db.logEvent("", string(userInfo), msg)
+
+	return nil
+}
+
 // AddCNCIIP will associate a new IP address with an existing CNCI
 // via the mac address
 func (ds *Datastore) AddCNCIIP(cnciMAC string, ip string) error {
@@ -476,6 +751,7 @@ func (ds *Datastore) removeTenantCNCI(tenantID string) error {
 
 	tenant.CNCIID = ""
 	tenant.CNCIIP = ""
+	tenant.CNCINodeID = ""
 
 	ds.tenantsLock.Unlock()
 
@@ -891,10 +1167,14 @@ func (ds *Datastore) deleteInstance(instanceID string) error {
 	delete(ds.instances, instanceID)
 	ds.instancesLock.Unlock()
 
+	if i == nil {
+		return errors.New("Instance Not Found")
+	}
+
 	ds.tenantsLock.Lock()
 	tenant := ds.tenants[i.TenantID]
-	delete(tenant.instances, instanceID)
 	if tenant != nil {
+		delete(tenant.instances, instanceID)
 		for name, val := range i.Usage {
 			for i := range tenant.Resources {
 				if tenant.Resources[i].Rname == name {
@@ -930,6 +1210,8 @@ func (ds *Datastore) deleteInstance(instanceID string) error {
 		glog.V(2).Info("deleteInstance: ", err)
 	}
 
+	ds.releaseInstanceVolumes(instanceID)
+
 	return err
 }
 
@@ -946,6 +1228,71 @@ func (ds *Datastore) DeleteInstance(instanceID string) error {
 	return nil
 }
 
+// InstanceEvacuated marks an instance which has been evacuated from
+// a compute node as pending, until it gets restarted on another node.
+// The instance keeps its resources and network configuration.
+func (ds *Datastore) InstanceEvacuated(instanceID string, nodeID string) error {
+	ds.instancesLock.Lock()
+	i, ok := ds.instances[instanceID]
+	if ok {
+		i.State = payloads.Pending
+		i.NodeID = ""
+		i.SSHIP = ""
+		i.SSHPort = 0
+	}
+	ds.instancesLock.Unlock()
+
+	if !ok {
+		return errors.New("Instance Not Found")
+	}
+
+	ds.instanceLastStatLock.Lock()
+	stat, ok := ds.instanceLastStat[instanceID]
+	if ok {
+		stat.NodeID = ""
+		stat.Status = payloads.Pending
+		ds.instanceLastStat[instanceID] = stat
+	}
+	ds.instanceLastStatLock.Unlock()
+
+	ds.nodesLock.Lock()
+	n, ok := ds.nodes[nodeID]
+	if ok {
+		delete(n.instances, instanceID)
+	}
+	ds.nodesLock.Unlock()
+
+	msg := fmt.Sprintf("Evacuated Instance %s from node %s", instanceID, nodeID)
+	ds.db.logEvent(i.TenantID, string(userInfo), msg)
+
+	return nil
+}
+
+// CNCIEvacuated records that the CNCI instance cnciID has been evacuated
+// from a compute node and returns the tenant it serves.  The tenant keeps
+// its CNCI UUID and MAC address until the CNCI is restarted elsewhere.
+func (ds *Datastore) CNCIEvacuated(cnciID string, nodeID string) (*types.Tenant, error) {
+	var tenant *types.Tenant
+
+	ds.tenantsLock.RLock()
+	for _, t := range ds.tenants {
+		if t.CNCIID == cnciID {
+			tenant = &t.Tenant
+			break
+		}
+	}
+	ds.tenantsLock.RUnlock()
+
+	if tenant == nil {
+		return nil, errors.New("No Tenant")
+	}
+
+	msg := fmt.Sprintf("Evacuated CNCI %s from node %s", cnciID, nodeID)
+	ds.db.logEvent(tenant.ID, string(userInfo), msg)
+
+	return tenant, nil
+}
+
 // DeleteNode removes a node from the node cache.
 func (ds *Datastore) DeleteNode(nodeID string) error {
 	ds.nodesLock.Lock()
@@ -1184,11 +1531,29 @@ func (ds *Datastore) addInstanceStats(stats []payloads.InstanceStat, nodeID stri
 			ds.nodesLock.Unlock()
 		}
 		ds.instancesLock.Unlock()
+
+		if !ok {
+			ds.updateCNCINode(stat.InstanceUUID, nodeID)
+		}
 	}
 
 	return ds.db.addInstanceStatsDB(stats, nodeID)
 }
 
+// updateCNCINode records that the CNCI cnciID runs on nodeID, if it is
+// the CNCI of a tenant.
+func (ds *Datastore) updateCNCINode(cnciID string, nodeID string) {
+	ds.tenantsLock.Lock()
+	defer ds.tenantsLock.Unlock()
+
+	for _, t := range ds.tenants {
+		if t.CNCIID == cnciID {
+			t.CNCINodeID = nodeID
+			return
+		}
+	}
+}
+
 // GetTenantCNCISummary retrieves information about a given CNCI id, or all CNCIs
 // If the cnci string is the null string, then this function will retrieve all
 // tenants.  If cnci is not null, it will only provide information about a specific
@@ -1271,3 +1636,420 @@ func (ds *Datastore) ClearLog() error {
 	// we don't as of yet cache any of the events that are logged.
 	return ds.db.clearLog()
 }
+
+// LogEvent adds an informational entry to the event log of a tenant.
+func (ds *Datastore) LogEvent(tenantID string, msg string) error {
+	return ds.db.logEvent(tenantID, string(userInfo), msg)
+}
+
+// LogWarning adds a warning entry to the event log of a tenant.
+func (ds *Datastore) LogWarning(tenantID string, msg string) error {
+	return ds.db.logEvent(tenantID, string(userWarn), msg)
+}
+
+// AddVolume stores a new volume in the datastore.
+func (ds *Datastore) AddVolume(volume *types.Volume) error {
+	err := ds.db.addVolume(volume)
+	if err != nil {
+		return err
+	}
+
+	v := *volume
+
+	ds.volumesLock.Lock()
+	ds.volumes[v.ID] = &v
+	ds.volumesLock.Unlock()
+
+	msg := fmt.Sprintf("Created Volume %s", v.ID)
+	ds.db.logEvent(v.TenantID, string(userInfo), msg)
+
+	return nil
+}
+
+// GetVolume retrieves a copy of a volume out of the datastore.
+func (ds *Datastore) GetVolume(id string) (*types.Volume, error) {
+	ds.volumesLock.RLock()
+	defer ds.volumesLock.RUnlock()
+
+	volume, ok := ds.volumes[id]
+	if !ok {
+		return nil, errors.New("Volume Not Found")
+	}
+
+	v := *volume
+	return &v, nil
+}
+
+// GetAllVolumesFromTenant retrieves copies of all the volumes belonging
+// to a specific tenant.
+func (ds *Datastore) GetAllVolumesFromTenant(tenantID string) ([]*types.Volume, error) {
+	var volumes []*types.Volume
+
+	ds.volumesLock.RLock()
+	defer ds.volumesLock.RUnlock()
+
+	for _, volume := range ds.volumes {
+		if volume.TenantID == tenantID {
+			v := *volume
+			volumes = append(volumes, &v)
+		}
+	}
+
+	return volumes, nil
+}
+
+// GetInstanceVolumes retrieves copies of all the volumes attached to an
+// instance.
+func (ds *Datastore) GetInstanceVolumes(instanceID string) ([]*types.Volume, error) {
+	var volumes []*types.Volume
+
+	ds.volumesLock.RLock()
+	defer ds.volumesLock.RUnlock()
+
+	for _, volume := range ds.volumes {
+		if volume.InstanceID == instanceID {
+			v := *volume
+			volumes = append(volumes, &v)
+		}
+	}
+
+	return volumes, nil
+}
+
+// DeleteVolume removes an available volume from the datastore.
+func (ds *Datastore) DeleteVolume(id string) error {
+	ds.volumesLock.Lock()
+
+	volume, ok := ds.volumes[id]
+	if !ok {
+		ds.volumesLock.Unlock()
+		return errors.New("Volume Not Found")
+	}
+
+	if volume.State != payloads.VolumeStatusAvailable {
+		ds.volumesLock.Unlock()
+		return errors.New("Volume is in use")
+	}
+
+	delete(ds.volumes, id)
+	ds.volumesLock.Unlock()
+
+	msg := fmt.Sprintf("Deleted Volume %s", id)
+	ds.db.logEvent(volume.TenantID, string(userInfo), msg)
+
+	return ds.db.removeVolume(id)
+}
+
+// AttachVolume marks an available volume as in use by an instance.
+// The volume is marked as in use as soon as the ATTACH_VOLUME command
+// is sent, and released if the launcher reports an AttachVolumeFailure.
+func (ds *Datastore) AttachVolume(volumeID string, instanceID string) error {
+	ds.volumesLock.Lock()
+
+	volume, ok := ds.volumes[volumeID]
+	if !ok {
+		ds.volumesLock.Unlock()
+		return errors.New("Volume Not Found")
+	}
+
+	if volume.State != payloads.VolumeStatusAvailable {
+		ds.volumesLock.Unlock()
+		return errors.New("Volume is in use")
+	}
+
+	volume.State = payloads.VolumeStatusInUse
+	volume.InstanceID = instanceID
+	v := *volume
+
+	ds.volumesLock.Unlock()
+
+	return ds.db.updateVolume(&v)
+}
+
+// DetachVolume marks a volume attached to an instance as available.
+func (ds *Datastore) DetachVolume(volumeID string, instanceID string) error {
+	ds.volumesLock.Lock()
+
+	volume, ok := ds.volumes[volumeID]
+	if !ok {
+		ds.volumesLock.Unlock()
+		return errors.New("Volume Not Found")
+	}
+
+	if volume.InstanceID != instanceID {
+		ds.volumesLock.Unlock()
+		return errors.New("Volume not attached to instance")
+	}
+
+	volume.State = payloads.VolumeStatusAvailable
+	volume.InstanceID = ""
+	v := *volume
+
+	ds.volumesLock.Unlock()
+
+	return ds.db.updateVolume(&v)
+}
+
+// releaseInstanceVolumes marks all the volumes attached to a deleted
+// instance as available.
+func (ds *Datastore) releaseInstanceVolumes(instanceID string) {
+	var released []types.Volume
+
+	ds.volumesLock.Lock()
+	for _, volume := range ds.volumes {
+		if volume.InstanceID != instanceID {
+			continue
+		}
+
+		volume.State = payloads.VolumeStatusAvailable
+		volume.InstanceID = ""
+		released = append(released, *volume)
+	}
+	ds.volumesLock.Unlock()
+
+	for i := range released {
+		err := ds.db.updateVolume(&released[i])
+		if err != nil {
+			glog.V(2).Info("releaseInstanceVolumes: ", err)
+		}
+	}
+}
+
+// AttachVolumeFailure releases a volume which could not be attached
+// and logs the failure in the datastore.
+func (ds *Datastore) AttachVolumeFailure(instanceID string, volumeID string, reason payloads.AttachVolumeFailureReason) error {
+	volume, err := ds.GetVolume(volumeID)
+	if err != nil {
+		return err
+	}
+
+	// The volume is still attached, possibly by an earlier request
+	if reason != payloads.AttachVolumeAlreadyAttached {
+		err = ds.DetachVolume(volumeID, instanceID)
+		if err != nil {
+			glog.V(2).Info("AttachVolumeFailure: ", err)
+		}
+	}
+
+	msg := fmt.Sprintf("Attach Volume Failure %s to %s: %s", volumeID, instanceID, reason.String())
+	ds.db.logEvent(volume.TenantID, string(userError), msg)
+
+	return nil
+}
+
+// DetachVolumeFailure marks a volume which could not be detached as in
+// use again and logs the failure in the datastore.
+func (ds *Datastore) DetachVolumeFailure(instanceID string, volumeID string, reason payloads.DetachVolumeFailureReason) error {
+	volume, err := ds.GetVolume(volumeID)
+	if err != nil {
+		return err
+	}
+
+	// The launcher no longer knows about the volume, leave it available
+	switch reason {
+	case payloads.DetachVolumeNoInstance,
+		payloads.DetachVolumeNotAttached:
+	default:
+		err = ds.AttachVolume(volumeID, instanceID)
+		if err != nil {
+			glog.V(2).Info("DetachVolumeFailure: ", err)
+		}
+	}
+
+	msg := fmt.Sprintf("Detach Volume Failure %s from %s: %s", volumeID, instanceID, reason.String())
+	ds.db.logEvent(volume.TenantID, string(userError), msg)
+
+	return nil
+}
+
+// SnapshotFailure logs the failure to create an image from an instance
+// in the datastore.
+func (ds *Datastore) SnapshotFailure(instanceID string, imageID string, reason payloads.SnapshotFailureReason) error {
+	i, err := ds.GetInstance(instanceID)
+	if err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("Snapshot Failure %s to image %s: %s", instanceID, imageID, reason.String())
+	ds.db.logEvent(i.TenantID, string(userError), msg)
+
+	return nil
+}
+
+// ResizeInstance changes the resources used by an instance.  The values
+// in usage replace those of the instance and the usage of the instance's
+// tenant is updated accordingly.
+func (ds *Datastore) ResizeInstance(instanceID string, usage map[string]int) error {
+	i, err := ds.setInstanceUsage(instanceID, usage)
+	if err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("Resized %s: vcpus %d mem_mb %d disk_mb %d", instanceID,
+		i.Usage[string(payloads.VCPUs)], i.Usage[string(payloads.MemMB)],
+		i.Usage[string(payloads.DiskMB)])
+	ds.db.logEvent(i.TenantID, string(userInfo), msg)
+
+	return nil
+}
+
+// ResizeFailure logs the failure to resize an instance in the datastore
+// and restores the resources the instance had before the resize.
+func (ds *Datastore) ResizeFailure(instanceID string, reason payloads.ResizeFailureReason, resources []payloads.RequestedResource) error {
+	usage := make(map[string]int)
+	for _, r := range resources {
+		usage[string(r.Type)] = r.Value
+	}
+
+	i, err := ds.setInstanceUsage(instanceID, usage)
+	if err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("Resize Failure %s: %s", instanceID, reason.String())
+	ds.db.logEvent(i.TenantID, string(userError), msg)
+
+	return nil
+}
+
+func (ds *Datastore) setInstanceUsage(instanceID string, usage map[string]int) (*types.Instance, error) {
+	ds.instancesLock.Lock()
+	i, ok := ds.instances[instanceID]
+	if !ok {
+		ds.instancesLock.Unlock()
+		return nil, errors.New("Instance Not Found")
+	}
+
+	oldUsage := i.Usage
+	newUsage := make(map[string]int)
+	for name, val := range oldUsage {
+		newUsage[name] = val
+	}
+	for name, val := range usage {
+		newUsage[name] = val
+	}
+	i.Usage = newUsage
+	ds.instancesLock.Unlock()
+
+	ds.tenantsLock.Lock()
+	tenant := ds.tenants[i.TenantID]
+	if tenant != nil {
+		for name, val := range newUsage {
+			for j := range tenant.Resources {
+				if tenant.Resources[j].Rname == name {
+					tenant.Resources[j].Usage += val - oldUsage[name]
+					break
+				}
+			}
+		}
+	}
+	ds.tenantsLock.Unlock()
+
+	// the cache is authoritative, as for AddInstance
+	err := ds.db.updateInstanceUsage(instanceID, newUsage)
+	if err != nil {
+		glog.Warningf("Unable to store usage of %s: %v", instanceID, err)
+	}
+
+	return i, nil
+}
+
+// AddImage stores a new image in the datastore.
+func (ds *Datastore) AddImage(image *types.Image) error {
+	return ds.db.addImage(image)
+}
+
+// GetImages retrieves all the images out of the datastore.
+// Images are not cached.
+func (ds *Datastore) GetImages() ([]*types.Image, error) {
+	return ds.db.getImages()
+}
+
+// GetImage retrieves an image out of the datastore.
+func (ds *Datastore) GetImage(id string) (*types.Image, error) {
+	images, err := ds.db.getImages()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, image := range images {
+		if image.ID == id {
+			return image, nil
+		}
+	}
+
+	return nil, errors.New("Image Not Found")
+}
+
+// UpdateImage stores the new state, size and checksum of an image.
+func (ds *Datastore) UpdateImage(image *types.Image) error {
+	return ds.db.updateImage(image)
+}
+
+// TransitionImageState atomically moves an image from state from to
+// state to.  It fails if the image is not in state from.
+func (ds *Datastore) TransitionImageState(id string, from string, to string) error {
+	updated, err := ds.db.updateImageState(id, from, to)
+	if err != nil {
+		return err
+	}
+
+	if !updated {
+		return fmt.Errorf("Image %s is not %s", id, from)
+	}
+
+	return nil
+}
+
+// DeleteImage removes an image from the datastore.
+func (ds *Datastore) DeleteImage(id string) error {
+	return ds.db.removeImage(id)
+}
+
+// GetIdentityProjects retrieves all the projects of the local identity
+// service.  Identity data is not cached.
+func (ds *Datastore) GetIdentityProjects() ([]*types.IdentityProject, error) {
+	return ds.db.getIdentityProjects()
+}
+
+// AddIdentityProject adds a project to the local identity service.
+func (ds *Datastore) AddIdentityProject(project *types.IdentityProject) error {
+	return ds.db.addIdentityProject(project)
+}
+
+// GetIdentityUser retrieves a local identity service user by name or ID.
+func (ds *Datastore) GetIdentityUser(user string) (*types.IdentityUser, error) {
+	users, err := ds.db.getIdentityUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, u := range users {
+		if u.Name == user || u.ID == user {
+			return u, nil
+		}
+	}
+
+	return nil, errors.New("User Not Found")
+}
+
+// AddIdentityUser adds a user to the local identity service.
+func (ds *Datastore) AddIdentityUser(user *types.IdentityUser) error {
+	return ds.db.addIdentityUser(user)
+}
+
+// GetIdentityRoles retrieves the roles of a local identity service user.
+func (ds *Datastore) GetIdentityRoles(userID string) ([]*types.IdentityRole, error) {
+	return ds.db.getIdentityRoles(userID)
+}
+
+// AddIdentityRole grants a role on a project to a local identity service
+// user.
+func (ds *Datastore) AddIdentityRole(role *types.IdentityRole) error {
+	return ds.db.addIdentityRole(role)
+}
+
+// GetIdentityKey returns the key signing the local identity service tokens.
+func (ds *Datastore) GetIdentityKey() ([]byte, error) {
+	return ds.db.getIdentityKey()
+}
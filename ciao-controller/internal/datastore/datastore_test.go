@@ -17,6 +17,7 @@
 package datastore
 
 import (
+	"bytes"
 	"database/sql"
 	"encoding/binary"
 	"errors"
@@ -516,6 +517,84 @@ func TestGetInstance(t *testing.T) {
 	}
 }
 
+func TestInstanceEvacuated(t *testing.T) {
+	instances, stat := addTestInstanceStats(t)
+
+	instance, err := ds.GetInstance(instances[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip := instance.IPAddress
+	mac := instance.MACAddress
+
+	err = ds.InstanceEvacuated(instance.ID, stat.NodeUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instance, err = ds.GetInstance(instances[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if instance.State != payloads.Pending {
+		t.Errorf("expected state %s, got %s", payloads.Pending, instance.State)
+	}
+
+	if instance.NodeID != "" {
+		t.Error("instance still assigned to evacuated node")
+	}
+
+	if instance.IPAddress != ip || instance.MACAddress != mac {
+		t.Error("instance network configuration changed")
+	}
+
+	nodeInstances, err := ds.GetAllInstancesByNode(stat.NodeUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, i := range nodeInstances {
+		if i.ID == instance.ID {
+			t.Error("instance still listed on evacuated node")
+		}
+	}
+
+	err = ds.InstanceEvacuated(uuid.Generate().String(), stat.NodeUUID)
+	if err == nil {
+		t.Error("evacuated non existing instance")
+	}
+}
+
+func TestCNCIEvacuated(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cnciID := uuid.Generate().String()
+	err = ds.AddTenantCNCI(tenant.ID, cnciID, tenant.CNCIMAC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	evacuated, err := ds.CNCIEvacuated(cnciID, uuid.Generate().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if evacuated.ID != tenant.ID || evacuated.CNCIID != cnciID {
+		t.Errorf("expected CNCI %s of tenant %s, got CNCI %s of tenant %s",
+			cnciID, tenant.ID, evacuated.CNCIID, evacuated.ID)
+	}
+
+	_, err = ds.CNCIEvacuated(uuid.Generate().String(), uuid.Generate().String())
+	if err == nil {
+		t.Error("evacuated non existing CNCI")
+	}
+}
+
 func TestHandleStats(t *testing.T) {
 	tenant, err := addTestTenant()
 	if err != nil {
@@ -1044,6 +1123,132 @@ func TestAddLimit(t *testing.T) {
 	}
 }
 
+func tenantLimit(t *testing.T, tenantID string, resourceID int) (int, int) {
+	var cached, stored int
+
+	tenant, err := ds.GetTenant(tenantID)
+	if err != nil || tenant == nil {
+		t.Fatal(err)
+	}
+	for _, r := range tenant.Resources {
+		if r.Rtype == resourceID {
+			cached = r.Limit
+		}
+	}
+
+	resources, err := ds.db.(*sqliteDB).getTenantResources(tenantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range resources {
+		if r.Rtype == resourceID {
+			stored = r.Limit
+		}
+	}
+
+	return cached, stored
+}
+
+func TestUpdateLimit(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, limit := range []int{4, 8} {
+		err = ds.AddLimit(tenant.ID, 2, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cached, stored := tenantLimit(t, tenant.ID, 2)
+		if cached != limit || stored != limit {
+			t.Fatalf("Limit not updated to %d: cached %d, stored %d", limit, cached, stored)
+		}
+	}
+
+	// only one limit is stored per tenant resource
+	var count int
+	err = ds.db.(*sqliteDB).db.QueryRow("SELECT count(*) FROM limits WHERE tenant_id = ? AND resource_id = 2", tenant.ID).Scan(&count)
+	if err != nil || count != 1 {
+		t.Fatalf("Expected a single limit, got %d: %v", count, err)
+	}
+
+	err = ds.AddLimit(tenant.ID, 2, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cached, stored := tenantLimit(t, tenant.ID, 2)
+	if cached != -1 || stored != -1 {
+		t.Fatalf("Limit not removed: cached %d, stored %d", cached, stored)
+	}
+}
+
+func TestDeleteTenant(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.AddLimit(tenant.ID, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err := ds.GetWorkloads()
+	if err != nil || len(wls) == 0 {
+		t.Fatal(err)
+	}
+
+	instance, err := addTestInstance(tenant, wls[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.DeleteTenant(tenant.ID)
+	if err == nil {
+		t.Fatal("Deleted tenant with instances")
+	}
+
+	err = ds.DeleteInstance(instance.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.DeleteTenant(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := ds.GetTenant(tenant.ID)
+	if err != nil || deleted != nil {
+		t.Fatalf("Tenant not deleted: %v", err)
+	}
+
+	var count int
+	err = ds.db.(*sqliteDB).db.QueryRow("SELECT count(*) FROM limits WHERE tenant_id = ?", tenant.ID).Scan(&count)
+	if err != nil || count != 0 {
+		t.Fatalf("Tenant limits not deleted: %d %v", count, err)
+	}
+
+	err = ds.db.(*sqliteDB).db.QueryRow("SELECT count(*) FROM tenant_network WHERE tenant_id = ?", tenant.ID).Scan(&count)
+	if err != nil || count != 0 {
+		t.Fatalf("Tenant subnets not deleted: %d %v", count, err)
+	}
+
+	err = ds.DeleteTenant(tenant.ID)
+	if err == nil {
+		t.Fatal("Deleted unknown tenant")
+	}
+
+	// deleting an unknown instance must not panic
+	err = ds.DeleteInstance(instance.ID)
+	if err == nil {
+		t.Fatal("Deleted unknown instance")
+	}
+}
+
 func TestRemoveTenantCNCI(t *testing.T) {
 	tenant, err := addTestTenant()
 	if err != nil {
@@ -1322,6 +1527,62 @@ func TestGetWorkload(t *testing.T) {
 	ds.workloadsLock.Unlock()
 }
 
+func TestGetWorkloadConstraints(t *testing.T) {
+	wls, err := ds.GetWorkloads()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, ok := ds.db.(*sqliteDB)
+	if !ok {
+		t.Skip("not a sqlite datastore")
+	}
+
+	wlID := wls[0].ID
+	constraints := [][]string{
+		{requiredLabelConstraint, "rack=r1"},
+		{preferredLabelConstraint, "ssd=true"},
+		{antiAffinityConstraint, ""},
+		{requiredLabelConstraint, "invalid"},
+	}
+
+	db.dbLock.Lock()
+	for _, c := range constraints {
+		err = db.create("workload_constraints", wlID, c[0], c[1])
+		if err != nil {
+			db.dbLock.Unlock()
+			t.Fatal(err)
+		}
+	}
+	db.dbLock.Unlock()
+
+	defer func() {
+		db.dbLock.Lock()
+		_, err := db.db.Exec("DELETE FROM workload_constraints WHERE workload_id = ?", wlID)
+		db.dbLock.Unlock()
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	wl, err := db.getWorkloadNoCache(wlID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(wl.RequiredLabels) != 1 || wl.RequiredLabels["rack"] != "r1" {
+		t.Errorf("Unexpected required labels %v", wl.RequiredLabels)
+	}
+
+	if len(wl.PreferredLabels) != 1 || wl.PreferredLabels["ssd"] != "true" {
+		t.Errorf("Unexpected preferred labels %v", wl.PreferredLabels)
+	}
+
+	if wl.AntiAffinity == false {
+		t.Error("Expected anti-affinity")
+	}
+}
+
 func TestRestartFailure(t *testing.T) {
 	tenant, err := addTestTenant()
 	if err != nil {
@@ -1441,6 +1702,149 @@ func TestStartFailureFullCloud(t *testing.T) {
 	}
 }
 
+func addTestVolume(t *testing.T, tenantID string) *types.Volume {
+	volume := &types.Volume{
+		ID:       uuid.Generate().String(),
+		TenantID: tenantID,
+		Size:     1,
+		Format:   payloads.RawVolume,
+		Path:     "/var/lib/ciao/volumes/test",
+		State:    payloads.VolumeStatusAvailable,
+	}
+
+	err := ds.AddVolume(volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return volume
+}
+
+func TestVolumeAttachDetach(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	volume := addTestVolume(t, tenant.ID)
+	instanceID := uuid.Generate().String()
+
+	err = ds.AttachVolume(volume.ID, instanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.AttachVolume(volume.ID, uuid.Generate().String())
+	if err == nil {
+		t.Fatal("Volume attached twice")
+	}
+
+	err = ds.DeleteVolume(volume.ID)
+	if err == nil {
+		t.Fatal("Deleted attached volume")
+	}
+
+	// the database must match the cache
+	volumes, err := ds.db.getVolumes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, v := range volumes {
+		if v.ID == volume.ID {
+			found = v.InstanceID == instanceID && v.State == payloads.VolumeStatusInUse
+		}
+	}
+	if !found {
+		t.Fatal("Attached volume not stored in database")
+	}
+
+	err = ds.DetachVolume(volume.ID, instanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.DeleteVolume(volume.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ds.GetVolume(volume.ID)
+	if err == nil {
+		t.Fatal("Volume not deleted")
+	}
+}
+
+func TestDeleteInstanceVolumes(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err := ds.GetWorkloads()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instance, err := addTestInstance(tenant, wls[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	volume := addTestVolume(t, tenant.ID)
+
+	err = ds.AttachVolume(volume.ID, instance.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(1 * time.Second)
+
+	err = ds.DeleteInstance(instance.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := ds.GetVolume(volume.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v.State != payloads.VolumeStatusAvailable || v.InstanceID != "" {
+		t.Fatal("Volume not released by deleted instance")
+	}
+}
+
+func TestAttachVolumeFailure(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	volume := addTestVolume(t, tenant.ID)
+	instanceID := uuid.Generate().String()
+
+	err = ds.AttachVolume(volume.ID, instanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.AttachVolumeFailure(instanceID, volume.ID, payloads.AttachVolumeAttachFailure)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := ds.GetVolume(volume.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v.State != payloads.VolumeStatusAvailable {
+		t.Fatal("Volume not released after attach failure")
+	}
+}
+
 func testAllocateTenantIPs(t *testing.T, nIPs int) {
 	nIPsPerSubnet := 253
 
@@ -1480,6 +1884,402 @@ func testAllocateTenantIPs(t *testing.T, nIPs int) {
 	}
 }
 
+func TestCloneWorkload(t *testing.T) {
+	wls, err := ds.GetWorkloads()
+	if err != nil || len(wls) == 0 {
+		t.Fatal(err)
+	}
+
+	source := wls[0]
+	imageID := uuid.Generate().String()
+
+	tenantID := uuid.Generate().String()
+
+	wl, err := ds.CloneWorkload(source.ID, "clone", imageID, "clone image", tenantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if wl.ID == source.ID || wl.Description != "clone" || wl.ImageID != imageID ||
+		wl.TenantID != tenantID {
+		t.Fatalf("Unexpected clone %v", wl)
+	}
+
+	// the database must match the cache
+	stored, err := ds.db.getWorkloadNoCache(wl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored.ImageID != imageID || stored.ImageName != "clone image" || stored.TenantID != tenantID ||
+		stored.Config != source.Config || stored.VMType != source.VMType ||
+		len(stored.Defaults) != len(source.Defaults) {
+		t.Fatalf("Clone not stored correctly %v", stored)
+	}
+
+	_, err = ds.CloneWorkload(uuid.Generate().String(), "clone", imageID, "clone image", tenantID)
+	if err == nil {
+		t.Fatal("Cloned unknown workload")
+	}
+}
+
+func testWorkload() types.Workload {
+	return types.Workload{
+		Description: "test workload",
+		FWType:      payloads.Legacy,
+		VMType:      payloads.QEMU,
+		ImageID:     uuid.Generate().String(),
+		Config:      "---\n#cloud-config\n...\n",
+		Defaults: []payloads.RequestedResource{
+			{Type: payloads.VCPUs, Value: 2, Mandatory: true},
+			{Type: payloads.MemMB, Value: 512, Mandatory: true},
+		},
+	}
+}
+
+func workloadConfigPath(t *testing.T, id string) string {
+	var filename string
+
+	err := ds.db.(*sqliteDB).db.QueryRow("SELECT filename FROM workload_template WHERE id = ?", id).Scan(&filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fmt.Sprintf("%s/%s", ds.db.(*sqliteDB).workloadsPath, filename)
+}
+
+func TestAddWorkload(t *testing.T) {
+	wl, err := ds.AddWorkload(testWorkload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.DeleteWorkload(wl.ID)
+
+	if wl.ID == "" {
+		t.Fatal("Workload ID not generated")
+	}
+
+	cached, err := ds.GetWorkload(wl.ID)
+	if err != nil || cached.Description != "test workload" {
+		t.Fatalf("Workload not cached: %v", err)
+	}
+
+	// the database must match the cache
+	stored, err := ds.db.getWorkloadNoCache(wl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored.ImageID != wl.ImageID || stored.FWType != payloads.Legacy ||
+		stored.VMType != payloads.QEMU || stored.Config != wl.Config ||
+		len(stored.Defaults) != 2 {
+		t.Fatalf("Workload not stored correctly %v", stored)
+	}
+}
+
+func TestUpdateWorkload(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wl, err := ds.AddWorkload(testWorkload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.DeleteWorkload(wl.ID)
+
+	instance, err := addTestInstance(tenant, wl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// let the instance reach the database
+	time.Sleep(1 * time.Second)
+
+	previousConfig := workloadConfigPath(t, wl.ID)
+
+	update := testWorkload()
+	update.ID = wl.ID
+	update.Description = "updated workload"
+	update.Config = "---\n#cloud-config\nruncmd:\n - echo updated\n...\n"
+	update.Defaults[1].Value = 1024
+
+	_, err = ds.UpdateWorkload(update)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := ds.db.getWorkloadNoCache(wl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored.Description != "updated workload" || stored.Config != update.Config ||
+		stored.ImageID != update.ImageID {
+		t.Fatalf("Workload not updated %v", stored)
+	}
+
+	for _, r := range stored.Defaults {
+		if r.Type == payloads.MemMB && r.Value != 1024 {
+			t.Errorf("Workload defaults not updated %v", stored.Defaults)
+		}
+	}
+
+	_, err = os.Stat(previousConfig)
+	if !os.IsNotExist(err) {
+		t.Errorf("Previous configuration %s not removed", previousConfig)
+	}
+
+	// existing instances keep their resources
+	instances, err := ds.db.getInstances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range instances {
+		if i.ID == instance.ID && i.Usage[string(payloads.MemMB)] != 512 {
+			t.Errorf("Instance usage changed: %v", i.Usage)
+		}
+	}
+
+	err = ds.DeleteInstance(instance.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	update.ID = uuid.Generate().String()
+	_, err = ds.UpdateWorkload(update)
+	if err == nil {
+		t.Fatal("Updated unknown workload")
+	}
+}
+
+func TestDeleteWorkload(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wl, err := ds.AddWorkload(testWorkload())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := workloadConfigPath(t, wl.ID)
+
+	instance, err := addTestInstance(tenant, wl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.DeleteWorkload(wl.ID)
+	if err == nil {
+		t.Fatal("Deleted workload in use")
+	}
+
+	err = ds.DeleteInstance(instance.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.DeleteWorkload(wl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ds.GetWorkload(wl.ID)
+	if err == nil {
+		t.Fatal("Deleted workload still available")
+	}
+
+	_, err = os.Stat(config)
+	if !os.IsNotExist(err) {
+		t.Errorf("Configuration %s not removed", config)
+	}
+
+	err = ds.DeleteWorkload(wl.ID)
+	if err == nil {
+		t.Fatal("Deleted unknown workload")
+	}
+}
+
+func tenantUsage(t *testing.T, tenantID string) map[string]int {
+	tenant, err := ds.getTenant(tenantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	usage := make(map[string]int)
+	for _, r := range tenant.Resources {
+		usage[r.Rname] = r.Usage
+	}
+
+	return usage
+}
+
+func TestIdentity(t *testing.T) {
+	project := types.IdentityProject{
+		ID:   uuid.Generate().String(),
+		Name: "test-project",
+	}
+
+	err := ds.AddIdentityProject(&project)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := types.IdentityUser{
+		ID:       uuid.Generate().String(),
+		Name:     "test-user",
+		Password: "hash",
+	}
+
+	err = ds.AddIdentityUser(&user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.AddIdentityUser(&user)
+	if err == nil {
+		t.Fatal("Added a duplicate user")
+	}
+
+	role := types.IdentityRole{
+		UserID:    user.ID,
+		ProjectID: project.ID,
+		Role:      "admin",
+	}
+
+	// granting a role twice is not an error
+	for i := 0; i < 2; i++ {
+		err = ds.AddIdentityRole(&role)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	u, err := ds.GetIdentityUser(user.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *u != user {
+		t.Fatalf("Expected user %v got %v", user, *u)
+	}
+
+	_, err = ds.GetIdentityUser("nobody")
+	if err == nil {
+		t.Fatal("Found unknown user")
+	}
+
+	roles, err := ds.GetIdentityRoles(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(roles) != 1 || *roles[0] != role {
+		t.Fatalf("Expected role %v got %v", role, roles)
+	}
+
+	projects, err := ds.GetIdentityProjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, p := range projects {
+		if *p == project {
+			found = true
+		}
+	}
+
+	if found == false {
+		t.Fatal("Project not found")
+	}
+
+	key, err := ds.GetIdentityKey()
+	if err != nil || len(key) == 0 {
+		t.Fatal("Unable to get identity key")
+	}
+
+	key2, err := ds.GetIdentityKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(key, key2) == false {
+		t.Fatal("Identity key changed")
+	}
+}
+
+func TestResizeInstance(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err := ds.GetWorkloads()
+	if err != nil || len(wls) == 0 {
+		t.Fatal(err)
+	}
+
+	instance, err := addTestInstance(tenant, wls[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// let the instance reach the database
+	time.Sleep(1 * time.Second)
+
+	before := tenantUsage(t, tenant.ID)
+	mem := instance.Usage[string(payloads.MemMB)]
+
+	err = ds.ResizeInstance(instance.ID, map[string]int{string(payloads.MemMB): mem + 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := ds.GetInstance(instance.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.Usage[string(payloads.MemMB)] != mem+256 {
+		t.Errorf("Instance not resized: %v", i.Usage)
+	}
+	if tenantUsage(t, tenant.ID)[string(payloads.MemMB)] != before[string(payloads.MemMB)]+256 {
+		t.Error("Tenant usage not updated")
+	}
+
+	// the new usage survives a reload of the instances
+	instances, err := ds.db.getInstances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stored := range instances {
+		if stored.ID == instance.ID && stored.Usage[string(payloads.MemMB)] != mem+256 {
+			t.Errorf("Resize not stored: %v", stored.Usage)
+		}
+	}
+
+	resources := []payloads.RequestedResource{{Type: payloads.MemMB, Value: mem}}
+	err = ds.ResizeFailure(instance.ID, payloads.ResizeNoCapacity, resources)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after := tenantUsage(t, tenant.ID)
+	for name, val := range before {
+		if after[name] != val {
+			t.Errorf("Tenant usage of %s not restored: %d != %d", name, after[name], val)
+		}
+	}
+
+	err = ds.ResizeInstance(uuid.Generate().String(), nil)
+	if err == nil {
+		t.Error("Resized unknown instance")
+	}
+}
+
 func TestAllocate100IPs(t *testing.T) {
 	testAllocateTenantIPs(t, 100)
 }
@@ -16,12 +16,15 @@
 package datastore
 
 import (
+	"crypto/rand"
 	"database/sql"
 	"encoding/csv"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/01org/ciao/ciao-controller/types"
 	"github.com/01org/ciao/payloads"
+	"github.com/docker/distribution/uuid"
 	"github.com/golang/glog"
 	sqlite3 "github.com/mattn/go-sqlite3"
 	"io/ioutil"
@@ -322,6 +325,155 @@ func (d workloadResourceData) Init() error {
 	return d.ds.exec(d.db, cmd)
 }
 
+// workload placement constraints
+type workloadConstraintData struct {
+	namedData
+}
+
+const (
+	requiredLabelConstraint  = "required_label"
+	preferredLabelConstraint = "preferred_label"
+	antiAffinityConstraint   = "anti_affinity"
+)
+
+func (d workloadConstraintData) Populate() error {
+	lines, err := d.ReadCsv()
+	if err != nil {
+		return err
+	}
+
+	for _, line := range lines {
+		workloadID := line[0]
+		constraintType := line[1]
+		label := line[2]
+		err = d.ds.create(d.name, workloadID, constraintType, label)
+		if err != nil {
+			glog.V(2).Info("could not add workload constraint: ", err)
+		}
+	}
+
+	return err
+}
+
+func (d workloadConstraintData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS workload_constraints
+		(
+		workload_id varchar(32),
+		constraint_type text,
+		label text,
+		foreign key(workload_id) references workload_template(id)
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS wlc_index
+		ON workload_constraints(workload_id, constraint_type, label);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+// block storage volumes
+type volumeData struct {
+	namedData
+}
+
+func (d volumeData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS volumes
+		(
+		id string primary key,
+		tenant_id string,
+		size integer,
+		format string,
+		path string,
+		state string,
+		instance_id string,
+		foreign key(tenant_id) references tenants(id)
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+// image service images
+type imageData struct {
+	namedData
+}
+
+func (d imageData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS images
+		(
+		id string primary key,
+		name string,
+		state string,
+		size integer,
+		checksum string,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+		source_workload varchar(32),
+		tenant_id varchar(32),
+		upload_token string
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+// local identity service data
+type identityProjectData struct {
+	namedData
+}
+
+func (d identityProjectData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS identity_projects
+		(
+		id varchar(32) primary key,
+		name text unique
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+type identityUserData struct {
+	namedData
+}
+
+func (d identityUserData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS identity_users
+		(
+		id varchar(32) primary key,
+		name text unique,
+		password text
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+type identityRoleData struct {
+	namedData
+}
+
+func (d identityRoleData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS identity_roles
+		(
+		user_id varchar(32),
+		project_id varchar(32),
+		role text,
+		foreign key(user_id) references identity_users(id),
+		foreign key(project_id) references identity_projects(id),
+		unique(user_id, project_id, role)
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
+type identityKeyData struct {
+	namedData
+}
+
+func (d identityKeyData) Init() error {
+	cmd := `CREATE TABLE IF NOT EXISTS identity_keys
+		(
+		id integer primary key,
+		key text
+		);`
+
+	return d.ds.exec(d.db, cmd)
+}
+
 // workload template data
 type workloadTemplateData struct {
 	namedData
@@ -342,7 +494,7 @@ func (d workloadTemplateData) Populate() error {
 		imageID := line[5]
 		imageName := line[6]
 		internal := line[7]
-		err = d.ds.create(d.name, id, description, filename, fwType, vmType, imageID, imageName, internal)
+		err = d.ds.create(d.name, id, description, filename, fwType, vmType, imageID, imageName, internal, "")
 		if err != nil {
 			glog.V(2).Info("could not add workload: ", err)
 		}
@@ -361,7 +513,8 @@ func (d workloadTemplateData) Init() error {
 		vm_type text,
 		image_id varchar(32),
 		image_name text,
-		internal integer
+		internal integer,
+		tenant_id varchar(32) DEFAULT ''
 		);`
 
 	return d.ds.exec(d.db, cmd)
@@ -528,7 +681,14 @@ func getPersistentStore(config Config) (persistentStore, error) {
 		instanceData{namedData{ds: ds, name: "instances", db: ds.db}},
 		workloadTemplateData{namedData{ds: ds, name: "workload_template", db: ds.db}},
 		workloadResourceData{namedData{ds: ds, name: "workload_resources", db: ds.db}},
+		workloadConstraintData{namedData{ds: ds, name: "workload_constraints", db: ds.db}},
 		usageData{namedData{ds: ds, name: "usage", db: ds.db}},
+		volumeData{namedData{ds: ds, name: "volumes", db: ds.db}},
+		imageData{namedData{ds: ds, name: "images", db: ds.db}},
+		identityProjectData{namedData{ds: ds, name: "identity_projects", db: ds.db}},
+		identityUserData{namedData{ds: ds, name: "identity_users", db: ds.db}},
+		identityRoleData{namedData{ds: ds, name: "identity_roles", db: ds.db}},
+		identityKeyData{namedData{ds: ds, name: "identity_keys", db: ds.db}},
 		nodeStatisticsData{namedData{ds: ds, name: "node_statistics", db: ds.tdb}},
 		logData{namedData{ds: ds, name: "log", db: ds.tdb}},
 		subnetData{namedData{ds: ds, name: "tenant_network", db: ds.db}},
@@ -745,12 +905,119 @@ func (ds *sqliteDB) getWorkloadDefaults(ID string) ([]payloads.RequestedResource
 	return defaults, nil
 }
 
+// getInstanceUsage overrides the values in usage with the resource
+// usage recorded for an instance.
+func (ds *sqliteDB) getInstanceUsage(instanceID string, usage map[string]int) error {
+	query := `SELECT resources.name, value FROM usage
+		  JOIN resources
+		  ON usage.resource_id=resources.id
+		  WHERE instance_id = ?`
+
+	db := ds.getTableDB("usage")
+
+	rows, err := db.Query(query, instanceID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var val int
+		var rname string
+
+		err = rows.Scan(&rname, &val)
+		if err != nil {
+			return err
+		}
+		usage[rname] = val
+	}
+
+	return rows.Err()
+}
+
+// getWorkloadConstraints fills in the placement constraints of a workload.
+// Label constraints are stored as key=value strings.
+func (ds *sqliteDB) getWorkloadConstraints(wl *workload) error {
+	query := `SELECT constraint_type, label FROM workload_constraints
+		  WHERE workload_id = ?`
+
+	db := ds.getTableDB("workload_constraints")
+
+	rows, err := db.Query(query, wl.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var constraintType string
+		var label string
+
+		err = rows.Scan(&constraintType, &label)
+		if err != nil {
+			return err
+		}
+
+		switch constraintType {
+		case antiAffinityConstraint:
+			wl.AntiAffinity = true
+			continue
+		case requiredLabelConstraint, preferredLabelConstraint:
+		default:
+			glog.Warningf("Unknown constraint %s for workload %s", constraintType, wl.ID)
+			continue
+		}
+
+		kv := strings.SplitN(label, "=", 2)
+		if len(kv) != 2 {
+			glog.Warningf("Invalid %s %s for workload %s", constraintType, label, wl.ID)
+			continue
+		}
+
+		if constraintType == requiredLabelConstraint {
+			if wl.RequiredLabels == nil {
+				wl.RequiredLabels = make(map[string]string)
+			}
+			wl.RequiredLabels[kv[0]] = kv[1]
+		} else {
+			if wl.PreferredLabels == nil {
+				wl.PreferredLabels = make(map[string]string)
+			}
+			wl.PreferredLabels[kv[0]] = kv[1]
+		}
+	}
+
+	return rows.Err()
+}
+
+// addLimit sets the limit of a tenant resource, replacing any previous
+// limit.  A negative limit removes the limit.
 func (ds *sqliteDB) addLimit(tenantID string, resourceID int, limit int) error {
+	datastore := ds.getTableDB("limits")
+
 	ds.dbLock.Lock()
-	err := ds.create("limits", resourceID, tenantID, limit)
-	ds.dbLock.Unlock()
+	defer ds.dbLock.Unlock()
 
-	return err
+	tx, err := datastore.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM limits WHERE tenant_id = ? AND resource_id = ?", tenantID, resourceID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if limit >= 0 {
+		_, err = tx.Exec("INSERT INTO limits VALUES (?, ?, ?)", resourceID, tenantID, limit)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
 }
 
 func (ds *sqliteDB) getTenantResources(ID string) ([]*types.Resource, error) {
@@ -833,6 +1100,33 @@ func (ds *sqliteDB) addTenant(ID string, MAC string) error {
 	return err
 }
 
+// deleteTenant removes a tenant along with its limits and its subnets.
+func (ds *sqliteDB) deleteTenant(ID string) error {
+	datastore := ds.getTableDB("tenants")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	tx, err := datastore.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, cmd := range []string{
+		"DELETE FROM limits WHERE tenant_id = ?",
+		"DELETE FROM tenant_network WHERE tenant_id = ?",
+		"DELETE FROM tenants WHERE id = ?",
+	} {
+		_, err = tx.Exec(cmd, ID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
 func (ds *sqliteDB) getTenantNoCache(ID string) (*tenant, error) {
 	query := `SELECT	tenants.id,
 				tenants.name,
@@ -881,19 +1175,23 @@ func (ds *sqliteDB) getWorkloadNoCache(id string) (*workload, error) {
 			 fw_type,
 			 vm_type,
 			 image_id,
-			 image_name
+			 image_name,
+			 tenant_id
 		  FROM workload_template
 		  WHERE id = ?`
 
 	work := new(workload)
 
 	var VMType string
+	var tenantID sql.NullString
 
-	err := datastore.QueryRow(query, id).Scan(&work.ID, &work.Description, &work.filename, &work.FWType, &VMType, &work.ImageID, &work.ImageName)
+	err := datastore.QueryRow(query, id).Scan(&work.ID, &work.Description, &work.filename, &work.FWType, &VMType, &work.ImageID, &work.ImageName, &tenantID)
 	if err != nil {
 		return nil, err
 	}
 
+	work.TenantID = tenantID.String
+
 	work.VMType = payloads.Hypervisor(VMType)
 
 	work.Config, err = ds.getConfigNoCache(id)
@@ -906,6 +1204,11 @@ func (ds *sqliteDB) getWorkloadNoCache(id string) (*workload, error) {
 		return nil, err
 	}
 
+	err = ds.getWorkloadConstraints(work)
+	if err != nil {
+		return nil, err
+	}
+
 	return work, nil
 }
 
@@ -920,7 +1223,8 @@ func (ds *sqliteDB) getWorkloadsNoCache() ([]*workload, error) {
 			 fw_type,
 			 vm_type,
 			 image_id,
-			 image_name
+			 image_name,
+			 tenant_id
 		  FROM workload_template
 		  WHERE internal = 0`
 
@@ -934,12 +1238,15 @@ func (ds *sqliteDB) getWorkloadsNoCache() ([]*workload, error) {
 		wl := new(workload)
 
 		var VMType string
+		var tenantID sql.NullString
 
-		err = rows.Scan(&wl.ID, &wl.Description, &wl.filename, &wl.FWType, &VMType, &wl.ImageID, &wl.ImageName)
+		err = rows.Scan(&wl.ID, &wl.Description, &wl.filename, &wl.FWType, &VMType, &wl.ImageID, &wl.ImageName, &tenantID)
 		if err != nil {
 			return nil, err
 		}
 
+		wl.TenantID = tenantID.String
+
 		wl.Config, err = ds.getConfigNoCache(wl.ID)
 		if err != nil {
 			return nil, err
@@ -950,6 +1257,11 @@ func (ds *sqliteDB) getWorkloadsNoCache() ([]*workload, error) {
 			return nil, err
 		}
 
+		err = ds.getWorkloadConstraints(wl)
+		if err != nil {
+			return nil, err
+		}
+
 		wl.VMType = payloads.Hypervisor(VMType)
 
 		workloads = append(workloads, wl)
@@ -960,6 +1272,222 @@ func (ds *sqliteDB) getWorkloadsNoCache() ([]*workload, error) {
 	return workloads, nil
 }
 
+// workloadConfigPrefix prefixes the names of the cloud-init configuration
+// files written for workloads created or updated at runtime.  Only those
+// files are ever removed by the datastore.
+const workloadConfigPrefix = "workload-"
+
+func (ds *sqliteDB) writeWorkloadConfig(config string) (string, error) {
+	filename := workloadConfigPrefix + uuid.Generate().String() + ".yaml"
+	path := fmt.Sprintf("%s/%s", ds.workloadsPath, filename)
+
+	err := ioutil.WriteFile(path, []byte(config), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	return filename, nil
+}
+
+// releaseWorkloadConfig removes a configuration file written by
+// writeWorkloadConfig once no workload template references it anymore.
+// The caller must hold dbLock.
+func (ds *sqliteDB) releaseWorkloadConfig(filename string) {
+	if !strings.HasPrefix(filename, workloadConfigPrefix) {
+		return
+	}
+
+	var count int
+	err := ds.db.QueryRow("SELECT count(*) FROM workload_template WHERE filename = ?", filename).Scan(&count)
+	if err != nil || count > 0 {
+		return
+	}
+
+	path := fmt.Sprintf("%s/%s", ds.workloadsPath, filename)
+	err = os.Remove(path)
+	if err != nil {
+		glog.Warningf("Unable to remove workload configuration %s: %v", path, err)
+	}
+}
+
+func insertWorkloadDetails(tx *sql.Tx, wl *workload) error {
+	for _, r := range wl.Defaults {
+		_, err := tx.Exec(`INSERT INTO workload_resources
+				  SELECT ?, id, ?, ?, ? FROM resources WHERE name = ?`,
+			wl.ID, r.Value, r.Value, r.Mandatory, string(r.Type))
+		if err != nil {
+			return err
+		}
+	}
+
+	var constraints [][2]string
+	for key, value := range wl.RequiredLabels {
+		constraints = append(constraints, [2]string{requiredLabelConstraint, key + "=" + value})
+	}
+	for key, value := range wl.PreferredLabels {
+		constraints = append(constraints, [2]string{preferredLabelConstraint, key + "=" + value})
+	}
+	if wl.AntiAffinity {
+		constraints = append(constraints, [2]string{antiAffinityConstraint, ""})
+	}
+
+	for _, c := range constraints {
+		_, err := tx.Exec("INSERT INTO workload_constraints VALUES (?, ?, ?)",
+			wl.ID, c[0], c[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addWorkload stores a new workload template.  A workload without a
+// configuration file name gets its Config written to a new file in the
+// workloads directory.
+func (ds *sqliteDB) addWorkload(wl *workload) error {
+	datastore := ds.db
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	if wl.filename == "" {
+		filename, err := ds.writeWorkloadConfig(wl.Config)
+		if err != nil {
+			return err
+		}
+		wl.filename = filename
+	}
+
+	tx, err := datastore.Begin()
+	if err != nil {
+		ds.releaseWorkloadConfig(wl.filename)
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO workload_template VALUES (?, ?, ?, ?, ?, ?, ?, 0, ?)",
+		wl.ID, wl.Description, wl.filename, wl.FWType, string(wl.VMType), wl.ImageID, wl.ImageName,
+		wl.TenantID)
+	if err != nil {
+		tx.Rollback()
+		ds.releaseWorkloadConfig(wl.filename)
+		return err
+	}
+
+	err = insertWorkloadDetails(tx, wl)
+	if err != nil {
+		tx.Rollback()
+		ds.releaseWorkloadConfig(wl.filename)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// updateWorkload replaces the template, default resources and constraints
+// of an existing workload.  A modified Config is written to a new file,
+// leaving the configuration of workloads sharing the previous one intact.
+func (ds *sqliteDB) updateWorkload(wl *workload) error {
+	datastore := ds.db
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	var previous string
+	err := datastore.QueryRow("SELECT filename FROM workload_template WHERE id = ? AND internal = 0", wl.ID).Scan(&previous)
+	if err != nil {
+		return err
+	}
+
+	filename := previous
+	config, err := ioutil.ReadFile(fmt.Sprintf("%s/%s", ds.workloadsPath, previous))
+	if err != nil || string(config) != wl.Config {
+		filename, err = ds.writeWorkloadConfig(wl.Config)
+		if err != nil {
+			return err
+		}
+	}
+
+	tx, err := datastore.Begin()
+	if err != nil {
+		ds.releaseWorkloadConfig(filename)
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE workload_template
+			  SET description = ?, filename = ?, fw_type = ?, vm_type = ?, image_id = ?, image_name = ?
+			  WHERE id = ?`,
+		wl.Description, filename, wl.FWType, string(wl.VMType), wl.ImageID, wl.ImageName, wl.ID)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM workload_resources WHERE workload_id = ?", wl.ID)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM workload_constraints WHERE workload_id = ?", wl.ID)
+	}
+	if err == nil {
+		err = insertWorkloadDetails(tx, wl)
+	}
+	if err != nil {
+		tx.Rollback()
+		ds.releaseWorkloadConfig(filename)
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		ds.releaseWorkloadConfig(filename)
+		return err
+	}
+
+	wl.filename = filename
+	if previous != filename {
+		ds.releaseWorkloadConfig(previous)
+	}
+
+	return nil
+}
+
+// deleteWorkload removes a workload template, along with its configuration
+// file if it was written by the datastore and is not shared.
+func (ds *sqliteDB) deleteWorkload(id string) error {
+	datastore := ds.db
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	var filename string
+	err := datastore.QueryRow("SELECT filename FROM workload_template WHERE id = ? AND internal = 0", id).Scan(&filename)
+	if err != nil {
+		return err
+	}
+
+	tx, err := datastore.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, cmd := range []string{
+		"DELETE FROM workload_resources WHERE workload_id = ?",
+		"DELETE FROM workload_constraints WHERE workload_id = ?",
+		"DELETE FROM workload_template WHERE id = ?",
+	} {
+		_, err = tx.Exec(cmd, id)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	ds.releaseWorkloadConfig(filename)
+
+	return nil
+}
+
 func (ds *sqliteDB) updateTenant(t *tenant) error {
 	db := ds.getTableDB("tenants")
 
@@ -1242,6 +1770,14 @@ func (ds *sqliteDB) getInstances() ([]*types.Instance, error) {
 		for c := range defaults {
 			usage[string(defaults[c].Type)] = defaults[c].Value
 		}
+
+		// resized instances no longer use their workload defaults
+		err = ds.getInstanceUsage(i.ID, usage)
+		if err != nil {
+			tx.Rollback()
+			ds.tdbLock.RUnlock()
+			return nil, err
+		}
 		i.Usage = usage
 
 		instances = append(instances, &i)
@@ -1345,6 +1881,12 @@ func (ds *sqliteDB) getTenantInstances(tenantID string) (map[string]*types.Insta
 		for c := range defaults {
 			usage[string(defaults[c].Type)] = defaults[c].Value
 		}
+
+		// resized instances no longer use their workload defaults
+		err = ds.getInstanceUsage(i.ID, usage)
+		if err != nil {
+			return nil, err
+		}
 		i.Usage = usage
 
 		instances[i.ID] = i
@@ -1409,6 +1951,304 @@ func (ds *sqliteDB) removeInstance(instanceID string) error {
 	return err
 }
 
+func (ds *sqliteDB) getVolumes() ([]*types.Volume, error) {
+	var volumes []*types.Volume
+
+	query := `SELECT id, tenant_id, size, format, path, state, instance_id
+		  FROM volumes`
+
+	db := ds.getTableDB("volumes")
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var v types.Volume
+		var format string
+
+		err = rows.Scan(&v.ID, &v.TenantID, &v.Size, &format, &v.Path, &v.State, &v.InstanceID)
+		if err != nil {
+			return nil, err
+		}
+		v.Format = payloads.VolumeFormat(format)
+
+		volumes = append(volumes, &v)
+	}
+
+	return volumes, rows.Err()
+}
+
+// Volume paths are not quoted by create(), so use a prepared statement.
+func (ds *sqliteDB) addVolume(volume *types.Volume) error {
+	db := ds.getTableDB("volumes")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec("INSERT INTO volumes VALUES (?, ?, ?, ?, ?, ?, ?)",
+		volume.ID, volume.TenantID, volume.Size, string(volume.Format),
+		volume.Path, volume.State, volume.InstanceID)
+
+	return err
+}
+
+func (ds *sqliteDB) updateVolume(volume *types.Volume) error {
+	db := ds.getTableDB("volumes")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec("UPDATE volumes SET state = ?, instance_id = ? WHERE id = ?",
+		volume.State, volume.InstanceID, volume.ID)
+
+	return err
+}
+
+func (ds *sqliteDB) removeVolume(volumeID string) error {
+	db := ds.getTableDB("volumes")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec("DELETE FROM volumes WHERE id = ?", volumeID)
+
+	return err
+}
+
+func (ds *sqliteDB) getImages() ([]*types.Image, error) {
+	var images []*types.Image
+
+	query := `SELECT id, name, state, size, checksum, created_at, source_workload,
+		  tenant_id, upload_token
+		  FROM images ORDER BY created_at`
+
+	db := ds.getTableDB("images")
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i types.Image
+		var sourceWorkload sql.NullString
+		var tenantID sql.NullString
+		var uploadToken sql.NullString
+
+		err = rows.Scan(&i.ID, &i.Name, &i.State, &i.Size, &i.Checksum, &i.CreatedAt, &sourceWorkload,
+			&tenantID, &uploadToken)
+		if err != nil {
+			return nil, err
+		}
+		i.SourceWorkload = sourceWorkload.String
+		i.TenantID = tenantID.String
+		i.UploadToken = uploadToken.String
+
+		images = append(images, &i)
+	}
+
+	return images, rows.Err()
+}
+
+func (ds *sqliteDB) addImage(image *types.Image) error {
+	db := ds.getTableDB("images")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec("INSERT INTO images VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		image.ID, image.Name, image.State, image.Size, image.Checksum, image.CreatedAt,
+		image.SourceWorkload, image.TenantID, image.UploadToken)
+
+	return err
+}
+
+func (ds *sqliteDB) updateImage(image *types.Image) error {
+	db := ds.getTableDB("images")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec("UPDATE images SET state = ?, size = ?, checksum = ? WHERE id = ?",
+		image.State, image.Size, image.Checksum, image.ID)
+
+	return err
+}
+
+func (ds *sqliteDB) updateImageState(imageID string, from string, to string) (bool, error) {
+	db := ds.getTableDB("images")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	res, err := db.Exec("UPDATE images SET state = ? WHERE id = ? AND state = ?",
+		to, imageID, from)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+
+	return n == 1, err
+}
+
+func (ds *sqliteDB) removeImage(imageID string) error {
+	db := ds.getTableDB("images")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec("DELETE FROM images WHERE id = ?", imageID)
+
+	return err
+}
+
+func (ds *sqliteDB) getIdentityProjects() ([]*types.IdentityProject, error) {
+	var projects []*types.IdentityProject
+
+	db := ds.getTableDB("identity_projects")
+
+	rows, err := db.Query("SELECT id, name FROM identity_projects")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p types.IdentityProject
+
+		err = rows.Scan(&p.ID, &p.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		projects = append(projects, &p)
+	}
+
+	return projects, rows.Err()
+}
+
+func (ds *sqliteDB) addIdentityProject(project *types.IdentityProject) error {
+	db := ds.getTableDB("identity_projects")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec("INSERT INTO identity_projects VALUES (?, ?)", project.ID, project.Name)
+
+	return err
+}
+
+func (ds *sqliteDB) getIdentityUsers() ([]*types.IdentityUser, error) {
+	var users []*types.IdentityUser
+
+	db := ds.getTableDB("identity_users")
+
+	rows, err := db.Query("SELECT id, name, password FROM identity_users")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u types.IdentityUser
+
+		err = rows.Scan(&u.ID, &u.Name, &u.Password)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, &u)
+	}
+
+	return users, rows.Err()
+}
+
+func (ds *sqliteDB) addIdentityUser(user *types.IdentityUser) error {
+	db := ds.getTableDB("identity_users")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec("INSERT INTO identity_users VALUES (?, ?, ?)", user.ID, user.Name, user.Password)
+
+	return err
+}
+
+func (ds *sqliteDB) getIdentityRoles(userID string) ([]*types.IdentityRole, error) {
+	var roles []*types.IdentityRole
+
+	db := ds.getTableDB("identity_roles")
+
+	rows, err := db.Query("SELECT user_id, project_id, role FROM identity_roles WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r types.IdentityRole
+
+		err = rows.Scan(&r.UserID, &r.ProjectID, &r.Role)
+		if err != nil {
+			return nil, err
+		}
+
+		roles = append(roles, &r)
+	}
+
+	return roles, rows.Err()
+}
+
+func (ds *sqliteDB) addIdentityRole(role *types.IdentityRole) error {
+	db := ds.getTableDB("identity_roles")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	_, err := db.Exec("INSERT OR IGNORE INTO identity_roles VALUES (?, ?, ?)",
+		role.UserID, role.ProjectID, role.Role)
+
+	return err
+}
+
+// getIdentityKey returns the key signing the local identity service
+// tokens, generating it the first time.
+func (ds *sqliteDB) getIdentityKey() ([]byte, error) {
+	var key string
+
+	db := ds.getTableDB("identity_keys")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	err := db.QueryRow("SELECT key FROM identity_keys WHERE id = 1").Scan(&key)
+	if err == nil {
+		return hex.DecodeString(key)
+	}
+
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	buf := make([]byte, 32)
+	_, err = rand.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec("INSERT INTO identity_keys VALUES (1, ?)", hex.EncodeToString(buf))
+	if err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
 func (ds *sqliteDB) addUsage(instanceID string, usage map[string]int) error {
 	datastore := ds.getTableDB("usage")
 
@@ -1420,7 +2260,7 @@ func (ds *sqliteDB) addUsage(instanceID string, usage map[string]int) error {
 		return err
 	}
 
-	cmd := `INSERT INTO usage (instance_id, resource_id, value)
+	cmd := `INSERT OR REPLACE INTO usage (instance_id, resource_id, value)
 		SELECT ?, resources.id, ?
 		FROM resources
 		WHERE name = ?`
@@ -1450,6 +2290,13 @@ func (ds *sqliteDB) addUsage(instanceID string, usage map[string]int) error {
 	return nil
 }
 
+// updateInstanceUsage records the new resource usage of a resized
+// instance.  Usage rows are unique per instance and resource, so they
+// are simply replaced.
+func (ds *sqliteDB) updateInstanceUsage(instanceID string, usage map[string]int) error {
+	return ds.addUsage(instanceID, usage)
+}
+
 func (ds *sqliteDB) addNodeStatDB(stat payloads.Stat) error {
 	datastore := ds.getTableDB("node_statistics")
 
@@ -0,0 +1,838 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	datastore "github.com/01org/ciao/ciao-controller/internal/datastore"
+	"github.com/01org/ciao/ciao-controller/types"
+	"github.com/docker/distribution/uuid"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/rackspace/gophercloud"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	localTokenLifetime     = 1 * time.Hour
+	passwordHashIterations = 4096
+	serviceProjectName     = "service"
+	adminRole              = "admin"
+)
+
+var (
+	errInvalidCredentials = errors.New("Invalid credentials")
+	errInvalidToken       = errors.New("Invalid token")
+	errTokenExpired       = errors.New("Token expired")
+	errProjectNotFound    = errors.New("Project Not Found")
+	errProjectExists      = errors.New("Project already exists")
+	errUserExists         = errors.New("User already exists")
+)
+
+// localIdentity is a minimal identity service keeping its users, projects
+// and roles in the controller datastore. It issues HMAC signed tokens which
+// are validated locally, so that small clusters and test setups can run
+// without Keystone.
+type localIdentity struct {
+	ds  *datastore.Datastore
+	key []byte
+}
+
+// localToken is the signed content of a local identity service token.
+// Unscoped tokens have no project and no roles.
+type localToken struct {
+	UserID      string    `json:"user_id"`
+	UserName    string    `json:"user_name"`
+	ProjectID   string    `json:"project_id,omitempty"`
+	ProjectName string    `json:"project_name,omitempty"`
+	Roles       []string  `json:"roles,omitempty"`
+	IssuedAt    time.Time `json:"issued_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// pbkdf2SHA256 derives a keyLen bytes key from password as specified by
+// RFC 2898, with HMAC-SHA256 as the pseudorandom function.
+func pbkdf2SHA256(password []byte, salt []byte, iterations int, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	blocks := (keyLen + prf.Size() - 1) / prf.Size()
+	index := make([]byte, 4)
+
+	var key []byte
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(index, uint32(block))
+		prf.Write(index)
+		u := prf.Sum(nil)
+
+		t := make([]byte, len(u))
+		copy(t, u)
+
+		for n := 1; n < iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+
+			for i := range t {
+				t[i] ^= u[i]
+			}
+		}
+
+		key = append(key, t...)
+	}
+
+	return key[:keyLen]
+}
+
+// hashPassword returns a salted password hash, formatted as
+// pbkdf2-sha256$<iterations>$<salt>$<hash>.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	hash := pbkdf2SHA256([]byte(password), salt, passwordHashIterations, sha256.Size)
+
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordHashIterations,
+		hex.EncodeToString(salt), hex.EncodeToString(hash)), nil
+}
+
+func checkPassword(hash string, password string) bool {
+	fields := strings.Split(hash, "$")
+	if len(fields) != 4 || fields[0] != "pbkdf2-sha256" {
+		return false
+	}
+
+	iterations, err := strconv.Atoi(fields[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+
+	salt, err := hex.DecodeString(fields[2])
+	if err != nil {
+		return false
+	}
+
+	expected, err := hex.DecodeString(fields[3])
+	if err != nil {
+		return false
+	}
+
+	computed := pbkdf2SHA256([]byte(password), salt, iterations, len(expected))
+
+	return hmac.Equal(computed, expected)
+}
+
+func newLocalIdentity(ds *datastore.Datastore, config identityConfig) (*localIdentity, error) {
+	key, err := ds.GetIdentityKey()
+	if err != nil {
+		return nil, err
+	}
+
+	id := &localIdentity{
+		ds:  ds,
+		key: key,
+	}
+
+	err = id.bootstrap(config.serviceUserName, config.servicePassword)
+	if err != nil {
+		return nil, err
+	}
+
+	return id, nil
+}
+
+// bootstrap creates the service project and the controller service user,
+// with the admin role on it, the first time the local identity service is
+// used.
+func (id *localIdentity) bootstrap(user string, password string) error {
+	_, err := id.ds.GetIdentityUser(user)
+	if err == nil {
+		return nil
+	}
+
+	if password == "" {
+		return errors.New("A service user password is required")
+	}
+
+	project, err := id.getProject(serviceProjectName)
+	if err == errProjectNotFound {
+		project, err = id.addProject(serviceProjectName)
+	}
+	if err != nil {
+		return err
+	}
+
+	u, err := id.addUser(user, password)
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("Created local identity service user %s", user)
+
+	return id.grantRole(u.ID, project.ID, adminRole)
+}
+
+// getProject looks a project up by name or ID.
+func (id *localIdentity) getProject(project string) (*types.IdentityProject, error) {
+	projects, err := id.ds.GetIdentityProjects()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range projects {
+		if p.ID == project || p.Name == project {
+			return p, nil
+		}
+	}
+
+	return nil, errProjectNotFound
+}
+
+func (id *localIdentity) addProject(name string) (*types.IdentityProject, error) {
+	_, err := id.getProject(name)
+	if err == nil {
+		return nil, errProjectExists
+	}
+
+	project := &types.IdentityProject{
+		ID:   uuid.Generate().String(),
+		Name: name,
+	}
+
+	err = id.ds.AddIdentityProject(project)
+	if err != nil {
+		return nil, err
+	}
+
+	return project, nil
+}
+
+func (id *localIdentity) addUser(name string, password string) (*types.IdentityUser, error) {
+	_, err := id.ds.GetIdentityUser(name)
+	if err == nil {
+		return nil, errUserExists
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &types.IdentityUser{
+		ID:       uuid.Generate().String(),
+		Name:     name,
+		Password: hash,
+	}
+
+	err = id.ds.AddIdentityUser(user)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (id *localIdentity) grantRole(userID string, projectID string, role string) error {
+	r := types.IdentityRole{
+		UserID:    userID,
+		ProjectID: projectID,
+		Role:      role,
+	}
+
+	return id.ds.AddIdentityRole(&r)
+}
+
+// userProjects returns the projects a user has at least one role on.
+func (id *localIdentity) userProjects(userID string) ([]*types.IdentityProject, error) {
+	roles, err := id.ds.GetIdentityRoles(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	projects, err := id.ds.GetIdentityProjects()
+	if err != nil {
+		return nil, err
+	}
+
+	var userProjects []*types.IdentityProject
+	for _, p := range projects {
+		for _, r := range roles {
+			if r.ProjectID == p.ID {
+				userProjects = append(userProjects, p)
+				break
+			}
+		}
+	}
+
+	return userProjects, nil
+}
+
+// issueToken authenticates a user by name or ID and returns a token scoped
+// to project, or an unscoped token if project is empty.
+func (id *localIdentity) issueToken(user string, password string, project string) (string, *localToken, error) {
+	u, err := id.ds.GetIdentityUser(user)
+	if err != nil {
+		return "", nil, errInvalidCredentials
+	}
+
+	if checkPassword(u.Password, password) == false {
+		return "", nil, errInvalidCredentials
+	}
+
+	now := time.Now().UTC()
+	t := &localToken{
+		UserID:    u.ID,
+		UserName:  u.Name,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(localTokenLifetime),
+	}
+
+	if project != "" {
+		p, err := id.getProject(project)
+		if err != nil {
+			return "", nil, errInvalidCredentials
+		}
+
+		roles, err := id.ds.GetIdentityRoles(u.ID)
+		if err != nil {
+			return "", nil, err
+		}
+
+		for _, r := range roles {
+			if r.ProjectID == p.ID {
+				t.Roles = append(t.Roles, r.Role)
+			}
+		}
+
+		if len(t.Roles) == 0 {
+			return "", nil, errInvalidCredentials
+		}
+
+		t.ProjectID = p.ID
+		t.ProjectName = p.Name
+	}
+
+	token, err := id.sign(t)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, t, nil
+}
+
+func (id *localIdentity) signature(payload string) []byte {
+	mac := hmac.New(sha256.New, id.key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// sign encodes a token as <payload>.<signature>, both base64url encoded.
+func (id *localIdentity) sign(t *localToken) (string, error) {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	signature := base64.RawURLEncoding.EncodeToString(id.signature(payload))
+
+	return payload + "." + signature, nil
+}
+
+func (id *localIdentity) parseToken(token string) (*localToken, error) {
+	fields := strings.Split(token, ".")
+	if len(fields) != 2 {
+		return nil, errInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	if hmac.Equal(signature, id.signature(fields[0])) == false {
+		return nil, errInvalidToken
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(fields[0])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	var t localToken
+	err = json.Unmarshal(b, &t)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	if time.Now().After(t.ExpiresAt) {
+		return nil, errTokenExpired
+	}
+
+	return &t, nil
+}
+
+// validateService checks that a token is scoped to tenantID. The local
+// identity service catalog only has the ciao compute service.
+func (id *localIdentity) validateService(token string, tenantID string, serviceType string, serviceName string) bool {
+	t, err := id.parseToken(token)
+	if err != nil {
+		glog.V(2).Info(err)
+		return false
+	}
+
+	if t.ProjectID == "" || t.ProjectID != tenantID {
+		return false
+	}
+
+	if serviceType != "compute" {
+		return false
+	}
+
+	return serviceName == "" || serviceName == "ciao"
+}
+
+func (id *localIdentity) validateAuthToken(token string) bool {
+	_, err := id.parseToken(token)
+	return err == nil
+}
+
+func (id *localIdentity) validateProjectRole(token string, project string, role string) bool {
+	t, err := id.parseToken(token)
+	if err != nil {
+		glog.V(2).Info(err)
+		return false
+	}
+
+	if project != "" && t.ProjectName != project {
+		return false
+	}
+
+	for _, r := range t.Roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+ * The local identity service exposes the subset of the Keystone v3 API
+ * needed by ciao-cli and gophercloud based clients.
+ */
+
+type identityEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type identityEndpoint struct {
+	ID        string `json:"id"`
+	Interface string `json:"interface"`
+	Region    string `json:"region"`
+	URL       string `json:"url"`
+}
+
+type identityService struct {
+	ID        string             `json:"id"`
+	Name      string             `json:"name"`
+	Type      string             `json:"type"`
+	Endpoints []identityEndpoint `json:"endpoints"`
+}
+
+type identityTokenRequest struct {
+	Auth struct {
+		Identity struct {
+			Methods  []string `json:"methods"`
+			Password struct {
+				User struct {
+					ID       string `json:"id"`
+					Name     string `json:"name"`
+					Password string `json:"password"`
+				} `json:"user"`
+			} `json:"password"`
+		} `json:"identity"`
+		Scope struct {
+			Project identityEntity `json:"project"`
+		} `json:"scope"`
+	} `json:"auth"`
+}
+
+type identityTokenResponse struct {
+	Token struct {
+		Methods   []string          `json:"methods"`
+		ExpiresAt string            `json:"expires_at"`
+		IssuedAt  string            `json:"issued_at"`
+		User      identityEntity    `json:"user"`
+		Project   *identityEntity   `json:"project,omitempty"`
+		Roles     []identityEntity  `json:"roles,omitempty"`
+		Catalog   []identityService `json:"catalog"`
+	} `json:"token"`
+}
+
+type identityProjectResponse struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	DomainID string `json:"domain_id"`
+	Enabled  bool   `json:"enabled"`
+}
+
+type identityProjectsResponse struct {
+	Projects []identityProjectResponse `json:"projects"`
+}
+
+type identityProjectRequest struct {
+	Project struct {
+		Name string `json:"name"`
+	} `json:"project"`
+}
+
+type identityUserRequest struct {
+	User struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	} `json:"user"`
+}
+
+func writeIdentityToken(w http.ResponseWriter, r *http.Request, t *localToken, status int) {
+	var resp identityTokenResponse
+
+	resp.Token.Methods = []string{"password"}
+	resp.Token.ExpiresAt = t.ExpiresAt.Format(gophercloud.RFC3339Milli)
+	resp.Token.IssuedAt = t.IssuedAt.Format(gophercloud.RFC3339Milli)
+	resp.Token.User = identityEntity{ID: t.UserID, Name: t.UserName}
+	resp.Token.Catalog = []identityService{}
+
+	if t.ProjectID != "" {
+		resp.Token.Project = &identityEntity{ID: t.ProjectID, Name: t.ProjectName}
+
+		for _, role := range t.Roles {
+			resp.Token.Roles = append(resp.Token.Roles, identityEntity{ID: role, Name: role})
+		}
+
+		url := fmt.Sprintf("https://%s/v2.1/%s", r.Host, t.ProjectID)
+		resp.Token.Catalog = append(resp.Token.Catalog, identityService{
+			ID:   "ciao",
+			Name: "ciao",
+			Type: "compute",
+			Endpoints: []identityEndpoint{
+				{ID: "ciao-public", Interface: "public", Region: "RegionOne", URL: url},
+				{ID: "ciao-internal", Interface: "internal", Region: "RegionOne", URL: url},
+				{ID: "ciao-admin", Interface: "admin", Region: "RegionOne", URL: url},
+			},
+		})
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+func writeIdentityProjects(w http.ResponseWriter, projects []*types.IdentityProject) {
+	resp := identityProjectsResponse{
+		Projects: []identityProjectResponse{},
+	}
+
+	for _, p := range projects {
+		resp.Projects = append(resp.Projects, identityProjectResponse{
+			ID:       p.ID,
+			Name:     p.Name,
+			DomainID: "default",
+			Enabled:  true,
+		})
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func createIdentityToken(w http.ResponseWriter, r *http.Request, id *localIdentity) {
+	var req identityTokenRequest
+
+	dumpRequest(r)
+
+	defer r.Body.Close()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	password := false
+	for _, m := range req.Auth.Identity.Methods {
+		if m == "password" {
+			password = true
+		}
+	}
+
+	if password == false {
+		http.Error(w, "Only password authentication is supported", http.StatusBadRequest)
+		return
+	}
+
+	user := req.Auth.Identity.Password.User
+	name := user.ID
+	if name == "" {
+		name = user.Name
+	}
+
+	project := req.Auth.Scope.Project.ID
+	if project == "" {
+		project = req.Auth.Scope.Project.Name
+	}
+
+	token, t, err := id.issueToken(name, user.Password, project)
+	if err == errInvalidCredentials {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("X-Subject-Token", token)
+	writeIdentityToken(w, r, t, http.StatusCreated)
+}
+
+func showIdentityToken(w http.ResponseWriter, r *http.Request, id *localIdentity) {
+	dumpRequest(r)
+
+	_, err := id.parseToken(r.Header.Get("X-Auth-Token"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	t, err := id.parseToken(r.Header.Get("X-Subject-Token"))
+	if err != nil {
+		http.Error(w, "Token Not Found", http.StatusNotFound)
+		return
+	}
+
+	writeIdentityToken(w, r, t, http.StatusOK)
+}
+
+func listIdentityUserProjects(w http.ResponseWriter, r *http.Request, context *controller, id *localIdentity) {
+	dumpRequest(r)
+
+	vars := mux.Vars(r)
+	user := vars["user"]
+
+	t, err := id.parseToken(r.Header.Get("X-Auth-Token"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if t.UserID != user && adminToken(context, r) == false {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	projects, err := id.userProjects(user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeIdentityProjects(w, projects)
+}
+
+func listIdentityProjects(w http.ResponseWriter, r *http.Request, context *controller, id *localIdentity) {
+	dumpRequest(r)
+
+	if adminToken(context, r) == false {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	projects, err := id.ds.GetIdentityProjects()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeIdentityProjects(w, projects)
+}
+
+func createIdentityProject(w http.ResponseWriter, r *http.Request, context *controller, id *localIdentity) {
+	var req identityProjectRequest
+
+	dumpRequestBody(r, true)
+
+	if adminToken(context, r) == false {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	defer r.Body.Close()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Project.Name == "" {
+		http.Error(w, "Missing project name", http.StatusBadRequest)
+		return
+	}
+
+	p, err := id.addProject(req.Project.Name)
+	if err == errProjectExists {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(struct {
+		Project identityEntity `json:"project"`
+	}{identityEntity{ID: p.ID, Name: p.Name}})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(b)
+}
+
+func createIdentityUser(w http.ResponseWriter, r *http.Request, context *controller, id *localIdentity) {
+	var req identityUserRequest
+
+	dumpRequest(r)
+
+	if adminToken(context, r) == false {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	defer r.Body.Close()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.User.Name == "" || req.User.Password == "" {
+		http.Error(w, "Missing user name or password", http.StatusBadRequest)
+		return
+	}
+
+	u, err := id.addUser(req.User.Name, req.User.Password)
+	if err == errUserExists {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(struct {
+		User identityEntity `json:"user"`
+	}{identityEntity{ID: u.ID, Name: u.Name}})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(b)
+}
+
+func grantIdentityRole(w http.ResponseWriter, r *http.Request, context *controller, id *localIdentity) {
+	dumpRequest(r)
+
+	if adminToken(context, r) == false {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	p, err := id.getProject(vars["project"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	u, err := id.ds.GetIdentityUser(vars["user"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	err = id.grantRole(u.ID, p.ID, vars["role"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,329 @@
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testServiceUser     = "ciao-test-service"
+	testServicePassword = "iheartciao"
+)
+
+func newTestLocalIdentity(t *testing.T) *localIdentity {
+	config := identityConfig{
+		serviceUserName: testServiceUser,
+		servicePassword: testServicePassword,
+	}
+
+	id, err := newLocalIdentity(context.ds, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return id
+}
+
+func TestPBKDF2SHA256(t *testing.T) {
+	var tests = []struct {
+		password   string
+		salt       string
+		iterations int
+		key        string
+	}{
+		{
+			password:   "passwd",
+			salt:       "salt",
+			iterations: 1,
+			key:        "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783",
+		},
+		{
+			password:   "password",
+			salt:       "salt",
+			iterations: 4096,
+			key:        "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a",
+		},
+	}
+
+	for _, test := range tests {
+		key := pbkdf2SHA256([]byte(test.password), []byte(test.salt), test.iterations, len(test.key)/2)
+		if hex.EncodeToString(key) != test.key {
+			t.Errorf("Expected %s got %x", test.key, key)
+		}
+	}
+}
+
+func TestPasswordHash(t *testing.T) {
+	hash, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if checkPassword(hash, "secret") == false {
+		t.Fatal("Password does not match its hash")
+	}
+
+	if checkPassword(hash, "Secret") == true {
+		t.Fatal("Wrong password matches")
+	}
+
+	hash2, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hash == hash2 {
+		t.Fatal("Password hashes are not salted")
+	}
+
+	if checkPassword("secret", "secret") == true {
+		t.Fatal("Malformed hash matches")
+	}
+}
+
+func TestLocalIdentityToken(t *testing.T) {
+	id := newTestLocalIdentity(t)
+
+	project, err := id.getProject(serviceProjectName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, _, err := id.issueToken(testServiceUser, testServicePassword, serviceProjectName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id.validateProjectRole(token, serviceProjectName, adminRole) == false {
+		t.Fatal("Service user is not admin")
+	}
+
+	if id.validateProjectRole(token, "admin", adminRole) == true {
+		t.Fatal("Token validated for the wrong project")
+	}
+
+	if id.validateService(token, project.ID, "compute", "ciao") == false {
+		t.Fatal("Token not valid for its project")
+	}
+
+	if id.validateService(token, computeTestUser, "compute", "") == true {
+		t.Fatal("Token valid for another tenant")
+	}
+
+	// tokens survive a controller restart
+	id = newTestLocalIdentity(t)
+	if id.validateService(token, project.ID, "compute", "") == false {
+		t.Fatal("Token not valid after restart")
+	}
+
+	_, _, err = id.issueToken(testServiceUser, "wrong", serviceProjectName)
+	if err != errInvalidCredentials {
+		t.Fatalf("Expected %v got %v", errInvalidCredentials, err)
+	}
+
+	unscoped, _, err := id.issueToken(testServiceUser, testServicePassword, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id.validateProjectRole(unscoped, "", adminRole) == true {
+		t.Fatal("Unscoped token has roles")
+	}
+}
+
+func TestLocalIdentityInvalidToken(t *testing.T) {
+	id := newTestLocalIdentity(t)
+
+	project, err := id.getProject(serviceProjectName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, lt, err := id.issueToken(testServiceUser, testServicePassword, serviceProjectName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// forge a token for another project with the original signature
+	forged := *lt
+	forged.ProjectID = computeTestUser
+	forgedToken, err := id.sign(&forged)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := forgedToken[:strings.Index(forgedToken, ".")] +
+		token[strings.Index(token, "."):]
+
+	expired := *lt
+	expired.ExpiresAt = time.Now().Add(-1 * time.Minute)
+	expiredToken, err := id.sign(&expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := &localIdentity{key: []byte("not the signing key")}
+	otherToken, err := other.sign(lt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		token string
+		err   error
+	}{
+		{tampered, errInvalidToken},
+		{expiredToken, errTokenExpired},
+		{otherToken, errInvalidToken},
+		{"", errInvalidToken},
+		{"imavalidtoken", errInvalidToken},
+	}
+
+	for _, test := range tests {
+		_, err := id.parseToken(test.token)
+		if err != test.err {
+			t.Errorf("Expected %v got %v", test.err, err)
+		}
+
+		if id.validateService(test.token, project.ID, "compute", "") == true {
+			t.Errorf("Invalid token %q validated", test.token)
+		}
+	}
+}
+
+func TestLocalIdentityAPI(t *testing.T) {
+	id := newTestLocalIdentity(t)
+
+	project, err := id.addProject("local-identity-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := id.addUser("local-identity-user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = id.grantRole(user.ID, project.ID, "member")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/v3/auth/tokens", func(w http.ResponseWriter, r *http.Request) {
+		createIdentityToken(w, r, id)
+	}).Methods("POST")
+	r.HandleFunc("/v3/auth/tokens", func(w http.ResponseWriter, r *http.Request) {
+		showIdentityToken(w, r, id)
+	}).Methods("GET")
+	r.HandleFunc("/v3/users/{user}/projects", func(w http.ResponseWriter, r *http.Request) {
+		listIdentityUserProjects(w, r, context, id)
+	}).Methods("GET")
+
+	var tests = []struct {
+		body   string
+		status int
+	}{
+		{`{"auth":{"identity":{"methods":["password"],"password":{"user":{"name":"local-identity-user","password":"password"}}},"scope":{"project":{"name":"local-identity-api"}}}}`, http.StatusCreated},
+		{`{"auth":{"identity":{"methods":["password"],"password":{"user":{"id":"` + user.ID + `","password":"password"}}},"scope":{"project":{"id":"` + project.ID + `"}}}}`, http.StatusCreated},
+		{`{"auth":{"identity":{"methods":["password"],"password":{"user":{"name":"local-identity-user","password":"wrong"}}}}}`, http.StatusUnauthorized},
+		{`{"auth":{"identity":{"methods":["password"],"password":{"user":{"name":"local-identity-user","password":"password"}}},"scope":{"project":{"name":"service"}}}}`, http.StatusUnauthorized},
+		{`{"auth":{"identity":{"methods":["token"]}}}`, http.StatusBadRequest},
+	}
+
+	var token string
+	for _, test := range tests {
+		req, err := http.NewRequest("POST", "/v3/auth/tokens", bytes.NewBufferString(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if w.Code != test.status {
+			t.Fatalf("Expected status %d got %d: %s", test.status, w.Code, w.Body.String())
+		}
+
+		if w.Code == http.StatusCreated {
+			token = w.Header().Get("X-Subject-Token")
+		}
+	}
+
+	req, err := http.NewRequest("GET", "/v3/auth/tokens", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Auth-Token", token)
+	req.Header.Set("X-Subject-Token", token)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d got %d", http.StatusOK, w.Code)
+	}
+
+	var resp identityTokenResponse
+	err = json.Unmarshal(w.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Token.Project == nil || resp.Token.Project.ID != project.ID ||
+		resp.Token.User.ID != user.ID || len(resp.Token.Catalog) != 1 {
+		t.Fatalf("Unexpected token %s", w.Body.String())
+	}
+
+	req.Header.Set("X-Subject-Token", "imavalidtoken")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected status %d got %d", http.StatusNotFound, w.Code)
+	}
+
+	req, err = http.NewRequest("GET", "/v3/users/"+user.ID+"/projects", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Auth-Token", token)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d got %d", http.StatusOK, w.Code)
+	}
+
+	var projects identityProjectsResponse
+	err = json.Unmarshal(w.Body.Bytes(), &projects)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(projects.Projects) != 1 || projects.Projects[0].ID != project.ID {
+		t.Fatalf("Unexpected projects %s", w.Body.String())
+	}
+}
@@ -23,12 +23,16 @@ import (
 	"github.com/golang/glog"
 	"os"
 	"sync"
+	"time"
 )
 
 type controller struct {
-	client *ssntpClient
-	ds     *datastore.Datastore
-	id     *identity
+	client  *ssntpClient
+	ds      *datastore.Datastore
+	id      identityProvider
+	tokens  *tokenCache
+	volumes volumeDriver
+	images  *imageStore
 }
 
 var cert = flag.String("cert", "/etc/pki/ciao/cert-client-localhost.pem", "Client certificate")
@@ -38,6 +42,7 @@ var identityURL = flag.String("identity", "identity:35357", "Keystone URL")
 var serviceUser = flag.String("username", "csr", "Openstack Service Username")
 var servicePassword = flag.String("password", "", "Openstack Service Username")
 var computeAPIPort = flag.Int("computeport", openstackComputeAPIPort, "Openstack Compute API port")
+var imageAPIPort = flag.Int("imageport", imageServicePort, "Image service API port")
 var httpsCAcert = flag.String("httpscert", "/etc/pki/ciao/ciao-controller-cacert.pem", "HTTPS CA certificate")
 var httpsKey = flag.String("httpskey", "/etc/pki/ciao/ciao-controller-key.pem", "HTTPS cert key")
 var tablesInitPath = flag.String("tables_init_path", "./tables", "path to csv files")
@@ -45,6 +50,11 @@ var workloadsPath = flag.String("workloads_path", "./workloads", "path to yaml f
 var noNetwork = flag.Bool("nonetwork", false, "Debug with no networking")
 var persistentDatastoreLocation = flag.String("database_path", "./ciao-controller.db", "path to persistent database")
 var transientDatastoreLocation = flag.String("stats_path", "/tmp/ciao-controller-stats.db", "path to stats database")
+var imagesPath = flag.String("images_path", "/var/lib/ciao/controller/images", "path to image service files")
+var imageMaxSizeMB = flag.Int64("image_max_size", 20480, "maximum size in MB of uploaded images, 0 for no limit")
+var volumesPath = flag.String("volumes_path", "/var/lib/ciao/volumes", "path to volume files, shared with compute nodes")
+var localIdentityService = flag.Bool("local_identity", false, "Use the built-in identity service instead of Keystone")
+var tokenCacheTTL = flag.Duration("token_cache_ttl", 5*time.Minute, "How long validated tokens are cached, 0 disables caching")
 var logDir = "/var/lib/ciao/logs/controller"
 
 func init() {
@@ -72,6 +82,8 @@ func main() {
 
 	context := new(controller)
 	context.ds = new(datastore.Datastore)
+	context.volumes = &localVolumeDriver{dir: *volumesPath}
+	context.images = &imageStore{dir: *imagesPath, maxSize: *imageMaxSizeMB << 20}
 
 	dsConfig := datastore.Config{
 		PersistentURI:     *persistentDatastoreLocation,
@@ -107,14 +119,25 @@ func main() {
 		servicePassword: *servicePassword,
 	}
 
-	context.id, err = newIdentityClient(idConfig)
-	if err != nil {
-		glog.Fatal("Unable to authenticate to Keystone: ", err)
-		return
+	if *localIdentityService {
+		context.id, err = newLocalIdentity(context.ds, idConfig)
+		if err != nil {
+			glog.Fatal("Unable to start the local identity service: ", err)
+			return
+		}
+	} else {
+		context.id, err = newIdentityClient(idConfig)
+		if err != nil {
+			glog.Fatal("Unable to authenticate to Keystone: ", err)
+			return
+		}
 	}
 
+	context.tokens = newTokenCache(*tokenCacheTTL)
+
 	wg.Add(1)
 	go createComputeAPI(context)
+	go createImageAPI(context)
 
 	wg.Wait()
 	context.ds.Exit()
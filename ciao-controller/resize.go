@@ -0,0 +1,138 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/01org/ciao/payloads"
+	"github.com/golang/glog"
+)
+
+var errOverTenantLimits = errors.New("Over Tenant Limits")
+
+// resizableResources are the resources of an instance a resize can change.
+var resizableResources = []payloads.Resource{payloads.VCPUs, payloads.MemMB, payloads.DiskMB}
+
+// instanceResources returns the requested resources of an instance started
+// from a workload with the given defaults, but using the values in usage.
+func instanceResources(defaults []payloads.RequestedResource, usage map[string]int) []payloads.RequestedResource {
+	resources := make([]payloads.RequestedResource, 0, len(defaults))
+	found := make(map[payloads.Resource]bool)
+
+	for _, r := range defaults {
+		if val, ok := usage[string(r.Type)]; ok {
+			r.Value = val
+		}
+		resources = append(resources, r)
+		found[r.Type] = true
+	}
+
+	for _, t := range resizableResources {
+		if val, ok := usage[string(t)]; ok && !found[t] {
+			resources = append(resources, payloads.RequestedResource{Type: t, Value: val})
+		}
+	}
+
+	return resources
+}
+
+// resizeInstance changes the vcpus, memory and disk size of a stopped
+// instance.  Values of 0 leave the corresponding resource unchanged and
+// disks can only grow.  The tenant's usage is updated right away and
+// restored if the launcher or the scheduler report a failure.  If the
+// instance's node cannot accommodate the new resources, the scheduler
+// fails the resize with ResizeNoCapacity and the instance stays where it
+// is, stopped and with its disk.
+func (c *controller) resizeInstance(instanceID string, vcpus int, memMB int, diskMB int) error {
+	i, err := c.ds.GetInstance(instanceID)
+	if err != nil {
+		return err
+	}
+
+	if i.NodeID == "" {
+		return errors.New("Instance Not Assigned to Node")
+	}
+
+	if i.State != payloads.ComputeStatusStopped {
+		return fmt.Errorf("Instance %s is not stopped", instanceID)
+	}
+
+	if i.CNCI {
+		return errors.New("CNCI instances cannot be resized")
+	}
+
+	requested := map[string]int{
+		string(payloads.VCPUs):  vcpus,
+		string(payloads.MemMB):  memMB,
+		string(payloads.DiskMB): diskMB,
+	}
+
+	usage := make(map[string]int)
+	delta := make(map[string]int)
+	for name, val := range requested {
+		if val < 0 {
+			return fmt.Errorf("Invalid %s value %d", name, val)
+		} else if val == 0 {
+			continue
+		}
+		usage[name] = val
+		delta[name] = val - i.Usage[name]
+	}
+
+	if len(usage) == 0 {
+		return errors.New("No resources to resize")
+	}
+
+	if delta[string(payloads.DiskMB)] < 0 {
+		return errors.New("Disks cannot be shrunk")
+	}
+
+	ok, err := (&instance{Instance: *i, context: c}).allowed(delta, 0)
+	if err != nil {
+		return err
+	} else if !ok {
+		return errOverTenantLimits
+	}
+
+	wl, err := c.ds.GetWorkload(i.WorkloadID)
+	if err != nil {
+		return err
+	}
+
+	current := instanceResources(wl.Defaults, i.Usage)
+
+	err = c.ds.ResizeInstance(instanceID, usage)
+	if err != nil {
+		return err
+	}
+
+	resized := instanceResources(wl.Defaults, i.Usage)
+
+	go c.client.ResizeInstance(instanceID, i.NodeID, resized, current)
+
+	return nil
+}
+
+// resizeFailure restores the resources an instance had before a
+// failed resize.
+func (c *controller) resizeFailure(instanceID string, reason payloads.ResizeFailureReason, resources []payloads.RequestedResource) {
+	err := c.ds.ResizeFailure(instanceID, reason, resources)
+	if err != nil {
+		glog.V(2).Info("ResizeFailure: ", err)
+	}
+}
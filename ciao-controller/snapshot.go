@@ -0,0 +1,94 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/01org/ciao/ciao-controller/types"
+	"github.com/01org/ciao/payloads"
+	"github.com/docker/distribution/uuid"
+	"github.com/golang/glog"
+)
+
+// snapshotInstance creates a queued image and asks the launcher running
+// instanceID to upload a snapshot of the instance's root disk to it.
+// A workload booting from the image is registered once the upload
+// completes.
+func (c *controller) snapshotInstance(instanceID string, name string) (*types.Image, error) {
+	i, err := c.ds.GetInstance(instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if i.NodeID == "" {
+		return nil, errors.New("Instance Not Assigned to Node")
+	}
+
+	if i.State != payloads.Running {
+		return nil, fmt.Errorf("Instance %s is not running", instanceID)
+	}
+
+	if i.CNCI {
+		return nil, errors.New("CNCI instances cannot be snapshotted")
+	}
+
+	image, err := c.queueImage(&types.Image{
+		Name:           name,
+		SourceWorkload: i.WorkloadID,
+		TenantID:       i.TenantID,
+		UploadToken:    uuid.Generate().String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	go c.client.Snapshot(instanceID, image.ID, image.UploadToken, i.NodeID)
+
+	return image, nil
+}
+
+// registerSnapshotWorkload adds a workload identical to the one the
+// snapshotted instance was started from, but booting from the snapshot.
+// Only the tenant owning the snapshotted instance can use the workload.
+func (c *controller) registerSnapshotWorkload(image *types.Image) {
+	wl, err := c.ds.CloneWorkload(image.SourceWorkload, image.Name, image.ID, image.Name, image.TenantID)
+	if err != nil {
+		glog.Errorf("Unable to register workload for snapshot %s: %v", image.ID, err)
+		return
+	}
+
+	glog.Infof("Registered workload %s for snapshot %s", wl.ID, image.ID)
+}
+
+// snapshotFailure drops the image a failed snapshot was to be uploaded to.
+func (c *controller) snapshotFailure(instanceID string, imageID string, reason payloads.SnapshotFailureReason) {
+	err := c.ds.SnapshotFailure(instanceID, imageID, reason)
+	if err != nil {
+		glog.V(2).Info("SnapshotFailure: ", err)
+	}
+
+	image, err := c.ds.GetImage(imageID)
+	if err != nil || image.State != payloads.ImageStatusQueued {
+		return
+	}
+
+	err = c.deleteImage(imageID)
+	if err != nil {
+		glog.Warningf("Unable to delete image %s of failed snapshot: %v", imageID, err)
+	}
+}
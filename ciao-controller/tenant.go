@@ -0,0 +1,145 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/01org/ciao/ciao-controller/types"
+	"github.com/01org/ciao/payloads"
+	"github.com/golang/glog"
+)
+
+// validateQuotas checks that quotas only limit the instances, vcpus,
+// mem_mb and disk_mb resources.
+func validateQuotas(quotas []payloads.CiaoQuota) error {
+	for _, q := range quotas {
+		switch q.Resource {
+		case "instances", string(payloads.VCPUs), payloads.MemMB, payloads.DiskMB:
+		default:
+			return fmt.Errorf("Invalid quota resource %q", q.Resource)
+		}
+
+		if q.Limit == 0 {
+			return fmt.Errorf("Invalid %s limit", q.Resource)
+		}
+	}
+
+	return nil
+}
+
+func tenantResources(t *types.Tenant) payloads.CiaoTenantResources {
+	tenantResource := payloads.CiaoTenantResources{
+		ID: t.ID,
+	}
+
+	for _, resource := range t.Resources {
+		switch resource.Rtype {
+		case instances:
+			tenantResource.InstanceLimit = resource.Limit
+			tenantResource.InstanceUsage = resource.Usage
+
+		case vcpu:
+			tenantResource.VCPULimit = resource.Limit
+			tenantResource.VCPUUsage = resource.Usage
+
+		case memory:
+			tenantResource.MemLimit = resource.Limit
+			tenantResource.MemUsage = resource.Usage
+
+		case disk:
+			tenantResource.DiskLimit = resource.Limit
+			tenantResource.DiskUsage = resource.Usage
+		}
+	}
+
+	return tenantResource
+}
+
+// setTenantQuotas updates the limits of the tenant resources.  The new
+// limits apply to the instances launched from then on.
+func (c *controller) setTenantQuotas(tenantID string, quotas []payloads.CiaoQuota) error {
+	t, err := c.ds.GetTenant(tenantID)
+	if err != nil {
+		return err
+	}
+
+	if t == nil {
+		return errors.New("Tenant Not Found")
+	}
+
+	for _, q := range quotas {
+		for _, r := range t.Resources {
+			if r.Rname != q.Resource {
+				continue
+			}
+
+			err = c.ds.AddLimit(tenantID, r.Rtype, q.Limit)
+			if err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	return nil
+}
+
+func (c *controller) createTenant(tenantID string, quotas []payloads.CiaoQuota) error {
+	var err error
+
+	if *noNetwork {
+		_, err = c.ds.AddTenant(tenantID)
+	} else {
+		err = c.addTenant(tenantID)
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.setTenantQuotas(tenantID, quotas)
+}
+
+func (c *controller) deleteTenant(tenantID string) error {
+	t, err := c.ds.GetTenant(tenantID)
+	if err != nil {
+		return err
+	}
+
+	if t == nil {
+		return errors.New("Tenant Not Found")
+	}
+
+	cnciID := t.CNCIID
+	cnciNodeID := t.CNCINodeID
+
+	err = c.ds.DeleteTenant(tenantID)
+	if err != nil {
+		return err
+	}
+
+	// The tenant does not need to wait for its CNCI to be deleted.
+	if cnciID != "" {
+		if cnciNodeID == "" {
+			glog.Warningf("Node of CNCI %s (%s) unknown, not deleting it", cnciID, t.CNCIIP)
+		} else {
+			go c.client.DeleteInstance(cnciID, cnciNodeID)
+		}
+	}
+
+	return nil
+}
@@ -32,6 +32,19 @@ type Workload struct {
 	ImageName   string                       `json:"-"`
 	Config      string                       `json:"-"`
 	Defaults    []payloads.RequestedResource `json:"-"`
+
+	// RequiredLabels and PreferredLabels are matched against the
+	// labels of the compute nodes when placing instances.
+	RequiredLabels  map[string]string `json:"-"`
+	PreferredLabels map[string]string `json:"-"`
+
+	// AntiAffinity keeps the instances of this workload that belong
+	// to the same tenant on separate compute nodes.
+	AntiAffinity bool `json:"-"`
+
+	// TenantID is set for the workloads only available to one tenant,
+	// such as the ones booting from a snapshot of its instances.
+	TenantID string `json:"-"`
 }
 
 // Instance contains information about an instance of a workload.
@@ -49,6 +62,39 @@ type Instance struct {
 	Usage      map[string]int `json:"-"`
 }
 
+// Volume contains information about a block storage volume.
+// InstanceID is empty unless the volume is attached to an instance.
+type Volume struct {
+	ID         string                `json:"id"`
+	TenantID   string                `json:"tenant_id"`
+	Size       int                   `json:"size"`
+	Format     payloads.VolumeFormat `json:"format"`
+	Path       string                `json:"-"`
+	State      string                `json:"status"`
+	InstanceID string                `json:"instance_id"`
+}
+
+// Image contains information about an image stored by the image service.
+type Image struct {
+	ID        string
+	Name      string
+	State     string
+	Size      int64
+	Checksum  string
+	CreatedAt time.Time
+
+	// SourceWorkload is set for images created from a snapshot of an
+	// instance.  It is the workload the instance was started from.
+	SourceWorkload string
+
+	// TenantID is the tenant owning the snapshotted instance, if any.
+	TenantID string
+
+	// UploadToken is sent to the node asked to snapshot an instance.
+	// The image data may only be uploaded by presenting this token.
+	UploadToken string
+}
+
 // SortedInstancesByID implements sort.Interface for Instance by ID string
 type SortedInstancesByID []*Instance
 
@@ -71,6 +117,11 @@ type Tenant struct {
 	CNCIMAC   string
 	CNCIIP    string
 	Resources []*Resource
+
+	// CNCINodeID is the node the CNCI was last reported running on.
+	// It is only known from the CNCI statistics and is not stored
+	// in the database.
+	CNCINodeID string
 }
 
 // Resource contains quota or limit information on a resource type.
@@ -162,3 +213,25 @@ type Node struct {
 	IPAddr   string `json:"ip_address"`
 	Hostname string `json:"hostname"`
 }
+
+// IdentityProject is a project of the local identity service.
+type IdentityProject struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// IdentityUser is a user of the local identity service.  Password is
+// the hash of the user password.
+type IdentityUser struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Password string `json:"-"`
+}
+
+// IdentityRole grants a role on a project to a local identity service
+// user.
+type IdentityRole struct {
+	UserID    string `json:"user_id"`
+	ProjectID string `json:"project_id"`
+	Role      string `json:"role"`
+}
@@ -0,0 +1,189 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/01org/ciao/ciao-controller/types"
+	"github.com/01org/ciao/payloads"
+	"github.com/docker/distribution/uuid"
+	"github.com/golang/glog"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+)
+
+// volumeDriver creates and deletes the storage backing volumes.
+type volumeDriver interface {
+	createVolume(id string, sizeGB int, format payloads.VolumeFormat) (string, error)
+	deleteVolume(path string) error
+}
+
+// localVolumeDriver stores volumes as files in a local directory.
+// The launchers open those files directly, so the directory must be
+// shared with all compute nodes, unless the controller and the
+// launcher run on the same node.
+type localVolumeDriver struct {
+	dir string
+}
+
+func (d *localVolumeDriver) createVolume(id string, sizeGB int, format payloads.VolumeFormat) (string, error) {
+	err := os.MkdirAll(d.dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	volumePath := path.Join(d.dir, id)
+	size := int64(sizeGB) << 30
+
+	switch format {
+	case payloads.RawVolume:
+		f, err := os.OpenFile(volumePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return "", err
+		}
+
+		// Raw volumes are sparse files
+		err = f.Truncate(size)
+		f.Close()
+		if err != nil {
+			os.Remove(volumePath)
+			return "", err
+		}
+	case payloads.Qcow2Volume:
+		cmd := exec.Command("qemu-img", "create", "-f", "qcow2", volumePath, strconv.FormatInt(size, 10))
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			os.Remove(volumePath)
+			return "", fmt.Errorf("Unable to create qcow2 volume: %v %s", err, out)
+		}
+	default:
+		return "", fmt.Errorf("Unsupported volume format %s", format)
+	}
+
+	return volumePath, nil
+}
+
+func (d *localVolumeDriver) deleteVolume(volumePath string) error {
+	err := os.Remove(volumePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (c *controller) createVolume(tenantID string, sizeGB int, format payloads.VolumeFormat) (*types.Volume, error) {
+	if sizeGB <= 0 {
+		return nil, errors.New("Invalid volume size")
+	}
+
+	if format == "" {
+		format = payloads.RawVolume
+	}
+
+	volume := &types.Volume{
+		ID:       uuid.Generate().String(),
+		TenantID: tenantID,
+		Size:     sizeGB,
+		Format:   format,
+		State:    payloads.VolumeStatusAvailable,
+	}
+
+	volumePath, err := c.volumes.createVolume(volume.ID, sizeGB, format)
+	if err != nil {
+		return nil, err
+	}
+	volume.Path = volumePath
+
+	err = c.ds.AddVolume(volume)
+	if err != nil {
+		c.volumes.deleteVolume(volumePath)
+		return nil, err
+	}
+
+	return volume, nil
+}
+
+func (c *controller) deleteVolume(volumeID string) error {
+	volume, err := c.ds.GetVolume(volumeID)
+	if err != nil {
+		return err
+	}
+
+	err = c.ds.DeleteVolume(volumeID)
+	if err != nil {
+		return err
+	}
+
+	err = c.volumes.deleteVolume(volume.Path)
+	if err != nil {
+		glog.Warningf("Unable to delete volume %s storage: %v", volumeID, err)
+	}
+
+	return nil
+}
+
+func (c *controller) attachVolume(volumeID string, instanceID string) error {
+	// get node id.  If there is no node id we can't send an attach
+	i, err := c.ds.GetInstance(instanceID)
+	if err != nil {
+		return err
+	}
+
+	if i.NodeID == "" {
+		return errors.New("Instance Not Assigned to Node")
+	}
+
+	volume, err := c.ds.GetVolume(volumeID)
+	if err != nil {
+		return err
+	}
+
+	if volume.TenantID != i.TenantID {
+		return errors.New("Volume Not Found")
+	}
+
+	err = c.ds.AttachVolume(volumeID, instanceID)
+	if err != nil {
+		return err
+	}
+
+	go c.client.AttachVolume(volume, instanceID, i.NodeID)
+	return nil
+}
+
+func (c *controller) detachVolume(volumeID string, instanceID string) error {
+	i, err := c.ds.GetInstance(instanceID)
+	if err != nil {
+		return err
+	}
+
+	if i.NodeID == "" {
+		return errors.New("Instance Not Assigned to Node")
+	}
+
+	err = c.ds.DetachVolume(volumeID, instanceID)
+	if err != nil {
+		return err
+	}
+
+	go c.client.DetachVolume(volumeID, instanceID, i.NodeID)
+	return nil
+}
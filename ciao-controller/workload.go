@@ -0,0 +1,125 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/01org/ciao/ciao-controller/types"
+	"github.com/01org/ciao/payloads"
+)
+
+// cnciDescription is the description of the internal CNCI workload, which
+// the datastore looks the CNCI workload up by.
+const cnciDescription = "CNCI"
+
+func workloadToCiaoWorkload(wl *types.Workload) payloads.CiaoWorkload {
+	w := payloads.CiaoWorkload{
+		ID:          wl.ID,
+		Description: wl.Description,
+		FWType:      payloads.Firmware(wl.FWType),
+		VMType:      wl.VMType,
+		ImageID:     wl.ImageID,
+		ImageName:   wl.ImageName,
+		Config:      wl.Config,
+		Defaults:    []payloads.CiaoWorkloadResource{},
+	}
+
+	for _, r := range wl.Defaults {
+		w.Defaults = append(w.Defaults, payloads.CiaoWorkloadResource{
+			Type:      r.Type,
+			Value:     r.Value,
+			Mandatory: r.Mandatory,
+		})
+	}
+
+	return w
+}
+
+func ciaoWorkloadToWorkload(w payloads.CiaoWorkload) types.Workload {
+	wl := types.Workload{
+		ID:          w.ID,
+		Description: w.Description,
+		FWType:      string(w.FWType),
+		VMType:      w.VMType,
+		ImageID:     w.ImageID,
+		ImageName:   w.ImageName,
+		Config:      w.Config,
+	}
+
+	for _, r := range w.Defaults {
+		wl.Defaults = append(wl.Defaults, payloads.RequestedResource{
+			Type:      r.Type,
+			Value:     r.Value,
+			Mandatory: r.Mandatory,
+		})
+	}
+
+	return wl
+}
+
+// validateWorkload checks that instances can be launched from wl.
+func validateWorkload(wl *types.Workload) error {
+	if wl.Description == "" {
+		return errors.New("Missing workload description")
+	}
+
+	if wl.Description == cnciDescription {
+		return fmt.Errorf("Workload description %s is reserved", cnciDescription)
+	}
+
+	switch wl.VMType {
+	case payloads.QEMU:
+		if wl.FWType != string(payloads.EFI) && wl.FWType != payloads.Legacy {
+			return fmt.Errorf("Invalid firmware type %q", wl.FWType)
+		}
+
+		if wl.ImageID == "" {
+			return errors.New("Missing image ID")
+		}
+	case payloads.Docker:
+		if wl.ImageName == "" {
+			return errors.New("Missing image name")
+		}
+	default:
+		return fmt.Errorf("Invalid VM type %q", wl.VMType)
+	}
+
+	resources := make(map[payloads.Resource]bool)
+	for _, r := range wl.Defaults {
+		switch r.Type {
+		case payloads.VCPUs, payloads.MemMB, payloads.DiskMB, payloads.NetworkNode:
+		default:
+			return fmt.Errorf("Invalid resource %q", r.Type)
+		}
+
+		if resources[r.Type] {
+			return fmt.Errorf("Duplicate resource %s", r.Type)
+		}
+		resources[r.Type] = true
+
+		if r.Value < 0 {
+			return fmt.Errorf("Invalid %s value %d", r.Type, r.Value)
+		}
+	}
+
+	if !resources[payloads.VCPUs] || !resources[payloads.MemMB] {
+		return errors.New("Workload resources not set")
+	}
+
+	return nil
+}
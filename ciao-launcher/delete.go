@@ -30,10 +30,6 @@ type deleteError struct {
 }
 
 func (de *deleteError) send(client *ssntpConn, instance string) {
-	if !client.isConnected() {
-		return
-	}
-
 	payload, err := generateDeleteError(instance, de)
 	if err != nil {
 		glog.Errorf("Unable to generate payload for delete_failure: %v", err)
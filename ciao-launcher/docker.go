@@ -426,6 +426,26 @@ func (d *docker) lostVM() {
 	d.prevCPUTime = -1
 }
 
+func (d *docker) attachVolume(volume *volumeConfig) error {
+	return errVolumesNotSupported
+}
+
+func (d *docker) detachVolume(volume string) error {
+	return errVolumesNotSupported
+}
+
+func (d *docker) snapshot(target string) error {
+	return errSnapshotsNotSupported
+}
+
+func (d *docker) exportDisk(target string) error {
+	return errSnapshotsNotSupported
+}
+
+func (d *docker) resize(cpus, memMB, diskMB int) error {
+	return errResizeNotSupported
+}
+
 //BUG(markus): Everything from here onwards should be in a different file.  It's confusing
 
 func dockerKillInstance(instanceDir string) {
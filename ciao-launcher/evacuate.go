@@ -0,0 +1,151 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/01org/ciao/payloads"
+	"github.com/golang/glog"
+)
+
+// migrateStopTimeout is how long we wait for a VM to stop before copying
+// its root disk.
+const migrateStopTimeout = time.Minute
+
+type evacuateCmd struct {
+	nextState  payloads.EvacuateNextState
+	migrations map[string]payloads.InstanceMigration
+	force      bool
+}
+
+/*
+Evacuating a node is driven by the controller.  Once the overseer has
+stopped accepting new instances we remove all of our instances one by one,
+sending an InstanceEvacuated event rather than an InstanceDeleted event
+for each of them.  It is then up to the controller to restart these
+instances on another node, reusing their UUIDs and network configuration.
+The overseer puts the node into MAINTENANCE when the last instance has gone.
+
+The EVACUATE command tells us which image to upload the root disk of each
+instance to.  An instance is powered down and its root disk uploaded before
+the instance is deleted, and the InstanceEvacuated event carries the image,
+so that the controller restarts the instance from it.  Unless the EVACUATE
+command is forced, the overseer refuses to evacuate a node hosting instances
+other than CNCIs, which hold no state, without a migration, and instances
+whose root disk cannot be uploaded are left on the node.  The evacuation is
+then aborted and the node accepts new instances again once the other
+instances have been evacuated.
+*/
+
+// processMigrate uploads a copy of the root disk of a stopped instance to
+// the image service, for the instance to be restarted from on another node.
+func processMigrate(vm virtualizer, cmd *insMigrateCmd) *snapshotError {
+	err := os.MkdirAll(snapshotsPath, 0755)
+	if err != nil {
+		return &snapshotError{err, payloads.SnapshotSnapshotFailure}
+	}
+
+	diskPath := path.Join(snapshotsPath, cmd.image)
+	defer func() { _ = os.Remove(diskPath) }()
+
+	err = vm.exportDisk(diskPath)
+	if err == errSnapshotsNotSupported {
+		return &snapshotError{err, payloads.SnapshotNotSupported}
+	} else if err != nil {
+		return &snapshotError{err, payloads.SnapshotSnapshotFailure}
+	}
+
+	err = uploadImage(cmd.image, cmd.uploadToken, diskPath)
+	if err != nil {
+		return &snapshotError{err, payloads.SnapshotUploadFailure}
+	}
+
+	return nil
+}
+
+// migrateInstance has the instance go routine of e upload the root disk
+// of e to the image it is to be restarted from.  A failed migration is
+// reported to the controller as a snapshot failure, so that the image
+// gets dropped.
+func migrateInstance(client *ssntpConn, e ovsEvacuateResult, m payloads.InstanceMigration, force bool) error {
+	errCh := make(chan *snapshotError)
+	e.cmdCh <- &insMigrateCmd{
+		image:       m.ImageUUID,
+		uploadToken: m.UploadToken,
+		force:       force,
+		errCh:       errCh,
+	}
+
+	se := <-errCh
+	if se == nil {
+		glog.Infof("Root disk of %s uploaded as image %s", e.instance, m.ImageUUID)
+		return nil
+	}
+
+	se.send(client, e.instance, m.ImageUUID)
+	return fmt.Errorf("Unable to migrate root disk[%s]: %v", string(se.code), se.err)
+}
+
+func processEvacuate(client *ssntpConn, cmd *evacuateCmd, ovsCh chan<- interface{}) {
+	targetCh := make(chan []ovsEvacuateResult)
+	ovsCh <- &ovsEvacuateCmd{cmd.nextState, cmd.migrations, cmd.force, targetCh}
+	evacuees := <-targetCh
+	if evacuees == nil {
+		return
+	}
+
+	glog.Infof("Evacuating %d instances, next state %s", len(evacuees), cmd.nextState)
+
+	kept := 0
+	for _, e := range evacuees {
+		var image string
+		if m, ok := cmd.migrations[e.instance]; ok {
+			err := migrateInstance(client, e, m, cmd.force)
+			if err == nil {
+				image = m.ImageUUID
+			} else if cmd.force {
+				glog.Warningf("%s of %s, restarting it from its image", err, e.instance)
+			} else {
+				glog.Warningf("%s of %s, keeping it", err, e.instance)
+				kept++
+				continue
+			}
+		}
+
+		e.cmdCh <- &insDeleteCmd{running: e.running}
+
+		errCh := make(chan error)
+		ovsCh <- &ovsRemoveCmd{
+			instance: e.instance,
+			evacuate: true,
+			image:    image,
+			errCh:    errCh,
+		}
+		err := <-errCh
+		if err != nil {
+			glog.Warningf("Unable to evacuate %s: %v", e.instance, err)
+		}
+	}
+
+	if kept > 0 {
+		ovsCh <- &ovsAbortEvacuationCmd{}
+	}
+}
@@ -0,0 +1,245 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"gopkg.in/yaml.v2"
+
+	"github.com/01org/ciao/payloads"
+)
+
+var errNoImageService = errors.New("No image service configured")
+
+// imageService holds the URL of the image service backing images are
+// downloaded from.  It is set from the image_service of the cluster
+// configuration.
+var imageService struct {
+	sync.RWMutex
+	url string
+}
+
+type imageDownload struct {
+	done chan struct{}
+	err  error
+}
+
+// imageDownloads tracks the downloads in progress, so that instances
+// started concurrently from the same missing image only download it once.
+var imageDownloads struct {
+	sync.Mutex
+	downloads map[string]*imageDownload
+}
+
+func init() {
+	imageDownloads.downloads = make(map[string]*imageDownload)
+}
+
+func updateImageService(payload []byte) {
+	var cfg payloads.Configure
+
+	if len(payload) == 0 {
+		return
+	}
+
+	err := yaml.Unmarshal(payload, &cfg)
+	if err != nil {
+		glog.Warningf("Unable to parse cluster configuration: %v", err)
+		return
+	}
+
+	url := strings.TrimSuffix(cfg.Configure.ImageService.URL, "/")
+
+	imageService.Lock()
+	if imageService.url != url {
+		glog.Infof("Image service set to %q", url)
+		imageService.url = url
+	}
+	imageService.Unlock()
+}
+
+func imageServiceURL() string {
+	imageService.RLock()
+	defer imageService.RUnlock()
+
+	return imageService.url
+}
+
+// The image service authenticates compute nodes through their SSNTP
+// certificate.
+func newImageClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+
+	if imageCACertPath != "" {
+		caPEM, err := ioutil.ReadFile(imageCACertPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		tlsConfig.RootCAs.AppendCertsFromPEM(caPEM)
+	}
+
+	cert, err := tls.LoadX509KeyPair(clientCertPath, clientCertPath)
+	if err != nil {
+		glog.Warningf("Unable to load client certificate for image service: %v", err)
+	} else {
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}, nil
+}
+
+func getImageMetadata(client *http.Client, url string) (*payloads.CiaoImage, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+
+	var image payloads.CiaoImage
+	err = json.NewDecoder(resp.Body).Decode(&image)
+	if err != nil {
+		return nil, err
+	}
+
+	return &image, nil
+}
+
+// fetchImage downloads an image into dir.  The image is written to a
+// temporary file which is only renamed once its checksum has been
+// verified, so a partial download is never mistaken for a backing image.
+func fetchImage(imageID, dir string) error {
+	if !uuidRegexp.MatchString(imageID) {
+		return fmt.Errorf("Invalid image id %s", imageID)
+	}
+
+	serviceURL := imageServiceURL()
+	if serviceURL == "" {
+		return errNoImageService
+	}
+
+	client, err := newImageClient()
+	if err != nil {
+		return err
+	}
+
+	imageURL := serviceURL + "/v2/images/" + imageID
+	image, err := getImageMetadata(client, imageURL)
+	if err != nil {
+		return err
+	}
+
+	if image.Status != payloads.ImageStatusActive {
+		return fmt.Errorf("Image %s is %s", imageID, image.Status)
+	}
+
+	resp, err := client.Get(imageURL + "/file")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s/file: %s", imageURL, resp.Status)
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".download-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tmp != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if checksum != image.Checksum {
+		return fmt.Errorf("Checksum mismatch for image %s: expected %s got %s",
+			imageID, image.Checksum, checksum)
+	}
+
+	err = os.Rename(tmp.Name(), path.Join(dir, imageID))
+	if err != nil {
+		return err
+	}
+	tmp = nil
+
+	glog.Infof("Downloaded image %s (%d bytes)", imageID, image.Size)
+
+	return nil
+}
+
+// downloadImage downloads an image from the image service into dir,
+// waiting for any download of the same image already in progress.
+func downloadImage(imageID, dir string) error {
+	imageDownloads.Lock()
+	dl, ok := imageDownloads.downloads[imageID]
+	if ok {
+		imageDownloads.Unlock()
+		<-dl.done
+		return dl.err
+	}
+
+	dl = &imageDownload{done: make(chan struct{})}
+	imageDownloads.downloads[imageID] = dl
+	imageDownloads.Unlock()
+
+	dl.err = fetchImage(imageID, dir)
+
+	imageDownloads.Lock()
+	delete(imageDownloads.downloads, imageID)
+	imageDownloads.Unlock()
+	close(dl.done)
+
+	return dl.err
+}
@@ -17,6 +17,7 @@
 package main
 
 import (
+	"fmt"
 	"path"
 	"sync"
 	"time"
@@ -54,13 +55,39 @@ type insStartCmd struct {
 	cfg      *vmConfig
 	rcvStamp time.Time
 }
-type insRestartCmd struct{}
+type insRestartCmd struct {
+	requestID uint64
+}
 type insDeleteCmd struct {
 	suicide bool
 	running ovsRunningState
 }
-type insStopCmd struct{}
+type insStopCmd struct {
+	requestID uint64
+}
 type insMonitorCmd struct{}
+type insAttachVolumeCmd struct {
+	volume *volumeConfig
+}
+type insDetachVolumeCmd struct {
+	volume string
+}
+type insSnapshotCmd struct {
+	image       string
+	uploadToken string
+}
+type insMigrateCmd struct {
+	image       string
+	uploadToken string
+	force       bool
+	errCh       chan<- *snapshotError
+}
+type insResizeCmd struct {
+	cpus    int
+	mem     int
+	disk    int
+	current []payloads.RequestedResource
+}
 
 /*
 This functions asks the server loop to kill the instance.  An instance
@@ -135,14 +162,14 @@ func (id *instanceData) restartCommand(cmd *insRestartCmd) {
 	if id.shuttingDown {
 		restartErr := &restartError{nil, payloads.RestartNoInstance}
 		glog.Errorf("Unable to restart instance[%s]", string(restartErr.code))
-		restartErr.send(&id.ac.ssntpConn, id.instance)
+		restartErr.send(&id.ac.ssntpConn, id.instance, cmd.requestID)
 		return
 	}
 
 	if id.monitorCh != nil {
 		restartErr := &restartError{nil, payloads.RestartAlreadyRunning}
 		glog.Errorf("Unable to restart instance[%s]", string(restartErr.code))
-		restartErr.send(&id.ac.ssntpConn, id.instance)
+		restartErr.send(&id.ac.ssntpConn, id.instance, cmd.requestID)
 		return
 	}
 
@@ -151,13 +178,14 @@ func (id *instanceData) restartCommand(cmd *insRestartCmd) {
 	if restartErr != nil {
 		glog.Errorf("Unable to restart instance[%s]: %v", string(restartErr.code),
 			restartErr.err)
-		restartErr.send(&id.ac.ssntpConn, id.instance)
+		restartErr.send(&id.ac.ssntpConn, id.instance, cmd.requestID)
 		return
 	}
 
 	id.connectedCh = make(chan struct{})
 	id.monitorCloseCh = make(chan struct{})
 	id.monitorCh = id.vm.monitorVM(id.monitorCloseCh, id.connectedCh, &id.instanceWg, false)
+	id.ac.sendAck(cmd.requestID)
 }
 
 func (id *instanceData) monitorCommand(cmd *insMonitorCmd) {
@@ -170,18 +198,145 @@ func (id *instanceData) stopCommand(cmd *insStopCmd) {
 	if id.shuttingDown {
 		stopErr := &stopError{nil, payloads.StopNoInstance}
 		glog.Errorf("Unable to stop instance[%s]", string(stopErr.code))
-		stopErr.send(&id.ac.ssntpConn, id.instance)
+		stopErr.send(&id.ac.ssntpConn, id.instance, cmd.requestID)
 		return
 	}
 
 	if id.monitorCh == nil {
 		stopErr := &stopError{nil, payloads.StopAlreadyStopped}
 		glog.Errorf("Unable to stop instance[%s]", string(stopErr.code))
-		stopErr.send(&id.ac.ssntpConn, id.instance)
+		stopErr.send(&id.ac.ssntpConn, id.instance, cmd.requestID)
 		return
 	}
 	glog.Infof("Powerdown %s", id.instance)
 	id.monitorCh <- virtualizerStopCmd
+	id.ac.sendAck(cmd.requestID)
+}
+
+// Volumes can only be hot plugged into, and unplugged from, connected VMs.
+func (id *instanceData) vmConnected() bool {
+	return !id.shuttingDown && id.monitorCh != nil && id.connectedCh == nil
+}
+
+func (id *instanceData) attachVolumeCommand(cmd *insAttachVolumeCmd) {
+	var attachErr *attachVolumeError
+
+	if id.vmConnected() {
+		attachErr = processAttachVolume(id.vm, id.instanceDir, id.cfg, cmd.volume)
+	} else {
+		attachErr = &attachVolumeError{nil, payloads.AttachVolumeNotRunning}
+	}
+
+	if attachErr != nil {
+		glog.Errorf("Unable to attach volume %s to instance[%s]: %v", cmd.volume.UUID,
+			string(attachErr.code), attachErr.err)
+		attachErr.send(&id.ac.ssntpConn, id.instance, cmd.volume.UUID)
+		return
+	}
+
+	glog.Infof("Volume %s attached to %s", cmd.volume.UUID, id.instance)
+}
+
+func (id *instanceData) detachVolumeCommand(cmd *insDetachVolumeCmd) {
+	var detachErr *detachVolumeError
+
+	if id.vmConnected() {
+		detachErr = processDetachVolume(id.vm, id.instanceDir, id.cfg, cmd.volume)
+	} else {
+		detachErr = &detachVolumeError{nil, payloads.DetachVolumeNotRunning}
+	}
+
+	if detachErr != nil {
+		glog.Errorf("Unable to detach volume %s from instance[%s]: %v", cmd.volume,
+			string(detachErr.code), detachErr.err)
+		detachErr.send(&id.ac.ssntpConn, id.instance, cmd.volume)
+		return
+	}
+
+	glog.Infof("Volume %s detached from %s", cmd.volume, id.instance)
+}
+
+func (id *instanceData) snapshotCommand(cmd *insSnapshotCmd) {
+	var snapshotErr *snapshotError
+
+	if id.vmConnected() {
+		snapshotErr = processSnapshot(id.vm, &id.ac.ssntpConn, id.instance, cmd)
+	} else {
+		snapshotErr = &snapshotError{nil, payloads.SnapshotNotRunning}
+	}
+
+	if snapshotErr != nil {
+		glog.Errorf("Unable to snapshot instance %s to image %s[%s]: %v", id.instance,
+			cmd.image, string(snapshotErr.code), snapshotErr.err)
+		snapshotErr.send(&id.ac.ssntpConn, id.instance, cmd.image)
+		return
+	}
+
+	glog.Infof("Instance %s snapshotted, uploading image %s", id.instance, cmd.image)
+}
+
+func (id *instanceData) resizeCommand(cmd *insResizeCmd) {
+	var resizeErr *resizeError
+
+	if id.shuttingDown {
+		resizeErr = &resizeError{nil, payloads.ResizeNoInstance}
+	} else if id.monitorCh != nil {
+		resizeErr = &resizeError{nil, payloads.ResizeNotStopped}
+	} else {
+		resizeErr = processResize(id.vm, id.instanceDir, id.cfg, cmd)
+	}
+
+	if resizeErr != nil {
+		glog.Errorf("Unable to resize instance %s[%s]: %v", id.instance,
+			string(resizeErr.code), resizeErr.err)
+		resizeErr.send(&id.ac.ssntpConn, id.instance, cmd.current)
+		return
+	}
+
+	glog.Infof("Instance %s resized: vcpus %d mem %d disk %d", id.instance,
+		id.cfg.Cpus, id.cfg.Mem, id.cfg.Disk)
+	id.ovsCh <- &ovsResizeCmd{id.instance, id.cfg.Cpus, id.cfg.Mem, id.cfg.Disk}
+	id.ovsCh <- &ovsStatusCmd{}
+}
+
+// migrateCommand powers the VM down, if it is running, and uploads a copy
+// of its root disk to the image service.  The VM is restarted if the
+// upload fails, unless the instance is to be evacuated regardless.
+func (id *instanceData) migrateCommand(cmd *insMigrateCmd) {
+	if id.shuttingDown {
+		cmd.errCh <- &snapshotError{nil, payloads.SnapshotNoInstance}
+		return
+	}
+
+	running := id.monitorCh != nil
+	if running {
+		glog.Infof("Powerdown %s before migrating its root disk", id.instance)
+		id.monitorCh <- virtualizerStopCmd
+		select {
+		case <-id.monitorCloseCh:
+			id.lostVM()
+		case <-time.After(migrateStopTimeout):
+			err := fmt.Errorf("Timed out waiting for %s to stop", id.instance)
+			cmd.errCh <- &snapshotError{err, payloads.SnapshotSnapshotFailure}
+			return
+		}
+	}
+
+	migrateErr := processMigrate(id.vm, cmd)
+	if migrateErr != nil && running && !cmd.force {
+		glog.Infof("Restarting %s, its root disk could not be migrated", id.instance)
+		restartErr := processRestart(id.instanceDir, id.vm, &id.ac.ssntpConn, id.cfg)
+		if restartErr != nil {
+			glog.Errorf("Unable to restart instance[%s]: %v", string(restartErr.code),
+				restartErr.err)
+		} else {
+			id.connectedCh = make(chan struct{})
+			id.monitorCloseCh = make(chan struct{})
+			id.monitorCh = id.vm.monitorVM(id.monitorCloseCh, id.connectedCh, &id.instanceWg, false)
+		}
+	}
+
+	cmd.errCh <- migrateErr
 }
 
 func (id *instanceData) deleteCommand(cmd *insDeleteCmd) bool {
@@ -245,6 +400,16 @@ func (id *instanceData) instanceCommand(cmd interface{}) bool {
 		id.monitorCommand(cmd)
 	case *insStopCmd:
 		id.stopCommand(cmd)
+	case *insAttachVolumeCmd:
+		id.attachVolumeCommand(cmd)
+	case *insDetachVolumeCmd:
+		id.detachVolumeCommand(cmd)
+	case *insSnapshotCmd:
+		id.snapshotCommand(cmd)
+	case *insResizeCmd:
+		id.resizeCommand(cmd)
+	case *insMigrateCmd:
+		id.migrateCommand(cmd)
 	case *insDeleteCmd:
 		if id.deleteCommand(cmd) {
 			return false
@@ -256,6 +421,21 @@ func (id *instanceData) instanceCommand(cmd interface{}) bool {
 	return true
 }
 
+func (id *instanceData) lostVM() {
+	id.vm.lostVM()
+	d, m, c := id.vm.stats()
+	id.ovsCh <- &ovsStatsUpdateCmd{id.instance, m, d, c}
+
+	glog.Infof("Lost VM instance: %s", id.instance)
+	id.monitorCloseCh = nil
+	id.connectedCh = nil
+	close(id.monitorCh)
+	id.monitorCh = nil
+	id.statsTimer = nil
+	id.ovsCh <- &ovsStateChange{id.instance, ovsStopped}
+	id.st = nil
+}
+
 func (id *instanceData) instanceLoop() {
 
 	id.vm.init(id.cfg, id.instanceDir)
@@ -278,18 +458,7 @@ DONE:
 			}
 		case <-id.monitorCloseCh:
 			// Means we've lost VM for now
-			id.vm.lostVM()
-			d, m, c := id.vm.stats()
-			id.ovsCh <- &ovsStatsUpdateCmd{id.instance, m, d, c}
-
-			glog.Infof("Lost VM instance: %s", id.instance)
-			id.monitorCloseCh = nil
-			id.connectedCh = nil
-			close(id.monitorCh)
-			id.monitorCh = nil
-			id.statsTimer = nil
-			id.ovsCh <- &ovsStateChange{id.instance, ovsStopped}
-			id.st = nil
+			id.lostVM()
 		case <-id.connectedCh:
 			id.logStartTrace()
 			id.connectedCh = nil
@@ -25,6 +25,8 @@ import (
 	"os/signal"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -81,6 +83,33 @@ func (f *uiFlag) Enabled() bool {
 	return string(*f) != "none"
 }
 
+// labelsFlag holds the labels reported to the scheduler, which matches
+// them against the placement constraints of new instances.
+type labelsFlag map[string]string
+
+func (f labelsFlag) String() string {
+	labels := make([]string, 0, len(f))
+	for key, value := range f {
+		labels = append(labels, key+"="+value)
+	}
+	sort.Strings(labels)
+
+	return strings.Join(labels, ",")
+}
+
+func (f labelsFlag) Set(val string) error {
+	for _, label := range strings.Split(val, ",") {
+		kv := strings.SplitN(label, "=", 2)
+		key := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || key == "" {
+			return fmt.Errorf("key=value[,key=value] expected")
+		}
+		f[key] = strings.TrimSpace(kv[1])
+	}
+
+	return nil
+}
+
 var serverURL string
 var serverCertPath string
 var clientCertPath string
@@ -91,6 +120,8 @@ var hardReset bool
 var diskLimit bool
 var memLimit bool
 var simulate bool
+var nodeLabels = make(labelsFlag)
+var imageCACertPath string
 var maxInstances = int(math.MaxInt32)
 
 func init() {
@@ -104,6 +135,8 @@ func init() {
 	flag.BoolVar(&diskLimit, "disk-limit", true, "Use disk usage limits")
 	flag.BoolVar(&memLimit, "mem-limit", true, "Use memory usage limits")
 	flag.BoolVar(&simulate, "simulation", false, "Launcher simulation")
+	flag.Var(nodeLabels, "labels", "Comma separated key=value node labels")
+	flag.StringVar(&imageCACertPath, "image-cacert", "", "CA certificate of the image service, system CAs if empty")
 }
 
 const (
@@ -139,6 +172,19 @@ func (s *ssntpConn) setStatus(status bool) {
 	s.Unlock()
 }
 
+// sendAck acknowledges the successful processing of a command sent
+// with a request ID.
+func (s *ssntpConn) sendAck(requestID uint64) {
+	if requestID == 0 || !s.isConnected() {
+		return
+	}
+
+	_, err := s.SendAck(requestID)
+	if err != nil {
+		glog.Errorf("Unable to send ACK: %v", err)
+	}
+}
+
 type agentClient struct {
 	ssntpConn
 	cmdCh chan *cmdWrapper
@@ -151,6 +197,7 @@ func (client *agentClient) DisconnectNotify() {
 
 func (client *agentClient) ConnectNotify() {
 	client.setStatus(true)
+	updateImageService(client.ClusterConfiguration())
 	client.cmdCh <- &cmdWrapper{"", &statusCmd{}}
 	glog.Info("connected")
 }
@@ -183,11 +230,11 @@ func (client *agentClient) CommandNotify(cmd ssntp.Command, frame *ssntp.Frame)
 				payloadErr.err,
 				payloads.RestartFailureReason(payloadErr.code),
 			}
-			restartError.send(&client.ssntpConn, "")
+			restartError.send(&client.ssntpConn, "", frame.RequestID)
 			glog.Errorf("Unable to parse YAML: %v", payloadErr.err)
 			return
 		}
-		client.cmdCh <- &cmdWrapper{instance, &insRestartCmd{}}
+		client.cmdCh <- &cmdWrapper{instance, &insRestartCmd{frame.RequestID}}
 	case ssntp.STOP:
 		instance, payloadErr := parseStopPayload(payload)
 		if payloadErr != nil {
@@ -195,11 +242,11 @@ func (client *agentClient) CommandNotify(cmd ssntp.Command, frame *ssntp.Frame)
 				payloadErr.err,
 				payloads.StopFailureReason(payloadErr.code),
 			}
-			stopError.send(&client.ssntpConn, "")
+			stopError.send(&client.ssntpConn, "", frame.RequestID)
 			glog.Errorf("Unable to parse YAML: %s", payloadErr)
 			return
 		}
-		client.cmdCh <- &cmdWrapper{instance, &insStopCmd{}}
+		client.cmdCh <- &cmdWrapper{instance, &insStopCmd{frame.RequestID}}
 	case ssntp.DELETE:
 		instance, payloadErr := parseDeletePayload(payload)
 		if payloadErr != nil {
@@ -212,6 +259,67 @@ func (client *agentClient) CommandNotify(cmd ssntp.Command, frame *ssntp.Frame)
 			return
 		}
 		client.cmdCh <- &cmdWrapper{instance, &insDeleteCmd{}}
+	case ssntp.EVACUATE:
+		evacuate, err := parseEvacuatePayload(payload)
+		if err != nil {
+			glog.Errorf("Unable to parse YAML: %v", err)
+			return
+		}
+		client.cmdCh <- &cmdWrapper{"", evacuate}
+	case ssntp.AttachVolume:
+		instance, volume, payloadErr := parseAttachVolumePayload(payload)
+		if payloadErr != nil {
+			attachError := &attachVolumeError{
+				payloadErr.err,
+				payloads.AttachVolumeFailureReason(payloadErr.code),
+			}
+			attachError.send(&client.ssntpConn, instance, "")
+			glog.Errorf("Unable to parse YAML: %v", payloadErr.err)
+			return
+		}
+		client.cmdCh <- &cmdWrapper{instance, &insAttachVolumeCmd{volume}}
+	case ssntp.DetachVolume:
+		instance, volume, payloadErr := parseDetachVolumePayload(payload)
+		if payloadErr != nil {
+			detachError := &detachVolumeError{
+				payloadErr.err,
+				payloads.DetachVolumeFailureReason(payloadErr.code),
+			}
+			detachError.send(&client.ssntpConn, instance, volume)
+			glog.Errorf("Unable to parse YAML: %v", payloadErr.err)
+			return
+		}
+		client.cmdCh <- &cmdWrapper{instance, &insDetachVolumeCmd{volume}}
+	case ssntp.Snapshot:
+		instance, snapshot, payloadErr := parseSnapshotPayload(payload)
+		if payloadErr != nil {
+			snapshotError := &snapshotError{
+				payloadErr.err,
+				payloads.SnapshotFailureReason(payloadErr.code),
+			}
+			snapshotError.send(&client.ssntpConn, instance, "")
+			glog.Errorf("Unable to parse YAML: %v", payloadErr.err)
+			return
+		}
+		client.cmdCh <- &cmdWrapper{instance, snapshot}
+	case ssntp.Resize:
+		instance, resize, payloadErr := parseResizePayload(payload)
+		if payloadErr != nil {
+			resizeError := &resizeError{
+				payloadErr.err,
+				payloads.ResizeFailureReason(payloadErr.code),
+			}
+			var current []payloads.RequestedResource
+			if resize != nil {
+				current = resize.current
+			}
+			resizeError.send(&client.ssntpConn, instance, current)
+			glog.Errorf("Unable to parse YAML: %v", payloadErr.err)
+			return
+		}
+		client.cmdCh <- &cmdWrapper{instance, resize}
+	case ssntp.CONFIGURE:
+		updateImageService(payload)
 	}
 }
 
@@ -244,6 +352,9 @@ func processCommand(client *ssntpConn, cmd *cmdWrapper, ovsCh chan<- interface{}
 	case *statusCmd:
 		ovsCh <- &ovsStatsStatusCmd{}
 		return
+	case *evacuateCmd:
+		processEvacuate(client, insCmd, ovsCh)
+		return
 	case *insStartCmd:
 		targetCh := make(chan ovsAddResult)
 		ovsCh <- &ovsAddCmd{cmd.instance, insCmd.cfg, targetCh}
@@ -272,7 +383,7 @@ func processCommand(client *ssntpConn, cmd *cmdWrapper, ovsCh chan<- interface{}
 		if target == nil {
 			glog.Errorf("Instance %s does not exist", cmd.instance)
 			se := stopError{nil, payloads.StopNoInstance}
-			se.send(client, cmd.instance)
+			se.send(client, cmd.instance, insCmd.requestID)
 			return
 		}
 	case *insRestartCmd:
@@ -280,7 +391,39 @@ func processCommand(client *ssntpConn, cmd *cmdWrapper, ovsCh chan<- interface{}
 		if target == nil {
 			glog.Errorf("Instance %s does not exist", cmd.instance)
 			re := restartError{nil, payloads.RestartNoInstance}
-			re.send(client, cmd.instance)
+			re.send(client, cmd.instance, insCmd.requestID)
+			return
+		}
+	case *insAttachVolumeCmd:
+		target = insCmdChannel(cmd.instance, ovsCh)
+		if target == nil {
+			glog.Errorf("Instance %s does not exist", cmd.instance)
+			ae := attachVolumeError{nil, payloads.AttachVolumeNoInstance}
+			ae.send(client, cmd.instance, insCmd.volume.UUID)
+			return
+		}
+	case *insDetachVolumeCmd:
+		target = insCmdChannel(cmd.instance, ovsCh)
+		if target == nil {
+			glog.Errorf("Instance %s does not exist", cmd.instance)
+			de := detachVolumeError{nil, payloads.DetachVolumeNoInstance}
+			de.send(client, cmd.instance, insCmd.volume)
+			return
+		}
+	case *insSnapshotCmd:
+		target = insCmdChannel(cmd.instance, ovsCh)
+		if target == nil {
+			glog.Errorf("Instance %s does not exist", cmd.instance)
+			se := snapshotError{nil, payloads.SnapshotNoInstance}
+			se.send(client, cmd.instance, insCmd.image)
+			return
+		}
+	case *insResizeCmd:
+		target = insCmdChannel(cmd.instance, ovsCh)
+		if target == nil {
+			glog.Errorf("Instance %s does not exist", cmd.instance)
+			re := resizeError{nil, payloads.ResizeNoInstance}
+			re.send(client, cmd.instance, insCmd.current)
 			return
 		}
 	default:
@@ -297,9 +440,10 @@ func processCommand(client *ssntpConn, cmd *cmdWrapper, ovsCh chan<- interface{}
 	if delCmd != nil {
 		errCh := make(chan error)
 		ovsCh <- &ovsRemoveCmd{
-			cmd.instance,
-			delCmd.suicide,
-			errCh}
+			instance: cmd.instance,
+			suicide:  delCmd.suicide,
+			errCh:    errCh,
+		}
 		<-errCh
 	}
 }
@@ -60,9 +60,26 @@ type ovsGetCmd struct {
 type ovsRemoveCmd struct {
 	instance string
 	suicide  bool
+	evacuate bool
+	image    string
 	errCh    chan<- error
 }
 
+type ovsEvacuateResult struct {
+	instance string
+	cmdCh    chan<- interface{}
+	running  ovsRunningState
+}
+
+type ovsEvacuateCmd struct {
+	nextState  payloads.EvacuateNextState
+	migrations map[string]payloads.InstanceMigration
+	force      bool
+	targetCh   chan<- []ovsEvacuateResult
+}
+
+type ovsAbortEvacuationCmd struct{}
+
 type ovsStateChange struct {
 	instance string
 	state    ovsRunningState
@@ -75,6 +92,13 @@ type ovsStatsUpdateCmd struct {
 	CPUUsage      int
 }
 
+type ovsResizeCmd struct {
+	instance string
+	cpus     int
+	memMB    int
+	diskMB   int
+}
+
 type ovsTraceFrame struct {
 	frame *ssntp.Frame
 }
@@ -108,6 +132,9 @@ type ovsInstanceState struct {
 	maxMemoryMB    int
 	sshIP          string
 	sshPort        int
+	cnci           bool
+
+	antiAffinityGroup string
 }
 
 type overseer struct {
@@ -123,6 +150,8 @@ type overseer struct {
 	diskSpaceAvailable int
 	memoryAvailable    int
 	traceFrames        *list.List
+	evacuating         bool
+	nextState          payloads.EvacuateNextState
 }
 
 type cnStats struct {
@@ -280,6 +309,11 @@ func getLoadAvg() int {
 
 func (ovs *overseer) roomAvailable(cfg *vmConfig) bool {
 
+	if ovs.evacuating {
+		glog.Warning("We're being evacuated.  No new instances accepted")
+		return false
+	}
+
 	if len(ovs.instances) >= maxInstances {
 		glog.Warningf("We're FULL.  Too many instances %d", len(ovs.instances))
 		return false
@@ -336,6 +370,13 @@ func (ovs *overseer) updateAvailableResources(cns *cnStats) {
 
 func (ovs *overseer) computeStatus() ssntp.Status {
 
+	if ovs.evacuating {
+		if len(ovs.instances) == 0 {
+			return ssntp.MAINTENANCE
+		}
+		return ssntp.FULL
+	}
+
 	if len(ovs.instances) >= maxInstances {
 		return ssntp.FULL
 	}
@@ -355,6 +396,24 @@ func (ovs *overseer) computeStatus() ssntp.Status {
 	return ssntp.READY
 }
 
+// antiAffinityGroups returns the anti-affinity groups of all the
+// instances known to the overseer, each group listed once.
+func (ovs *overseer) antiAffinityGroups() []string {
+	var groups []string
+	seen := make(map[string]bool)
+
+	for _, state := range ovs.instances {
+		group := state.antiAffinityGroup
+		if group == "" || seen[group] {
+			continue
+		}
+		seen[group] = true
+		groups = append(groups, group)
+	}
+
+	return groups
+}
+
 func (ovs *overseer) sendStatusCommand(cns *cnStats, status ssntp.Status) {
 	var s payloads.Ready
 
@@ -364,7 +423,10 @@ func (ovs *overseer) sendStatusCommand(cns *cnStats, status ssntp.Status) {
 	s.MemTotalMB, s.MemAvailableMB = cns.totalMemMB, cns.availableMemMB
 	s.Load = cns.load
 	s.CpusOnline = cns.cpusOnline
+	s.VCPUsAllocated = ovs.vcpusAllocated
 	s.DiskTotalMB, s.DiskAvailableMB = cns.totalDiskMB, cns.availableDiskMB
+	s.Labels = nodeLabels
+	s.AntiAffinityGroups = ovs.antiAffinityGroups()
 
 	payload, err := yaml.Marshal(&s)
 	if err != nil {
@@ -489,6 +551,46 @@ func (ovs *overseer) sendInstanceDeletedEvent(instance string) {
 	}
 }
 
+func (ovs *overseer) sendInstanceEvacuatedEvent(instance, image string) {
+	var event payloads.EventInstanceEvacuated
+
+	event.InstanceEvacuated.InstanceUUID = instance
+	event.InstanceEvacuated.NodeUUID = ovs.ac.ssntpConn.UUID()
+	event.InstanceEvacuated.Remaining = len(ovs.instances)
+	event.InstanceEvacuated.ImageUUID = image
+
+	payload, err := yaml.Marshal(&event)
+	if err != nil {
+		glog.Errorf("Unable to Marshall InstanceEvacuated %v", err)
+		return
+	}
+
+	_, err = ovs.ac.ssntpConn.SendEvent(ssntp.InstanceEvacuated, payload)
+	if err != nil {
+		glog.Errorf("Failed to send event command %v", err)
+		return
+	}
+}
+
+func (ovs *overseer) sendNodeEvacuatedEvent() {
+	var event payloads.EventNodeEvacuated
+
+	event.NodeEvacuated.NodeUUID = ovs.ac.ssntpConn.UUID()
+	event.NodeEvacuated.NextState = ovs.nextState
+
+	payload, err := yaml.Marshal(&event)
+	if err != nil {
+		glog.Errorf("Unable to Marshall NodeEvacuated %v", err)
+		return
+	}
+
+	_, err = ovs.ac.ssntpConn.SendEvent(ssntp.NodeEvacuated, payload)
+	if err != nil {
+		glog.Errorf("Failed to send event command %v", err)
+		return
+	}
+}
+
 func (ovs *overseer) processGetCommand(cmd *ovsGetCmd) {
 	glog.Infof("Overseer: looking for instance %s", cmd.instance)
 	var insState ovsGetResult
@@ -525,6 +627,9 @@ func (ovs *overseer) processAddCommand(cmd *ovsAddCmd) {
 			maxMemoryMB:    cfg.Mem,
 			sshIP:          cfg.ConcIP,
 			sshPort:        cfg.SSHPort,
+			cnci:           cfg.NetworkNode,
+
+			antiAffinityGroup: cfg.AntiAffinityGroup,
 		}
 	} else {
 		canAdd = false
@@ -556,17 +661,73 @@ func (ovs *overseer) processRemoveCommand(cmd *ovsRemoveCmd) {
 	}
 
 	delete(ovs.instances, cmd.instance)
-	if !cmd.suicide {
+	if cmd.evacuate {
+		ovs.sendInstanceEvacuatedEvent(cmd.instance, cmd.image)
+	} else if !cmd.suicide {
 		ovs.sendInstanceDeletedEvent(cmd.instance)
 	}
+
+	if ovs.evacuating && len(ovs.instances) == 0 {
+		ovs.completeEvacuation()
+	}
 	cmd.errCh <- nil
 }
 
-func (ovs *overseer) processStatusCommand(cmd *ovsStatusCmd) {
-	glog.Info("Overseer: Recieved Status Command")
-	if !ovs.ac.ssntpConn.isConnected() {
+func (ovs *overseer) processEvacuateCommand(cmd *ovsEvacuateCmd) {
+	glog.Infof("Overseer: evacuating, next state %s", cmd.nextState)
+	if ovs.evacuating {
+		glog.Warning("Overseer: evacuation already in progress")
+		cmd.targetCh <- nil
 		return
 	}
+
+	if !cmd.force {
+		for instance, target := range ovs.instances {
+			if _, ok := cmd.migrations[instance]; ok || target.cnci {
+				continue
+			}
+
+			glog.Warningf("Overseer: refusing to evacuate, the root disk of %s would be lost",
+				instance)
+			cmd.targetCh <- nil
+			return
+		}
+	}
+
+	ovs.evacuating = true
+	ovs.nextState = cmd.nextState
+
+	evacuees := make([]ovsEvacuateResult, 0, len(ovs.instances))
+	for instance, target := range ovs.instances {
+		evacuees = append(evacuees, ovsEvacuateResult{instance, target.cmdCh, target.running})
+	}
+
+	if len(ovs.instances) == 0 {
+		ovs.completeEvacuation()
+	} else {
+		// Let the scheduler know we're no longer accepting new instances
+		ovs.processStatusCommand(&ovsStatusCmd{})
+	}
+
+	cmd.targetCh <- evacuees
+}
+
+// processAbortEvacuationCommand lets the node accept new instances again
+// once some of its instances could not be evacuated.
+func (ovs *overseer) processAbortEvacuationCommand(cmd *ovsAbortEvacuationCmd) {
+	glog.Warningf("Overseer: evacuation aborted, %d instances left", len(ovs.instances))
+	ovs.evacuating = false
+	ovs.processStatusCommand(&ovsStatusCmd{})
+}
+
+func (ovs *overseer) completeEvacuation() {
+	glog.Infof("Overseer: node evacuated, entering maintenance")
+	ovs.sendNodeEvacuatedEvent()
+	ovs.processStatusCommand(&ovsStatusCmd{})
+}
+
+func (ovs *overseer) processStatusCommand(cmd *ovsStatusCmd) {
+	glog.Info("Overseer: Recieved Status Command")
 	cns := getStats()
 	ovs.updateAvailableResources(cns)
 	ovs.sendStatusCommand(cns, ovs.computeStatus())
@@ -574,9 +735,6 @@ func (ovs *overseer) processStatusCommand(cmd *ovsStatusCmd) {
 
 func (ovs *overseer) processStatsStatusCommand(cmd *ovsStatsStatusCmd) {
 	glog.Info("Overseer: Recieved StatsStatus Command")
-	if !ovs.ac.ssntpConn.isConnected() {
-		return
-	}
 	cns := getStats()
 	ovs.updateAvailableResources(cns)
 	status := ovs.computeStatus()
@@ -592,6 +750,22 @@ func (ovs *overseer) processStateChangeCommand(cmd *ovsStateChange) {
 	}
 }
 
+func (ovs *overseer) processResizeCommand(cmd *ovsResizeCmd) {
+	glog.Infof("Overseer: resizing %s", cmd.instance)
+	target := ovs.instances[cmd.instance]
+	if target == nil {
+		return
+	}
+
+	ovs.vcpusAllocated += cmd.cpus - target.maxVCPUs
+	ovs.memoryAllocated += cmd.memMB - target.maxMemoryMB
+	ovs.diskSpaceAllocated += cmd.diskMB - target.maxDiskUsageMB
+
+	target.maxVCPUs = cmd.cpus
+	target.maxMemoryMB = cmd.memMB
+	target.maxDiskUsageMB = cmd.diskMB
+}
+
 func (ovs *overseer) processStatusUpdateCommand(cmd *ovsStatsUpdateCmd) {
 	if glog.V(1) {
 		glog.Infof("STATS Update for %s: Mem %d Disk %d Cpu %d",
@@ -619,6 +793,10 @@ func (ovs *overseer) processCommand(cmd interface{}) {
 		ovs.processAddCommand(cmd)
 	case *ovsRemoveCmd:
 		ovs.processRemoveCommand(cmd)
+	case *ovsEvacuateCmd:
+		ovs.processEvacuateCommand(cmd)
+	case *ovsAbortEvacuationCmd:
+		ovs.processAbortEvacuationCommand(cmd)
 	case *ovsStatusCmd:
 		ovs.processStatusCommand(cmd)
 	case *ovsStatsStatusCmd:
@@ -627,6 +805,8 @@ func (ovs *overseer) processCommand(cmd interface{}) {
 		ovs.processStateChangeCommand(cmd)
 	case *ovsStatsUpdateCmd:
 		ovs.processStatusUpdateCommand(cmd)
+	case *ovsResizeCmd:
+		ovs.processResizeCommand(cmd)
 	case *ovsTraceFrame:
 		ovs.processTraceFrameCommand(cmd)
 	default:
@@ -721,6 +901,9 @@ func startOverseer(wg *sync.WaitGroup, ac *agentClient) chan<- interface{} {
 			maxMemoryMB:    cfg.Mem,
 			sshIP:          cfg.ConcIP,
 			sshPort:        cfg.SSHPort,
+			cnci:           cfg.NetworkNode,
+
+			antiAffinityGroup: cfg.AntiAffinityGroup,
 		}
 		toMonitor = append(toMonitor, target)
 
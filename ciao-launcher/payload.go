@@ -57,6 +57,16 @@ type vmConfig struct {
 	ConcUUID    string
 	VnicUUID    string
 	SSHPort     int
+
+	AntiAffinityGroup string
+
+	Volumes []volumeConfig
+}
+
+type volumeConfig struct {
+	UUID   string
+	Path   string
+	Format payloads.VolumeFormat
 }
 
 type extractedDoc struct {
@@ -176,6 +186,16 @@ func parseStartPayload(data []byte) (*vmConfig, *payloadError) {
 		}
 	}
 
+	// Volumes attached to an instance restarted on this node
+	var volumes []volumeConfig
+	for _, v := range start.Volumes {
+		volume, err := parseVolume(v.VolumeUUID, v.Path, v.Format)
+		if err != nil {
+			return nil, &payloadError{err, payloads.InvalidData}
+		}
+		volumes = append(volumes, *volume)
+	}
+
 	net := &start.Networking
 	vnicIP := strings.TrimSpace(net.PrivateIP)
 	sshPort := computeSSHPort(networkNode, vnicIP)
@@ -196,6 +216,10 @@ func parseStartPayload(data []byte) (*vmConfig, *payloadError) {
 		ConcUUID:    strings.TrimSpace(net.ConcentratorUUID),
 		VnicUUID:    strings.TrimSpace(net.VnicUUID),
 		SSHPort:     sshPort,
+
+		AntiAffinityGroup: strings.TrimSpace(start.Constraints.AntiAffinityGroup),
+
+		Volumes: volumes,
 	}, nil
 }
 
@@ -231,6 +255,42 @@ func generateDeleteError(instance string, deleteErr *deleteError) (out []byte, e
 	return yaml.Marshal(df)
 }
 
+func generateAttachVolumeError(instance, volume string, attachErr *attachVolumeError) (out []byte, err error) {
+	af := &payloads.ErrorAttachVolumeFailure{
+		InstanceUUID: instance,
+		VolumeUUID:   volume,
+		Reason:       attachErr.code,
+	}
+	return yaml.Marshal(af)
+}
+
+func generateDetachVolumeError(instance, volume string, detachErr *detachVolumeError) (out []byte, err error) {
+	df := &payloads.ErrorDetachVolumeFailure{
+		InstanceUUID: instance,
+		VolumeUUID:   volume,
+		Reason:       detachErr.code,
+	}
+	return yaml.Marshal(df)
+}
+
+func generateSnapshotError(instance, image string, snapshotErr *snapshotError) (out []byte, err error) {
+	sf := &payloads.ErrorSnapshotFailure{
+		InstanceUUID: instance,
+		ImageUUID:    image,
+		Reason:       snapshotErr.code,
+	}
+	return yaml.Marshal(sf)
+}
+
+func generateResizeError(instance string, resources []payloads.RequestedResource, resizeErr *resizeError) (out []byte, err error) {
+	rf := &payloads.ErrorResizeFailure{
+		InstanceUUID: instance,
+		Reason:       resizeErr.code,
+		Resources:    resources,
+	}
+	return yaml.Marshal(rf)
+}
+
 func generateNetEventPayload(ssntpEvent *libsnnet.SsntpEventInfo, agentUUID string) ([]byte, error) {
 	var event interface{}
 	var eventData *payloads.TenantAddedEvent
@@ -309,6 +369,203 @@ func parseStopPayload(data []byte) (string, *payloadError) {
 	return instance, nil
 }
 
+func parseAttachVolumePayload(data []byte) (string, *volumeConfig, *payloadError) {
+	var clouddata payloads.AttachVolume
+
+	err := yaml.Unmarshal(data, &clouddata)
+	if err != nil {
+		return "", nil, &payloadError{err, payloads.AttachVolumeInvalidPayload}
+	}
+
+	attach := &clouddata.Attach
+	instance := strings.TrimSpace(attach.InstanceUUID)
+	if !uuidRegexp.MatchString(instance) {
+		err = fmt.Errorf("Invalid instance id received: %s", instance)
+		return "", nil, &payloadError{err, payloads.AttachVolumeInvalidData}
+	}
+
+	volume, err := parseVolume(attach.VolumeUUID, attach.Path, attach.Format)
+	if err != nil {
+		return instance, nil, &payloadError{err, payloads.AttachVolumeInvalidData}
+	}
+
+	return instance, volume, nil
+}
+
+func parseVolume(uuid string, volumePath string, format payloads.VolumeFormat) (*volumeConfig, error) {
+	volume := &volumeConfig{
+		UUID:   strings.TrimSpace(uuid),
+		Path:   strings.TrimSpace(volumePath),
+		Format: format,
+	}
+
+	if !uuidRegexp.MatchString(volume.UUID) {
+		return nil, fmt.Errorf("Invalid volume id received: %s", volume.UUID)
+	}
+
+	// qemu drive options are comma separated
+	if !path.IsAbs(volume.Path) || strings.Contains(volume.Path, ",") {
+		return nil, fmt.Errorf("Invalid volume path received: %s", volume.Path)
+	}
+
+	switch volume.Format {
+	case "":
+		volume.Format = payloads.RawVolume
+	case payloads.RawVolume, payloads.Qcow2Volume:
+	default:
+		return nil, fmt.Errorf("Invalid volume format received: %s", volume.Format)
+	}
+
+	return volume, nil
+}
+
+func parseDetachVolumePayload(data []byte) (string, string, *payloadError) {
+	var clouddata payloads.DetachVolume
+
+	err := yaml.Unmarshal(data, &clouddata)
+	if err != nil {
+		return "", "", &payloadError{err, payloads.DetachVolumeInvalidPayload}
+	}
+
+	instance := strings.TrimSpace(clouddata.Detach.InstanceUUID)
+	if !uuidRegexp.MatchString(instance) {
+		err = fmt.Errorf("Invalid instance id received: %s", instance)
+		return "", "", &payloadError{err, payloads.DetachVolumeInvalidData}
+	}
+
+	volume := strings.TrimSpace(clouddata.Detach.VolumeUUID)
+	if !uuidRegexp.MatchString(volume) {
+		err = fmt.Errorf("Invalid volume id received: %s", volume)
+		return instance, "", &payloadError{err, payloads.DetachVolumeInvalidData}
+	}
+
+	return instance, volume, nil
+}
+
+func parseSnapshotPayload(data []byte) (string, *insSnapshotCmd, *payloadError) {
+	var clouddata payloads.Snapshot
+
+	err := yaml.Unmarshal(data, &clouddata)
+	if err != nil {
+		return "", nil, &payloadError{err, payloads.SnapshotInvalidPayload}
+	}
+
+	instance := strings.TrimSpace(clouddata.Snapshot.InstanceUUID)
+	if !uuidRegexp.MatchString(instance) {
+		err = fmt.Errorf("Invalid instance id received: %s", instance)
+		return "", nil, &payloadError{err, payloads.SnapshotInvalidData}
+	}
+
+	image := strings.TrimSpace(clouddata.Snapshot.ImageUUID)
+	if !uuidRegexp.MatchString(image) {
+		err = fmt.Errorf("Invalid image id received: %s", image)
+		return instance, nil, &payloadError{err, payloads.SnapshotInvalidData}
+	}
+
+	return instance, &insSnapshotCmd{
+		image:       image,
+		uploadToken: strings.TrimSpace(clouddata.Snapshot.UploadToken),
+	}, nil
+}
+
+func parseResizePayload(data []byte) (string, *insResizeCmd, *payloadError) {
+	var clouddata payloads.Resize
+
+	err := yaml.Unmarshal(data, &clouddata)
+	if err != nil {
+		return "", nil, &payloadError{err, payloads.ResizeInvalidPayload}
+	}
+
+	resize := &clouddata.Resize
+	cmd := &insResizeCmd{
+		current: resize.CurrentResources,
+	}
+
+	instance := strings.TrimSpace(resize.InstanceUUID)
+	if !uuidRegexp.MatchString(instance) {
+		err = fmt.Errorf("Invalid instance id received: %s", instance)
+		return "", cmd, &payloadError{err, payloads.ResizeInvalidData}
+	}
+
+	for _, r := range resize.RequestedResources {
+		switch r.Type {
+		case payloads.VCPUs:
+			cmd.cpus = r.Value
+		case payloads.MemMB:
+			cmd.mem = r.Value
+		case payloads.DiskMB:
+			cmd.disk = r.Value
+		}
+	}
+
+	if cmd.cpus < 0 || cmd.mem <= 0 || cmd.disk < 0 {
+		err = fmt.Errorf("Invalid resources received: vcpus %d mem_mb %d disk_mb %d",
+			cmd.cpus, cmd.mem, cmd.disk)
+		return instance, cmd, &payloadError{err, payloads.ResizeInvalidData}
+	}
+
+	return instance, cmd, nil
+}
+
+func parseEvacuatePayload(data []byte) (*evacuateCmd, error) {
+	var clouddata payloads.Evacuate
+
+	err := yaml.Unmarshal(data, &clouddata)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := &evacuateCmd{
+		nextState:  clouddata.Evacuate.NextState,
+		migrations: make(map[string]payloads.InstanceMigration),
+		force:      clouddata.Evacuate.Force,
+	}
+
+	for _, m := range clouddata.Evacuate.Migrations {
+		if m.InstanceUUID == "" || m.ImageUUID == "" {
+			return nil, fmt.Errorf("Invalid migration received: %v", m)
+		}
+		cmd.migrations[m.InstanceUUID] = m
+	}
+
+	switch cmd.nextState {
+	case "":
+		cmd.nextState = payloads.EvacuateMaintenance
+		return cmd, nil
+	case payloads.EvacuateMaintenance, payloads.EvacuateShutdown,
+		payloads.EvacuateUpdate, payloads.EvacuateReboot:
+		return cmd, nil
+	}
+
+	return nil, fmt.Errorf("Invalid next state received: %s", cmd.nextState)
+}
+
+// saveVMConfig overwrites the state file of an existing instance.  The
+// new state is written to a temporary file first, so that a crash never
+// leaves a truncated state file behind.
+func saveVMConfig(instanceDir string, cfg *vmConfig) error {
+	cfgFilePath := path.Join(instanceDir, instanceState)
+	tmpFilePath := cfgFilePath + ".tmp"
+	cfgFile, err := os.OpenFile(tmpFilePath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+	if err != nil {
+		glog.Errorf("Unable to create state file %v", err)
+		return err
+	}
+
+	enc := gob.NewEncoder(cfgFile)
+	err = enc.Encode(cfg)
+	if closeErr := cfgFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		glog.Errorf("Failed to store state information %v", err)
+		_ = os.Remove(tmpFilePath)
+		return err
+	}
+
+	return os.Rename(tmpFilePath, cfgFilePath)
+}
+
 func loadVMConfig(instanceDir string) (*vmConfig, error) {
 	cfgFilePath := path.Join(instanceDir, instanceState)
 	cfgFile, err := os.Open(cfgFilePath)
@@ -62,6 +62,7 @@ type qemu struct {
 	prevSampleTime time.Time
 	isoPath        string
 	ciaoISOPath    string
+	qmpCmdCh       chan *qmpCmd
 }
 
 func (q *qemu) init(cfg *vmConfig, instanceDir string) {
@@ -242,10 +243,31 @@ func (q *qemu) createRootfs() error {
 	return cmd.Run()
 }
 
+// resize only needs to grow the root disk, the new vcpus and memory
+// are picked up from q.cfg by the next startVM.
+func (q *qemu) resize(cpus, memMB, diskMB int) error {
+	if diskMB <= q.cfg.Disk {
+		return nil
+	}
+
+	vmImage := path.Join(q.instanceDir, "image.qcow2")
+	glog.Infof("Resizing qcow image %s to %dM", vmImage, diskMB)
+
+	params := []string{"resize", vmImage, fmt.Sprintf("%dM", diskMB)}
+	out, err := exec.Command("qemu-img", params...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Unable to resize %s: %v: %s", vmImage, err, out)
+	}
+
+	return nil
+}
+
 func (q *qemu) checkBackingImage() error {
 	backingImage := path.Join(imagesPath, q.cfg.Image)
 	_, err := os.Stat(backingImage)
-	if err != nil {
+	if os.IsNotExist(err) {
+		return errImageNotFound
+	} else if err != nil {
 		return fmt.Errorf("Backing Image does not exist: %v", err)
 	}
 
@@ -265,7 +287,7 @@ func (q *qemu) checkBackingImage() error {
 }
 
 func (q *qemu) downloadBackingImage() error {
-	return fmt.Errorf("Not supported yet!")
+	return downloadImage(q.cfg.Image, imagesPath)
 }
 
 func (q *qemu) createImage(bridge string, userData, metaData []byte) error {
@@ -485,6 +507,7 @@ func (q *qemu) startVM(vnicName, ipAddress string) error {
 		ciaoParam := fmt.Sprintf("file=%s,if=virtio,media=cdrom", q.ciaoISOPath)
 		params = append(params, "-drive", ciaoParam)
 	}
+	params = append(params, volumeParams(q.cfg.Volumes)...)
 
 	if vnicName != "" {
 		if q.cfg.NetworkNode {
@@ -564,6 +587,7 @@ func (q *qemu) lostVM() {
 	}
 	q.pid = 0
 	q.prevCPUTime = -1
+	q.qmpCmdCh = nil
 }
 
 func readLoop(instance string, eventCh chan string, scanner *bufio.Scanner) {
@@ -615,10 +639,18 @@ func connectToVM(instance, instanceDir string, eventCh chan string, connectedCh
 	return retval, nil
 }
 
-func qmpLoop(instance string, conn net.Conn, qmpChannel chan string, eventCh chan string, closedCh chan struct{}) (chan string, chan struct{}) {
+func qmpLoop(instance string, conn net.Conn, qmpChannel chan string, qmpCmdCh chan *qmpCmd,
+	eventCh chan string, closedCh chan struct{}) (chan string, chan struct{}) {
+	var runningCmd *qmpCmd
 	waitForShutdown := false
 	quitting := false
 
+	defer func() {
+		if runningCmd != nil {
+			runningCmd.resultCh <- errQMPConnectionLost
+		}
+	}()
+
 DONE:
 	for {
 		select {
@@ -640,8 +672,22 @@ DONE:
 					waitForShutdown = true
 				}
 			}
+		case cmd := <-qmpCmdCh:
+			if runningCmd != nil || waitForShutdown || eventCh == nil {
+				cmd.resultCh <- fmt.Errorf("Instance %s is not ready for QMP commands", instance)
+				continue
+			}
+			if err := cmd.next(conn); err != nil {
+				cmd.resultCh <- err
+				continue
+			}
+			runningCmd = cmd
 		case event, ok := <-eventCh:
 			if !ok {
+				if runningCmd != nil {
+					runningCmd.resultCh <- errQMPConnectionLost
+					runningCmd = nil
+				}
 				close(closedCh)
 				closedCh = nil
 				eventCh = nil
@@ -654,6 +700,9 @@ DONE:
 				}
 				continue
 			}
+			if runningCmd != nil && runningCmd.response(conn, event) {
+				runningCmd = nil
+			}
 			if waitForShutdown == true && strings.Contains(event, "return") {
 				waitForShutdown = false
 				if quitting {
@@ -666,8 +715,8 @@ DONE:
 	return eventCh, closedCh
 }
 
-func qmpConnect(qmpChannel chan string, instance, instanceDir string, closedCh chan struct{},
-	connectedCh chan struct{}, wg *sync.WaitGroup, boot bool) {
+func qmpConnect(qmpChannel chan string, qmpCmdCh chan *qmpCmd, instance, instanceDir string,
+	closedCh chan struct{}, connectedCh chan struct{}, wg *sync.WaitGroup, boot bool) {
 	var conn net.Conn
 
 	defer func() {
@@ -685,7 +734,7 @@ func qmpConnect(qmpChannel chan string, instance, instanceDir string, closedCh c
 		return
 	}
 
-	eventCh, closedCh = qmpLoop(instance, conn, qmpChannel, eventCh, closedCh)
+	eventCh, closedCh = qmpLoop(instance, conn, qmpChannel, qmpCmdCh, eventCh, closedCh)
 
 	_ = conn.Close()
 
@@ -710,8 +759,9 @@ func qmpConnect(qmpChannel chan string, instance, instanceDir string, closedCh c
 func (q *qemu) monitorVM(closedCh chan struct{}, connectedCh chan struct{},
 	wg *sync.WaitGroup, boot bool) chan string {
 	qmpChannel := make(chan string)
+	q.qmpCmdCh = make(chan *qmpCmd)
 	wg.Add(1)
-	go qmpConnect(qmpChannel, q.cfg.Instance, q.instanceDir, closedCh, connectedCh, wg, boot)
+	go qmpConnect(qmpChannel, q.qmpCmdCh, q.cfg.Instance, q.instanceDir, closedCh, connectedCh, wg, boot)
 	return qmpChannel
 }
 
@@ -0,0 +1,187 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const qmpTimeout = 30 * time.Second
+
+var errQMPConnectionLost = errors.New("Lost connection to qemu domain socket")
+
+// qmpCmd is a sequence of QMP commands, e.g., hot plugging a volume.  The
+// commands are run by the monitor go routine, which owns the QMP
+// connection, one at a time, stopping at the first one that fails.
+// If event is set, the sequence only completes once qemu has also
+// emitted that event, which is how qemu reports the end of block jobs.
+// The event is watched for as soon as the first command is sent, as it
+// may well be emitted before the last command returns.  The result of
+// the sequence is sent on resultCh.
+type qmpCmd struct {
+	commands  []string
+	event     string
+	eventSeen bool
+	eventErr  error
+	resultCh  chan error
+}
+
+func (cmd *qmpCmd) next(conn net.Conn) error {
+	_, err := fmt.Fprintln(conn, cmd.commands[0])
+	return err
+}
+
+// response processes a line read from the QMP socket.  It returns true
+// once the sequence is complete and its result has been sent.
+func (cmd *qmpCmd) response(conn net.Conn, line string) bool {
+	if cmd.event != "" && !cmd.eventSeen {
+		event, err := parseQMPEvent(line)
+		if event == cmd.event {
+			cmd.eventSeen = true
+			cmd.eventErr = err
+		}
+	}
+
+	isResponse, err := parseQMPResponse(line)
+	if !isResponse {
+		if len(cmd.commands) == 0 && cmd.eventSeen {
+			cmd.resultCh <- cmd.eventErr
+			return true
+		}
+		return false
+	}
+
+	cmd.commands = cmd.commands[1:]
+	if err == nil && len(cmd.commands) > 0 {
+		err = cmd.next(conn)
+		if err == nil {
+			return false
+		}
+	}
+
+	if err == nil && cmd.event != "" {
+		if !cmd.eventSeen {
+			return false
+		}
+		err = cmd.eventErr
+	}
+
+	cmd.resultCh <- err
+	return true
+}
+
+// parseQMPResponse returns true if line is the response to a QMP command,
+// as opposed to an asynchronous event, along with the error reported by
+// that command.
+func parseQMPResponse(line string) (bool, error) {
+	var resp struct {
+		Return json.RawMessage `json:"return"`
+		Error  *struct {
+			Class string `json:"class"`
+			Desc  string `json:"desc"`
+		} `json:"error"`
+	}
+
+	if err := json.Unmarshal([]byte(line), &resp); err != nil {
+		return false, nil
+	}
+
+	if resp.Error != nil {
+		return true, fmt.Errorf("%s: %s", resp.Error.Class, resp.Error.Desc)
+	}
+
+	if resp.Return == nil {
+		return false, nil
+	}
+
+	// human-monitor-command returns the output of the HMP command,
+	// which is either empty or OK on success.
+	var output string
+	if err := json.Unmarshal(resp.Return, &output); err == nil {
+		output = strings.TrimSpace(output)
+		if output != "" && output != "OK" {
+			return true, errors.New(output)
+		}
+	}
+
+	return true, nil
+}
+
+// parseQMPEvent returns the name of the QMP event in line, or an empty
+// string if line is not an event, along with the error reported in the
+// event data, as block job events do.
+func parseQMPEvent(line string) (string, error) {
+	var event struct {
+		Event string `json:"event"`
+		Data  struct {
+			Device string `json:"device"`
+			Error  string `json:"error"`
+		} `json:"data"`
+	}
+
+	if err := json.Unmarshal([]byte(line), &event); err != nil {
+		return "", nil
+	}
+
+	if event.Data.Error != "" {
+		return event.Event, fmt.Errorf("%s: %s", event.Data.Device, event.Data.Error)
+	}
+
+	return event.Event, nil
+}
+
+func qmpCommand(command string, args map[string]string) string {
+	cmd := map[string]interface{}{"execute": command}
+	if args != nil {
+		cmd["arguments"] = args
+	}
+
+	data, _ := json.Marshal(cmd)
+	return string(data)
+}
+
+// runQMPCommands hands commands to the monitor go routine and waits up
+// to timeout for them to complete, along with event if it is not empty.
+func (q *qemu) runQMPCommands(commands []string, event string, timeout time.Duration) error {
+	if q.qmpCmdCh == nil {
+		return fmt.Errorf("Instance %s is not running", q.cfg.Instance)
+	}
+
+	cmd := &qmpCmd{
+		commands: commands,
+		event:    event,
+		resultCh: make(chan error, 1),
+	}
+
+	select {
+	case q.qmpCmdCh <- cmd:
+	case <-time.After(qmpTimeout):
+		return fmt.Errorf("Timed out waiting for qemu monitor of %s", q.cfg.Instance)
+	}
+
+	select {
+	case err := <-cmd.resultCh:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("Timed out waiting for qemu to answer %s", q.cfg.Instance)
+	}
+}
@@ -0,0 +1,78 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// qemu names drives that are not given an id after their interface and
+// index.  The instance's image.qcow2 is the first virtio drive passed
+// to qemu by startVM.
+const rootDrive = "virtio0"
+
+const qmpSnapshotTimeout = 30 * time.Minute
+
+// The guest is paused while the backup job is started, which is when
+// drive-backup captures the state of the drive, and resumed right away.
+// The copy itself proceeds with the guest running, until qemu reports
+// it complete with BLOCK_JOB_COMPLETED.  As the backup is a full one,
+// the target image does not depend on the instance's backing image.
+func (q *qemu) snapshot(target string) error {
+	cont := qmpCommand("cont", nil)
+	commands := []string{
+		qmpCommand("stop", nil),
+		qmpCommand("drive-backup", map[string]string{
+			"device": rootDrive,
+			"sync":   "full",
+			"format": "qcow2",
+			"target": target,
+		}),
+		cont,
+	}
+
+	err := q.runQMPCommands(commands, "BLOCK_JOB_COMPLETED", qmpSnapshotTimeout)
+	if err != nil {
+		// Make sure we do not leave the guest paused
+		if contErr := q.runQMPCommands([]string{cont}, "", qmpTimeout); contErr != nil {
+			glog.Warningf("Unable to resume instance %s: %v", q.cfg.Instance, contErr)
+		}
+	}
+
+	return err
+}
+
+// exportDisk merges the instance's image.qcow2 with its backing image
+// into target, so that target can be used on nodes which do not have
+// the backing image.
+func (q *qemu) exportDisk(target string) error {
+	vmImage := path.Join(q.instanceDir, "image.qcow2")
+	glog.Infof("Exporting qcow image %s to %s", vmImage, target)
+
+	params := []string{"convert", "-O", "qcow2", vmImage, target}
+	out, err := exec.Command("qemu-img", params...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Unable to export %s: %v: %s", vmImage, err, out)
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+)
+
+func volumeDriveID(volume string) string {
+	return "drive-" + volume
+}
+
+func volumeDeviceID(volume string) string {
+	return "volume-" + volume
+}
+
+func volumeDriveParam(volume *volumeConfig) string {
+	return fmt.Sprintf("file=%s,if=none,id=%s,aio=threads,format=%s",
+		volume.Path, volumeDriveID(volume.UUID), volume.Format)
+}
+
+// volumeParams returns the qemu command line parameters attaching
+// volumes at boot time, using the same drive and device IDs as
+// attachVolume so that they can later be detached.
+func volumeParams(volumes []volumeConfig) []string {
+	var params []string
+
+	for i := range volumes {
+		volume := &volumes[i]
+		deviceParam := fmt.Sprintf("virtio-blk-pci,drive=%s,id=%s",
+			volumeDriveID(volume.UUID), volumeDeviceID(volume.UUID))
+		params = append(params, "-drive", volumeDriveParam(volume))
+		params = append(params, "-device", deviceParam)
+	}
+
+	return params
+}
+
+// The drive is added through the human monitor, as the QMP blockdev-add
+// arguments differ between qemu releases.  It is deleted along with the
+// device by device_del.
+func (q *qemu) attachVolume(volume *volumeConfig) error {
+	driveAdd := "drive_add 0 " + volumeDriveParam(volume)
+	commands := []string{
+		qmpCommand("human-monitor-command", map[string]string{
+			"command-line": driveAdd,
+		}),
+		qmpCommand("device_add", map[string]string{
+			"driver": "virtio-blk-pci",
+			"drive":  volumeDriveID(volume.UUID),
+			"id":     volumeDeviceID(volume.UUID),
+		}),
+	}
+
+	return q.runQMPCommands(commands, "", qmpTimeout)
+}
+
+// device_del only requests the removal of the device, which completes
+// once the guest OS releases it.
+func (q *qemu) detachVolume(volume string) error {
+	commands := []string{
+		qmpCommand("device_del", map[string]string{
+			"id": volumeDeviceID(volume),
+		}),
+	}
+
+	return q.runQMPCommands(commands, "", qmpTimeout)
+}
@@ -0,0 +1,83 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"github.com/golang/glog"
+)
+
+var errResizeNotSupported = errors.New("Resizing is not supported")
+
+/*
+Only stopped instances can be resized.  An instance is resized in place by
+updating its vmConfig, from which qemu's command line is built on the next
+restart, and by growing its root disk.  RESIZE commands only reach this
+node once the scheduler has checked that the node can accommodate the new
+resources.  Instances are never moved to another node by a resize.
+*/
+
+type resizeError struct {
+	err  error
+	code payloads.ResizeFailureReason
+}
+
+func (re *resizeError) send(client *ssntpConn, instance string, resources []payloads.RequestedResource) {
+	payload, err := generateResizeError(instance, resources, re)
+	if err != nil {
+		glog.Errorf("Unable to generate payload for resize_failure: %v", err)
+		return
+	}
+
+	_, err = client.SendError(ssntp.ResizeFailure, payload)
+	if err != nil {
+		glog.Errorf("Unable to send resize_failure: %v", err)
+	}
+}
+
+func processResize(vm virtualizer, instanceDir string, cfg *vmConfig, cmd *insResizeCmd) *resizeError {
+	if cmd.disk != 0 && cmd.disk < cfg.Disk {
+		err := fmt.Errorf("Cannot shrink disk from %dM to %dM", cfg.Disk, cmd.disk)
+		return &resizeError{err, payloads.ResizeInvalidData}
+	}
+
+	err := vm.resize(cmd.cpus, cmd.mem, cmd.disk)
+	if err == errResizeNotSupported {
+		return &resizeError{err, payloads.ResizeNotSupported}
+	} else if err != nil {
+		return &resizeError{err, payloads.ResizeResizeFailure}
+	}
+
+	oldCfg := *cfg
+	cfg.Cpus = cmd.cpus
+	cfg.Mem = cmd.mem
+	if cmd.disk != 0 {
+		cfg.Disk = cmd.disk
+	}
+
+	err = saveVMConfig(instanceDir, cfg)
+	if err != nil {
+		*cfg = oldCfg
+		return &resizeError{err, payloads.ResizeResizeFailure}
+	}
+
+	return nil
+}
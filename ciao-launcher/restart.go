@@ -29,18 +29,14 @@ type restartError struct {
 	code payloads.RestartFailureReason
 }
 
-func (re *restartError) send(client *ssntpConn, instance string) {
-	if !client.isConnected() {
-		return
-	}
-
+func (re *restartError) send(client *ssntpConn, instance string, requestID uint64) {
 	payload, err := generateRestartError(instance, re)
 	if err != nil {
 		glog.Errorf("Unable to generate payload for restart_failure: %v", err)
 		return
 	}
 
-	_, err = client.SendError(ssntp.RestartFailure, payload)
+	_, err = client.SendErrorReply(requestID, ssntp.RestartFailure, payload)
 	if err != nil {
 		glog.Errorf("Unable to send restart_failure: %v", err)
 	}
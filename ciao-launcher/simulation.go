@@ -17,6 +17,7 @@
 package main
 
 import (
+	"io/ioutil"
 	"math/rand"
 	"sync"
 	"time"
@@ -130,3 +131,28 @@ func (s *simulation) connected() {
 func (s *simulation) lostVM() {
 	glog.Infof("simulation: lostVM\n")
 }
+
+func (s *simulation) attachVolume(volume *volumeConfig) error {
+	glog.Infof("simulation: attachVolume %s\n", volume.UUID)
+	return nil
+}
+
+func (s *simulation) detachVolume(volume string) error {
+	glog.Infof("simulation: detachVolume %s\n", volume)
+	return nil
+}
+
+func (s *simulation) snapshot(target string) error {
+	glog.Infof("simulation: snapshot %s\n", target)
+	return ioutil.WriteFile(target, nil, 0644)
+}
+
+func (s *simulation) exportDisk(target string) error {
+	glog.Infof("simulation: exportDisk %s\n", target)
+	return ioutil.WriteFile(target, nil, 0644)
+}
+
+func (s *simulation) resize(cpus, memMB, diskMB int) error {
+	glog.Infof("simulation: resize to vcpus %d mem %d disk %d\n", cpus, memMB, diskMB)
+	return nil
+}
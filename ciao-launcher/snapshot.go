@@ -0,0 +1,139 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"github.com/golang/glog"
+)
+
+// snapshotsPath holds the snapshots being uploaded to the image service.
+// They are kept out of the instance directories so that deleting an
+// instance does not interrupt the upload of its snapshot.
+const snapshotsPath = "/var/lib/ciao/snapshots"
+
+var errSnapshotsNotSupported = errors.New("Snapshots are not supported")
+
+type snapshotError struct {
+	err  error
+	code payloads.SnapshotFailureReason
+}
+
+func (se *snapshotError) send(client *ssntpConn, instance, image string) {
+	payload, err := generateSnapshotError(instance, image, se)
+	if err != nil {
+		glog.Errorf("Unable to generate payload for snapshot_failure: %v", err)
+		return
+	}
+
+	_, err = client.SendError(ssntp.SnapshotFailure, payload)
+	if err != nil {
+		glog.Errorf("Unable to send snapshot_failure: %v", err)
+	}
+}
+
+// uploadImage uploads the image file at imagePath to the image service,
+// as the data of the queued image imageID.  uploadToken is the token
+// received in the SNAPSHOT command.
+func uploadImage(imageID, uploadToken, imagePath string) error {
+	serviceURL := imageServiceURL()
+	if serviceURL == "" {
+		return errNoImageService
+	}
+
+	client, err := newImageClient()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(imagePath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	fileURL := serviceURL + "/v2/images/" + imageID + "/file"
+	req, err := http.NewRequest("PUT", fileURL, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = fi.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(payloads.ImageUploadTokenHeader, uploadToken)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("PUT %s: %s", fileURL, resp.Status)
+	}
+
+	return nil
+}
+
+func uploadSnapshot(client *ssntpConn, instance, image, uploadToken, snapshotPath string) {
+	defer func() { _ = os.Remove(snapshotPath) }()
+
+	err := uploadImage(image, uploadToken, snapshotPath)
+	if err != nil {
+		glog.Errorf("Unable to upload snapshot of %s: %v", instance, err)
+		se := &snapshotError{err, payloads.SnapshotUploadFailure}
+		se.send(client, instance, image)
+		return
+	}
+
+	glog.Infof("Snapshot of %s uploaded as image %s", instance, image)
+}
+
+// processSnapshot copies the root disk of an instance and uploads the
+// copy in the background, so that the instance go routine is not blocked
+// for the duration of the upload.
+func processSnapshot(vm virtualizer, client *ssntpConn, instance string, cmd *insSnapshotCmd) *snapshotError {
+	err := os.MkdirAll(snapshotsPath, 0755)
+	if err != nil {
+		return &snapshotError{err, payloads.SnapshotSnapshotFailure}
+	}
+
+	snapshotPath := path.Join(snapshotsPath, cmd.image)
+	err = vm.snapshot(snapshotPath)
+	if err != nil {
+		_ = os.Remove(snapshotPath)
+		if err == errSnapshotsNotSupported {
+			return &snapshotError{err, payloads.SnapshotNotSupported}
+		}
+		return &snapshotError{err, payloads.SnapshotSnapshotFailure}
+	}
+
+	go uploadSnapshot(client, instance, cmd.image, cmd.uploadToken, snapshotPath)
+
+	return nil
+}
@@ -44,10 +44,6 @@ type startTimes struct {
 }
 
 func (se *startError) send(client *ssntpConn, instance string) {
-	if !client.isConnected() {
-		return
-	}
-
 	payload, err := generateStartError(instance, se)
 	if err != nil {
 		glog.Errorf("Unable to generate payload for start_failure: %v", err)
@@ -71,6 +67,13 @@ func ensureBackingImage(vm virtualizer) error {
 			glog.Errorf("Unable to download backing image: %v", err)
 			return err
 		}
+
+		// Check the size of the downloaded image
+		err = vm.checkBackingImage()
+		if err != nil {
+			glog.Errorf("Backing image check failed")
+			return err
+		}
 	} else if err != nil {
 		glog.Errorf("Backing image check failed")
 		return err
@@ -16,7 +16,26 @@
 
 package main
 
-import "testing"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"gopkg.in/yaml.v2"
+)
 
 const (
 	commentString   = "# Here's a comment\n"
@@ -129,3 +148,426 @@ func TestSplitYaml(t *testing.T) {
 	}
 
 }
+
+// Test anti-affinity group parsing
+//
+// The anti-affinity group of an instance is stored in its vmConfig so
+// that launcher can report it to the scheduler, even after a restart.
+//
+// Test should pass okay.
+func TestStartAntiAffinityGroup(t *testing.T) {
+	constraints := `  constraints:
+    required_labels:
+      rack: r1
+    anti_affinity_group: tenant/db
+`
+	cfg, payloadErr := parseStartPayload([]byte(startString + constraints))
+	if payloadErr != nil {
+		t.Fatalf("Unable to parse start payload: %v", payloadErr.err)
+	}
+
+	if cfg.AntiAffinityGroup != "tenant/db" {
+		t.Fatalf("Expected anti-affinity group tenant/db, got %s", cfg.AntiAffinityGroup)
+	}
+}
+
+// Test ATTACH_VOLUME payload parsing
+//
+// Volume paths end up in qemu -drive options, so relative paths and
+// paths containing commas are rejected.  The format defaults to raw.
+//
+// Test should pass okay.
+func TestAttachVolumePayload(t *testing.T) {
+	attach := `attach_volume:
+  instance_uuid: 3390740c-dce9-48d6-b83a-a717417072ce
+  volume_uuid: 67d86208-b46c-4465-9018-e14187d4010d
+  workload_agent_uuid: 59460b8a-5f53-4e3e-b5ce-b71fed8c7e64
+`
+	_, volume, payloadErr := parseAttachVolumePayload([]byte(attach +
+		"  path: /var/lib/ciao/volumes/67d86208-b46c-4465-9018-e14187d4010d\n"))
+	if payloadErr != nil {
+		t.Fatalf("Unable to parse attach volume payload: %v", payloadErr.err)
+	}
+	if volume.Format != "raw" {
+		t.Fatalf("Expected raw volume format, got %s", volume.Format)
+	}
+
+	for _, path := range []string{"volume.img", "/tmp/a,file=/etc/shadow"} {
+		_, _, payloadErr = parseAttachVolumePayload([]byte(attach + "  path: " + path + "\n"))
+		if payloadErr == nil {
+			t.Fatalf("Volume path %s should have been rejected", path)
+		}
+	}
+}
+
+// Test START volume parsing
+//
+// Instances restarted on another node carry their attached volumes in
+// the START payload.  These are validated like ATTACH_VOLUME volumes.
+//
+// Test should pass okay.
+func TestStartVolumesPayload(t *testing.T) {
+	volumes := `  volumes:
+    - volume_uuid: 67d86208-b46c-4465-9018-e14187d4010d
+      path: %s
+`
+	cfg, payloadErr := parseStartPayload([]byte(startString + fmt.Sprintf(volumes,
+		"/var/lib/ciao/volumes/67d86208-b46c-4465-9018-e14187d4010d")))
+	if payloadErr != nil {
+		t.Fatalf("Unable to parse start payload: %v", payloadErr.err)
+	}
+	if len(cfg.Volumes) != 1 || cfg.Volumes[0].UUID != "67d86208-b46c-4465-9018-e14187d4010d" ||
+		cfg.Volumes[0].Format != payloads.RawVolume {
+		t.Fatalf("Unexpected volumes %v", cfg.Volumes)
+	}
+
+	_, payloadErr = parseStartPayload([]byte(startString + fmt.Sprintf(volumes, "volume.img")))
+	if payloadErr == nil || payloadErr.code != payloads.InvalidData {
+		t.Fatalf("Relative volume path should have been rejected")
+	}
+}
+
+// Test QMP response parsing
+//
+// Events are not responses, and human-monitor-command failures are
+// reported through its return string rather than through an error.
+//
+// Test should pass okay.
+func TestParseQMPResponse(t *testing.T) {
+	var tests = []struct {
+		line       string
+		isResponse bool
+		failed     bool
+	}{
+		{`{"QMP": {"version": {}, "capabilities": []}}`, false, false},
+		{`{"timestamp": {}, "event": "DEVICE_DELETED", "data": {}}`, false, false},
+		{`{"return": {}}`, true, false},
+		{`{"return": ""}`, true, false},
+		{`{"return": "OK\r\n"}`, true, false},
+		{`{"return": "Could not open '/tmp/vol': No such file\r\n"}`, true, true},
+		{`{"error": {"class": "GenericError", "desc": "Duplicate ID"}}`, true, true},
+		{`garbage`, false, false},
+	}
+
+	for _, test := range tests {
+		isResponse, err := parseQMPResponse(test.line)
+		if isResponse != test.isResponse || (err != nil) != test.failed {
+			t.Fatalf("Unexpected result for %s: %t %v", test.line, isResponse, err)
+		}
+	}
+}
+
+// Test QMP command sequences waiting for an event
+//
+// Block job completion events may be emitted before the command that
+// follows the one starting the job returns, or after all the commands
+// have returned.  Either way the sequence completes once both the
+// commands and the event are done, and job errors are reported.
+//
+// Test should pass okay.
+func TestQMPCmdEvent(t *testing.T) {
+	const (
+		ret       = `{"return": {}}`
+		completed = `{"event": "BLOCK_JOB_COMPLETED", "data": {"device": "virtio0"}}`
+		failed    = `{"event": "BLOCK_JOB_COMPLETED", "data": {"device": "virtio0", "error": "No space left on device"}}`
+	)
+
+	var tests = []struct {
+		lines  []string
+		failed bool
+	}{
+		{[]string{ret, ret, completed, ret}, false},
+		{[]string{ret, ret, ret, completed}, false},
+		{[]string{ret, ret, ret, failed}, true},
+	}
+
+	conn, qemuConn := net.Pipe()
+	defer func() { _ = conn.Close() }()
+	go func() { _, _ = io.Copy(ioutil.Discard, qemuConn) }()
+
+	for _, test := range tests {
+		cmd := &qmpCmd{
+			commands: []string{"stop", "drive-backup", "cont"},
+			event:    "BLOCK_JOB_COMPLETED",
+			resultCh: make(chan error, 1),
+		}
+
+		for i, line := range test.lines {
+			done := cmd.response(conn, line)
+			if done != (i == len(test.lines)-1) {
+				t.Fatalf("Unexpected completion after %s", line)
+			}
+		}
+
+		err := <-cmd.resultCh
+		if (err != nil) != test.failed {
+			t.Fatalf("Unexpected result for %v: %v", test.lines, err)
+		}
+	}
+}
+
+// Test SNAPSHOT payload parsing
+//
+// Both the instance and the image must be valid UUIDs as the image UUID
+// ends up in a file path.
+//
+// Test should pass okay.
+func TestSnapshotPayload(t *testing.T) {
+	snapshot := `snapshot:
+  instance_uuid: 3390740c-dce9-48d6-b83a-a717417072ce
+  workload_agent_uuid: 59460b8a-5f53-4e3e-b5ce-b71fed8c7e64
+`
+	instance, cmd, payloadErr := parseSnapshotPayload([]byte(snapshot +
+		"  image_uuid: b265f62b-e957-47fd-a0a2-6dc261c7315c\n  upload_token: secret\n"))
+	if payloadErr != nil {
+		t.Fatalf("Unable to parse snapshot payload: %v", payloadErr.err)
+	}
+	if instance != "3390740c-dce9-48d6-b83a-a717417072ce" ||
+		cmd.image != "b265f62b-e957-47fd-a0a2-6dc261c7315c" || cmd.uploadToken != "secret" {
+		t.Fatalf("Unexpected instance %s or snapshot %v", instance, cmd)
+	}
+
+	_, _, payloadErr = parseSnapshotPayload([]byte(snapshot + "  image_uuid: ../../etc\n"))
+	if payloadErr == nil || payloadErr.code != payloads.SnapshotInvalidData {
+		t.Fatalf("Invalid image UUID should have been rejected")
+	}
+}
+
+func TestResizePayload(t *testing.T) {
+	resize := `resize:
+  instance_uuid: 3390740c-dce9-48d6-b83a-a717417072ce
+  workload_agent_uuid: 59460b8a-5f53-4e3e-b5ce-b71fed8c7e64
+  requested_resources:
+  - type: vcpus
+    value: 4
+  - type: disk_mb
+    value: 20000
+`
+	instance, cmd, payloadErr := parseResizePayload([]byte(resize +
+		"  - type: mem_mb\n    value: 1024\n"))
+	if payloadErr != nil {
+		t.Fatalf("Unable to parse resize payload: %v", payloadErr.err)
+	}
+	if instance != "3390740c-dce9-48d6-b83a-a717417072ce" ||
+		cmd.cpus != 4 || cmd.mem != 1024 || cmd.disk != 20000 {
+		t.Fatalf("Unexpected instance %s or resources %v", instance, cmd)
+	}
+
+	_, _, payloadErr = parseResizePayload([]byte(resize))
+	if payloadErr == nil || payloadErr.code != payloads.ResizeInvalidData {
+		t.Fatalf("Missing mem_mb should have been rejected")
+	}
+}
+
+// Test in place resizes
+//
+// The new resources are persisted in the instance's state file and
+// disks cannot be shrunk.
+//
+// Test should pass okay.
+func TestProcessResize(t *testing.T) {
+	instanceDir, err := ioutil.TempDir("", "resize-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(instanceDir) }()
+
+	cfg := &vmConfig{Cpus: 1, Mem: 512, Disk: 10000}
+	vm := &simulation{}
+	vm.init(cfg, instanceDir)
+
+	resizeErr := processResize(vm, instanceDir, cfg, &insResizeCmd{cpus: 2, mem: 1024, disk: 5000})
+	if resizeErr == nil || resizeErr.code != payloads.ResizeInvalidData {
+		t.Fatalf("Disk shrink should have been rejected")
+	}
+
+	resizeErr = processResize(vm, instanceDir, cfg, &insResizeCmd{cpus: 2, mem: 1024, disk: 20000})
+	if resizeErr != nil {
+		t.Fatalf("Unable to resize instance: %v", resizeErr.err)
+	}
+
+	saved, err := loadVMConfig(instanceDir)
+	if err != nil {
+		t.Fatalf("Unable to load instance state: %v", err)
+	}
+	if saved.Cpus != 2 || saved.Mem != 1024 || saved.Disk != 20000 {
+		t.Errorf("Unexpected instance state after resize: %v", saved)
+	}
+}
+
+// Test backing image downloads
+//
+// Images are fetched from the image service set in the cluster
+// configuration and only stored once their checksum has been verified.
+//
+// Test should pass okay.
+func TestDownloadImage(t *testing.T) {
+	const imageID = "73a86d7e-93c0-480e-9c41-ab42f69b7799"
+	data := "ciao image"
+	hash := sha256.Sum256([]byte(data))
+	image := payloads.CiaoImage{
+		ID:       imageID,
+		Status:   payloads.ImageStatusActive,
+		Size:     int64(len(data)),
+		Checksum: hex.EncodeToString(hash[:]),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/images/"+imageID, func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(&image)
+	})
+	mux.HandleFunc("/v2/images/"+imageID+"/file", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(data))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "ciao-launcher-images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	updateImageService([]byte("configure:\n  image_service:\n    url: " + server.URL + "/\n"))
+	defer updateImageService([]byte("configure:\n"))
+
+	image.Checksum = "0000"
+	if err = downloadImage(imageID, dir); err == nil {
+		t.Fatal("Image with bad checksum downloaded")
+	}
+
+	image.Checksum = hex.EncodeToString(hash[:])
+	if err = downloadImage(imageID, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := ioutil.ReadFile(path.Join(dir, imageID))
+	if err != nil || string(stored) != data {
+		t.Fatalf("Downloaded image not stored: %v", err)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Temporary download files left behind: %v", err)
+	}
+}
+
+// replayTestTransport is an in-memory SSNTP transport which lets tests
+// break the client connection and hold its reconnection.
+type replayTestTransport struct {
+	*ssntp.MemoryTransport
+	hold   sync.RWMutex
+	dialed chan net.Conn
+}
+
+func (t *replayTestTransport) Dial(address string) (net.Conn, error) {
+	t.hold.RLock()
+	defer t.hold.RUnlock()
+
+	conn, err := t.MemoryTransport.Dial(address)
+	if err == nil {
+		t.dialed <- conn
+	}
+	return conn, err
+}
+
+type replayTestServer struct {
+	connected    chan string
+	disconnected chan string
+	errors       chan *ssntp.Frame
+}
+
+func (s *replayTestServer) ConnectNotify(uuid string, role uint32) {
+	s.connected <- uuid
+}
+
+func (s *replayTestServer) DisconnectNotify(uuid string, role uint32) {
+	s.disconnected <- uuid
+}
+
+func (s *replayTestServer) StatusNotify(uuid string, status ssntp.Status, frame *ssntp.Frame) {
+}
+
+func (s *replayTestServer) CommandNotify(uuid string, command ssntp.Command, frame *ssntp.Frame) {
+}
+
+func (s *replayTestServer) EventNotify(uuid string, event ssntp.Event, frame *ssntp.Frame) {
+}
+
+func (s *replayTestServer) ErrorNotify(uuid string, error ssntp.Error, frame *ssntp.Frame) {
+	if error == ssntp.StartFailure {
+		s.errors <- frame
+	}
+}
+
+// Checks that a StartFailure sent while ciao-launcher is disconnected
+// from its server is received by the server once ciao-launcher has
+// reconnected.
+func TestStartErrorReplay(t *testing.T) {
+	transport := &replayTestTransport{
+		MemoryTransport: ssntp.NewMemoryTransport(),
+		dialed:          make(chan net.Conn, 2),
+	}
+
+	ntf := &replayTestServer{
+		connected:    make(chan string, 2),
+		disconnected: make(chan string, 2),
+		errors:       make(chan *ssntp.Frame, 2),
+	}
+
+	var server ssntp.Server
+	serverConfig := &ssntp.Config{
+		Role:            ssntp.SCHEDULER,
+		CustomTransport: transport,
+	}
+	go func() { _ = server.Serve(serverConfig, ntf) }()
+	time.Sleep(100 * time.Millisecond)
+	defer server.Stop()
+
+	client := &agentClient{
+		cmdCh: make(chan *cmdWrapper, 2),
+	}
+	clientConfig := &ssntp.Config{
+		Role:            ssntp.AGENT,
+		CustomTransport: transport,
+	}
+	if err := client.Dial(clientConfig, client); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	<-ntf.connected
+
+	transport.hold.Lock()
+	conn := <-transport.dialed
+	_ = conn.Close()
+	<-ntf.disconnected
+
+	for i := 0; client.isConnected(); i++ {
+		if i == 100 {
+			transport.hold.Unlock()
+			t.Fatal("Client did not notice the disconnection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	instance := "67d86208-b46c-4465-9018-fe14087d415f"
+	se := &startError{nil, payloads.FullComputeNode}
+	se.send(&client.ssntpConn, instance)
+
+	transport.hold.Unlock()
+
+	select {
+	case frame := <-ntf.errors:
+		var failure payloads.ErrorStartFailure
+		err := yaml.Unmarshal(frame.Payload, &failure)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if failure.InstanceUUID != instance || failure.Reason != payloads.FullComputeNode {
+			t.Fatalf("Unexpected StartFailure %v", failure)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("StartFailure not replayed")
+	}
+}
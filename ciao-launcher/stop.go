@@ -27,18 +27,14 @@ type stopError struct {
 	code payloads.StopFailureReason
 }
 
-func (se *stopError) send(client *ssntpConn, instance string) {
-	if !client.isConnected() {
-		return
-	}
-
+func (se *stopError) send(client *ssntpConn, instance string, requestID uint64) {
 	payload, err := generateStopError(instance, se)
 	if err != nil {
 		glog.Errorf("Unable to generate payload for stop_failure: %v", err)
 		return
 	}
 
-	_, err = client.SendError(ssntp.StopFailure, payload)
+	_, err = client.SendErrorReply(requestID, ssntp.StopFailure, payload)
 	if err != nil {
 		glog.Errorf("Unable to send stop_failure: %v", err)
 	}
@@ -194,6 +194,18 @@ func (ts *testServer) EventNotify(uuid string, event ssntp.Event, frame *ssntp.F
 		if err == nil {
 			e = &payload
 		}
+	case ssntp.InstanceEvacuated:
+		payload := payloads.EventInstanceEvacuated{}
+		err := yaml.Unmarshal(frame.Payload, &payload)
+		if err == nil {
+			e = &payload
+		}
+	case ssntp.NodeEvacuated:
+		payload := payloads.EventNodeEvacuated{}
+		err := yaml.Unmarshal(frame.Payload, &payload)
+		if err == nil {
+			e = &payload
+		}
 	}
 
 	c.events = append(c.events, e)
@@ -445,6 +457,10 @@ func serve(done chan os.Signal) {
 			func(w http.ResponseWriter, r *http.Request) {
 				yamlCommand(w, r, ssntp.DELETE)
 			})
+		http.HandleFunc("/evacuate",
+			func(w http.ResponseWriter, r *http.Request) {
+				yamlCommand(w, r, ssntp.EVACUATE)
+			})
 		http.HandleFunc("/stats", stats)
 		http.HandleFunc("/status", status)
 		http.HandleFunc("/drain", drain)
@@ -46,6 +46,7 @@ func init() {
 		fmt.Fprintln(os.Stderr, "\tdelete")
 		fmt.Fprintln(os.Stderr, "\tstop")
 		fmt.Fprintln(os.Stderr, "\trestart")
+		fmt.Fprintln(os.Stderr, "\tevacuate")
 		fmt.Fprintln(os.Stderr, "\tdrain")
 		fmt.Fprintln(os.Stderr, "\tstats")
 		fmt.Fprintln(os.Stderr, "\tistats")
@@ -420,6 +421,26 @@ func del(host string) error {
 	return postYaml(host, "delete", client, &del)
 }
 
+func evacuate(host string) error {
+	var evac payloads.Evacuate
+
+	fs := flag.NewFlagSet("evacuate", flag.ExitOnError)
+	cp := ""
+	nextState := string(payloads.EvacuateMaintenance)
+	fs.StringVar(&cp, "client", "", "UUID of client")
+	fs.StringVar(&nextState, "next-state", nextState,
+		"maintenance, shutdown, update or reboot")
+	fs.BoolVar(&evac.Evacuate.Force, "force", false,
+		"Evacuate instances even if their root disks are not migrated")
+
+	if err := fs.Parse(flag.Args()[1:]); err != nil {
+		return err
+	}
+
+	evac.Evacuate.NextState = payloads.EvacuateNextState(nextState)
+	return postYaml(host, "evacuate", cp, &evac)
+}
+
 func main() {
 
 	flag.Parse()
@@ -437,6 +458,7 @@ func main() {
 		"stop":      stop,
 		"restart":   restart,
 		"delete":    del,
+		"evacuate":  evacuate,
 		"drain":     drain,
 		"startf":    startf,
 	}
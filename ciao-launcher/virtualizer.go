@@ -123,4 +123,29 @@ type virtualizer interface {
 	// The instance go routine then calls lostVM so that the virtualizer can update
 	// its internal state.
 	lostVM()
+
+	// Hot plugs a block storage volume into a running VM.  Only called once
+	// the VM is connected.  Virtualizers that do not support volumes return
+	// errVolumesNotSupported.  Volumes recorded in the vmConfig passed to init
+	// are expected to be attached by startVM.
+	attachVolume(volume *volumeConfig) error
+
+	// Unplugs a volume previously attached with attachVolume or by startVM.
+	detachVolume(volume string) error
+
+	// Copies the root disk of a running VM to target, as a standalone
+	// qcow2 image.  Only called once the VM is connected.  Virtualizers
+	// that do not support snapshots return errSnapshotsNotSupported.
+	snapshot(target string) error
+
+	// Copies the root disk of a stopped VM to target, as a standalone
+	// qcow2 image.  Virtualizers that do not support snapshots return
+	// errSnapshotsNotSupported.
+	exportDisk(target string) error
+
+	// Changes the vcpus, memory and disk size of a stopped VM.  The vmConfig
+	// passed to init still holds the current values and is updated by the
+	// caller once resize succeeds.  The disk is only ever grown.
+	// Virtualizers that do not support resizing return errResizeNotSupported.
+	resize(cpus, memMB, diskMB int) error
 }
@@ -0,0 +1,120 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"github.com/golang/glog"
+)
+
+var errVolumesNotSupported = errors.New("Volumes are not supported")
+
+type attachVolumeError struct {
+	err  error
+	code payloads.AttachVolumeFailureReason
+}
+
+func (ae *attachVolumeError) send(client *ssntpConn, instance, volume string) {
+	payload, err := generateAttachVolumeError(instance, volume, ae)
+	if err != nil {
+		glog.Errorf("Unable to generate payload for attach_volume_failure: %v", err)
+		return
+	}
+
+	_, err = client.SendError(ssntp.AttachVolumeFailure, payload)
+	if err != nil {
+		glog.Errorf("Unable to send attach_volume_failure: %v", err)
+	}
+}
+
+type detachVolumeError struct {
+	err  error
+	code payloads.DetachVolumeFailureReason
+}
+
+func (de *detachVolumeError) send(client *ssntpConn, instance, volume string) {
+	payload, err := generateDetachVolumeError(instance, volume, de)
+	if err != nil {
+		glog.Errorf("Unable to generate payload for detach_volume_failure: %v", err)
+		return
+	}
+
+	_, err = client.SendError(ssntp.DetachVolumeFailure, payload)
+	if err != nil {
+		glog.Errorf("Unable to send detach_volume_failure: %v", err)
+	}
+}
+
+// findVolume returns the index of volume in the volumes attached to
+// an instance, or -1 if it is not attached.
+func findVolume(cfg *vmConfig, volume string) int {
+	for i := range cfg.Volumes {
+		if cfg.Volumes[i].UUID == volume {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func processAttachVolume(vm virtualizer, instanceDir string, cfg *vmConfig, volume *volumeConfig) *attachVolumeError {
+	if findVolume(cfg, volume.UUID) != -1 {
+		return &attachVolumeError{nil, payloads.AttachVolumeAlreadyAttached}
+	}
+
+	err := vm.attachVolume(volume)
+	if err == errVolumesNotSupported {
+		return &attachVolumeError{err, payloads.AttachVolumeNotSupported}
+	} else if err != nil {
+		return &attachVolumeError{err, payloads.AttachVolumeAttachFailure}
+	}
+
+	// The volume is attached, failing to record it only means it
+	// will be missing after the next restart.
+	cfg.Volumes = append(cfg.Volumes, *volume)
+	err = saveVMConfig(instanceDir, cfg)
+	if err != nil {
+		glog.Warningf("Unable to record volume %s attachment: %v", volume.UUID, err)
+	}
+
+	return nil
+}
+
+func processDetachVolume(vm virtualizer, instanceDir string, cfg *vmConfig, volume string) *detachVolumeError {
+	i := findVolume(cfg, volume)
+	if i == -1 {
+		return &detachVolumeError{nil, payloads.DetachVolumeNotAttached}
+	}
+
+	err := vm.detachVolume(volume)
+	if err == errVolumesNotSupported {
+		return &detachVolumeError{err, payloads.DetachVolumeNotSupported}
+	} else if err != nil {
+		return &detachVolumeError{err, payloads.DetachVolumeDetachFailure}
+	}
+
+	cfg.Volumes = append(cfg.Volumes[:i], cfg.Volumes[i+1:]...)
+	err = saveVMConfig(instanceDir, cfg)
+	if err != nil {
+		glog.Warningf("Unable to record volume %s detachment: %v", volume, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,439 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"github.com/golang/glog"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// configStore persists the latest valid cluster configuration so that
+// it survives scheduler restarts.
+//
+// load returns a nil payload and no error when nothing has been stored yet.
+type configStore interface {
+	load() ([]byte, error)
+	store(payload []byte) error
+	String() string
+}
+
+func newConfigStore(storageType payloads.StorageType, uri string) (configStore, error) {
+	switch storageType {
+	case payloads.Filesystem:
+		if uri == "" {
+			return nil, fmt.Errorf("missing %s configuration storage path", storageType)
+		}
+		return &fileConfigStore{path: uri}, nil
+	case payloads.Etcd:
+		if uri == "" {
+			return nil, fmt.Errorf("missing %s configuration storage URI", storageType)
+		}
+		return &etcdConfigStore{endpoint: strings.TrimSuffix(uri, "/")}, nil
+	}
+
+	return nil, fmt.Errorf("unknown configuration storage type \"%s\"", storageType)
+}
+
+// fileConfigStore keeps the configuration payload in a local file.
+type fileConfigStore struct {
+	path string
+}
+
+func (s *fileConfigStore) String() string {
+	return payloads.Filesystem.String() + ":" + s.path
+}
+
+func (s *fileConfigStore) load() ([]byte, error) {
+	payload, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return payload, err
+}
+
+// The payload is written to a temporary file first and then renamed,
+// so that a crash never leaves a truncated configuration behind.
+func (s *fileConfigStore) store(payload []byte) error {
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(payload)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), s.path); err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+// etcdConfigKey is the etcd v2 key holding the configuration payload.
+const etcdConfigKey = "/v2/keys/ciao/scheduler/configuration"
+
+// etcdConfigStore keeps the configuration payload in an etcd key,
+// through the etcd v2 HTTP keys API.
+type etcdConfigStore struct {
+	endpoint string
+}
+
+type etcdResponse struct {
+	Node struct {
+		Value string `json:"value"`
+	} `json:"node"`
+}
+
+func (s *etcdConfigStore) String() string {
+	return payloads.Etcd.String() + ":" + s.endpoint
+}
+
+func (s *etcdConfigStore) load() ([]byte, error) {
+	resp, err := http.Get(s.endpoint + etcdConfigKey)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("etcd GET %s: %s", etcdConfigKey, resp.Status)
+	}
+
+	var etcdResp etcdResponse
+	err = json.NewDecoder(resp.Body).Decode(&etcdResp)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(etcdResp.Node.Value), nil
+}
+
+func (s *etcdConfigStore) store(payload []byte) error {
+	form := url.Values{}
+	form.Set("value", string(payload))
+
+	req, err := http.NewRequest("PUT", s.endpoint+etcdConfigKey, bytes.NewBufferString(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("etcd PUT %s: %s", etcdConfigKey, resp.Status)
+	}
+
+	return nil
+}
+
+func validateCIDR(name string, cidr string) error {
+	if cidr == "" {
+		return nil
+	}
+
+	if _, _, err := net.ParseCIDR(cidr); err != nil {
+		return fmt.Errorf("invalid %s \"%s\"", name, cidr)
+	}
+
+	return nil
+}
+
+func validateService(name string, service payloads.ConfigureService, expected payloads.ServiceType) error {
+	if service.Type != "" && service.Type != expected {
+		return fmt.Errorf("invalid %s type \"%s\"", name, service.Type)
+	}
+
+	if service.URL == "" {
+		return nil
+	}
+
+	u, err := url.Parse(service.URL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid %s URL \"%s\"", name, service.URL)
+	}
+
+	return nil
+}
+
+// validateConfiguration checks a CONFIGURE payload and returns the
+// unmarshalled configuration.
+func validateConfiguration(payload []byte) (*payloads.Configure, error) {
+	var cfg payloads.Configure
+
+	if err := yaml.Unmarshal(payload, &cfg); err != nil {
+		return nil, err
+	}
+
+	scheduler := cfg.Configure.Scheduler
+	if scheduler.ConfigStorageType != "" {
+		if _, err := newConfigStore(scheduler.ConfigStorageType, scheduler.ConfigStorageURI); err != nil {
+			return nil, err
+		}
+	}
+
+	port := cfg.Configure.Controller.ComputePort
+	if port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid compute port %d", port)
+	}
+
+	launcher := cfg.Configure.Launcher
+	if err := validateCIDR("compute network", launcher.ComputeNetwork); err != nil {
+		return nil, err
+	}
+	if err := validateCIDR("management network", launcher.ManagementNetwork); err != nil {
+		return nil, err
+	}
+
+	if err := validateService("image service", cfg.Configure.ImageService, payloads.Glance); err != nil {
+		return nil, err
+	}
+	if err := validateService("identity service", cfg.Configure.IdentityService, payloads.Keystone); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// Load the last stored configuration and hand it to new SSNTP clients.
+// A stored configuration which no longer validates is ignored.
+func (sched *ssntpSchedulerServer) loadConfiguration() error {
+	sched.configMutex.Lock()
+	defer sched.configMutex.Unlock()
+
+	payload, err := sched.configStore.load()
+	if err != nil {
+		return err
+	}
+
+	if payload == nil {
+		glog.Infof("No cluster configuration in %s\n", sched.configStore)
+		return nil
+	}
+
+	cfg, err := validateConfiguration(payload)
+	if err != nil {
+		return fmt.Errorf("invalid cluster configuration in %s: %s", sched.configStore, err)
+	}
+
+	// The configuration may have moved its storage since it was
+	// stored in the bootstrap one.
+	scheduler := cfg.Configure.Scheduler
+	if scheduler.ConfigStorageType != "" {
+		store, err := newConfigStore(scheduler.ConfigStorageType, scheduler.ConfigStorageURI)
+		if err != nil {
+			return err
+		}
+		sched.configStore = store
+	}
+
+	sched.configuration = payload
+	sched.ssntp.SetClusterConfiguration(payload)
+
+	glog.Infof("Loaded cluster configuration from %s\n", sched.configStore)
+
+	return nil
+}
+
+// Persist payload, switching to the storage backend it names if any,
+// and make it the current cluster configuration.  The bootstrap
+// storage is kept up to date too, so that the configuration and the
+// storage it moved to are found again after a restart.
+// The configuration is not applied if it cannot be stored.
+// The configMutex must be held.
+func (sched *ssntpSchedulerServer) applyConfiguration(cfg *payloads.Configure, payload []byte) error {
+	store := sched.configStore
+
+	scheduler := cfg.Configure.Scheduler
+	if scheduler.ConfigStorageType != "" {
+		var err error
+		store, err = newConfigStore(scheduler.ConfigStorageType, scheduler.ConfigStorageURI)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := store.store(payload); err != nil {
+		return fmt.Errorf("unable to store cluster configuration in %s: %s", store, err)
+	}
+
+	bootstrap := sched.bootstrapStore
+	if bootstrap != nil && bootstrap.String() != store.String() {
+		if err := bootstrap.store(payload); err != nil {
+			return fmt.Errorf("unable to store cluster configuration in %s: %s", bootstrap, err)
+		}
+	}
+
+	if store.String() != sched.configStore.String() {
+		glog.Infof("Cluster configuration storage moved to %s\n", store)
+		sched.configStore = store
+	}
+
+	sched.configuration = payload
+	sched.ssntp.SetClusterConfiguration(payload)
+
+	return nil
+}
+
+// Return the UUIDs of all agents and standby schedulers a CONFIGURE
+// command is broadcast to.
+func (sched *ssntpSchedulerServer) configurationRecipients() []string {
+	var uuids []string
+
+	sched.cnMutex.RLock()
+	for uuid := range sched.cnMap {
+		uuids = append(uuids, uuid)
+	}
+	sched.cnMutex.RUnlock()
+
+	sched.nnMutex.RLock()
+	for uuid := range sched.nnMap {
+		uuids = append(uuids, uuid)
+	}
+	sched.nnMutex.RUnlock()
+
+	sched.cnciMutex.RLock()
+	for uuid := range sched.cnciMap {
+		uuids = append(uuids, uuid)
+	}
+	sched.cnciMutex.RUnlock()
+
+	sched.peerMutex.RLock()
+	for uuid := range sched.peerMap {
+		uuids = append(uuids, uuid)
+	}
+	sched.peerMutex.RUnlock()
+
+	return uuids
+}
+
+// Validate a CONFIGURE command from the controller.  Valid
+// configurations are stored and forwarded to all agents, invalid ones
+// and the ones which cannot be stored are sent back to the controller
+// with an InvalidConfiguration error.
+func (sched *ssntpSchedulerServer) configure(controllerUUID string, payload []byte) (dest ssntp.ForwardDestination) {
+	cfg, err := validateConfiguration(payload)
+	if err != nil {
+		glog.Warningf("Invalid CONFIGURE from %s: %s\n", controllerUUID, err)
+		sched.ssntp.SendError(controllerUUID, ssntp.InvalidConfiguration, payload)
+		dest.SetDecision(ssntp.Discard)
+		return
+	}
+
+	sched.configMutex.Lock()
+	previous := sched.configuration
+	err = sched.applyConfiguration(cfg, payload)
+	if err == nil {
+		sched.prevConfiguration = previous
+	}
+	sched.configMutex.Unlock()
+
+	if err != nil {
+		glog.Errorf("Rejecting CONFIGURE from %s: %s\n", controllerUUID, err)
+		sched.ssntp.SendError(controllerUUID, ssntp.InvalidConfiguration, payload)
+		dest.SetDecision(ssntp.Discard)
+		return
+	}
+
+	recipients := sched.configurationRecipients()
+	if len(recipients) == 0 {
+		dest.SetDecision(ssntp.Discard)
+		return
+	}
+
+	for _, uuid := range recipients {
+		dest.AddRecipient(uuid)
+	}
+
+	return
+}
+
+// An agent could not apply the current configuration: roll back to the
+// previous valid one and broadcast it again.  Only one level of rollback
+// is kept, so further errors about the same configuration are ignored.
+func (sched *ssntpSchedulerServer) rollbackConfiguration(uuid string, payload []byte) {
+	sched.configMutex.Lock()
+
+	if bytes.Equal(payload, sched.configuration) == false {
+		sched.configMutex.Unlock()
+		glog.V(2).Infof("Ignoring InvalidConfiguration from %s for a stale configuration\n", uuid)
+		return
+	}
+
+	if sched.prevConfiguration == nil {
+		sched.configMutex.Unlock()
+		glog.Warningf("Agent %s rejected the cluster configuration, no previous one to roll back to\n", uuid)
+		return
+	}
+
+	previous := sched.prevConfiguration
+	cfg, err := validateConfiguration(previous)
+	if err != nil {
+		sched.configMutex.Unlock()
+		glog.Errorf("Unable to roll back to previous configuration: %s\n", err)
+		return
+	}
+
+	if err := sched.applyConfiguration(cfg, previous); err != nil {
+		sched.configMutex.Unlock()
+		glog.Errorf("Unable to roll back to previous configuration: %s\n", err)
+		return
+	}
+
+	glog.Warningf("Agent %s rejected the cluster configuration, rolling back\n", uuid)
+	sched.prevConfiguration = nil
+	sched.configMutex.Unlock()
+
+	for _, agent := range sched.configurationRecipients() {
+		_, err := sched.ssntp.SendCommand(agent, ssntp.CONFIGURE, previous)
+		if err != nil {
+			glog.Errorf("Unable to send CONFIGURE to %s: %s\n", agent, err)
+		}
+	}
+}
@@ -95,8 +95,36 @@ incurs latencies and hinders scalability.
 Today a compute node that has no remaining capacity (modulo a buffer
 amount for the launcher and host OS's stability) will report that
 it is full and the scheduler will not dispatch work to that node.
+Compute nodes are often only briefly full, e.g. while a batch of
+workloads is being launched and before the nodes report their updated
+statistics.  A START command that does not fit anywhere is thus
+queued, in a bounded FIFO per controller ("-pending-starts"), and
+dispatched as soon as a compute node reports being READY again.
 As a last resort, ciao-scheduler will return a "cloud full" status to
-ciao-controller if no compute nodes have capacity to do work.
+ciao-controller if no compute nodes have capacity to do work within
+"-pending-start-wait", or if the controller's queue is full.
+
+The "-policy" command line option lets the cloud administrator trade
+some of that speed for a denser or a more even packing of the cluster:
+
+  first-fit: the default, picks the first node with enough room for the
+             workload, starting right after the most recently used node.
+  best-fit:  bin-packs workloads, picking the node which would be left
+             with the least free memory, vcpus and disk.
+  spread:    picks the node which would be left with the most free
+             memory, vcpus and disk.
+
+Both best-fit and spread walk the whole compute node list for each
+workload.
+
+Whatever the policy, the constraints section of a START payload
+further restricts the candidate nodes.  A node must carry all the
+required labels reported by its launcher ("-labels"), and must not
+already run an instance of the workload's anti-affinity group.
+Nodes carrying the preferred labels are tried first, falling back to
+the other nodes when none of them fits.  Anti-affinity groups are
+claimed on dispatch, like the other resources, so that instances of
+the same group started in a burst do not end up on the same node.
 
 Data Structures and Scale
 
@@ -132,6 +160,25 @@ restart, or be stopped and updated and restarted, and launcher agents
 will simply reconnect and keep on continually updating the scheduler of
 any changes in their node statistics.
 
+The one piece of state the scheduler does persist is the cluster
+configuration.  The controller sends it down in CONFIGURE commands; the
+scheduler validates it, stores it (in a local file or in etcd, per the
+"-config-storage-type" and "-config-storage-uri" command line options,
+or per the storage settings of the configuration itself), and forwards
+it to every compute node, network node and CNCI agent.  When the
+configuration names another storage, it is stored there and in the
+command line one, so that it is found again after a restart.  New agents
+get the latest configuration in their CONNECTED frame.  Invalid
+configurations, and the ones which cannot be stored, are bounced back to
+the controller with an InvalidConfiguration error, and an agent reporting InvalidConfiguration
+makes the scheduler roll back to the previous valid configuration.
+
+A standby scheduler (see the "-peer" command line option) follows the
+primary scheduler's node statistics and cluster configuration over an
+SSNTP connection of its own, and starts serving once the primary is
+gone.  Launchers and controllers then fail over to it through their SSNTP
+URI lists.
+
 Fairness
 
 Ciao-scheduler currently implements an extremely trivial algorithm to
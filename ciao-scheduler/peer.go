@@ -0,0 +1,304 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"github.com/golang/glog"
+	"gopkg.in/yaml.v2"
+	"sync"
+	"time"
+)
+
+// peerNode is a standby scheduler's copy of the state the primary
+// scheduler holds for one of its compute or network nodes.
+type peerNode struct {
+	status ssntp.Status
+	stats  payloads.Ready
+}
+
+// schedulerPeer is the SSNTP client a standby scheduler uses to follow
+// the primary scheduler's state.  The primary sends it NodeConnected and
+// NodeDisconnected events, node STATUS frames and CONFIGURE commands.
+// Node state is only dropped when the node connects to this scheduler.
+type schedulerPeer struct {
+	sched *ssntpSchedulerServer
+	ssntp ssntp.Client
+	lost  chan struct{}
+	once  sync.Once
+}
+
+func newSchedulerPeer(sched *ssntpSchedulerServer) *schedulerPeer {
+	return &schedulerPeer{
+		sched: sched,
+		lost:  make(chan struct{}),
+	}
+}
+
+func (peer *schedulerPeer) ConnectNotify() {
+	glog.Infof("Standing by for primary scheduler %s\n", peer.ssntp.UUID())
+
+	payload := peer.ssntp.ClusterConfiguration()
+	if payload != nil {
+		peer.sched.followConfiguration(payload)
+	}
+}
+
+// The SSNTP client would reconnect to any scheduler in its URI list,
+// with growing delays.  A standby scheduler re-dials its primary itself
+// instead, so that it decides to take over within a bounded time.
+func (peer *schedulerPeer) DisconnectNotify() {
+	peer.once.Do(func() {
+		close(peer.lost)
+	})
+}
+
+func (peer *schedulerPeer) StatusNotify(status ssntp.Status, frame *ssntp.Frame) {
+	var stats payloads.Ready
+
+	err := yaml.Unmarshal(frame.Payload, &stats)
+	if err != nil || stats.NodeUUID == "" {
+		glog.Errorf("Bad %s yaml from primary scheduler\n", status)
+		return
+	}
+
+	peer.sched.peerMutex.Lock()
+	defer peer.sched.peerMutex.Unlock()
+
+	// Frames are processed concurrently, the status may beat the
+	// NodeConnected event
+	node := peer.sched.peerNodes[stats.NodeUUID]
+	if node == nil {
+		node = &peerNode{}
+		peer.sched.peerNodes[stats.NodeUUID] = node
+	}
+
+	node.status = status
+	if status == ssntp.READY {
+		node.stats = stats
+	}
+}
+
+func (peer *schedulerPeer) CommandNotify(command ssntp.Command, frame *ssntp.Frame) {
+	switch command {
+	case ssntp.CONFIGURE:
+		peer.sched.followConfiguration(frame.Payload)
+	default:
+		glog.V(2).Infof("Ignoring %s command from primary scheduler\n", command)
+	}
+}
+
+func (peer *schedulerPeer) EventNotify(event ssntp.Event, frame *ssntp.Frame) {
+	peer.sched.peerMutex.Lock()
+	defer peer.sched.peerMutex.Unlock()
+
+	switch event {
+	case ssntp.NodeConnected:
+		var ev payloads.NodeConnected
+		err := yaml.Unmarshal(frame.Payload, &ev)
+		if err != nil {
+			glog.Errorf("Bad %s yaml from primary scheduler\n", event)
+			return
+		}
+
+		if peer.sched.peerNodes[ev.Connected.NodeUUID] == nil {
+			peer.sched.peerNodes[ev.Connected.NodeUUID] = &peerNode{status: ssntp.CONNECTED}
+		}
+	case ssntp.NodeDisconnected:
+		// Keep the node state around: a primary scheduler shutting
+		// down disconnects all its nodes, and those are precisely the
+		// ones we expect to reconnect to us once we take over.
+	}
+}
+
+func (peer *schedulerPeer) ErrorNotify(error ssntp.Error, frame *ssntp.Frame) {
+	glog.V(2).Infof("ERROR %v from primary scheduler\n", error)
+}
+
+// Dial the primary scheduler and follow it until the connection is lost.
+// followPrimary returns false if the primary could not be reached within
+// peerWait.
+func (sched *ssntpSchedulerServer) followPrimary() bool {
+	peer := newSchedulerPeer(sched)
+	dialed := make(chan error, 1)
+
+	go func() {
+		dialed <- peer.ssntp.Dial(sched.peerConfig, peer)
+	}()
+
+	select {
+	case err := <-dialed:
+		if err != nil {
+			glog.Warningf("Unable to reach primary scheduler (%s)\n", err)
+			return false
+		}
+	case <-time.After(sched.peerWait):
+		glog.Infof("No primary scheduler found\n")
+		peer.ssntp.Close()
+		return false
+	}
+
+	<-peer.lost
+	peer.ssntp.Close()
+
+	return true
+}
+
+// Stand by for the primary scheduler for as long as it is alive.
+// standBy returns when this scheduler should start serving SSNTP clients,
+// either because no primary answered within peerWait or because the
+// primary went away.  A lost primary is re-dialed for peerWait before
+// taking over, and followed again if it answers: a standby scheduler
+// never takes over from a reachable primary.
+func (sched *ssntpSchedulerServer) standBy() {
+	if sched.peerConfig == nil {
+		return
+	}
+
+	if sched.followPrimary() == false {
+		glog.Infof("Becoming primary\n")
+		return
+	}
+
+	for {
+		glog.Warningf("Lost primary scheduler, re-dialing it for %s\n", sched.peerWait)
+		if sched.followPrimary() == false {
+			break
+		}
+	}
+
+	glog.Warningf("Primary scheduler gone, taking over\n")
+}
+
+// Seed a newly connected node with the state the primary scheduler last
+// reported for it, so that a scheduler which just took over can place
+// workloads on it right away.  The node must not be visible yet.
+func (sched *ssntpSchedulerServer) seedNodeFromPeer(node *nodeStat) {
+	sched.peerMutex.Lock()
+	peer := sched.peerNodes[node.uuid]
+	delete(sched.peerNodes, node.uuid)
+	sched.peerMutex.Unlock()
+
+	if peer == nil {
+		return
+	}
+
+	node.status = peer.status
+	if peer.status == ssntp.READY {
+		setNodeStats(node, &peer.stats)
+	}
+}
+
+// Track the cluster configuration of the primary scheduler, so that it
+// can be served to new clients after a take over.
+func (sched *ssntpSchedulerServer) followConfiguration(payload []byte) {
+	cfg, err := validateConfiguration(payload)
+	if err != nil {
+		glog.Warningf("Invalid configuration from primary scheduler: %s\n", err)
+		return
+	}
+
+	sched.configMutex.Lock()
+	defer sched.configMutex.Unlock()
+
+	if bytes.Equal(payload, sched.configuration) == true {
+		return
+	}
+
+	previous := sched.configuration
+	if err := sched.applyConfiguration(cfg, payload); err != nil {
+		glog.Errorf("Unable to follow primary scheduler configuration: %s\n", err)
+		return
+	}
+	sched.prevConfiguration = previous
+}
+
+// Add state for newly connected standby Scheduler, and send it the
+// state of all currently connected nodes.
+// This function is symmetric with disconnectPeerScheduler().
+func connectPeerScheduler(sched *ssntpSchedulerServer, uuid string) {
+	sched.peerMutex.Lock()
+	if sched.peerMap[uuid] == true {
+		sched.peerMutex.Unlock()
+		glog.Warningf("Unexpected reconnect from scheduler %s\n", uuid)
+		return
+	}
+	sched.peerMap[uuid] = true
+	sched.peerMutex.Unlock()
+
+	sched.cnMutex.RLock()
+	for _, node := range sched.cnList {
+		sched.sendPeerNode(uuid, node, payloads.ComputeNode)
+	}
+	sched.cnMutex.RUnlock()
+
+	sched.nnMutex.RLock()
+	for _, node := range sched.nnMap {
+		sched.sendPeerNode(uuid, node, payloads.NetworkNode)
+	}
+	sched.nnMutex.RUnlock()
+}
+
+// Undo previous state additions for departed standby Scheduler
+// This function is symmetric with connectPeerScheduler().
+func disconnectPeerScheduler(sched *ssntpSchedulerServer, uuid string) {
+	sched.peerMutex.Lock()
+	defer sched.peerMutex.Unlock()
+
+	if sched.peerMap[uuid] == false {
+		glog.Warningf("Unexpected disconnect from scheduler %s\n", uuid)
+		return
+	}
+
+	delete(sched.peerMap, uuid)
+}
+
+func (sched *ssntpSchedulerServer) sendPeerNode(peerUUID string, node *nodeStat, nodeType payloads.Resource) {
+	node.mutex.Lock()
+	status := node.status
+	stats := payloads.Ready{
+		NodeUUID:        node.uuid,
+		MemTotalMB:      node.memTotalMB,
+		MemAvailableMB:  node.memAvailMB,
+		DiskTotalMB:     node.diskTotalMB,
+		DiskAvailableMB: node.diskAvailMB,
+		Load:            node.load,
+		CpusOnline:      node.cpus,
+		VCPUsAllocated:  node.cpus - node.vcpusAvail,
+		Labels:          node.labels,
+	}
+	for group := range node.antiAffinityGroups {
+		stats.AntiAffinityGroups = append(stats.AntiAffinityGroups, group)
+	}
+	node.mutex.Unlock()
+
+	sched.sendNodeConnectionEvent(stats.NodeUUID, peerUUID, nodeType, true)
+
+	if status == ssntp.CONNECTED {
+		return
+	}
+
+	payload, err := yaml.Marshal(&stats)
+	if err != nil {
+		glog.Errorf("Unable to Marshall Status %v", err)
+		return
+	}
+
+	sched.ssntp.SendStatus(peerUUID, status, payload)
+}
@@ -0,0 +1,172 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"github.com/golang/glog"
+	"time"
+)
+
+// pendingStart is a START command which could not be dispatched because
+// all compute nodes were full.  It waits in its controller's FIFO until
+// a compute node reports being READY, or until its timer fires.
+type pendingStart struct {
+	payload  []byte
+	workload workResources
+	timer    *time.Timer
+}
+
+// Queue a START command for which no compute node could be found.
+// Returns false if the command could not be queued, either because
+// queueing is disabled or because the controller's queue is full.
+func (sched *ssntpSchedulerServer) queuePendingStart(controller *controllerStat, payload []byte, workload *workResources) bool {
+	if sched.pendingStartsMax <= 0 {
+		return false
+	}
+
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	if len(controller.pendingStarts) >= sched.pendingStartsMax {
+		glog.Warningf("Pending START queue full for controller %s\n", controller.uuid)
+		return false
+	}
+
+	pending := &pendingStart{
+		payload:  payload,
+		workload: *workload,
+	}
+	pending.timer = time.AfterFunc(sched.pendingStartWait, func() {
+		sched.expirePendingStart(controller, pending)
+	})
+	controller.pendingStarts = append(controller.pendingStarts, pending)
+
+	glog.V(2).Infof("Queued START for instance %s (%d pending for controller %s)\n",
+		workload.instanceUUID, len(controller.pendingStarts), controller.uuid)
+
+	return true
+}
+
+// hasPendingStarts returns true if START commands from controller are
+// waiting for a compute node.
+func hasPendingStarts(controller *controllerStat) bool {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	return len(controller.pendingStarts) > 0
+}
+
+// Remove pending from its controller's queue, returning false if it
+// was no longer queued.  The controller must be locked.
+func removePendingStart(controller *controllerStat, pending *pendingStart) bool {
+	for i, p := range controller.pendingStarts {
+		if p != pending {
+			continue
+		}
+
+		controller.pendingStarts = append(controller.pendingStarts[:i], controller.pendingStarts[i+1:]...)
+		return true
+	}
+
+	return false
+}
+
+// Drop a START command which waited too long in the queue and
+// let the controller know it could not be dispatched.
+func (sched *ssntpSchedulerServer) expirePendingStart(controller *controllerStat, pending *pendingStart) {
+	controller.mutex.Lock()
+	removed := removePendingStart(controller, pending)
+	controller.mutex.Unlock()
+
+	if removed == false {
+		return
+	}
+
+	sched.sendStartFailureError(controller.uuid, pending.workload.instanceUUID, payloads.FullCloud)
+}
+
+// Drop all queued START commands for a departing controller.
+// The controller must be locked.
+func flushPendingStarts(controller *controllerStat) {
+	for _, p := range controller.pendingStarts {
+		p.timer.Stop()
+	}
+	controller.pendingStarts = nil
+}
+
+// Dispatch as many queued START commands as the compute nodes can
+// take, in FIFO order for each controller.  Draining a controller's
+// queue stops at the first command that does not fit anywhere.
+func (sched *ssntpSchedulerServer) drainPendingStarts() {
+	sched.pendingDrainMutex.Lock()
+	defer sched.pendingDrainMutex.Unlock()
+
+	sched.controllerMutex.RLock()
+	controllers := make([]*controllerStat, len(sched.controllerList))
+	copy(controllers, sched.controllerList)
+	sched.controllerMutex.RUnlock()
+
+	for _, controller := range controllers {
+		for {
+			controller.mutex.Lock()
+			if len(controller.pendingStarts) == 0 {
+				controller.mutex.Unlock()
+				break
+			}
+			pending := controller.pendingStarts[0]
+			controller.mutex.Unlock()
+
+			node := pickComputeNode(sched, &pending.workload)
+			if node == nil {
+				break
+			}
+
+			// The START may have expired while we were looking for a node
+			controller.mutex.Lock()
+			claimed := pending.timer.Stop() && removePendingStart(controller, pending)
+			controller.mutex.Unlock()
+
+			if claimed == false {
+				node.mutex.Unlock()
+				continue
+			}
+
+			group := pending.workload.antiAffinityGroup
+			grouped := node.antiAffinityGroups[group]
+			sched.decrementResourceUsage(node, &pending.workload)
+			nodeUUID := node.uuid
+			node.mutex.Unlock()
+
+			glog.V(2).Infof("Dispatching queued START for instance %s to %s\n", pending.workload.instanceUUID, nodeUUID)
+			_, err := sched.ssntp.SendCommand(nodeUUID, ssntp.START, pending.payload)
+			if err != nil {
+				glog.Errorf("Unable to dispatch queued START for instance %s: %s\n", pending.workload.instanceUUID, err)
+
+				node.mutex.Lock()
+				sched.incrementResourceUsage(node, &pending.workload)
+				if group != "" && grouped == false {
+					delete(node.antiAffinityGroups, group)
+				}
+				node.mutex.Unlock()
+
+				sched.sendStartFailureError(controller.uuid, pending.workload.instanceUUID, payloads.FullComputeNode)
+			}
+		}
+	}
+}
@@ -0,0 +1,205 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+)
+
+// placementPolicy chooses a compute node for a workload.
+//
+// pickNode is called with the scheduler's cnMutex held for reading and
+// with at least two compute nodes in cnList.  As several workloads can be
+// placed concurrently, the most recently used node must only be accessed
+// through getMRU() and setMRU().  It returns either nil or a
+// locked nodeStat for which workloadFits() is true.
+type placementPolicy interface {
+	pickNode(sched *ssntpSchedulerServer, workload *workResources) *nodeStat
+	String() string
+}
+
+const (
+	firstFitPolicyName = "first-fit"
+	bestFitPolicyName  = "best-fit"
+	spreadPolicyName   = "spread"
+)
+
+func newPlacementPolicy(name string) (placementPolicy, error) {
+	switch name {
+	case firstFitPolicyName:
+		return firstFitPolicy{}, nil
+	case bestFitPolicyName:
+		return bestFitPolicy{}, nil
+	case spreadPolicyName:
+		return spreadPolicy{}, nil
+	}
+
+	return nil, fmt.Errorf("unknown placement policy \"%s\"", name)
+}
+
+// getMRU returns the most recently used compute node and its cnList index.
+func (sched *ssntpSchedulerServer) getMRU() (*nodeStat, int) {
+	sched.cnMRUMutex.Lock()
+	defer sched.cnMRUMutex.Unlock()
+
+	return sched.cnMRU, sched.cnMRUIndex
+}
+
+// setMRU records the most recently used compute node and its cnList index.
+func (sched *ssntpSchedulerServer) setMRU(node *nodeStat, index int) {
+	sched.cnMRUMutex.Lock()
+	sched.cnMRU = node
+	sched.cnMRUIndex = index
+	sched.cnMRUMutex.Unlock()
+}
+
+// firstFitPolicy returns the first node with enough room for the
+// workload, starting the search right after the most recently used node
+// so that consecutive workloads do not all land on the same node.
+type firstFitPolicy struct{}
+
+func (p firstFitPolicy) String() string {
+	return firstFitPolicyName
+}
+
+func (p firstFitPolicy) pickNode(sched *ssntpSchedulerServer, workload *workResources) *nodeStat {
+	mru, mruIndex := sched.getMRU()
+
+	/* First try nodes after the MRU */
+	if mruIndex != -1 && mruIndex < len(sched.cnList)-1 {
+		for i, node := range sched.cnList[mruIndex+1:] {
+			node.mutex.Lock()
+			if node == mru {
+				node.mutex.Unlock()
+				continue
+			}
+
+			if sched.workloadFits(node, workload) == true {
+				sched.setMRU(node, mruIndex+1+i)
+				return node // locked nodeStat
+			}
+			node.mutex.Unlock()
+		}
+	}
+
+	/* Then try the whole list, including the MRU */
+	for i, node := range sched.cnList {
+		node.mutex.Lock()
+		if sched.workloadFits(node, workload) == true {
+			sched.setMRU(node, i)
+			return node // locked nodeStat
+		}
+		node.mutex.Unlock()
+	}
+
+	return nil
+}
+
+// bestFitPolicy bin-packs workloads, returning the node that would be
+// left with the least free resources once the workload is placed on it.
+type bestFitPolicy struct{}
+
+func (p bestFitPolicy) String() string {
+	return bestFitPolicyName
+}
+
+func (p bestFitPolicy) pickNode(sched *ssntpSchedulerServer, workload *workResources) *nodeStat {
+	return pickScoredNode(sched, workload, func(score, best float64) bool {
+		return score < best
+	})
+}
+
+// spreadPolicy returns the node that would be left with the most free
+// resources once the workload is placed on it.
+type spreadPolicy struct{}
+
+func (p spreadPolicy) String() string {
+	return spreadPolicyName
+}
+
+func (p spreadPolicy) pickNode(sched *ssntpSchedulerServer, workload *workResources) *nodeStat {
+	return pickScoredNode(sched, workload, func(score, best float64) bool {
+		return score > best
+	})
+}
+
+// freeRatio returns the average fraction of a locked node's tracked
+// resources that would remain free once workload is placed on it.
+// Resources for which the node did not report a total are ignored.
+func freeRatio(node *nodeStat, workload *workResources) float64 {
+	var sum float64
+	var count int
+
+	if node.memTotalMB > 0 {
+		sum += float64(node.memAvailMB-workload.memReqMB) / float64(node.memTotalMB)
+		count++
+	}
+
+	if node.cpus > 0 {
+		sum += float64(node.vcpusAvail-workload.vcpusReq) / float64(node.cpus)
+		count++
+	}
+
+	if node.diskTotalMB > 0 {
+		sum += float64(node.diskAvailMB-workload.diskReqMB) / float64(node.diskTotalMB)
+		count++
+	}
+
+	if count == 0 {
+		return 0
+	}
+
+	return sum / float64(count)
+}
+
+// pickScoredNode walks the whole compute node list and returns the
+// fitting node whose freeRatio() is preferred by better().
+// The current best candidate stays locked while the walk carries on.
+// Nodes are always locked in cnList order, so concurrent walks
+// can not deadlock.
+func pickScoredNode(sched *ssntpSchedulerServer, workload *workResources, better func(score, best float64) bool) *nodeStat {
+	var best *nodeStat
+	var bestScore float64
+	bestIndex := -1
+
+	for i, node := range sched.cnList {
+		node.mutex.Lock()
+		if sched.workloadFits(node, workload) == false {
+			node.mutex.Unlock()
+			continue
+		}
+
+		score := freeRatio(node, workload)
+		if best != nil && better(score, bestScore) == false {
+			node.mutex.Unlock()
+			continue
+		}
+
+		if best != nil {
+			best.mutex.Unlock()
+		}
+		best = node
+		bestScore = score
+		bestIndex = i
+	}
+
+	if best != nil {
+		sched.setMRU(best, bestIndex)
+	}
+
+	return best // locked nodeStat
+}
@@ -35,6 +35,16 @@ var cert = flag.String("cert", "/etc/pki/ciao/cert-Scheduler-localhost.pem", "Se
 var cacert = flag.String("cacert", "/etc/pki/ciao/CAcert-server-localhost.pem", "CA certificate")
 var cpuprofile = flag.String("cpuprofile", "", "Write cpu profile to file")
 var heartbeat = flag.Bool("heartbeat", false, "Emit status heartbeat text")
+var pendingStarts = flag.Int("pending-starts", 256, "Maximum number of START commands queued per controller while the cloud is full, 0 disables queueing")
+var pendingStartWait = flag.Duration("pending-start-wait", 30*time.Second, "Maximum time a START command stays queued before failing")
+var policy = flag.String("policy", firstFitPolicyName, "Compute node placement policy: first-fit, best-fit or spread")
+var configStorageType = flag.String("config-storage-type", payloads.Filesystem.String(), "Cluster configuration storage type: file or etcd")
+var configStorageURI = flag.String("config-storage-uri", "/etc/ciao/configuration.yaml", "Cluster configuration file path or etcd endpoint URL")
+var peer = flag.String("peer", "", "Peer scheduler URI, this scheduler stands by while the peer is alive")
+var peerWait = flag.Duration("peer-wait", 10*time.Second, "Maximum time to wait for the peer scheduler before becoming primary")
+var ssntpHeartbeat = flag.Duration("ssntp-heartbeat", 10*time.Second, "Interval between SSNTP PING frames sent to clients supporting heartbeats, 0 disables dead client detection")
+var ssntpHeartbeatMisses = flag.Int("ssntp-heartbeat-misses", 3, "Number of heartbeat intervals without any frame after which a client is disconnected")
+var statsAddr = flag.String("stats-addr", "", "Address, e.g. localhost:8889, of the HTTP endpoint listing SSNTP sessions and frame counters, empty disables it")
 var logDir = "/var/lib/ciao/logs/scheduler"
 
 type ssntpSchedulerServer struct {
@@ -59,12 +69,39 @@ type ssntpSchedulerServer struct {
 	cnMutex    sync.RWMutex // Rlock traversing map, Lock modifying map
 	cnMRU      *nodeStat
 	cnMRUIndex int
+	cnMRUMutex sync.Mutex // cnMRU and cnMRUIndex are updated while placing workloads concurrently
 	//cnInactiveMap      map[string]nodeStat
 
+	// Compute Node placement policy
+	policy placementPolicy
+
+	// START commands waiting for a compute node to become READY
+	pendingStartsMax  int
+	pendingStartWait  time.Duration
+	pendingDrainMutex sync.Mutex // serializes pending START queues draining
+
 	// Network Nodes
 	nnMap   map[string]*nodeStat
 	nnMutex sync.RWMutex // Rlock traversing map, Lock modifying map
 	nnMRU   string
+
+	// CNCI Agents
+	cnciMap   map[string]bool
+	cnciMutex sync.RWMutex // Rlock traversing map, Lock modifying map
+
+	// Peer Schedulers
+	peerMap    map[string]bool      // standby schedulers following us
+	peerNodes  map[string]*peerNode // primary scheduler's nodes, while standing by
+	peerMutex  sync.RWMutex         // Rlock traversing maps, Lock modifying maps
+	peerConfig *ssntp.Config
+	peerWait   time.Duration
+
+	// Cluster configuration
+	configMutex       sync.Mutex
+	configStore       configStore
+	bootstrapStore    configStore // storage named on the command line
+	configuration     []byte      // latest valid CONFIGURE payload
+	prevConfiguration []byte      // CONFIGURE payload to roll back to
 }
 
 func newSsntpSchedulerServer() *ssntpSchedulerServer {
@@ -73,17 +110,28 @@ func newSsntpSchedulerServer() *ssntpSchedulerServer {
 		cnMap:         make(map[string]*nodeStat),
 		cnMRUIndex:    -1,
 		nnMap:         make(map[string]*nodeStat),
+		cnciMap:       make(map[string]bool),
+		peerMap:       make(map[string]bool),
+		peerNodes:     make(map[string]*peerNode),
+		policy:        firstFitPolicy{},
 	}
 }
 
 type nodeStat struct {
-	mutex      sync.Mutex
-	status     ssntp.Status
-	uuid       string
-	memTotalMB int
-	memAvailMB int
-	load       int
-	cpus       int
+	mutex       sync.Mutex
+	status      ssntp.Status
+	uuid        string
+	memTotalMB  int
+	memAvailMB  int
+	diskTotalMB int
+	diskAvailMB int
+	load        int
+	cpus        int
+	vcpusAvail  int
+	labels      map[string]string
+
+	// anti-affinity groups of the instances running on the node
+	antiAffinityGroups map[string]bool
 }
 
 type controllerStatus uint8
@@ -105,9 +153,10 @@ const (
 )
 
 type controllerStat struct {
-	mutex  sync.Mutex
-	status controllerStatus
-	uuid   string
+	mutex         sync.Mutex
+	status        controllerStatus
+	uuid          string
+	pendingStarts []*pendingStart // FIFO of START commands waiting for room
 }
 
 func (sched *ssntpSchedulerServer) sendNodeConnectionEvent(nodeUUID, controllerUUID string, nodeType payloads.Resource, connected bool) (int, error) {
@@ -151,6 +200,13 @@ func (sched *ssntpSchedulerServer) sendNodeConnectedEvents(nodeUUID string, node
 	for _, c := range sched.controllerMap {
 		sched.sendNodeConnectionEvent(nodeUUID, c.uuid, nodeType, true)
 	}
+
+	sched.peerMutex.RLock()
+	defer sched.peerMutex.RUnlock()
+
+	for uuid := range sched.peerMap {
+		sched.sendNodeConnectionEvent(nodeUUID, uuid, nodeType, true)
+	}
 }
 
 func (sched *ssntpSchedulerServer) sendNodeDisconnectedEvents(nodeUUID string, nodeType payloads.Resource) {
@@ -160,6 +216,13 @@ func (sched *ssntpSchedulerServer) sendNodeDisconnectedEvents(nodeUUID string, n
 	for _, c := range sched.controllerMap {
 		sched.sendNodeConnectionEvent(nodeUUID, c.uuid, nodeType, false)
 	}
+
+	sched.peerMutex.RLock()
+	defer sched.peerMutex.RUnlock()
+
+	for uuid := range sched.peerMap {
+		sched.sendNodeConnectionEvent(nodeUUID, uuid, nodeType, false)
+	}
 }
 
 // Add state for newly connected Controller
@@ -202,6 +265,10 @@ func disconnectController(sched *ssntpSchedulerServer, uuid string) {
 		return
 	}
 
+	controller.mutex.Lock()
+	flushPendingStarts(controller)
+	controller.mutex.Unlock()
+
 	// delete from map, remove from list
 	delete(sched.controllerMap, uuid)
 	for i, c := range sched.controllerList {
@@ -248,6 +315,7 @@ func connectComputeNode(sched *ssntpSchedulerServer, uuid string) {
 	var node nodeStat
 	node.status = ssntp.CONNECTED
 	node.uuid = uuid
+	sched.seedNodeFromPeer(&node)
 	sched.cnList = append(sched.cnList, &node)
 	sched.cnMap[uuid] = &node
 
@@ -277,9 +345,8 @@ func disconnectComputeNode(sched *ssntpSchedulerServer, uuid string) {
 		sched.cnList = append(sched.cnList[:i], sched.cnList[i+1:]...)
 	}
 
-	if node == sched.cnMRU {
-		sched.cnMRU = nil
-		sched.cnMRUIndex = -1
+	if mru, _ := sched.getMRU(); node == mru {
+		sched.setMRU(nil, -1)
 	}
 
 	sched.sendNodeDisconnectedEvents(uuid, payloads.ComputeNode)
@@ -299,6 +366,7 @@ func connectNetworkNode(sched *ssntpSchedulerServer, uuid string) {
 	var node nodeStat
 	node.status = ssntp.CONNECTED
 	node.uuid = uuid
+	sched.seedNodeFromPeer(&node)
 	sched.nnMap[uuid] = &node
 
 	sched.sendNodeConnectedEvents(uuid, payloads.NetworkNode)
@@ -320,6 +388,35 @@ func disconnectNetworkNode(sched *ssntpSchedulerServer, uuid string) {
 
 	sched.sendNodeDisconnectedEvents(uuid, payloads.NetworkNode)
 }
+
+// Add state for newly connected CNCI Agent
+// This function is symmetric with disconnectCNCIAgent().
+func connectCNCIAgent(sched *ssntpSchedulerServer, uuid string) {
+	sched.cnciMutex.Lock()
+	defer sched.cnciMutex.Unlock()
+
+	if sched.cnciMap[uuid] == true {
+		glog.Warningf("Unexpected reconnect from CNCI agent %s\n", uuid)
+		return
+	}
+
+	sched.cnciMap[uuid] = true
+}
+
+// Undo previous state additions for departed CNCI Agent
+// This function is symmetric with connectCNCIAgent().
+func disconnectCNCIAgent(sched *ssntpSchedulerServer, uuid string) {
+	sched.cnciMutex.Lock()
+	defer sched.cnciMutex.Unlock()
+
+	if sched.cnciMap[uuid] == false {
+		glog.Warningf("Unexpected disconnect from CNCI agent %s\n", uuid)
+		return
+	}
+
+	delete(sched.cnciMap, uuid)
+}
+
 func (sched *ssntpSchedulerServer) ConnectNotify(uuid string, role uint32) {
 	switch role {
 	case ssntp.Controller:
@@ -328,6 +425,10 @@ func (sched *ssntpSchedulerServer) ConnectNotify(uuid string, role uint32) {
 		connectComputeNode(sched, uuid)
 	case ssntp.NETAGENT:
 		connectNetworkNode(sched, uuid)
+	case ssntp.CNCIAGENT:
+		connectCNCIAgent(sched, uuid)
+	case ssntp.SCHEDULER:
+		connectPeerScheduler(sched, uuid)
 	}
 
 	glog.V(2).Infof("Connect (role 0x%x, uuid=%s)\n", role, uuid)
@@ -341,11 +442,36 @@ func (sched *ssntpSchedulerServer) DisconnectNotify(uuid string, role uint32) {
 		disconnectComputeNode(sched, uuid)
 	case ssntp.NETAGENT:
 		disconnectNetworkNode(sched, uuid)
+	case ssntp.CNCIAGENT:
+		disconnectCNCIAgent(sched, uuid)
+	case ssntp.SCHEDULER:
+		disconnectPeerScheduler(sched, uuid)
 	}
 
 	glog.V(2).Infof("Connect (role 0x%x, uuid=%s)\n", role, uuid)
 }
 
+// Update a locked node with the statistics from its READY status frame.
+func setNodeStats(node *nodeStat, stats *payloads.Ready) {
+	node.memTotalMB = stats.MemTotalMB
+	node.memAvailMB = stats.MemAvailableMB
+	node.diskTotalMB = stats.DiskTotalMB
+	node.diskAvailMB = stats.DiskAvailableMB
+	node.load = stats.Load
+	node.cpus = stats.CpusOnline
+	// launchers predating vcpus_allocated do not report their claims
+	node.vcpusAvail = stats.CpusOnline
+	if stats.VCPUsAllocated > 0 {
+		node.vcpusAvail -= stats.VCPUsAllocated
+	}
+	node.labels = stats.Labels
+
+	node.antiAffinityGroups = make(map[string]bool)
+	for _, group := range stats.AntiAffinityGroups {
+		node.antiAffinityGroups[group] = true
+	}
+}
+
 func (sched *ssntpSchedulerServer) StatusNotify(uuid string, status ssntp.Status, frame *ssntp.Frame) {
 	payload := frame.Payload
 
@@ -389,40 +515,73 @@ func (sched *ssntpSchedulerServer) StatusNotify(uuid string, status ssntp.Status
 			glog.Errorf("Bad READY yaml for node %s\n", uuid)
 			return
 		}
-		node.memTotalMB = stats.MemTotalMB
-		node.memAvailMB = stats.MemAvailableMB
-		node.load = stats.Load
-		node.cpus = stats.CpusOnline
-		//TODO pull in other types of payloads.Ready struct data
+		setNodeStats(node, &stats)
+
+		// a compute node has room again, try to dispatch queued START commands
+		if sched.cnMap[uuid] != nil {
+			go sched.drainPendingStarts()
+		}
 	}
 }
 
 type workResources struct {
 	instanceUUID string
 	memReqMB     int
+	vcpusReq     int
+	diskReqMB    int
 	networkNode  int
+
+	// placement constraints
+	requiredLabels    map[string]string
+	preferredLabels   map[string]string
+	antiAffinityGroup string
 }
 
 func (sched *ssntpSchedulerServer) getWorkloadResources(work *payloads.Start) (workload workResources, err error) {
+	workload.instanceUUID = work.Start.InstanceUUID
+
 	// loop the array to find resources
 	for idx := range work.Start.RequestedResources {
+		resource := &work.Start.RequestedResources[idx]
+
+		switch resource.Type {
 		// memory:
-		if work.Start.RequestedResources[idx].Type == payloads.MemMB {
-			workload.memReqMB = work.Start.RequestedResources[idx].Value
-		}
+		case payloads.MemMB:
+			workload.memReqMB = resource.Value
+
+		// vcpus and disk only constrain placement when mandatory
+		case payloads.VCPUs:
+			if resource.Mandatory {
+				workload.vcpusReq = resource.Value
+			}
+		case payloads.DiskMB:
+			if resource.Mandatory {
+				workload.diskReqMB = resource.Value
+			}
 
 		// network node
-		if work.Start.RequestedResources[idx].Type == payloads.NetworkNode {
-			workload.networkNode = work.Start.RequestedResources[idx].Value
+		case payloads.NetworkNode:
+			workload.networkNode = resource.Value
 		}
 
 		// etc...
 	}
 
+	constraints := &work.Start.Constraints
+	workload.requiredLabels = constraints.RequiredLabels
+	workload.preferredLabels = constraints.PreferredLabels
+	workload.antiAffinityGroup = constraints.AntiAffinityGroup
+
 	// validate the found resources
 	if workload.memReqMB <= 0 {
 		return workload, fmt.Errorf("invalid start payload resource demand: mem_mb (%d) <= 0, must be > 0", workload.memReqMB)
 	}
+	if workload.vcpusReq < 0 {
+		return workload, fmt.Errorf("invalid start payload resource demand: vcpus (%d) < 0", workload.vcpusReq)
+	}
+	if workload.diskReqMB < 0 {
+		return workload, fmt.Errorf("invalid start payload resource demand: disk_mb (%d) < 0", workload.diskReqMB)
+	}
 	if workload.networkNode != 0 && workload.networkNode != 1 {
 		return workload, fmt.Errorf("invalid start payload resource demand: network_node (%d) is not 0 or 1", workload.networkNode)
 	}
@@ -430,14 +589,36 @@ func (sched *ssntpSchedulerServer) getWorkloadResources(work *payloads.Start) (w
 	return workload, nil
 }
 
-// Check resource demands are satisfiable by the referenced, locked nodeStat object
+// Check resource demands are satisfiable by the referenced, locked nodeStat object.
+// Resources the node did not report (negative totals) are not checked.
 func (sched *ssntpSchedulerServer) workloadFits(node *nodeStat, workload *workResources) bool {
-	// simple scheduling policy == first memory fit
-	if node.memAvailMB >= workload.memReqMB &&
-		node.status == ssntp.READY {
-		return true
+	if node.status != ssntp.READY {
+		return false
+	}
+
+	if node.memAvailMB < workload.memReqMB {
+		return false
 	}
-	return false
+
+	if node.cpus >= 0 && node.vcpusAvail < workload.vcpusReq {
+		return false
+	}
+
+	if node.diskTotalMB >= 0 && node.diskAvailMB < workload.diskReqMB {
+		return false
+	}
+
+	for key, value := range workload.requiredLabels {
+		if label, ok := node.labels[key]; !ok || label != value {
+			return false
+		}
+	}
+
+	if workload.antiAffinityGroup != "" && node.antiAffinityGroups[workload.antiAffinityGroup] == true {
+		return false
+	}
+
+	return true
 }
 
 func (sched *ssntpSchedulerServer) sendStartFailureError(clientUUID string, instanceUUID string, reason payloads.StartFailureReason) {
@@ -511,6 +692,18 @@ func (sched *ssntpSchedulerServer) getWorkloadAgentUUID(command ssntp.Command, p
 		var cmd payloads.Evacuate
 		err := yaml.Unmarshal(payload, &cmd)
 		return "", cmd.Evacuate.WorkloadAgentUUID, err
+	case ssntp.AttachVolume:
+		var cmd payloads.AttachVolume
+		err := yaml.Unmarshal(payload, &cmd)
+		return cmd.Attach.InstanceUUID, cmd.Attach.WorkloadAgentUUID, err
+	case ssntp.DetachVolume:
+		var cmd payloads.DetachVolume
+		err := yaml.Unmarshal(payload, &cmd)
+		return cmd.Detach.InstanceUUID, cmd.Detach.WorkloadAgentUUID, err
+	case ssntp.Snapshot:
+		var cmd payloads.Snapshot
+		err := yaml.Unmarshal(payload, &cmd)
+		return cmd.Snapshot.InstanceUUID, cmd.Snapshot.WorkloadAgentUUID, err
 	}
 }
 
@@ -530,21 +723,146 @@ func (sched *ssntpSchedulerServer) fwdCmdToComputeNode(command ssntp.Command, pa
 	return
 }
 
+func (sched *ssntpSchedulerServer) sendInstanceCommandError(controllerUUID string, command ssntp.Command, frame *ssntp.Frame, instanceUUID string, stopReason payloads.StopFailureReason, restartReason payloads.RestartFailureReason) {
+	var payload []byte
+	var err error
+	var ssntpError ssntp.Error
+	var reason string
+
+	switch command {
+	case ssntp.STOP:
+		ssntpError = ssntp.StopFailure
+		reason = stopReason.String()
+		payload, err = yaml.Marshal(&payloads.ErrorStopFailure{
+			InstanceUUID: instanceUUID,
+			Reason:       stopReason,
+		})
+	case ssntp.RESTART:
+		ssntpError = ssntp.RestartFailure
+		reason = restartReason.String()
+		payload, err = yaml.Marshal(&payloads.ErrorRestartFailure{
+			InstanceUUID: instanceUUID,
+			Reason:       restartReason,
+		})
+	}
+	if err != nil {
+		glog.Errorf("Unable to Marshall Status %v", err)
+		return
+	}
+
+	glog.Warningf("Unable to forward %s for %s: %s\n", command, instanceUUID, reason)
+	sched.ssntp.SendErrorReply(controllerUUID, frame.RequestID, ssntpError, payload)
+}
+
+// STOP and RESTART commands are waited for by the Controller, which needs
+// an answer even when they cannot be forwarded to their compute node.
+// We thus reply to the Controller with an ERROR frame carrying the command
+// request ID when the command payload is corrupt or when the node is not
+// connected.
+func (sched *ssntpSchedulerServer) fwdInstanceCmdToComputeNode(controllerUUID string, command ssntp.Command, frame *ssntp.Frame) (dest ssntp.ForwardDestination, instanceUUID string) {
+	instanceUUID, cnDestUUID, err := sched.getWorkloadAgentUUID(command, frame.Payload)
+	if err != nil {
+		glog.Errorf("Bad %s command yaml from Controller: %s\n", command.String(), err)
+		sched.sendInstanceCommandError(controllerUUID, command, frame, instanceUUID, payloads.StopInvalidPayload, payloads.RestartInvalidPayload)
+		dest.SetDecision(ssntp.Discard)
+		return
+	}
+
+	if instanceUUID == "" || cnDestUUID == "" {
+		glog.Errorf("Bad %s command yaml from Controller, WorkloadAgentUUID == %s\n", command.String(), cnDestUUID)
+		sched.sendInstanceCommandError(controllerUUID, command, frame, instanceUUID, payloads.StopInvalidData, payloads.RestartInvalidData)
+		dest.SetDecision(ssntp.Discard)
+		return
+	}
+
+	sched.cnMutex.RLock()
+	cn := sched.cnMap[cnDestUUID]
+	sched.cnMutex.RUnlock()
+
+	sched.nnMutex.RLock()
+	nn := sched.nnMap[cnDestUUID]
+	sched.nnMutex.RUnlock()
+
+	if cn == nil && nn == nil {
+		sched.sendInstanceCommandError(controllerUUID, command, frame, instanceUUID, payloads.StopNodeUnavailable, payloads.RestartNodeUnavailable)
+		dest.SetDecision(ssntp.Discard)
+		return
+	}
+
+	glog.V(2).Infof("Forwarding controller %s command to %s\n", command.String(), cnDestUUID)
+	dest.AddRecipient(cnDestUUID)
+
+	return
+}
+
 // Decrement resource claims for the referenced locked nodeStat object
 func (sched *ssntpSchedulerServer) decrementResourceUsage(node *nodeStat, workload *workResources) {
 	node.memAvailMB -= workload.memReqMB
+	node.vcpusAvail -= workload.vcpusReq
+	node.diskAvailMB -= workload.diskReqMB
+
+	// The next READY frame from the node will report the group as well
+	if workload.antiAffinityGroup != "" {
+		if node.antiAffinityGroups == nil {
+			node.antiAffinityGroups = make(map[string]bool)
+		}
+		node.antiAffinityGroups[workload.antiAffinityGroup] = true
+	}
+}
+
+// Give back the resource claims of a workload which could not be sent to
+// the referenced locked nodeStat object
+func (sched *ssntpSchedulerServer) incrementResourceUsage(node *nodeStat, workload *workResources) {
+	node.memAvailMB += workload.memReqMB
+	node.vcpusAvail += workload.vcpusReq
+	node.diskAvailMB += workload.diskReqMB
 }
 
-// Find suitable compute node, returning referenced to a locked nodeStat if found
-func pickComputeNode(sched *ssntpSchedulerServer, controllerUUID string, workload *workResources) (node *nodeStat) {
+// Return a copy of workload which also requires its preferred labels,
+// or nil if it has no preferred labels.
+func preferredWorkload(workload *workResources) *workResources {
+	if len(workload.preferredLabels) == 0 {
+		return nil
+	}
+
+	preferred := *workload
+	preferred.requiredLabels = make(map[string]string)
+	for key, value := range workload.requiredLabels {
+		preferred.requiredLabels[key] = value
+	}
+	for key, value := range workload.preferredLabels {
+		if _, ok := preferred.requiredLabels[key]; !ok {
+			preferred.requiredLabels[key] = value
+		}
+	}
+
+	return &preferred
+}
+
+// Find suitable compute node, returning referenced to a locked nodeStat if found.
+// Nodes carrying the workload's preferred labels are tried first.
+func pickComputeNode(sched *ssntpSchedulerServer, workload *workResources) (node *nodeStat) {
 	sched.cnMutex.RLock()
 	defer sched.cnMutex.RUnlock()
 
 	if len(sched.cnList) == 0 {
-		sched.sendStartFailureError(controllerUUID, workload.instanceUUID, payloads.NoComputeNodes)
 		return nil
 	}
 
+	if preferred := preferredWorkload(workload); preferred != nil {
+		node = pickComputeNodeLocked(sched, preferred)
+		if node != nil {
+			return node // locked nodeStat
+		}
+	}
+
+	return pickComputeNodeLocked(sched, workload) // locked nodeStat
+}
+
+// pickComputeNode helper, cnMutex must be held for reading and cnList
+// must not be empty.
+func pickComputeNodeLocked(sched *ssntpSchedulerServer, workload *workResources) (node *nodeStat) {
+
 	/* Shortcut for 1 nodes cluster */
 	if len(sched.cnList) == 1 {
 		node := sched.cnList[0]
@@ -556,37 +874,14 @@ func pickComputeNode(sched *ssntpSchedulerServer, controllerUUID string, workloa
 		return nil
 	}
 
-	/* First try nodes after the MRU */
-	if sched.cnMRUIndex != -1 && sched.cnMRUIndex < len(sched.cnList)-1 {
-		for i, node := range sched.cnList[sched.cnMRUIndex+1:] {
-			node.mutex.Lock()
-			if node == sched.cnMRU {
-				node.mutex.Unlock()
-				continue
-			}
-
-			if sched.workloadFits(node, workload) == true {
-				sched.cnMRUIndex = sched.cnMRUIndex + 1 + i
-				sched.cnMRU = node
-				return node // locked nodeStat
-			}
-			node.mutex.Unlock()
-		}
-	}
+	return sched.policy.pickNode(sched, workload) // locked nodeStat
+}
 
-	/* Then try the whole list, including the MRU */
-	for i, node := range sched.cnList {
-		node.mutex.Lock()
-		if sched.workloadFits(node, workload) == true {
-			sched.cnMRUIndex = i
-			sched.cnMRU = node
-			return node // locked nodeStat
-		}
-		node.mutex.Unlock()
-	}
+func (sched *ssntpSchedulerServer) hasComputeNodes() bool {
+	sched.cnMutex.RLock()
+	defer sched.cnMutex.RUnlock()
 
-	sched.sendStartFailureError(controllerUUID, workload.instanceUUID, payloads.FullCloud)
-	return nil
+	return len(sched.cnList) > 0
 }
 
 // Find suitable net node, returning referenced to a locked nodeStat if found
@@ -607,13 +902,16 @@ func (sched *ssntpSchedulerServer) pickNetworkNode(controllerUUID string, worklo
 			sched.nnMRU = node.uuid
 			return node // locked nodeStat
 		}
+		node.mutex.Unlock()
 	}
 
 	sched.sendStartFailureError(controllerUUID, workload.instanceUUID, payloads.NoNetworkNodes)
 	return nil
 }
 
-func (sched *ssntpSchedulerServer) startWorkload(controllerUUID string, payload []byte) (dest ssntp.ForwardDestination, instanceUUID string) {
+func (sched *ssntpSchedulerServer) startWorkload(controller *controllerStat, payload []byte) (dest ssntp.ForwardDestination, instanceUUID string) {
+	controllerUUID := controller.uuid
+
 	var work payloads.Start
 	err := yaml.Unmarshal(payload, &work)
 	if err != nil {
@@ -634,7 +932,22 @@ func (sched *ssntpSchedulerServer) startWorkload(controllerUUID string, payload
 	var targetNode *nodeStat
 
 	if workload.networkNode == 0 {
-		targetNode = pickComputeNode(sched, controllerUUID, &workload)
+		// New START commands wait behind the queued ones, to keep
+		// each controller's START commands in FIFO order
+		queued := hasPendingStarts(controller)
+		if queued == false {
+			targetNode = pickComputeNode(sched, &workload)
+		}
+
+		if targetNode == nil {
+			if sched.hasComputeNodes() == false {
+				sched.sendStartFailureError(controllerUUID, instanceUUID, payloads.NoComputeNodes)
+			} else if sched.queuePendingStart(controller, payload, &workload) == false {
+				sched.sendStartFailureError(controllerUUID, instanceUUID, payloads.FullCloud)
+			} else if queued == true {
+				go sched.drainPendingStarts()
+			}
+		}
 	} else { //workload.network_node == 1
 		targetNode = sched.pickNetworkNode(controllerUUID, &workload)
 	}
@@ -650,13 +963,101 @@ func (sched *ssntpSchedulerServer) startWorkload(controllerUUID string, payload
 		dest.AddRecipient(targetNode.uuid)
 		targetNode.mutex.Unlock()
 	} else {
-		// TODO Queue the frame ?
+		// Queued START commands are sent by drainPendingStarts()
 		dest.SetDecision(ssntp.Discard)
 	}
 
 	return dest, instanceUUID
 }
 
+// Extract the vcpus, mem_mb and disk_mb values of a resource list
+func resizeResources(resources []payloads.RequestedResource) (workload workResources) {
+	for _, resource := range resources {
+		switch resource.Type {
+		case payloads.VCPUs:
+			workload.vcpusReq = resource.Value
+		case payloads.MemMB:
+			workload.memReqMB = resource.Value
+		case payloads.DiskMB:
+			workload.diskReqMB = resource.Value
+		}
+	}
+
+	return workload
+}
+
+func (sched *ssntpSchedulerServer) sendResizeFailureError(clientUUID string, cmd *payloads.ResizeCmd, reason payloads.ResizeFailureReason) {
+	error := payloads.ErrorResizeFailure{
+		InstanceUUID: cmd.InstanceUUID,
+		Reason:       reason,
+		Resources:    cmd.CurrentResources,
+	}
+
+	payload, err := yaml.Marshal(&error)
+	if err != nil {
+		glog.Errorf("Unable to Marshall Status %v", err)
+		return
+	}
+
+	glog.Warningf("Unable to resize %s: %v\n", cmd.InstanceUUID, reason)
+	sched.ssntp.SendError(clientUUID, ssntp.ResizeFailure, payload)
+}
+
+// A RESIZE command is forwarded to the node hosting the instance if the
+// node can accommodate the new resources.  A stopped instance holds no
+// memory or vcpus on its node, but its disk is already allocated.
+// Otherwise the resize fails with ResizeNoCapacity and the instance is
+// left untouched on its node.  Instances are never moved to another node
+// by a resize, as their root disk would not follow them.
+func (sched *ssntpSchedulerServer) resizeInstance(controllerUUID string, payload []byte) (dest ssntp.ForwardDestination, instanceUUID string) {
+	var resize payloads.Resize
+	err := yaml.Unmarshal(payload, &resize)
+	if err != nil {
+		glog.Errorf("Bad RESIZE yaml from Controller %s: %s\n", controllerUUID, err)
+		dest.SetDecision(ssntp.Discard)
+		return dest, ""
+	}
+
+	cmd := &resize.Resize
+	instanceUUID = cmd.InstanceUUID
+
+	requested := resizeResources(cmd.RequestedResources)
+	current := resizeResources(cmd.CurrentResources)
+	if requested.memReqMB <= 0 || requested.diskReqMB < current.diskReqMB {
+		glog.Errorf("Bad RESIZE resource list from Controller %s\n", controllerUUID)
+		sched.sendResizeFailureError(controllerUUID, cmd, payloads.ResizeInvalidData)
+		dest.SetDecision(ssntp.Discard)
+		return dest, instanceUUID
+	}
+
+	sched.cnMutex.RLock()
+	node := sched.cnMap[cmd.WorkloadAgentUUID]
+	sched.cnMutex.RUnlock()
+	if node == nil {
+		sched.sendResizeFailureError(controllerUUID, cmd, payloads.ResizeNoInstance)
+		dest.SetDecision(ssntp.Discard)
+		return dest, instanceUUID
+	}
+
+	growth := requested
+	growth.diskReqMB -= current.diskReqMB
+
+	node.mutex.Lock()
+	if sched.workloadFits(node, &growth) {
+		sched.decrementResourceUsage(node, &growth)
+		node.mutex.Unlock()
+
+		glog.V(2).Infof("Forwarding controller RESIZE command to %s\n", node.uuid)
+		dest.AddRecipient(node.uuid)
+		return dest, instanceUUID
+	}
+	node.mutex.Unlock()
+
+	sched.sendResizeFailureError(controllerUUID, cmd, payloads.ResizeNoCapacity)
+	dest.SetDecision(ssntp.Discard)
+	return dest, instanceUUID
+}
+
 func (sched *ssntpSchedulerServer) CommandForward(controllerUUID string, command ssntp.Command, frame *ssntp.Frame) (dest ssntp.ForwardDestination) {
 	payload := frame.Payload
 	instanceUUID := ""
@@ -685,15 +1086,25 @@ func (sched *ssntpSchedulerServer) CommandForward(controllerUUID string, command
 	switch command {
 	// the main command with scheduler processing
 	case ssntp.START:
-		dest, instanceUUID = sched.startWorkload(controllerUUID, payload)
+		dest, instanceUUID = sched.startWorkload(controller, payload)
 	case ssntp.RESTART:
 		fallthrough
 	case ssntp.STOP:
-		fallthrough
+		dest, instanceUUID = sched.fwdInstanceCmdToComputeNode(controllerUUID, command, frame)
 	case ssntp.DELETE:
 		fallthrough
 	case ssntp.EVACUATE:
+		fallthrough
+	case ssntp.AttachVolume:
+		fallthrough
+	case ssntp.DetachVolume:
+		fallthrough
+	case ssntp.Snapshot:
 		dest, instanceUUID = sched.fwdCmdToComputeNode(command, payload)
+	case ssntp.Resize:
+		dest, instanceUUID = sched.resizeInstance(controllerUUID, payload)
+	case ssntp.CONFIGURE:
+		dest = sched.configure(controllerUUID, payload)
 	default:
 		dest.SetDecision(ssntp.Discard)
 	}
@@ -738,6 +1149,10 @@ func (sched *ssntpSchedulerServer) EventNotify(uuid string, event ssntp.Event, f
 
 func (sched *ssntpSchedulerServer) ErrorNotify(uuid string, error ssntp.Error, frame *ssntp.Frame) {
 	glog.V(2).Infof("ERROR %v from %s\n", error, uuid)
+
+	if error == ssntp.InvalidConfiguration {
+		sched.rollbackConfiguration(uuid, frame.Payload)
+	}
 }
 
 func setLimits() {
@@ -834,12 +1249,13 @@ func heartBeatComputeNodes(sched *ssntpSchedulerServer) (s string) {
 	sched.cnMutex.RLock()
 	defer sched.cnMutex.RUnlock()
 
+	mru, _ := sched.getMRU()
 	for _, node := range sched.cnList {
 
 		node.mutex.Lock()
 		s += fmt.Sprintf("node-%s:", node.uuid[:8])
 		s += node.status.String()
-		if node == sched.cnMRU {
+		if node == mru {
 			s += "*"
 		}
 		s += ":" + fmt.Sprintf("%d/%d,%d",
@@ -938,6 +1354,14 @@ func setSSNTPForwardRules(sched *ssntpSchedulerServer) {
 			Operand: ssntp.ConcentratorInstanceAdded,
 			Dest:    ssntp.Controller,
 		},
+		{ // all InstanceEvacuated events go to all Controllers
+			Operand: ssntp.InstanceEvacuated,
+			Dest:    ssntp.Controller,
+		},
+		{ // all NodeEvacuated events go to all Controllers
+			Operand: ssntp.NodeEvacuated,
+			Dest:    ssntp.Controller,
+		},
 		{ // all StartFailure events go to all Controllers
 			Operand: ssntp.StartFailure,
 			Dest:    ssntp.Controller,
@@ -950,6 +1374,26 @@ func setSSNTPForwardRules(sched *ssntpSchedulerServer) {
 			Operand: ssntp.RestartFailure,
 			Dest:    ssntp.Controller,
 		},
+		{ // all AttachVolumeFailure events go to all Controllers
+			Operand: ssntp.AttachVolumeFailure,
+			Dest:    ssntp.Controller,
+		},
+		{ // all DetachVolumeFailure events go to all Controllers
+			Operand: ssntp.DetachVolumeFailure,
+			Dest:    ssntp.Controller,
+		},
+		{ // all SnapshotFailure events go to all Controllers
+			Operand: ssntp.SnapshotFailure,
+			Dest:    ssntp.Controller,
+		},
+		{ // all ResizeFailure events go to all Controllers
+			Operand: ssntp.ResizeFailure,
+			Dest:    ssntp.Controller,
+		},
+		{ // all ACK statuses go to all Controllers
+			Operand: ssntp.ACK,
+			Dest:    ssntp.Controller,
+		},
 		{ // all START command are processed by the Command forwarder
 			Operand:        ssntp.START,
 			CommandForward: sched,
@@ -970,6 +1414,46 @@ func setSSNTPForwardRules(sched *ssntpSchedulerServer) {
 			Operand:        ssntp.EVACUATE,
 			CommandForward: sched,
 		},
+		{ // all CONFIGURE command are processed by the Command forwarder
+			Operand:        ssntp.CONFIGURE,
+			CommandForward: sched,
+		},
+		{ // all AttachVolume command are processed by the Command forwarder
+			Operand:        ssntp.AttachVolume,
+			CommandForward: sched,
+		},
+		{ // all DetachVolume command are processed by the Command forwarder
+			Operand:        ssntp.DetachVolume,
+			CommandForward: sched,
+		},
+		{ // all Snapshot command are processed by the Command forwarder
+			Operand:        ssntp.Snapshot,
+			CommandForward: sched,
+		},
+		{ // all Resize command are processed by the Command forwarder
+			Operand:        ssntp.Resize,
+			CommandForward: sched,
+		},
+		{ // all READY statuses go to all standby Schedulers
+			Operand: ssntp.READY,
+			Dest:    ssntp.SCHEDULER,
+		},
+		{ // all FULL statuses go to all standby Schedulers
+			Operand: ssntp.FULL,
+			Dest:    ssntp.SCHEDULER,
+		},
+		{ // all OFFLINE statuses go to all standby Schedulers
+			Operand: ssntp.OFFLINE,
+			Dest:    ssntp.SCHEDULER,
+		},
+		{ // all MAINTENANCE statuses go to all standby Schedulers
+			Operand: ssntp.MAINTENANCE,
+			Dest:    ssntp.SCHEDULER,
+		},
+		{ // all InvalidConfiguration errors go to all Controllers
+			Operand: ssntp.InvalidConfiguration,
+			Dest:    ssntp.Controller,
+		},
 		{ // all TenantAdded events are processed by the Event forwarder
 			Operand:      ssntp.TenantAdded,
 			EventForward: sched,
@@ -985,6 +1469,91 @@ func setSSNTPForwardRules(sched *ssntpSchedulerServer) {
 	}
 }
 
+// setSSNTPAuthorizationRules restricts the frames each client role may
+// send to the ones it has a reason to.  All clients may report oversized
+// payloads, the SSNTP library answers those on its own.
+func setSSNTPAuthorizationRules(sched *ssntpSchedulerServer) {
+	// compute and network node launchers
+	launcherCommands := []ssntp.Command{ssntp.STATS}
+	launcherStatuses := []ssntp.Status{
+		ssntp.READY,
+		ssntp.FULL,
+		ssntp.OFFLINE,
+		ssntp.MAINTENANCE,
+	}
+	launcherEvents := []ssntp.Event{
+		ssntp.InstanceDeleted,
+		ssntp.TraceReport,
+		ssntp.InstanceEvacuated,
+		ssntp.NodeEvacuated,
+		ssntp.TenantAdded,
+		ssntp.TenantRemoved,
+	}
+	launcherErrors := []ssntp.Error{
+		ssntp.StartFailure,
+		ssntp.StopFailure,
+		ssntp.RestartFailure,
+		ssntp.DeleteFailure,
+		ssntp.AttachVolumeFailure,
+		ssntp.DetachVolumeFailure,
+		ssntp.SnapshotFailure,
+		ssntp.ResizeFailure,
+		ssntp.InvalidConfiguration,
+		ssntp.PayloadTooLarge,
+	}
+
+	sched.config.AuthorizationRules = []ssntp.FrameAuthorizationRule{
+		{
+			Role: ssntp.Controller,
+			Commands: []ssntp.Command{
+				ssntp.START,
+				ssntp.STOP,
+				ssntp.DELETE,
+				ssntp.EVACUATE,
+				ssntp.RESTART,
+				ssntp.CONFIGURE,
+				ssntp.AttachVolume,
+				ssntp.DetachVolume,
+				ssntp.Snapshot,
+				ssntp.Resize,
+				ssntp.AssignPublicIP,
+				ssntp.ReleasePublicIP,
+			},
+			Events: []ssntp.Event{ssntp.PublicIPAssigned},
+			Errors: []ssntp.Error{ssntp.PayloadTooLarge},
+		},
+		{
+			Role:     ssntp.AGENT,
+			Commands: launcherCommands,
+			Statuses: launcherStatuses,
+			Events:   launcherEvents,
+			Errors:   launcherErrors,
+		},
+		{
+			Role:     ssntp.NETAGENT,
+			Commands: launcherCommands,
+			Statuses: launcherStatuses,
+			Events:   launcherEvents,
+			Errors:   launcherErrors,
+		},
+		{
+			Role: ssntp.CNCIAGENT,
+			Events: []ssntp.Event{
+				ssntp.ConcentratorInstanceAdded,
+				ssntp.PublicIPAssigned,
+			},
+			Errors: []ssntp.Error{
+				ssntp.InvalidConfiguration,
+				ssntp.PayloadTooLarge,
+			},
+		},
+		{ // standby Schedulers only follow the primary one
+			Role:   ssntp.SCHEDULER,
+			Errors: []ssntp.Error{ssntp.PayloadTooLarge},
+		},
+	}
+}
+
 func configSchedulerServer() (sched *ssntpSchedulerServer) {
 	logDirFlag := flag.Lookup("log_dir")
 	if logDirFlag == nil {
@@ -1003,15 +1572,50 @@ func configSchedulerServer() (sched *ssntpSchedulerServer) {
 	sched.cpuprofile = *cpuprofile
 	sched.heartbeat = *heartbeat
 
+	placement, err := newPlacementPolicy(*policy)
+	if err != nil {
+		glog.Errorf("%s", err)
+		return nil
+	}
+	sched.policy = placement
+	glog.Infof("Using %s compute node placement policy", sched.policy)
+
+	store, err := newConfigStore(payloads.StorageType(*configStorageType), *configStorageURI)
+	if err != nil {
+		glog.Errorf("%s", err)
+		return nil
+	}
+	sched.configStore = store
+	sched.bootstrapStore = store
+	if err := sched.loadConfiguration(); err != nil {
+		glog.Warningf("Unable to load cluster configuration: %s", err)
+	}
+
+	if *peer != "" {
+		sched.peerConfig = &ssntp.Config{
+			URI:    *peer,
+			CAcert: *cacert,
+			Cert:   *cert,
+			Role:   ssntp.SCHEDULER,
+		}
+		sched.peerWait = *peerWait
+	}
+
+	sched.pendingStartsMax = *pendingStarts
+	sched.pendingStartWait = *pendingStartWait
+
 	toggleDebug(sched)
 
 	sched.config = &ssntp.Config{
-		CAcert: *cacert,
-		Cert:   *cert,
-		Role:   ssntp.SCHEDULER,
+		CAcert:            *cacert,
+		Cert:              *cert,
+		Role:              ssntp.SCHEDULER,
+		HeartbeatInterval: *ssntpHeartbeat,
+		HeartbeatMisses:   *ssntpHeartbeatMisses,
 	}
 
 	setSSNTPForwardRules(sched)
+	setSSNTPAuthorizationRules(sched)
 
 	return sched
 }
@@ -1025,5 +1629,11 @@ func main() {
 		return
 	}
 
+	if *statsAddr != "" {
+		go sched.serveStats(*statsAddr)
+	}
+
+	sched.standBy()
+
 	sched.ssntp.Serve(sched.config, sched)
 }
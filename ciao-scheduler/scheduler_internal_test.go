@@ -17,13 +17,22 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/01org/ciao/payloads"
 	"github.com/01org/ciao/ssntp"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
+	"reflect"
 	"sync"
 	"testing"
+	"time"
 )
 
 var sched *ssntpSchedulerServer
@@ -58,8 +67,11 @@ func spinUpComputeNode(sched *ssntpSchedulerServer, ident int, RAM int) {
 	node.uuid = fmt.Sprintf("%08d", ident)
 	node.memTotalMB = RAM
 	node.memAvailMB = RAM
+	node.diskTotalMB = 100000
+	node.diskAvailMB = 100000
 	node.load = 0
 	node.cpus = 4
+	node.vcpusAvail = 4
 
 	sched.cnMutex.Lock()
 	defer sched.cnMutex.Unlock()
@@ -138,28 +150,28 @@ func TestPickComputeNode(t *testing.T) {
 	}
 
 	// no compute nodes
-	node := PickComputeNode(sched, "", &resources)
+	node := PickComputeNode(sched, &resources)
 	if node != nil {
 		t.Error("fount fit in empty node list")
 	}
 
 	// 1st compute node, with little memory
 	spinUpComputeNodeVerySmall(sched, 1)
-	node = PickComputeNode(sched, "", &resources)
+	node = PickComputeNode(sched, &resources)
 	if node != nil {
 		t.Error("found fit when none should exist")
 	}
 
 	// 2nd compute node, with little memory
 	spinUpComputeNodeVerySmall(sched, 2)
-	node = PickComputeNode(sched, "", &resources)
+	node = PickComputeNode(sched, &resources)
 	if node != nil {
 		t.Error("found fit when none should exist")
 	}
 
 	// 3rd compute node, with a lot of memory
 	spinUpComputeNodeLarge(sched, 3)
-	node = PickComputeNode(sched, "", &resources)
+	node = PickComputeNode(sched, &resources)
 	if node == nil {
 		t.Error("found no fit when one should exist")
 	}
@@ -168,19 +180,1298 @@ func TestPickComputeNode(t *testing.T) {
 	for i := 4; i < 100; i++ {
 		spinUpComputeNode(sched, i, 256*i)
 	}
-	node = PickComputeNode(sched, "", &resources)
+	node = PickComputeNode(sched, &resources)
 	if node == nil {
 		t.Error("failed to fit in hundred node list")
 	}
 
 	// MRU set somewhere arbitrary
 	sched.cnMRUIndex = 42
-	node = PickComputeNode(sched, "", &resources)
+	node = PickComputeNode(sched, &resources)
 	if node == nil {
 		t.Error("failed to find fit after MRU")
 	}
 }
 
+func TestPickComputeNodeConcurrent(t *testing.T) {
+	for _, name := range []string{firstFitPolicyName, bestFitPolicyName} {
+		sched = configSchedulerServer()
+		if sched == nil {
+			t.Fatal("unable to configure test scheduler")
+		}
+
+		placement, err := newPlacementPolicy(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sched.policy = placement
+
+		for i := 1; i <= 4; i++ {
+			spinUpComputeNodeLarge(sched, i)
+		}
+
+		resources, err := sched.getWorkloadResources(createStartWorkload(1, 128, 1000))
+		if err != nil {
+			t.Fatal("bad workload resources")
+		}
+
+		// placements run concurrently, e.g. while draining pending STARTs
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if node := PickComputeNode(sched, &resources); node != nil {
+					node.mutex.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		if mru, _ := sched.getMRU(); mru == nil {
+			t.Errorf("%s: no MRU after placements", name)
+		}
+	}
+}
+
+func TestPickComputeNodeResources(t *testing.T) {
+	sched = configSchedulerServer()
+	if sched == nil {
+		t.Fatal("unable to configure test scheduler")
+	}
+
+	spinUpComputeNodeLarge(sched, 1)
+	spinUpComputeNodeLarge(sched, 2)
+
+	// too many vcpus for any node
+	resources, err := sched.getWorkloadResources(createStartWorkload(8, 256, 10000))
+	if err != nil {
+		t.Fatal("bad workload resources")
+	}
+	if node := PickComputeNode(sched, &resources); node != nil {
+		node.mutex.Unlock()
+		t.Error("found fit for vcpus demand larger than any node")
+	}
+
+	// too much disk for any node
+	resources, err = sched.getWorkloadResources(createStartWorkload(2, 256, 200000))
+	if err != nil {
+		t.Fatal("bad workload resources")
+	}
+	if node := PickComputeNode(sched, &resources); node != nil {
+		node.mutex.Unlock()
+		t.Error("found fit for disk demand larger than any node")
+	}
+
+	// non mandatory resources do not constrain placement
+	work := createStartWorkload(8, 256, 200000)
+	for i := range work.Start.RequestedResources {
+		work.Start.RequestedResources[i].Mandatory = false
+	}
+	resources, err = sched.getWorkloadResources(work)
+	if err != nil {
+		t.Fatal("bad workload resources")
+	}
+	node := PickComputeNode(sched, &resources)
+	if node == nil {
+		t.Fatal("found no fit for non mandatory resource demands")
+	}
+	node.mutex.Unlock()
+
+	// vcpus are claimed on dispatch: two 3 vcpus workloads can not
+	// share a 4 cpus node
+	resources, err = sched.getWorkloadResources(createStartWorkload(3, 256, 10000))
+	if err != nil {
+		t.Fatal("bad workload resources")
+	}
+	for i := 0; i < 2; i++ {
+		node = PickComputeNode(sched, &resources)
+		if node == nil {
+			t.Fatalf("found no fit for workload %d", i)
+		}
+		sched.decrementResourceUsage(node, &resources)
+		node.mutex.Unlock()
+	}
+	if node = PickComputeNode(sched, &resources); node != nil {
+		node.mutex.Unlock()
+		t.Error("found fit when all vcpus are claimed")
+	}
+}
+
+func sendReady(sched *ssntpSchedulerServer, node *nodeStat, vcpusAllocated int) {
+	ready := payloads.Ready{
+		NodeUUID:        node.uuid,
+		MemTotalMB:      node.memTotalMB,
+		MemAvailableMB:  node.memTotalMB,
+		DiskTotalMB:     node.diskTotalMB,
+		DiskAvailableMB: node.diskTotalMB,
+		CpusOnline:      4,
+		VCPUsAllocated:  vcpusAllocated,
+	}
+	payload, _ := yaml.Marshal(&ready)
+
+	sched.StatusNotify(node.uuid, ssntp.READY, &ssntp.Frame{Payload: payload})
+}
+
+func TestReadyAfterPlacement(t *testing.T) {
+	sched = configSchedulerServer()
+	if sched == nil {
+		t.Fatal("unable to configure test scheduler")
+	}
+
+	spinUpComputeNodeLarge(sched, 1)
+
+	resources, err := sched.getWorkloadResources(createStartWorkload(3, 256, 10000))
+	if err != nil {
+		t.Fatal("bad workload resources")
+	}
+
+	node := PickComputeNode(sched, &resources)
+	if node == nil {
+		t.Fatal("found no fit for workload")
+	}
+	sched.decrementResourceUsage(node, &resources)
+	node.mutex.Unlock()
+
+	// the launcher reports the instance vcpus, the claim survives READY
+	sendReady(sched, node, 3)
+	if node = PickComputeNode(sched, &resources); node != nil {
+		node.mutex.Unlock()
+		t.Fatal("found fit after READY reported all vcpus allocated")
+	}
+
+	// once the instance is gone its vcpus are available again
+	node = sched.cnMap["00000001"]
+	sendReady(sched, node, 0)
+	if node = PickComputeNode(sched, &resources); node == nil {
+		t.Fatal("found no fit after READY released the vcpus")
+	}
+	node.mutex.Unlock()
+}
+
+func TestPlacementPolicies(t *testing.T) {
+	var tests = []struct {
+		policy   string
+		expected string
+	}{
+		{firstFitPolicyName, "00000001"},
+		{bestFitPolicyName, "00000002"},
+		{spreadPolicyName, "00000003"},
+	}
+
+	for _, test := range tests {
+		sched = configSchedulerServer()
+		if sched == nil {
+			t.Fatal("unable to configure test scheduler")
+		}
+
+		placement, err := newPlacementPolicy(test.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sched.policy = placement
+
+		spinUpComputeNode(sched, 1, 16384)
+		spinUpComputeNode(sched, 2, 2048)
+		spinUpComputeNodeLarge(sched, 3)
+		spinUpComputeNodeVerySmall(sched, 4)
+
+		resources, err := sched.getWorkloadResources(createStartWorkload(2, 1024, 10000))
+		if err != nil {
+			t.Fatal("bad workload resources")
+		}
+
+		node := PickComputeNode(sched, &resources)
+		if node == nil {
+			t.Errorf("%s: found no fit when one should exist", test.policy)
+			continue
+		}
+		node.mutex.Unlock()
+
+		if node.uuid != test.expected {
+			t.Errorf("%s: expected node %s, got %s", test.policy, test.expected, node.uuid)
+		}
+	}
+
+	if _, err := newPlacementPolicy("worst-fit"); err == nil {
+		t.Error("unknown placement policy accepted")
+	}
+}
+
+func TestPlacementConstraints(t *testing.T) {
+	sched = configSchedulerServer()
+	if sched == nil {
+		t.Fatal("unable to configure test scheduler")
+	}
+
+	spinUpComputeNodeLarge(sched, 1)
+	spinUpComputeNodeLarge(sched, 2)
+	spinUpComputeNodeLarge(sched, 3)
+	sched.cnMap["00000002"].labels = map[string]string{"rack": "r1"}
+	sched.cnMap["00000003"].labels = map[string]string{"rack": "r1", "ssd": "true"}
+
+	pick := func(work *payloads.Start) *nodeStat {
+		resources, err := sched.getWorkloadResources(work)
+		if err != nil {
+			t.Fatal("bad workload resources")
+		}
+
+		node := PickComputeNode(sched, &resources)
+		if node != nil {
+			sched.decrementResourceUsage(node, &resources)
+			node.mutex.Unlock()
+		}
+		return node
+	}
+
+	// required labels
+	work := createStartWorkload(1, 256, 1000)
+	work.Start.Constraints.RequiredLabels = map[string]string{"rack": "r1"}
+	for i := 0; i < 4; i++ {
+		node := pick(work)
+		if node == nil || node.uuid == "00000001" {
+			t.Fatalf("workload %d placed on %v without required label", i, node)
+		}
+	}
+
+	work.Start.Constraints.RequiredLabels = map[string]string{"rack": "r2"}
+	if node := pick(work); node != nil {
+		t.Errorf("found fit on %s without required label", node.uuid)
+	}
+
+	// preferred labels, falling back to any node
+	work = createStartWorkload(1, 256, 1000)
+	work.Start.Constraints.PreferredLabels = map[string]string{"ssd": "true"}
+	if node := pick(work); node == nil || node.uuid != "00000003" {
+		t.Errorf("expected preferred node 00000003, got %v", node)
+	}
+
+	work.Start.Constraints.PreferredLabels = map[string]string{"gpu": "true"}
+	if node := pick(work); node == nil {
+		t.Error("found no fit when preferred labels match no node")
+	}
+
+	// anti-affinity: one instance of the group per node
+	work = createStartWorkload(1, 256, 1000)
+	work.Start.Constraints.AntiAffinityGroup = "tenant/db"
+	used := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		node := pick(work)
+		if node == nil {
+			t.Fatalf("found no fit for anti-affinity instance %d", i)
+		}
+		if used[node.uuid] {
+			t.Fatalf("anti-affinity instances share node %s", node.uuid)
+		}
+		used[node.uuid] = true
+	}
+
+	if node := pick(work); node != nil {
+		t.Errorf("anti-affinity instance placed on %s next to another one", node.uuid)
+	}
+
+	// the group leaves a node when its READY frame no longer reports it
+	node := sched.cnMap["00000001"]
+	node.mutex.Lock()
+	setNodeStats(node, &payloads.Ready{
+		MemTotalMB:      141312,
+		MemAvailableMB:  141312,
+		DiskTotalMB:     100000,
+		DiskAvailableMB: 100000,
+		CpusOnline:      4,
+	})
+	node.mutex.Unlock()
+
+	if node := pick(work); node == nil || node.uuid != "00000001" {
+		t.Errorf("expected anti-affinity instance on 00000001, got %v", node)
+	}
+}
+
+func TestFwdVolumeCmdToComputeNode(t *testing.T) {
+	sched = configSchedulerServer()
+	if sched == nil {
+		t.Fatal("unable to configure test scheduler")
+	}
+
+	var attach payloads.AttachVolume
+	attach.Attach.InstanceUUID = "c73322e8-d5fe-4d57-874c-dcee4fd368cd"
+	attach.Attach.VolumeUUID = "67d86208-b46c-4465-9018-fe14087d415f"
+	attach.Attach.WorkloadAgentUUID = "00000001"
+
+	var detach payloads.DetachVolume
+	detach.Detach.InstanceUUID = attach.Attach.InstanceUUID
+	detach.Detach.VolumeUUID = attach.Attach.VolumeUUID
+	detach.Detach.WorkloadAgentUUID = attach.Attach.WorkloadAgentUUID
+
+	var snapshot payloads.Snapshot
+	snapshot.Snapshot.InstanceUUID = attach.Attach.InstanceUUID
+	snapshot.Snapshot.ImageUUID = "b265f62b-e957-47fd-a0a2-6dc261c7315c"
+	snapshot.Snapshot.WorkloadAgentUUID = attach.Attach.WorkloadAgentUUID
+
+	var tests = []struct {
+		command ssntp.Command
+		cmd     interface{}
+	}{
+		{ssntp.AttachVolume, &attach},
+		{ssntp.DetachVolume, &detach},
+		{ssntp.Snapshot, &snapshot},
+	}
+
+	for _, test := range tests {
+		payload, err := yaml.Marshal(test.cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		instanceUUID, agentUUID, err := sched.getWorkloadAgentUUID(test.command, payload)
+		if err != nil {
+			t.Fatalf("%s: %s", test.command, err)
+		}
+
+		if instanceUUID != attach.Attach.InstanceUUID || agentUUID != "00000001" {
+			t.Errorf("%s: unexpected instance %s on agent %s", test.command, instanceUUID, agentUUID)
+		}
+	}
+}
+
+func TestFwdInstanceCmdToComputeNode(t *testing.T) {
+	sched = configSchedulerServer()
+	if sched == nil {
+		t.Fatal("unable to configure test scheduler")
+	}
+
+	spinUpComputeNodeLarge(sched, 1)
+
+	var stop payloads.Stop
+	stop.Stop.InstanceUUID = "c73322e8-d5fe-4d57-874c-dcee4fd368cd"
+	stop.Stop.WorkloadAgentUUID = "00000001"
+
+	var restart payloads.Restart
+	restart.Restart.InstanceUUID = stop.Stop.InstanceUUID
+	restart.Restart.WorkloadAgentUUID = "00000002"
+
+	var noAgent payloads.Stop
+	noAgent.Stop.InstanceUUID = stop.Stop.InstanceUUID
+
+	var forward, discard ssntp.ForwardDestination
+	forward.AddRecipient("00000001")
+	discard.SetDecision(ssntp.Discard)
+
+	var tests = []struct {
+		command ssntp.Command
+		cmd     interface{}
+		dest    ssntp.ForwardDestination
+	}{
+		{ssntp.STOP, &stop, forward},
+		{ssntp.RESTART, &restart, discard},
+		{ssntp.STOP, &noAgent, discard},
+		{ssntp.STOP, "{", discard},
+	}
+
+	for _, test := range tests {
+		payload, ok := test.cmd.(string)
+		if !ok {
+			y, err := yaml.Marshal(test.cmd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			payload = string(y)
+		}
+
+		frame := &ssntp.Frame{
+			Payload:   []byte(payload),
+			RequestID: 1,
+		}
+		dest, _ := sched.fwdInstanceCmdToComputeNode("00000003", test.command, frame)
+		if !reflect.DeepEqual(dest, test.dest) {
+			t.Errorf("%s: unexpected forwarding decision for %q", test.command, payload)
+		}
+	}
+}
+
+func createResize(agentUUID string, vCpus int, memMB int, diskMB int) []byte {
+	var resize payloads.Resize
+
+	resize.Resize.InstanceUUID = "c73322e8-d5fe-4d57-874c-dcee4fd368cd"
+	resize.Resize.WorkloadAgentUUID = agentUUID
+	resize.Resize.RequestedResources = createStartWorkload(vCpus, memMB, diskMB).Start.RequestedResources
+	resize.Resize.CurrentResources = createStartWorkload(1, 128, 1000).Start.RequestedResources
+
+	payload, _ := yaml.Marshal(&resize)
+	return payload
+}
+
+func TestResizeInstance(t *testing.T) {
+	sched = configSchedulerServer()
+	if sched == nil {
+		t.Fatal("unable to configure test scheduler")
+	}
+
+	spinUpComputeNodeVerySmall(sched, 1)
+	spinUpComputeNodeLarge(sched, 2)
+	small := sched.cnMap["00000001"]
+
+	// fits on the hosting node: only the disk growth is claimed
+	sched.resizeInstance("00000001", createResize(small.uuid, 1, 150, 3000))
+	if small.memAvailMB != 50 || small.vcpusAvail != 3 || small.diskAvailMB != 98000 {
+		t.Errorf("unexpected resources left on node: mem %d, vcpus %d, disk %d",
+			small.memAvailMB, small.vcpusAvail, small.diskAvailMB)
+	}
+
+	// does not fit on the hosting node: rejected even though another
+	// node has room, the instance stays stopped on its node with its disk
+	var discard ssntp.ForwardDestination
+	discard.SetDecision(ssntp.Discard)
+	large := sched.cnMap["00000002"]
+	largeMemMB := large.memAvailMB
+	for _, memMB := range []int{1024, 1024 * 1024} {
+		dest, _ := sched.resizeInstance("00000001", createResize(small.uuid, 1, memMB, 3000))
+		if !reflect.DeepEqual(dest, discard) {
+			t.Errorf("%d MB resize not discarded", memMB)
+		}
+		if small.memAvailMB != 50 || small.diskAvailMB != 98000 || large.memAvailMB != largeMemMB {
+			t.Errorf("resources claimed for %d MB resize", memMB)
+		}
+	}
+
+	// shrinking the disk is invalid
+	sched.resizeInstance("00000001", createResize(small.uuid, 1, 10, 500))
+	if small.memAvailMB != 50 {
+		t.Error("resources claimed on node for invalid resize")
+	}
+}
+
+func pendingStartsCount(controller *controllerStat) int {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	return len(controller.pendingStarts)
+}
+
+func TestPendingStarts(t *testing.T) {
+	sched = configSchedulerServer()
+	if sched == nil {
+		t.Fatal("unable to configure test scheduler")
+	}
+	sched.pendingStartsMax = 2
+	sched.pendingStartWait = time.Hour
+
+	spinUpController(sched, 1, controllerMaster)
+	controller := sched.controllerMap["00000001"]
+	spinUpComputeNodeVerySmall(sched, 1)
+	node := sched.cnMap["00000001"]
+
+	payload, err := yaml.Marshal(createStartWorkload(2, 256, 10000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no room: queued up to the limit
+	for i := 0; i < 3; i++ {
+		sched.startWorkload(controller, payload)
+	}
+	if n := pendingStartsCount(controller); n != 2 {
+		t.Fatalf("expected 2 pending START, got %d", n)
+	}
+
+	// still no room: nothing dispatched
+	sched.drainPendingStarts()
+	if n := pendingStartsCount(controller); n != 2 {
+		t.Fatalf("expected 2 pending START, got %d", n)
+	}
+
+	// room for a single workload, but the node has no SSNTP session:
+	// each dispatch fails and gives its claims back
+	node.mutex.Lock()
+	node.memAvailMB = 300
+	node.mutex.Unlock()
+	sched.drainPendingStarts()
+	if n := pendingStartsCount(controller); n != 0 {
+		t.Fatalf("expected no pending START, got %d", n)
+	}
+	node.mutex.Lock()
+	memAvailMB, vcpusAvail := node.memAvailMB, node.vcpusAvail
+	node.mutex.Unlock()
+	if memAvailMB != 300 || vcpusAvail != 4 {
+		t.Errorf("expected claims released after failed dispatch, got %d MB %d vcpus",
+			memAvailMB, vcpusAvail)
+	}
+
+	node.mutex.Lock()
+	node.memAvailMB = 200
+	node.mutex.Unlock()
+	for i := 0; i < 2; i++ {
+		sched.startWorkload(controller, payload)
+	}
+	if n := pendingStartsCount(controller); n != 2 {
+		t.Fatalf("expected 2 pending START, got %d", n)
+	}
+
+	// a connected compute node with room for a single workload:
+	// the first queued START is sent to it
+	transport := ssntp.NewMemoryTransport()
+	sched.config = &ssntp.Config{
+		Role:            ssntp.SCHEDULER,
+		CustomTransport: transport,
+	}
+	setSSNTPForwardRules(sched)
+	go sched.ssntp.Serve(sched.config, sched)
+	time.Sleep(100 * time.Millisecond)
+	defer sched.ssntp.Stop()
+
+	agent := &haTestAgent{
+		connected: make(chan struct{}, 2),
+		commands:  make(chan ssntp.Command, 2),
+	}
+	agentConfig := &ssntp.Config{
+		Role:            ssntp.AGENT,
+		CustomTransport: transport,
+	}
+	if err := agent.ssntp.Dial(agentConfig, agent); err != nil {
+		t.Fatal(err)
+	}
+	defer agent.ssntp.Close()
+	<-agent.connected
+
+	var agentNode *nodeStat
+	waitFor(t, "compute node connection", func() bool {
+		sched.cnMutex.RLock()
+		defer sched.cnMutex.RUnlock()
+		agentNode = sched.cnMap[agent.ssntp.UUID()]
+		return agentNode != nil
+	})
+	agentNode.mutex.Lock()
+	agentNode.status = ssntp.READY
+	agentNode.memTotalMB, agentNode.memAvailMB = 300, 300
+	agentNode.diskTotalMB, agentNode.diskAvailMB = 100000, 100000
+	agentNode.cpus, agentNode.vcpusAvail = 4, 4
+	agentNode.mutex.Unlock()
+
+	sched.drainPendingStarts()
+	if n := pendingStartsCount(controller); n != 1 {
+		t.Fatalf("expected 1 pending START, got %d", n)
+	}
+	agentNode.mutex.Lock()
+	memAvailMB = agentNode.memAvailMB
+	agentNode.mutex.Unlock()
+	if memAvailMB != 300-256 {
+		t.Errorf("expected %d MB available after dispatch, got %d", 300-256, memAvailMB)
+	}
+	select {
+	case command := <-agent.commands:
+		if command != ssntp.START {
+			t.Errorf("expected START command, got %s", command)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued START not received by the compute node")
+	}
+
+	// a departing controller drops its queue
+	DisconnectController(sched, "00000001")
+	if n := pendingStartsCount(controller); n != 0 {
+		t.Fatalf("expected no pending START, got %d", n)
+	}
+}
+
+func TestPendingStartsOrder(t *testing.T) {
+	sched = configSchedulerServer()
+	if sched == nil {
+		t.Fatal("unable to configure test scheduler")
+	}
+	sched.pendingStartWait = time.Hour
+
+	spinUpController(sched, 1, controllerMaster)
+	controller := sched.controllerMap["00000001"]
+	spinUpComputeNodeVerySmall(sched, 1)
+	node := sched.cnMap["00000001"]
+
+	large, err := yaml.Marshal(createStartWorkload(2, 256, 10000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, err := yaml.Marshal(createStartWorkload(1, 64, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sched.startWorkload(controller, large)
+
+	// the small START fits, but must not overtake the queued one
+	sched.startWorkload(controller, small)
+	if n := pendingStartsCount(controller); n != 2 {
+		t.Fatalf("expected 2 pending START, got %d", n)
+	}
+
+	node.mutex.Lock()
+	memAvailMB := node.memAvailMB
+	node.mutex.Unlock()
+	if memAvailMB != 200 {
+		t.Errorf("expected no claims for queued START, got %d MB available", memAvailMB)
+	}
+}
+
+func TestPendingStartsExpiry(t *testing.T) {
+	sched = configSchedulerServer()
+	if sched == nil {
+		t.Fatal("unable to configure test scheduler")
+	}
+	sched.pendingStartWait = 10 * time.Millisecond
+
+	spinUpController(sched, 1, controllerMaster)
+	controller := sched.controllerMap["00000001"]
+	spinUpComputeNodeVerySmall(sched, 1)
+
+	payload, err := yaml.Marshal(createStartWorkload(2, 256, 10000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sched.startWorkload(controller, payload)
+	if n := pendingStartsCount(controller); n != 1 {
+		t.Fatalf("expected 1 pending START, got %d", n)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if n := pendingStartsCount(controller); n != 0 {
+		t.Fatalf("expected expired pending START, got %d pending", n)
+	}
+
+	// queueing disabled
+	sched.pendingStartsMax = 0
+	sched.startWorkload(controller, payload)
+	if n := pendingStartsCount(controller); n != 0 {
+		t.Fatalf("expected no pending START, got %d", n)
+	}
+}
+
+func configurePayload(t *testing.T, storageType payloads.StorageType, storageURI string, computeNet string) []byte {
+	var cfg payloads.Configure
+
+	cfg.Configure.Scheduler.ConfigStorageType = storageType
+	cfg.Configure.Scheduler.ConfigStorageURI = storageURI
+	cfg.Configure.Controller.ComputePort = 8774
+	cfg.Configure.Launcher.ComputeNetwork = computeNet
+	cfg.Configure.Launcher.ManagementNetwork = "192.168.2.0/24"
+	cfg.Configure.ImageService.Type = payloads.Glance
+	cfg.Configure.ImageService.URL = "http://glance.example.com"
+	cfg.Configure.IdentityService.Type = payloads.Keystone
+	cfg.Configure.IdentityService.URL = "http://keystone.example.com"
+
+	payload, err := yaml.Marshal(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return payload
+}
+
+func TestValidateConfiguration(t *testing.T) {
+	valid := configurePayload(t, payloads.Filesystem, "/etc/ciao/configuration.yaml", "192.168.1.0/24")
+	if _, err := validateConfiguration(valid); err != nil {
+		t.Errorf("valid configuration rejected: %s", err)
+	}
+
+	var invalidTests = []struct {
+		name    string
+		payload []byte
+	}{
+		{"bad yaml", []byte("configure: [")},
+		{"unknown storage", configurePayload(t, "nfs", "/etc/ciao", "192.168.1.0/24")},
+		{"etcd without URI", configurePayload(t, payloads.Etcd, "", "192.168.1.0/24")},
+		{"bad compute network", configurePayload(t, payloads.Filesystem, "/etc/ciao/configuration.yaml", "192.168.1.110")},
+		{"bad port", []byte("configure:\n  controller:\n    compute_port: 70000\n")},
+		{"bad service", []byte("configure:\n  image_service:\n    type: keystone\n")},
+		{"service without scheme", []byte("configure:\n  image_service:\n    url: glance.example.com\n")},
+		{"service without host", []byte("configure:\n  identity_service:\n    url: http://\n")},
+	}
+	for _, test := range invalidTests {
+		if _, err := validateConfiguration(test.payload); err == nil {
+			t.Errorf("%s: invalid configuration accepted", test.name)
+		}
+	}
+}
+
+func TestFileConfigStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ciao-scheduler-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := newConfigStore(payloads.Filesystem, path.Join(dir, "ciao", "configuration.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := store.load()
+	if err != nil || payload != nil {
+		t.Fatalf("expected empty store, got %q (%v)", payload, err)
+	}
+
+	for _, computeNet := range []string{"192.168.1.0/24", "10.0.0.0/16"} {
+		expected := configurePayload(t, payloads.Filesystem, "", computeNet)
+		if err := store.store(expected); err != nil {
+			t.Fatal(err)
+		}
+
+		payload, err = store.load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(payload) != string(expected) {
+			t.Errorf("expected %q, got %q", expected, payload)
+		}
+	}
+}
+
+func TestEtcdConfigStore(t *testing.T) {
+	var value string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != etcdConfigKey {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case "PUT":
+			value = r.FormValue("value")
+			w.WriteHeader(http.StatusCreated)
+		case "GET":
+			if value == "" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"node": map[string]string{"value": value},
+			})
+		}
+	}))
+	defer server.Close()
+
+	store, err := newConfigStore(payloads.Etcd, server.URL+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := store.load()
+	if err != nil || payload != nil {
+		t.Fatalf("expected empty store, got %q (%v)", payload, err)
+	}
+
+	expected := configurePayload(t, payloads.Etcd, server.URL, "192.168.1.0/24")
+	if err := store.store(expected); err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err = store.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payload) != string(expected) {
+		t.Errorf("expected %q, got %q", expected, payload)
+	}
+}
+
+func TestConfigureRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ciao-scheduler-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sched = configSchedulerServer()
+	if sched == nil {
+		t.Fatal("unable to configure test scheduler")
+	}
+	sched.configStore = &fileConfigStore{path: path.Join(dir, "configuration.yaml")}
+	spinUpController(sched, 1, controllerMaster)
+	spinUpComputeNodeLarge(sched, 1)
+
+	checkConfiguration := func(expected []byte) {
+		if string(sched.ssntp.ClusterConfiguration()) != string(expected) {
+			t.Errorf("expected CONNECTED configuration %q, got %q", expected, sched.ssntp.ClusterConfiguration())
+		}
+
+		stored, err := sched.configStore.load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(stored) != string(expected) {
+			t.Errorf("expected stored configuration %q, got %q", expected, stored)
+		}
+	}
+
+	first := configurePayload(t, "", "", "192.168.1.0/24")
+	second := configurePayload(t, "", "", "10.0.0.0/16")
+
+	sched.configure("00000001", first)
+	checkConfiguration(first)
+
+	// invalid configurations are not applied
+	sched.configure("00000001", configurePayload(t, "", "", "bogus"))
+	checkConfiguration(first)
+
+	sched.configure("00000001", second)
+	checkConfiguration(second)
+
+	// errors about another configuration are ignored
+	sched.rollbackConfiguration("00000001", first)
+	checkConfiguration(second)
+
+	sched.rollbackConfiguration("00000001", second)
+	checkConfiguration(first)
+
+	// only one level of rollback
+	sched.rollbackConfiguration("00000001", first)
+	checkConfiguration(first)
+}
+
+func TestConfigureStorageMove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ciao-scheduler-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bootstrap := &fileConfigStore{path: path.Join(dir, "bootstrap.yaml")}
+	moved := path.Join(dir, "moved.yaml")
+
+	sched = configSchedulerServer()
+	if sched == nil {
+		t.Fatal("unable to configure test scheduler")
+	}
+	sched.configStore = bootstrap
+	sched.bootstrapStore = bootstrap
+	spinUpController(sched, 1, controllerMaster)
+
+	payload := configurePayload(t, payloads.Filesystem, moved, "192.168.1.0/24")
+	sched.configure("00000001", payload)
+
+	for _, store := range []configStore{bootstrap, &fileConfigStore{path: moved}} {
+		stored, err := store.load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(stored) != string(payload) {
+			t.Errorf("expected configuration %q in %s, got %q", payload, store, stored)
+		}
+	}
+
+	// a restarted scheduler finds the moved storage again
+	restarted := configSchedulerServer()
+	if restarted == nil {
+		t.Fatal("unable to configure test scheduler")
+	}
+	restarted.configStore = bootstrap
+	restarted.bootstrapStore = bootstrap
+	if err := restarted.loadConfiguration(); err != nil {
+		t.Fatal(err)
+	}
+	if restarted.configStore.String() != (&fileConfigStore{path: moved}).String() {
+		t.Errorf("expected configuration storage %s, got %s", moved, restarted.configStore)
+	}
+}
+
+func TestConfigureStoreError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ciao-scheduler-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sched = configSchedulerServer()
+	if sched == nil {
+		t.Fatal("unable to configure test scheduler")
+	}
+	sched.configStore = &fileConfigStore{path: path.Join(dir, "configuration.yaml")}
+	spinUpController(sched, 1, controllerMaster)
+
+	first := configurePayload(t, "", "", "192.168.1.0/24")
+	sched.configure("00000001", first)
+
+	// the storage directory is a regular file, storing fails
+	notDir := path.Join(dir, "configuration.yaml")
+	unstorable := configurePayload(t, payloads.Filesystem, path.Join(notDir, "configuration.yaml"), "10.0.0.0/16")
+	sched.configure("00000001", unstorable)
+
+	if string(sched.ssntp.ClusterConfiguration()) != string(first) {
+		t.Errorf("expected CONNECTED configuration %q, got %q", first, sched.ssntp.ClusterConfiguration())
+	}
+	if sched.configStore.String() != (&fileConfigStore{path: notDir}).String() {
+		t.Errorf("configuration storage unexpectedly moved to %s", sched.configStore)
+	}
+}
+
+const haTestPort = 8890
+
+type haTestAgent struct {
+	ssntp     ssntp.Client
+	connected chan struct{}
+	commands  chan ssntp.Command
+	errors    chan ssntp.Error
+}
+
+func (agent *haTestAgent) ConnectNotify() {
+	agent.connected <- struct{}{}
+}
+
+func (agent *haTestAgent) DisconnectNotify() {
+}
+
+func (agent *haTestAgent) StatusNotify(status ssntp.Status, frame *ssntp.Frame) {
+}
+
+func (agent *haTestAgent) CommandNotify(command ssntp.Command, frame *ssntp.Frame) {
+	if agent.commands != nil {
+		agent.commands <- command
+	}
+}
+
+func (agent *haTestAgent) EventNotify(event ssntp.Event, frame *ssntp.Frame) {
+}
+
+func (agent *haTestAgent) ErrorNotify(error ssntp.Error, frame *ssntp.Frame) {
+	if agent.errors != nil {
+		agent.errors <- error
+	}
+}
+
+func haTestScheduler(t *testing.T, dir string, name string) *ssntpSchedulerServer {
+	s := configSchedulerServer()
+	if s == nil {
+		t.Fatal("unable to configure test scheduler")
+	}
+	s.config.Port = haTestPort
+	s.configStore = &fileConfigStore{path: path.Join(dir, name+".yaml")}
+
+	return s
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for i := 0; i < 100; i++ {
+		if cond() == true {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	t.Fatalf("timeout waiting for %s", what)
+}
+
+func peerNodeMem(s *ssntpSchedulerServer, uuid string) int {
+	s.peerMutex.RLock()
+	defer s.peerMutex.RUnlock()
+
+	if s.peerNodes[uuid] == nil {
+		return 0
+	}
+
+	return s.peerNodes[uuid].stats.MemTotalMB
+}
+
+func computeNodeStatus(s *ssntpSchedulerServer, uuid string) (ssntp.Status, int) {
+	s.cnMutex.RLock()
+	defer s.cnMutex.RUnlock()
+
+	node := s.cnMap[uuid]
+	if node == nil {
+		return ssntp.OFFLINE, 0
+	}
+
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	return node.status, node.memAvailMB
+}
+
+// Test that a standby scheduler follows the primary scheduler's
+// node state and configuration, and takes over when the primary dies.
+func TestSchedulerTakeOver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ciao-scheduler-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	primary := haTestScheduler(t, dir, "primary")
+	go primary.ssntp.Serve(primary.config, primary)
+	time.Sleep(500 * time.Millisecond)
+	configuration := configurePayload(t, "", "", "192.168.1.0/24")
+	primary.configure("", configuration)
+
+	agent := &haTestAgent{connected: make(chan struct{}, 2)}
+	agentConfig := &ssntp.Config{
+		CAcert: *cacert,
+		Cert:   "/etc/pki/ciao/cert-client-localhost.pem",
+		Role:   ssntp.AGENT,
+		Port:   haTestPort,
+	}
+	if err := agent.ssntp.Dial(agentConfig, agent); err != nil {
+		t.Fatal(err)
+	}
+	defer agent.ssntp.Close()
+	<-agent.connected
+	agentUUID := agent.ssntp.UUID()
+
+	ready := payloads.Ready{
+		NodeUUID:        agentUUID,
+		MemTotalMB:      141312,
+		MemAvailableMB:  141312,
+		DiskTotalMB:     100000,
+		DiskAvailableMB: 100000,
+		CpusOnline:      4,
+	}
+	payload, err := yaml.Marshal(&ready)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := agent.ssntp.SendStatus(ssntp.READY, payload); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "primary READY node", func() bool {
+		status, _ := computeNodeStatus(primary, agentUUID)
+		return status == ssntp.READY
+	})
+
+	standby := haTestScheduler(t, dir, "standby")
+	standby.peerConfig = &ssntp.Config{
+		CAcert: *cacert,
+		Cert:   *cert,
+		Role:   ssntp.SCHEDULER,
+		Port:   haTestPort,
+	}
+	standby.peerWait = 5 * time.Second
+	go func() {
+		standby.standBy()
+		standby.ssntp.Serve(standby.config, standby)
+	}()
+
+	waitFor(t, "standby node state", func() bool {
+		return peerNodeMem(standby, agentUUID) == ready.MemTotalMB
+	})
+	if string(standby.ssntp.ClusterConfiguration()) != string(configuration) {
+		t.Errorf("standby did not follow the cluster configuration")
+	}
+
+	primary.ssntp.Stop()
+
+	// the agent fails over to the standby scheduler
+	select {
+	case <-agent.connected:
+	case <-time.After(30 * time.Second):
+		t.Fatal("agent did not reconnect to the standby scheduler")
+	}
+	defer standby.ssntp.Stop()
+
+	// and is schedulable without sending a new READY status
+	waitFor(t, "standby compute node", func() bool {
+		status, _ := computeNodeStatus(standby, agentUUID)
+		return status != ssntp.OFFLINE
+	})
+	status, memAvailMB := computeNodeStatus(standby, agentUUID)
+	if status != ssntp.READY || memAvailMB != ready.MemAvailableMB {
+		t.Errorf("expected READY node with %d MB, got %s with %d MB", ready.MemAvailableMB, status, memAvailMB)
+	}
+}
+
+// haTestTransport is an in-memory SSNTP transport keeping track of the
+// connections its clients dialed, so that tests can break them.
+type haTestTransport struct {
+	*ssntp.MemoryTransport
+	dialed chan net.Conn
+}
+
+func (t *haTestTransport) Dial(address string) (net.Conn, error) {
+	conn, err := t.MemoryTransport.Dial(address)
+	if err == nil {
+		t.dialed <- conn
+	}
+	return conn, err
+}
+
+// Test that a standby scheduler losing its connection to a reachable
+// primary keeps standing by, and only takes over once the primary is
+// gone.
+func TestSchedulerStandbyRedial(t *testing.T) {
+	transport := &haTestTransport{
+		MemoryTransport: ssntp.NewMemoryTransport(),
+		dialed:          make(chan net.Conn, 4),
+	}
+
+	primary := newSsntpSchedulerServer()
+	primary.config = &ssntp.Config{
+		Role:            ssntp.SCHEDULER,
+		CustomTransport: transport,
+	}
+	setSSNTPForwardRules(primary)
+	go primary.ssntp.Serve(primary.config, primary)
+	time.Sleep(100 * time.Millisecond)
+
+	standby := newSsntpSchedulerServer()
+	standby.peerConfig = &ssntp.Config{
+		Role:            ssntp.SCHEDULER,
+		CustomTransport: transport,
+	}
+	standby.peerWait = 2 * time.Second
+
+	takeover := make(chan struct{})
+	go func() {
+		standby.standBy()
+		close(takeover)
+	}()
+
+	peers := func() int {
+		primary.peerMutex.RLock()
+		defer primary.peerMutex.RUnlock()
+		return len(primary.peerMap)
+	}
+
+	conn := <-transport.dialed
+	waitFor(t, "standby scheduler", func() bool { return peers() == 1 })
+	conn.Close()
+
+	// the standby dials the primary again
+	select {
+	case <-transport.dialed:
+	case <-takeover:
+		t.Fatal("standby took over from a reachable primary")
+	case <-time.After(5 * time.Second):
+		t.Fatal("standby did not dial the primary again")
+	}
+
+	select {
+	case <-takeover:
+		t.Fatal("standby took over from a reachable primary")
+	case <-time.After(2 * standby.peerWait):
+	}
+	waitFor(t, "standby scheduler", func() bool { return peers() == 1 })
+
+	primary.ssntp.Stop()
+
+	select {
+	case <-takeover:
+	case <-time.After(10 * time.Second):
+		t.Fatal("standby did not take over")
+	}
+}
+
+// Test that the scheduler rejects frames a client role is not expected
+// to send, and accepts the ones it is.
+func TestAuthorizationRules(t *testing.T) {
+	transport := ssntp.NewMemoryTransport()
+
+	server := newSsntpSchedulerServer()
+	server.config = &ssntp.Config{
+		Role:            ssntp.SCHEDULER,
+		CustomTransport: transport,
+	}
+	setSSNTPForwardRules(server)
+	setSSNTPAuthorizationRules(server)
+	go server.ssntp.Serve(server.config, server)
+	time.Sleep(100 * time.Millisecond)
+	defer server.ssntp.Stop()
+
+	agent := &haTestAgent{
+		connected: make(chan struct{}, 2),
+		errors:    make(chan ssntp.Error, 2),
+	}
+	agentConfig := &ssntp.Config{
+		Role:            ssntp.AGENT,
+		CustomTransport: transport,
+	}
+	if err := agent.ssntp.Dial(agentConfig, agent); err != nil {
+		t.Fatal(err)
+	}
+	defer agent.ssntp.Close()
+	<-agent.connected
+
+	if _, err := agent.ssntp.SendCommand(ssntp.START, []byte("start")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case e := <-agent.errors:
+		if e != ssntp.UnauthorizedFrame {
+			t.Fatalf("expected %s, got %s", ssntp.UnauthorizedFrame, e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("START from an agent was not rejected")
+	}
+
+	ready := payloads.Ready{
+		NodeUUID:       agent.ssntp.UUID(),
+		MemTotalMB:     1024,
+		MemAvailableMB: 1024,
+	}
+	payload, err := yaml.Marshal(&ready)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := agent.ssntp.SendStatus(ssntp.READY, payload); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "READY node", func() bool {
+		status, _ := computeNodeStatus(server, agent.ssntp.UUID())
+		return status == ssntp.READY
+	})
+}
+
+func TestStatsEndpoint(t *testing.T) {
+	transport := ssntp.NewMemoryTransport()
+
+	server := newSsntpSchedulerServer()
+	server.config = &ssntp.Config{
+		Role:            ssntp.SCHEDULER,
+		CustomTransport: transport,
+	}
+	setSSNTPForwardRules(server)
+	go server.ssntp.Serve(server.config, server)
+	time.Sleep(100 * time.Millisecond)
+	defer server.ssntp.Stop()
+
+	agent := &haTestAgent{connected: make(chan struct{}, 2)}
+	agentConfig := &ssntp.Config{
+		Role:            ssntp.AGENT,
+		CustomTransport: transport,
+	}
+	if err := agent.ssntp.Dial(agentConfig, agent); err != nil {
+		t.Fatal(err)
+	}
+	defer agent.ssntp.Close()
+	<-agent.connected
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("GET", "/stats", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+
+	var stats schedulerStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stats.Sessions) != 1 {
+		t.Fatalf("expected 1 session, got %d", len(stats.Sessions))
+	}
+
+	session := stats.Sessions[0]
+	if session.UUID != agent.ssntp.UUID() || session.Role != "CNAgent" || session.RemoteAddress == "" {
+		t.Errorf("unexpected session %s %s %s", session.UUID, session.Role, session.RemoteAddress)
+	}
+
+	if len(session.Received) == 0 || len(stats.Received) == 0 {
+		t.Errorf("CONNECT frame not accounted for")
+	}
+
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("POST", "/stats", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
+
 func benchmarkPickComputeNode(b *testing.B, nodecount int) {
 	sched = configSchedulerServer()
 	if sched == nil {
@@ -202,7 +1493,7 @@ func benchmarkPickComputeNode(b *testing.B, nodecount int) {
 	// setup complete
 
 	for i := 0; i < b.N; i++ {
-		PickComputeNode(sched, "", &resources)
+		PickComputeNode(sched, &resources)
 	}
 }
 
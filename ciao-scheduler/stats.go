@@ -0,0 +1,74 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/01org/ciao/ssntp"
+	"github.com/golang/glog"
+	"net/http"
+)
+
+// schedulerStats is the scheduler admin statistics endpoint reply.
+type schedulerStats struct {
+	ssntp.Stats
+	Sessions []ssntp.SessionStats `json:"sessions"`
+}
+
+// ServeHTTP lists the connected SSNTP sessions, with their role, UUID,
+// remote address and frame counters, together with the scheduler wide
+// counters.
+func (sched *ssntpSchedulerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := schedulerStats{
+		Stats:    sched.ssntp.Stats(),
+		Sessions: sched.ssntp.SessionStats(),
+	}
+
+	if stats.Sessions == nil {
+		stats.Sessions = []ssntp.SessionStats{}
+	}
+
+	b, err := json.MarshalIndent(stats, "", "\t")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// serveStats serves the admin statistics endpoint on addr. This
+// endpoint is not authenticated and should only be bound to a
+// loopback or management network address.
+func (sched *ssntpSchedulerServer) serveStats(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/stats", sched)
+
+	glog.Infof("Serving SSNTP statistics on http://%s/stats", addr)
+
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		glog.Errorf("Unable to serve SSNTP statistics: %s", err)
+	}
+}
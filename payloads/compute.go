@@ -218,6 +218,29 @@ type CiaoTenantResources struct {
 	DiskUsage     int       `json:"disk_usage"`
 }
 
+// CiaoQuota is the limit of a tenant resource, i.e. one of instances,
+// vcpus, mem_mb or disk_mb.  A negative limit means no limit.
+type CiaoQuota struct {
+	Resource string `json:"resource"`
+	Limit    int    `json:"limit"`
+}
+
+// CiaoTenantQuotas represents the unmarshalled version of the contents of a
+// v2.1/tenants/{tenant}/quotas PUT request.  Resources which are not part
+// of the request keep their limit.
+type CiaoTenantQuotas struct {
+	Quotas []CiaoQuota `json:"quotas"`
+}
+
+// CiaoCreateTenant represents the unmarshalled version of the contents of a
+// v2.1/tenants POST request.  The tenant ID is its keystone project ID.
+type CiaoCreateTenant struct {
+	Tenant struct {
+		ID     string      `json:"id"`
+		Quotas []CiaoQuota `json:"quotas"`
+	} `json:"tenant"`
+}
+
 // CiaoUsage contains a snapshot of resource consumption for a tenant.
 type CiaoUsage struct {
 	VCPU      int       `json:"cpus_usage"`
@@ -307,6 +330,53 @@ type CiaoServersAction struct {
 	ServerIDs []string `json:"servers"`
 }
 
+// ServerActionStatus describes the outcome of a v2.1/servers/action request
+// for a single instance.
+type ServerActionStatus string
+
+const (
+	// ServerActionAccepted means that the action was sent to the instance.
+	ServerActionAccepted ServerActionStatus = "accepted"
+
+	// ServerActionNotFound means that the instance does not exist.
+	ServerActionNotFound ServerActionStatus = "not_found"
+
+	// ServerActionForbidden means that the instance belongs to another
+	// tenant.
+	ServerActionForbidden ServerActionStatus = "forbidden"
+
+	// ServerActionInvalidState means that the action cannot be performed
+	// in the current state of the instance.
+	ServerActionInvalidState ServerActionStatus = "invalid_state"
+
+	// ServerActionFailed means that the instance node could not perform
+	// the action.
+	ServerActionFailed ServerActionStatus = "failed"
+
+	// ServerActionUnavailable means that the action could not be sent
+	// to the instance node.
+	ServerActionUnavailable ServerActionStatus = "unavailable"
+
+	// ServerActionTimedOut means that the instance node did not answer
+	// the action in time.
+	ServerActionTimedOut ServerActionStatus = "timed_out"
+)
+
+// CiaoServerActionResult contains the outcome of a v2.1/servers/action
+// request for a single instance.
+type CiaoServerActionResult struct {
+	ID      string             `json:"id"`
+	Status  ServerActionStatus `json:"status"`
+	Message string             `json:"message,omitempty"`
+}
+
+// CiaoServersActionResults represents the marshalled version of the response
+// to a v2.1/servers/action request.  It contains one result per instance the
+// action was attempted on.
+type CiaoServersActionResults struct {
+	Results []CiaoServerActionResult `json:"servers"`
+}
+
 // CiaoTraceSummary contains information about a specific SSNTP Trace label.
 type CiaoTraceSummary struct {
 	Label     string `json:"label"`
@@ -364,3 +434,125 @@ type CiaoEvent struct {
 type CiaoEvents struct {
 	Events []CiaoEvent `json:"events"`
 }
+
+const (
+	// VolumeStatusAvailable is the status of a volume which is not
+	// attached to any instance.
+	VolumeStatusAvailable = "available"
+
+	// VolumeStatusInUse is the status of a volume which is attached,
+	// or being attached, to an instance.
+	VolumeStatusInUse = "in-use"
+)
+
+// CiaoVolume contains information about a block storage volume.
+type CiaoVolume struct {
+	ID         string       `json:"id"`
+	TenantID   string       `json:"tenant_id"`
+	Size       int          `json:"size"`
+	Format     VolumeFormat `json:"format"`
+	Status     string       `json:"status"`
+	InstanceID string       `json:"instance_id"`
+}
+
+// CiaoVolumes represents the unmarshalled version of the response to a
+// v2.1/{tenant}/volumes request.
+type CiaoVolumes struct {
+	Volumes []CiaoVolume `json:"volumes"`
+}
+
+// CiaoCreateVolume represents the unmarshalled version of the contents of
+// a v2.1/{tenant}/volumes POST request.  The size is in GB and the
+// format defaults to raw.
+type CiaoCreateVolume struct {
+	Volume struct {
+		Size   int          `json:"size"`
+		Format VolumeFormat `json:"format"`
+	} `json:"volume"`
+}
+
+// CiaoVolumeResponse represents the unmarshalled version of the response
+// to a v2.1/{tenant}/volumes POST request.
+type CiaoVolumeResponse struct {
+	Volume CiaoVolume `json:"volume"`
+}
+
+// CiaoVolumeAttachment represents the unmarshalled version of the contents
+// of a v2.1/{tenant}/servers/{server}/os-volume_attachments POST request.
+type CiaoVolumeAttachment struct {
+	VolumeAttachment struct {
+		VolumeID string `json:"volumeId"`
+	} `json:"volumeAttachment"`
+}
+
+// CiaoCreateServerImage represents the unmarshalled version of the
+// contents of a createImage v2.1/{tenant}/servers/{server}/action
+// POST request.
+type CiaoCreateServerImage struct {
+	CreateImage struct {
+		Name     string            `json:"name"`
+		Metadata map[string]string `json:"metadata,omitempty"`
+	} `json:"createImage"`
+}
+
+// CiaoServerImage represents the unmarshalled version of the response
+// to a createImage v2.1/{tenant}/servers/{server}/action POST request.
+type CiaoServerImage struct {
+	ImageID string `json:"image_id"`
+}
+
+// CiaoResizeServer represents the unmarshalled version of the contents
+// of a resize v2.1/{tenant}/servers/{server}/action POST request.
+// Resources left to 0 are not changed.
+type CiaoResizeServer struct {
+	Resize struct {
+		VCPUs  int `json:"vcpus"`
+		MemMB  int `json:"mem_mb"`
+		DiskMB int `json:"disk_mb"`
+	} `json:"resize"`
+}
+
+// CiaoWorkloadResource is a default resource of a workload.
+type CiaoWorkloadResource struct {
+	Type      Resource `json:"type"`
+	Value     int      `json:"value"`
+	Mandatory bool     `json:"mandatory"`
+}
+
+// CiaoWorkload contains information about a workload, i.e. a template
+// from which instances are launched.  Config is the cloud-init
+// configuration of the workload instances.
+type CiaoWorkload struct {
+	ID          string                 `json:"id"`
+	Description string                 `json:"description"`
+	FWType      Firmware               `json:"fw_type"`
+	VMType      Hypervisor             `json:"vm_type"`
+	ImageID     string                 `json:"image_id"`
+	ImageName   string                 `json:"image_name"`
+	Config      string                 `json:"config"`
+	Defaults    []CiaoWorkloadResource `json:"defaults"`
+}
+
+// CiaoWorkloads represents the unmarshalled version of the response to a
+// v2.1/workloads request.
+type CiaoWorkloads struct {
+	Workloads []CiaoWorkload `json:"workloads"`
+}
+
+// CiaoWorkloadRequest represents the unmarshalled version of the contents
+// of a v2.1/workloads POST or a v2.1/workloads/{workload} PUT request, and
+// of the response to these requests.
+type CiaoWorkloadRequest struct {
+	Workload CiaoWorkload `json:"workload"`
+}
+
+// HTTPError represents the details of a compute API error.
+type HTTPError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// HTTPErrorResponse represents the unmarshalled version of a compute API
+// error response. As for Nova, it contains a single HTTPError named after
+// the fault type, e.g. {"itemNotFound": {"code": 404, "message": "..."}}.
+type HTTPErrorResponse map[string]HTTPError
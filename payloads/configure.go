@@ -16,25 +16,26 @@
 
 package payloads
 
-// ServiceType is reserved for future use.
+// ServiceType is the type of an external service the cluster relies on.
 type ServiceType string
 
-// StorageType is reserved for future use.
+// StorageType is the type of backend the scheduler persists the
+// cluster configuration to.
 type StorageType string
 
 const (
-	// Glance is reserved for future use.
+	// Glance is the OpenStack image service.
 	Glance ServiceType = "glance"
 
-	// Keystone is reserved for future use.
+	// Keystone is the OpenStack identity service.
 	Keystone ServiceType = "keystone"
 )
 
 const (
-	// Filesystem is reserved for future use.
+	// Filesystem stores the cluster configuration in a local file.
 	Filesystem StorageType = "file"
 
-	// Etcd is reserved for future use.
+	// Etcd stores the cluster configuration in an etcd cluster.
 	Etcd StorageType = "etcd"
 )
 
@@ -60,13 +61,15 @@ func (s StorageType) String() string {
 	return ""
 }
 
-// ConfigureScheduler is reserved for future use.
+// ConfigureScheduler describes where the scheduler persists the
+// cluster configuration.  ConfigStorageURI is a file path for
+// Filesystem storage and an etcd endpoint URL for Etcd storage.
 type ConfigureScheduler struct {
 	ConfigStorageType StorageType `yaml:"storage_type"`
 	ConfigStorageURI  string      `yaml:"storage_uri"`
 }
 
-// ConfigureController is reserved for future use.
+// ConfigureController contains the controller specific configuration.
 type ConfigureController struct {
 	ComputePort      int    `yaml:"compute_port"`
 	ComputeCACert    string `yaml:"compute_ca"`
@@ -75,7 +78,8 @@ type ConfigureController struct {
 	IdentityPassword string `yaml:"identity_password"`
 }
 
-// ConfigureLauncher is reserved for future use.
+// ConfigureLauncher contains the launcher specific configuration.
+// ComputeNetwork and ManagementNetwork are subnets in CIDR notation.
 type ConfigureLauncher struct {
 	ComputeNetwork    string `yaml:"compute_net"`
 	ManagementNetwork string `yaml:"mgmt_net"`
@@ -83,13 +87,13 @@ type ConfigureLauncher struct {
 	MemoryLimit       bool   `yaml:"mem_limit"`
 }
 
-// ConfigureService is reserved for future use.
+// ConfigureService describes an external service endpoint.
 type ConfigureService struct {
 	Type ServiceType `yaml:"type"`
 	URL  string      `yaml:"url"`
 }
 
-// ConfigurePayload is reserved for future use.
+// ConfigurePayload is the full cluster configuration.
 type ConfigurePayload struct {
 	Scheduler       ConfigureScheduler  `yaml:"scheduler"`
 	Controller      ConfigureController `yaml:"controller"`
@@ -98,7 +102,8 @@ type ConfigurePayload struct {
 	IdentityService ConfigureService    `yaml:"identity_service"`
 }
 
-// Configure is reserved for future use.
+// Configure represents the unmarshalled version of the contents of a
+// SSNTP CONFIGURE command payload, and of a CONNECTED status payload.
 type Configure struct {
 	Configure ConfigurePayload `yaml:"configure"`
 }
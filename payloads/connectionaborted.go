@@ -0,0 +1,53 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// ConnectionAbortedReason denotes the underlying error that made an
+// SSNTP peer abort a connection.
+type ConnectionAbortedReason string
+
+const (
+	// CertificateRevoked indicates that the peer certificate is
+	// listed in the certificate revocation list.
+	CertificateRevoked ConnectionAbortedReason = "certificate_revoked"
+
+	// InvalidCertificateRole indicates that the peer certificate does
+	// not carry the role OID matching the role it declared.
+	InvalidCertificateRole ConnectionAbortedReason = "invalid_certificate_role"
+)
+
+// ErrorConnectionAborted represents the unmarshalled version of the contents of a
+// SSNTP ERROR frame whose type is set to ssntp.ConnectionAborted.
+type ErrorConnectionAborted struct {
+	// Reason provides the reason for the connection abortion, e.g.,
+	// CertificateRevoked.
+	Reason ConnectionAbortedReason `yaml:"reason"`
+
+	// Serial is the serial number of the aborted peer certificate.
+	Serial string `yaml:"serial,omitempty"`
+}
+
+func (r ConnectionAbortedReason) String() string {
+	switch r {
+	case CertificateRevoked:
+		return "Certificate revoked"
+	case InvalidCertificateRole:
+		return "Invalid certificate role"
+	}
+
+	return ""
+}
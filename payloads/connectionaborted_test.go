@@ -0,0 +1,63 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestConnectionAbortedUnmarshal(t *testing.T) {
+	connectionAbortedYaml := `reason: certificate_revoked
+serial: "4096"
+`
+	var error ErrorConnectionAborted
+	err := yaml.Unmarshal([]byte(connectionAbortedYaml), &error)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if error.Reason != CertificateRevoked {
+		t.Error("Wrong Error field")
+	}
+
+	if error.Serial != "4096" {
+		t.Error("Wrong Serial field")
+	}
+}
+
+func TestConnectionAbortedString(t *testing.T) {
+	var stringTests = []struct {
+		r        ConnectionAbortedReason
+		expected string
+	}{
+		{CertificateRevoked, "Certificate revoked"},
+		{InvalidCertificateRole, "Invalid certificate role"},
+	}
+
+	for _, test := range stringTests {
+		error := ErrorConnectionAborted{
+			Reason: test.r,
+		}
+
+		s := error.Reason.String()
+		if s != test.expected {
+			t.Errorf("expected \"%s\", got \"%s\"", test.expected, s)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// ConnectionFailureReason denotes the underlying error that prevented
+// an SSNTP client from connecting to an SSNTP server.
+type ConnectionFailureReason string
+
+const (
+	// UnsupportedVersion indicates that the SSNTP server does not
+	// support the SSNTP version the client connected with.
+	UnsupportedVersion ConnectionFailureReason = "unsupported_version"
+)
+
+// ErrorConnectionFailure represents the unmarshalled version of the contents of a
+// SSNTP ERROR frame whose type is set to ssntp.ConnectionFailure.
+type ErrorConnectionFailure struct {
+	// Reason provides the reason for the connection failure, e.g.,
+	// UnsupportedVersion.
+	Reason ConnectionFailureReason `yaml:"reason"`
+
+	// Version is the SSNTP version, e.g. "2.0", the client tried to
+	// connect with.
+	Version string `yaml:"version"`
+
+	// SupportedVersions lists the SSNTP versions the server supports.
+	SupportedVersions []string `yaml:"supported_versions"`
+}
+
+func (r ConnectionFailureReason) String() string {
+	switch r {
+	case UnsupportedVersion:
+		return "Unsupported SSNTP version"
+	}
+
+	return ""
+}
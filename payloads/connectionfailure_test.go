@@ -0,0 +1,60 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestConnectionFailureUnmarshal(t *testing.T) {
+	connectionFailureYaml := `reason: unsupported_version
+version: "2.0"
+supported_versions:
+- "0.1"
+- "1.0"
+`
+	var error ErrorConnectionFailure
+	err := yaml.Unmarshal([]byte(connectionFailureYaml), &error)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if error.Reason != UnsupportedVersion {
+		t.Error("Wrong Error field")
+	}
+
+	if error.Version != "2.0" {
+		t.Error("Wrong Version field")
+	}
+
+	if len(error.SupportedVersions) != 2 || error.SupportedVersions[1] != "1.0" {
+		t.Error("Wrong SupportedVersions field")
+	}
+}
+
+func TestConnectionFailureString(t *testing.T) {
+	error := ErrorConnectionFailure{
+		Reason: UnsupportedVersion,
+	}
+
+	s := error.Reason.String()
+	if s != "Unsupported SSNTP version" {
+		t.Errorf("expected \"Unsupported SSNTP version\", got \"%s\"", s)
+	}
+}
@@ -16,12 +16,111 @@
 
 package payloads
 
-// EvacuateCmd is reserved for future use.
+// EvacuateNextState describes the state a compute node should reach once
+// all of its instances have been evacuated.
+type EvacuateNextState string
+
+const (
+	// EvacuateMaintenance puts the node in maintenance mode.
+	EvacuateMaintenance EvacuateNextState = "maintenance"
+
+	// EvacuateShutdown is used when the node is going to be shut down.
+	EvacuateShutdown = "shutdown"
+
+	// EvacuateUpdate is used when the node is going to run a software update.
+	EvacuateUpdate = "update"
+
+	// EvacuateReboot is used when the node is going to be rebooted.
+	EvacuateReboot = "reboot"
+)
+
+// EvacuateCmd contains the information needed to evacuate a compute node.
 type EvacuateCmd struct {
+	// WorkloadAgentUUID identifies the agent running on the node to
+	// evacuate.
 	WorkloadAgentUUID string `yaml:"workload_agent_uuid"`
+
+	// NextState is the state the node should reach once evacuated.  An
+	// empty NextState is equivalent to EvacuateMaintenance.
+	NextState EvacuateNextState `yaml:"next_state,omitempty"`
+
+	// Migrations lists the instances whose root disks are uploaded to
+	// the image service before they are removed from the node.
+	Migrations []InstanceMigration `yaml:"migrations,omitempty"`
+
+	// Force has instances missing from Migrations, or whose root disks
+	// fail to be uploaded, evacuated anyway.  These instances restart
+	// from their images and lose the content of their root disks.
+	// Unless Force is set, a node hosting such instances, CNCIs aside,
+	// is not evacuated.
+	Force bool `yaml:"force,omitempty"`
+}
+
+// InstanceMigration tells a node being evacuated where to upload the
+// root disk of one of its instances.
+type InstanceMigration struct {
+	// InstanceUUID is the UUID of the instance to migrate.
+	InstanceUUID string `yaml:"instance_uuid"`
+
+	// ImageUUID is the UUID of the queued image the root disk of the
+	// instance is uploaded to.
+	ImageUUID string `yaml:"image_uuid"`
+
+	// UploadToken must be presented to the image service to upload
+	// the image data.
+	UploadToken string `yaml:"upload_token"`
 }
 
-// Evacuate is reserved for future use.
+// Evacuate represents the unmarshalled version of the contents of a SSNTP
+// EVACUATE payload.  The controller sends this command to a compute node
+// agent to have it stop accepting new instances and hand all of its
+// existing ones back to the controller for rescheduling.
 type Evacuate struct {
 	Evacuate EvacuateCmd `yaml:"evacuate"`
 }
+
+// InstanceEvacuatedEvent contains information about an instance that has
+// just been removed from a node being evacuated.
+type InstanceEvacuatedEvent struct {
+	// InstanceUUID is the UUID of the evacuated instance.
+	InstanceUUID string `yaml:"instance_uuid"`
+
+	// NodeUUID is the SSNTP UUID of the agent running on the evacuated
+	// node.
+	NodeUUID string `yaml:"node_uuid"`
+
+	// Remaining is the number of instances still to be evacuated from
+	// the node.
+	Remaining int `yaml:"remaining"`
+
+	// ImageUUID is the UUID of the image holding the root disk of the
+	// instance, which the instance should be restarted from.  It is
+	// empty if the root disk was not migrated.
+	ImageUUID string `yaml:"image_uuid,omitempty"`
+}
+
+// EventInstanceEvacuated represents the unmarshalled version of the contents
+// of an SSNTP ssntp.InstanceEvacuated event.  This event is sent by
+// ciao-launcher for each instance it removes while evacuating its node.
+// The controller is expected to restart the instance elsewhere.
+type EventInstanceEvacuated struct {
+	InstanceEvacuated InstanceEvacuatedEvent `yaml:"instance_evacuated"`
+}
+
+// NodeEvacuatedEvent contains information about a node that has no
+// instances left after having been evacuated.
+type NodeEvacuatedEvent struct {
+	// NodeUUID is the SSNTP UUID of the agent running on the node.
+	NodeUUID string `yaml:"node_uuid"`
+
+	// NextState is the state requested in the EVACUATE command.
+	NextState EvacuateNextState `yaml:"next_state"`
+}
+
+// EventNodeEvacuated represents the unmarshalled version of the contents
+// of an SSNTP ssntp.NodeEvacuated event.  This event is sent by
+// ciao-launcher once the last instance has left its node, right before
+// it enters maintenance mode.
+type EventNodeEvacuated struct {
+	NodeEvacuated NodeEvacuatedEvent `yaml:"node_evacuated"`
+}
@@ -51,3 +51,195 @@ func TestEvacUnmarshal(t *testing.T) {
 		t.Errorf("Wrong Agent UUID field [%s]", cmd.Evacuate.WorkloadAgentUUID)
 	}
 }
+
+const evacForceYaml = "" +
+	"evacuate:\n" +
+	"  workload_agent_uuid: " + evacAgentUUID + "\n" +
+	"  force: true\n"
+
+func TestEvacForceUnmarshal(t *testing.T) {
+	var cmd Evacuate
+	err := yaml.Unmarshal([]byte(evacForceYaml), &cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !cmd.Evacuate.Force {
+		t.Error("Force field not set")
+	}
+}
+
+const evacImageUUID = "9601a7e0-c9b5-4ba0-a9e0-8e7e3b6b8c0d"
+const evacUploadToken = "7d3ac0b4-b0e2-4ea9-9f6a-7b5cbb3c9f43"
+const evacMigrationsYaml = "" +
+	"evacuate:\n" +
+	"  workload_agent_uuid: " + evacAgentUUID + "\n" +
+	"  migrations:\n" +
+	"  - instance_uuid: " + insEvacUUID + "\n" +
+	"    image_uuid: " + evacImageUUID + "\n" +
+	"    upload_token: " + evacUploadToken + "\n"
+
+func TestEvacMigrationsMarshal(t *testing.T) {
+	var cmd Evacuate
+	cmd.Evacuate.WorkloadAgentUUID = evacAgentUUID
+	cmd.Evacuate.Migrations = []InstanceMigration{
+		{
+			InstanceUUID: insEvacUUID,
+			ImageUUID:    evacImageUUID,
+			UploadToken:  evacUploadToken,
+		},
+	}
+
+	y, err := yaml.Marshal(&cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != evacMigrationsYaml {
+		t.Errorf("EVACUATE marshalling failed\n[%s]\n vs\n[%s]", string(y), evacMigrationsYaml)
+	}
+}
+
+func TestEvacMigrationsUnmarshal(t *testing.T) {
+	var cmd Evacuate
+	err := yaml.Unmarshal([]byte(evacMigrationsYaml), &cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(cmd.Evacuate.Migrations) != 1 {
+		t.Fatalf("Expected 1 migration, got %d", len(cmd.Evacuate.Migrations))
+	}
+
+	m := cmd.Evacuate.Migrations[0]
+	if m.InstanceUUID != insEvacUUID || m.ImageUUID != evacImageUUID ||
+		m.UploadToken != evacUploadToken {
+		t.Errorf("Wrong migration %v", m)
+	}
+}
+
+const evacNextStateYaml = "" +
+	"evacuate:\n" +
+	"  workload_agent_uuid: " + evacAgentUUID + "\n" +
+	"  next_state: update\n"
+
+func TestEvacNextStateMarshal(t *testing.T) {
+	var cmd Evacuate
+	cmd.Evacuate.WorkloadAgentUUID = evacAgentUUID
+	cmd.Evacuate.NextState = EvacuateUpdate
+
+	y, err := yaml.Marshal(&cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != evacNextStateYaml {
+		t.Errorf("EVACUATE marshalling failed\n[%s]\n vs\n[%s]", string(y), evacNextStateYaml)
+	}
+}
+
+func TestEvacNextStateUnmarshal(t *testing.T) {
+	var cmd Evacuate
+	err := yaml.Unmarshal([]byte(evacNextStateYaml), &cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if cmd.Evacuate.NextState != EvacuateUpdate {
+		t.Errorf("Wrong next state field [%s]", cmd.Evacuate.NextState)
+	}
+}
+
+const insEvacUUID = "2f6e1fc2-54ac-4cdb-9a0b-6d55ad7ab0a5"
+const insEvacYaml = "" +
+	"instance_evacuated:\n" +
+	"  instance_uuid: " + insEvacUUID + "\n" +
+	"  node_uuid: " + evacAgentUUID + "\n" +
+	"  remaining: 2\n"
+
+func TestInstanceEvacuatedMarshal(t *testing.T) {
+	var evt EventInstanceEvacuated
+	evt.InstanceEvacuated.InstanceUUID = insEvacUUID
+	evt.InstanceEvacuated.NodeUUID = evacAgentUUID
+	evt.InstanceEvacuated.Remaining = 2
+
+	y, err := yaml.Marshal(&evt)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != insEvacYaml {
+		t.Errorf("InstanceEvacuated marshalling failed\n[%s]\n vs\n[%s]", string(y), insEvacYaml)
+	}
+}
+
+const insEvacImageYaml = insEvacYaml +
+	"  image_uuid: " + evacImageUUID + "\n"
+
+func TestInstanceEvacuatedImageUnmarshal(t *testing.T) {
+	var evt EventInstanceEvacuated
+	err := yaml.Unmarshal([]byte(insEvacImageYaml), &evt)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if evt.InstanceEvacuated.ImageUUID != evacImageUUID {
+		t.Errorf("Wrong image UUID field [%s]", evt.InstanceEvacuated.ImageUUID)
+	}
+}
+
+func TestInstanceEvacuatedUnmarshal(t *testing.T) {
+	var evt EventInstanceEvacuated
+	err := yaml.Unmarshal([]byte(insEvacYaml), &evt)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if evt.InstanceEvacuated.InstanceUUID != insEvacUUID {
+		t.Errorf("Wrong instance UUID field [%s]", evt.InstanceEvacuated.InstanceUUID)
+	}
+
+	if evt.InstanceEvacuated.NodeUUID != evacAgentUUID {
+		t.Errorf("Wrong node UUID field [%s]", evt.InstanceEvacuated.NodeUUID)
+	}
+
+	if evt.InstanceEvacuated.Remaining != 2 {
+		t.Errorf("Wrong remaining field [%d]", evt.InstanceEvacuated.Remaining)
+	}
+}
+
+const nodeEvacYaml = "" +
+	"node_evacuated:\n" +
+	"  node_uuid: " + evacAgentUUID + "\n" +
+	"  next_state: maintenance\n"
+
+func TestNodeEvacuatedMarshal(t *testing.T) {
+	var evt EventNodeEvacuated
+	evt.NodeEvacuated.NodeUUID = evacAgentUUID
+	evt.NodeEvacuated.NextState = EvacuateMaintenance
+
+	y, err := yaml.Marshal(&evt)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != nodeEvacYaml {
+		t.Errorf("NodeEvacuated marshalling failed\n[%s]\n vs\n[%s]", string(y), nodeEvacYaml)
+	}
+}
+
+func TestNodeEvacuatedUnmarshal(t *testing.T) {
+	var evt EventNodeEvacuated
+	err := yaml.Unmarshal([]byte(nodeEvacYaml), &evt)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if evt.NodeEvacuated.NodeUUID != evacAgentUUID {
+		t.Errorf("Wrong node UUID field [%s]", evt.NodeEvacuated.NodeUUID)
+	}
+
+	if evt.NodeEvacuated.NextState != EvacuateMaintenance {
+		t.Errorf("Wrong next state field [%s]", evt.NodeEvacuated.NextState)
+	}
+}
@@ -0,0 +1,65 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"time"
+)
+
+const (
+	// ImageStatusQueued is the status of an image whose data has not
+	// been uploaded yet.
+	ImageStatusQueued = "queued"
+
+	// ImageStatusSaving is the status of an image whose data is being
+	// uploaded.
+	ImageStatusSaving = "saving"
+
+	// ImageStatusActive is the status of an image which can be
+	// downloaded.
+	ImageStatusActive = "active"
+)
+
+// ImageUploadTokenHeader is the HTTP header carrying the upload token
+// of a snapshot image, as received in the SNAPSHOT command.
+const ImageUploadTokenHeader = "X-Ciao-Upload-Token"
+
+// CiaoImage contains information about an image of the ciao image
+// service.  Checksum is the hex encoded SHA-256 digest of the image data
+// and is empty until the data is uploaded.
+type CiaoImage struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Status    string    `json:"status"`
+	Size      int64     `json:"size"`
+	Checksum  string    `json:"checksum"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CiaoImages represents the unmarshalled version of the response to a
+// v2/images request.
+type CiaoImages struct {
+	Images []CiaoImage `json:"images"`
+}
+
+// CiaoCreateImage represents the unmarshalled version of the contents of
+// a v2/images POST request.  The ID is optional, and lets workloads refer
+// to an image before it is created.
+type CiaoCreateImage struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
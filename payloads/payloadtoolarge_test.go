@@ -0,0 +1,70 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestPayloadTooLargeUnmarshal(t *testing.T) {
+	tooLargeYaml := `type: COMMAND
+operand: START
+max_size: 16777216
+`
+	var error ErrorPayloadTooLarge
+	err := yaml.Unmarshal([]byte(tooLargeYaml), &error)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if error.Type != "COMMAND" {
+		t.Error("Wrong Type field")
+	}
+
+	if error.Operand != "START" {
+		t.Error("Wrong Operand field")
+	}
+
+	if error.MaxSize != 16777216 {
+		t.Error("Wrong MaxSize field")
+	}
+}
+
+func TestPayloadTooLargeMarshal(t *testing.T) {
+	error := ErrorPayloadTooLarge{
+		Type:    "STATUS",
+		Operand: "READY",
+		MaxSize: 1024,
+	}
+
+	y, err := yaml.Marshal(&error)
+	if err != nil {
+		t.Error(err)
+	}
+
+	var unmarshalled ErrorPayloadTooLarge
+	err = yaml.Unmarshal(y, &unmarshalled)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if unmarshalled != error {
+		t.Errorf("Marshalling round trip failed: %v", unmarshalled)
+	}
+}
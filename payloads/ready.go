@@ -44,6 +44,18 @@ type Ready struct {
 	// Number of CPUs present in the CN/NN.  Derived from the number of
 	// cpu[0-9]+ entries in /proc/stat.
 	CpusOnline int `yaml:"cpus_online"`
+
+	// VCPUsAllocated is the number of vCPUs claimed by the instances
+	// currently running on the CN/NN.
+	VCPUsAllocated int `yaml:"vcpus_allocated"`
+
+	// Labels are the key value pairs the CN/NN was configured with,
+	// matched against the placement constraints of new instances.
+	Labels map[string]string `yaml:"labels,omitempty"`
+
+	// AntiAffinityGroups lists the anti-affinity groups of the instances
+	// currently running on the CN/NN.
+	AntiAffinityGroups []string `yaml:"anti_affinity_groups,omitempty"`
 }
 
 // Init initialises the Ready structure.
@@ -55,4 +67,7 @@ func (s *Ready) Init() {
 	s.DiskAvailableMB = -1
 	s.Load = -1
 	s.CpusOnline = -1
+	s.VCPUsAllocated = -1
+	s.Labels = nil
+	s.AntiAffinityGroups = nil
 }
@@ -31,12 +31,17 @@ disk_total_mb: 500000
 disk_available_mb: 256000
 load: 0
 cpus_online: 4
+vcpus_allocated: 3
 `
 	var cmd Ready
 	err := yaml.Unmarshal([]byte(readyYaml), &cmd)
 	if err != nil {
 		t.Error(err)
 	}
+
+	if cmd.VCPUsAllocated != 3 {
+		t.Errorf("Expected 3 allocated vcpus got %d", cmd.VCPUsAllocated)
+	}
 }
 
 func TestReadyMarshal(t *testing.T) {
@@ -79,6 +84,7 @@ load: 1
 		DiskAvailableMB: -1,
 		Load:            1,
 		CpusOnline:      -1,
+		VCPUsAllocated:  -1,
 	}
 	if cmd.NodeUUID != expectedCmd.NodeUUID ||
 		cmd.MemTotalMB != expectedCmd.MemTotalMB ||
@@ -86,9 +92,32 @@ load: 1
 		cmd.DiskTotalMB != expectedCmd.DiskTotalMB ||
 		cmd.DiskAvailableMB != expectedCmd.DiskAvailableMB ||
 		cmd.Load != expectedCmd.Load ||
-		cmd.CpusOnline != expectedCmd.CpusOnline {
+		cmd.CpusOnline != expectedCmd.CpusOnline ||
+		cmd.VCPUsAllocated != expectedCmd.VCPUsAllocated {
 		t.Error("Unexpected values in Ready")
 	}
 
 	fmt.Println(cmd)
 }
+
+func TestReadyLabels(t *testing.T) {
+	readyYaml := `node_uuid: 2400bce6-ccc8-4a45-b2aa-b5cc3790077b
+labels:
+  rack: r1
+anti_affinity_groups:
+- tenant/db
+`
+	var cmd Ready
+	cmd.Init()
+
+	err := yaml.Unmarshal([]byte(readyYaml), &cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cmd.Labels["rack"] != "r1" ||
+		len(cmd.AntiAffinityGroups) != 1 ||
+		cmd.AntiAffinityGroups[0] != "tenant/db" {
+		t.Errorf("Unexpected labels in Ready %v", cmd)
+	}
+}
@@ -0,0 +1,46 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// ResizeCmd contains the information needed to change the resources of
+// a stopped instance.
+type ResizeCmd struct {
+	// InstanceUUID is the UUID of the instance to resize.
+	InstanceUUID string `yaml:"instance_uuid"`
+
+	// WorkloadAgentUUID identifies the node on which the instance is
+	// hosted.  This information is needed by the scheduler to route
+	// the command to the correct CN.
+	WorkloadAgentUUID string `yaml:"workload_agent_uuid"`
+
+	// RequestedResources contains the new vcpus, mem_mb and disk_mb
+	// values of the instance.
+	RequestedResources []RequestedResource `yaml:"requested_resources"`
+
+	// CurrentResources contains the vcpus, mem_mb and disk_mb values
+	// of the instance before the resize.  They are used by the
+	// scheduler to compute the additional resources the hosting node
+	// needs to provide.
+	CurrentResources []RequestedResource `yaml:"current_resources"`
+}
+
+// Resize represents the unmarshalled version of the contents of an
+// SSNTP Resize payload.
+type Resize struct {
+	// Resize contains information about the instance to resize.
+	Resize ResizeCmd `yaml:"resize"`
+}
@@ -0,0 +1,105 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestResizeUnmarshal(t *testing.T) {
+	resizeYaml := `resize:
+  instance_uuid: 3390740c-dce9-48d6-b83a-a717417072ce
+  workload_agent_uuid: 59460b8a-5f53-4e3e-b5ce-b71fed8c7e64
+  requested_resources:
+  - type: vcpus
+    value: 4
+  - type: mem_mb
+    value: 1024
+  - type: disk_mb
+    value: 20000
+  current_resources:
+  - type: vcpus
+    value: 2
+  - type: mem_mb
+    value: 512
+  - type: disk_mb
+    value: 10000
+`
+	var cmd Resize
+	err := yaml.Unmarshal([]byte(resizeYaml), &cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cmd.Resize.InstanceUUID != instanceUUID ||
+		cmd.Resize.WorkloadAgentUUID != agentUUID {
+		t.Errorf("Unexpected values in Resize %v", cmd)
+	}
+
+	expected := []RequestedResource{
+		{Type: VCPUs, Value: 4},
+		{Type: MemMB, Value: 1024},
+		{Type: DiskMB, Value: 20000},
+	}
+	if len(cmd.Resize.RequestedResources) != len(expected) {
+		t.Fatalf("Unexpected requested resources %v", cmd.Resize.RequestedResources)
+	}
+	for i, r := range expected {
+		if cmd.Resize.RequestedResources[i] != r {
+			t.Errorf("Unexpected requested resource %v, expected %v",
+				cmd.Resize.RequestedResources[i], r)
+		}
+	}
+
+	if len(cmd.Resize.CurrentResources) != 3 ||
+		cmd.Resize.CurrentResources[1].Value != 512 {
+		t.Errorf("Unexpected current resources %v", cmd.Resize.CurrentResources)
+	}
+}
+
+func TestResizeFailureUnmarshal(t *testing.T) {
+	failureYaml := `instance_uuid: 3390740c-dce9-48d6-b83a-a717417072ce
+reason: no_capacity
+resources:
+- type: mem_mb
+  value: 512
+`
+	var error ErrorResizeFailure
+	err := yaml.Unmarshal([]byte(failureYaml), &error)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if error.InstanceUUID != instanceUUID {
+		t.Error("Wrong UUID field")
+	}
+
+	if error.Reason != ResizeNoCapacity {
+		t.Error("Wrong Error field")
+	}
+
+	if len(error.Resources) != 1 || error.Resources[0].Type != MemMB ||
+		error.Resources[0].Value != 512 {
+		t.Errorf("Unexpected resources %v", error.Resources)
+	}
+
+	if error.Reason.String() != "No node can accommodate the new resources" {
+		t.Errorf("Unexpected reason string \"%s\"", error.Reason)
+	}
+}
@@ -0,0 +1,90 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// ResizeFailureReason denotes the underlying error that prevented
+// an SSNTP Resize command from changing the resources of an instance.
+type ResizeFailureReason string
+
+const (
+	// ResizeNoInstance indicates that an instance could not be
+	// resized as it does not exist on the node to which the
+	// Resize command was sent.
+	ResizeNoInstance ResizeFailureReason = "no_instance"
+
+	// ResizeInvalidPayload indicates that the payload of the SSNTP
+	// Resize command was corrupt and could not be unmarshalled.
+	ResizeInvalidPayload = "invalid_payload"
+
+	// ResizeInvalidData is returned by ciao-launcher if the
+	// contents of the Resize payload are incorrect, e.g., the
+	// mem_mb resource is missing.
+	ResizeInvalidData = "invalid_data"
+
+	// ResizeNotStopped indicates that the instance is running and
+	// only stopped instances can be resized.
+	ResizeNotStopped = "not_stopped"
+
+	// ResizeNotSupported indicates that the instance's virtualizer,
+	// e.g., docker, does not support resizing.
+	ResizeNotSupported = "not_supported"
+
+	// ResizeResizeFailure indicates that the instance's disk could
+	// not be grown or that its configuration could not be updated.
+	ResizeResizeFailure = "resize_failure"
+
+	// ResizeNoCapacity is returned by the scheduler when no node can
+	// accommodate the new resources of the instance.
+	ResizeNoCapacity = "no_capacity"
+)
+
+// ErrorResizeFailure represents the unmarshalled version of the contents
+// of a SSNTP ERROR frame whose type is set to ssntp.ResizeFailure.
+type ErrorResizeFailure struct {
+	// InstanceUUID is the UUID of the instance that could not be
+	// resized.
+	InstanceUUID string `yaml:"instance_uuid"`
+
+	// Reason provides the reason for the resize failure, e.g.,
+	// ResizeNotStopped.
+	Reason ResizeFailureReason `yaml:"reason"`
+
+	// Resources contains the resources of the instance before the
+	// resize, i.e., the resources the instance still has.
+	Resources []RequestedResource `yaml:"resources"`
+}
+
+func (r ResizeFailureReason) String() string {
+	switch r {
+	case ResizeNoInstance:
+		return "Instance does not exist"
+	case ResizeInvalidPayload:
+		return "YAML payload is corrupt"
+	case ResizeInvalidData:
+		return "Command section of YAML payload is corrupt or missing required information"
+	case ResizeNotStopped:
+		return "Instance is not stopped"
+	case ResizeNotSupported:
+		return "Instance does not support resizing"
+	case ResizeResizeFailure:
+		return "Failed to resize instance"
+	case ResizeNoCapacity:
+		return "No node can accommodate the new resources"
+	}
+
+	return ""
+}
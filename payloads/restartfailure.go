@@ -52,6 +52,10 @@ const (
 	// RestartNetworkFailure indicates that it was not possible to
 	// initialise networking for the instance before restarting it.
 	RestartNetworkFailure = "network_failure"
+
+	// RestartNodeUnavailable is returned by ciao-scheduler when the node
+	// to which the RESTART command is addressed is not connected.
+	RestartNodeUnavailable = "node_unavailable"
 )
 
 // ErrorRestartFailure represents the unmarshalled version of the contents of a
@@ -81,6 +85,8 @@ func (r RestartFailureReason) String() string {
 		return "Failed to launch instance"
 	case RestartNetworkFailure:
 		return "Failed to locate VNIC for instance"
+	case RestartNodeUnavailable:
+		return "Instance node is not connected"
 	}
 
 	return ""
@@ -68,6 +68,7 @@ func TestRestartFailureString(t *testing.T) {
 		{RestartInstanceCorrupt, "Instance is corrupt"},
 		{RestartLaunchFailure, "Failed to launch instance"},
 		{RestartNetworkFailure, "Failed to locate VNIC for instance"},
+		{RestartNodeUnavailable, "Instance node is not connected"},
 	}
 	error := ErrorRestartFailure{
 		InstanceUUID: uuid.Generate().String(),
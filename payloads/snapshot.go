@@ -0,0 +1,46 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// SnapshotCmd contains the information needed to copy the root disk of
+// a running instance into a new image.
+type SnapshotCmd struct {
+	// InstanceUUID is the UUID of the instance to snapshot.
+	InstanceUUID string `yaml:"instance_uuid"`
+
+	// ImageUUID is the UUID of the image the snapshot is uploaded to.
+	// The image must have been created, and not yet uploaded, on the
+	// image service.
+	ImageUUID string `yaml:"image_uuid"`
+
+	// UploadToken must be presented to the image service along with
+	// the snapshot data.  It is only sent to the node running the
+	// instance, so that no other node can upload to the image.
+	UploadToken string `yaml:"upload_token"`
+
+	// WorkloadAgentUUID identifies the node on which the instance is
+	// running.  This information is needed by the scheduler to route
+	// the command to the correct CN.
+	WorkloadAgentUUID string `yaml:"workload_agent_uuid"`
+}
+
+// Snapshot represents the unmarshalled version of the contents of an
+// SSNTP Snapshot payload.
+type Snapshot struct {
+	// Snapshot contains information about the instance to snapshot.
+	Snapshot SnapshotCmd `yaml:"snapshot"`
+}
@@ -0,0 +1,68 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+const imageUUID = "b265f62b-e957-47fd-a0a2-6dc261c7315c"
+
+func TestSnapshotUnmarshal(t *testing.T) {
+	snapshotYaml := `snapshot:
+  instance_uuid: 3390740c-dce9-48d6-b83a-a717417072ce
+  image_uuid: b265f62b-e957-47fd-a0a2-6dc261c7315c
+  workload_agent_uuid: 59460b8a-5f53-4e3e-b5ce-b71fed8c7e64
+`
+	var cmd Snapshot
+	err := yaml.Unmarshal([]byte(snapshotYaml), &cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cmd.Snapshot.InstanceUUID != instanceUUID ||
+		cmd.Snapshot.ImageUUID != imageUUID ||
+		cmd.Snapshot.WorkloadAgentUUID != agentUUID {
+		t.Errorf("Unexpected values in Snapshot %v", cmd)
+	}
+}
+
+func TestSnapshotFailureUnmarshal(t *testing.T) {
+	failureYaml := `instance_uuid: 3390740c-dce9-48d6-b83a-a717417072ce
+image_uuid: b265f62b-e957-47fd-a0a2-6dc261c7315c
+reason: upload_failure
+`
+	var error ErrorSnapshotFailure
+	err := yaml.Unmarshal([]byte(failureYaml), &error)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if error.InstanceUUID != instanceUUID || error.ImageUUID != imageUUID {
+		t.Error("Wrong UUID field")
+	}
+
+	if error.Reason != SnapshotUploadFailure {
+		t.Error("Wrong Error field")
+	}
+
+	if error.Reason.String() != "Failed to upload snapshot" {
+		t.Errorf("Unexpected reason string \"%s\"", error.Reason)
+	}
+}
@@ -0,0 +1,90 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// SnapshotFailureReason denotes the underlying error that prevented
+// an SSNTP Snapshot command from creating an image from an instance.
+type SnapshotFailureReason string
+
+const (
+	// SnapshotNoInstance indicates that an instance could not be
+	// snapshotted as it does not exist on the node to which the
+	// Snapshot command was sent.
+	SnapshotNoInstance SnapshotFailureReason = "no_instance"
+
+	// SnapshotInvalidPayload indicates that the payload of the SSNTP
+	// Snapshot command was corrupt and could not be unmarshalled.
+	SnapshotInvalidPayload = "invalid_payload"
+
+	// SnapshotInvalidData is returned by ciao-launcher if the
+	// contents of the Snapshot payload are incorrect, e.g., the
+	// image_uuid is missing.
+	SnapshotInvalidData = "invalid_data"
+
+	// SnapshotNotRunning indicates that the instance is not running
+	// and only running instances can be snapshotted.
+	SnapshotNotRunning = "not_running"
+
+	// SnapshotNotSupported indicates that the instance's
+	// virtualizer, e.g., docker, does not support snapshots.
+	SnapshotNotSupported = "not_supported"
+
+	// SnapshotSnapshotFailure indicates that the hypervisor failed to
+	// copy the instance's root disk.
+	SnapshotSnapshotFailure = "snapshot_failure"
+
+	// SnapshotUploadFailure indicates that the snapshot could not be
+	// uploaded to the image service.
+	SnapshotUploadFailure = "upload_failure"
+)
+
+// ErrorSnapshotFailure represents the unmarshalled version of the contents
+// of a SSNTP ERROR frame whose type is set to ssntp.SnapshotFailure.
+type ErrorSnapshotFailure struct {
+	// InstanceUUID is the UUID of the instance that could not be
+	// snapshotted.
+	InstanceUUID string `yaml:"instance_uuid"`
+
+	// ImageUUID is the UUID of the image the snapshot was to be
+	// uploaded to.
+	ImageUUID string `yaml:"image_uuid"`
+
+	// Reason provides the reason for the snapshot failure, e.g.,
+	// SnapshotNotRunning.
+	Reason SnapshotFailureReason `yaml:"reason"`
+}
+
+func (r SnapshotFailureReason) String() string {
+	switch r {
+	case SnapshotNoInstance:
+		return "Instance does not exist"
+	case SnapshotInvalidPayload:
+		return "YAML payload is corrupt"
+	case SnapshotInvalidData:
+		return "Command section of YAML payload is corrupt or missing required information"
+	case SnapshotNotRunning:
+		return "Instance is not running"
+	case SnapshotNotSupported:
+		return "Instance does not support snapshots"
+	case SnapshotSnapshotFailure:
+		return "Failed to snapshot instance"
+	case SnapshotUploadFailure:
+		return "Failed to upload snapshot"
+	}
+
+	return ""
+}
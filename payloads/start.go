@@ -141,6 +141,36 @@ type NetworkResources struct {
 	PublicIP bool `yaml:"public_ip"`
 }
 
+// VolumeResource describes a block storage volume attached to an instance
+// when it starts.
+type VolumeResource struct {
+	// VolumeUUID is the UUID of the volume.
+	VolumeUUID string `yaml:"volume_uuid"`
+
+	// Path is the path of the volume image, as seen from the CN.
+	Path string `yaml:"path"`
+
+	// Format is the format of the volume image, e.g., Qcow2Volume.
+	Format VolumeFormat `yaml:"format"`
+}
+
+// PlacementConstraints restricts the set of nodes on which an instance
+// can be started.
+type PlacementConstraints struct {
+	// RequiredLabels lists the labels, and their values, that a node
+	// must carry for the instance to be started on it.
+	RequiredLabels map[string]string `yaml:"required_labels,omitempty"`
+
+	// PreferredLabels lists the labels, and their values, of the nodes
+	// the instance should preferably be started on.  Nodes carrying all
+	// of them are tried first, other nodes are only used if none fits.
+	PreferredLabels map[string]string `yaml:"preferred_labels,omitempty"`
+
+	// AntiAffinityGroup is an opaque group name.  Two instances
+	// belonging to the same group are never started on the same node.
+	AntiAffinityGroup string `yaml:"anti_affinity_group,omitempty"`
+}
+
 // StartCmd contains the information needed to start a new instance.
 type StartCmd struct {
 	// TenantUUID is the UUID of the tennant to which the new instance will
@@ -180,6 +210,15 @@ type StartCmd struct {
 	// Networking contains all the information required to set up networking
 	// for the new instance.
 	Networking NetworkResources `yaml:"networking"`
+
+	// Constraints restricts the nodes on which the instance can be
+	// started.  Only used for CN instances.
+	Constraints PlacementConstraints `yaml:"constraints,omitempty"`
+
+	// Volumes lists the volumes already attached to an instance which is
+	// started again on another node, e.g., after an evacuation.  Only
+	// used for qemu instances.
+	Volumes []VolumeResource `yaml:"volumes,omitempty"`
 }
 
 // Start represents the unmarshalled version of the contents of a SSNTP START
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"github.com/01org/ciao/testutil"
 	"gopkg.in/yaml.v2"
+	"strings"
 	"testing"
 )
 
@@ -122,3 +123,38 @@ func TestStartUnmarshalPartial(t *testing.T) {
 
 	fmt.Println(cmd)
 }
+
+func TestStartConstraints(t *testing.T) {
+	constraintsYaml := `start:
+  instance_uuid: 923d1f2b-aabe-4a9b-9982-8664b0e52f93
+  constraints:
+    required_labels:
+      rack: r1
+    preferred_labels:
+      ssd: "true"
+    anti_affinity_group: tenant/db
+`
+	var cmd Start
+	err := yaml.Unmarshal([]byte(constraintsYaml), &cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	constraints := cmd.Start.Constraints
+	if constraints.RequiredLabels["rack"] != "r1" ||
+		constraints.PreferredLabels["ssd"] != "true" ||
+		constraints.AntiAffinityGroup != "tenant/db" {
+		t.Errorf("Unexpected constraints %v", constraints)
+	}
+
+	// Constraints are optional and should not show up when unset
+	cmd.Start.Constraints = PlacementConstraints{}
+	y, err := yaml.Marshal(&cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(y), "constraints") {
+		t.Errorf("Unexpected constraints in %s", string(y))
+	}
+}
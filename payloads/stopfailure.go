@@ -40,6 +40,10 @@ const (
 	// is not currently running, e.g., it's status is either exited or
 	// pending.
 	StopAlreadyStopped = "already_stopped"
+
+	// StopNodeUnavailable is returned by ciao-scheduler when the node
+	// to which the STOP command is addressed is not connected.
+	StopNodeUnavailable = "node_unavailable"
 )
 
 // ErrorStopFailure represents the unmarshalled version of the contents of a
@@ -63,6 +67,8 @@ func (r StopFailureReason) String() string {
 		return "Command section of YAML payload is corrupt or missing required information"
 	case StopAlreadyStopped:
 		return "Instance has already shut down"
+	case StopNodeUnavailable:
+		return "Instance node is not connected"
 	}
 
 	return ""
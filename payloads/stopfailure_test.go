@@ -65,6 +65,7 @@ func TestStopFailureString(t *testing.T) {
 		{StopInvalidPayload, "YAML payload is corrupt"},
 		{StopInvalidData, "Command section of YAML payload is corrupt or missing required information"},
 		{StopAlreadyStopped, "Instance has already shut down"},
+		{StopNodeUnavailable, "Instance node is not connected"},
 	}
 	error := ErrorStopFailure{
 		InstanceUUID: uuid.Generate().String(),
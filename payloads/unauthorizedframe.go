@@ -0,0 +1,31 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// ErrorUnauthorizedFrame represents the unmarshalled version of the contents of a
+// SSNTP ERROR frame whose type is set to ssntp.UnauthorizedFrame.
+type ErrorUnauthorizedFrame struct {
+	// Type is the rejected frame type, e.g. COMMAND.
+	Type string `yaml:"type"`
+
+	// Operand is the rejected frame operand, e.g. START.
+	Operand string `yaml:"operand"`
+
+	// Role is the SSNTP role of the client that sent the rejected
+	// frame, e.g. CNAgent.
+	Role string `yaml:"role"`
+}
@@ -0,0 +1,70 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestUnauthorizedFrameUnmarshal(t *testing.T) {
+	unauthorizedYaml := `type: COMMAND
+operand: START
+role: CNAgent
+`
+	var error ErrorUnauthorizedFrame
+	err := yaml.Unmarshal([]byte(unauthorizedYaml), &error)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if error.Type != "COMMAND" {
+		t.Error("Wrong Type field")
+	}
+
+	if error.Operand != "START" {
+		t.Error("Wrong Operand field")
+	}
+
+	if error.Role != "CNAgent" {
+		t.Error("Wrong Role field")
+	}
+}
+
+func TestUnauthorizedFrameMarshal(t *testing.T) {
+	error := ErrorUnauthorizedFrame{
+		Type:    "EVENT",
+		Operand: "Public IP Assigned",
+		Role:    "CNAgent",
+	}
+
+	y, err := yaml.Marshal(&error)
+	if err != nil {
+		t.Error(err)
+	}
+
+	var unmarshalled ErrorUnauthorizedFrame
+	err = yaml.Unmarshal(y, &unmarshalled)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if unmarshalled != error {
+		t.Errorf("Marshalling round trip failed: %v", unmarshalled)
+	}
+}
@@ -0,0 +1,81 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// VolumeFormat is the on disk format of a block storage volume image.
+type VolumeFormat string
+
+const (
+	// RawVolume indicates that a volume image is a raw block device
+	// image.
+	RawVolume VolumeFormat = "raw"
+
+	// Qcow2Volume indicates that a volume image is a qcow2 image.
+	Qcow2Volume = "qcow2"
+)
+
+// AttachVolumeCmd contains the information needed to hot plug a block
+// storage volume into a running instance.
+type AttachVolumeCmd struct {
+	// InstanceUUID is the UUID of the instance to which the volume
+	// is to be attached.
+	InstanceUUID string `yaml:"instance_uuid"`
+
+	// VolumeUUID is the UUID of the volume to attach.
+	VolumeUUID string `yaml:"volume_uuid"`
+
+	// WorkloadAgentUUID identifies the node on which the instance is
+	// running.  This information is needed by the scheduler to route
+	// the command to the correct CN.
+	WorkloadAgentUUID string `yaml:"workload_agent_uuid"`
+
+	// Path is the path of the volume image, as seen from the CN.
+	Path string `yaml:"path"`
+
+	// Format is the format of the volume image, e.g., Qcow2Volume.
+	Format VolumeFormat `yaml:"format"`
+}
+
+// AttachVolume represents the unmarshalled version of the contents of an
+// SSNTP AttachVolume payload.
+type AttachVolume struct {
+	// Attach contains information about the volume to attach.
+	Attach AttachVolumeCmd `yaml:"attach_volume"`
+}
+
+// DetachVolumeCmd contains the information needed to unplug a block
+// storage volume from a running instance.
+type DetachVolumeCmd struct {
+	// InstanceUUID is the UUID of the instance from which the volume
+	// is to be detached.
+	InstanceUUID string `yaml:"instance_uuid"`
+
+	// VolumeUUID is the UUID of the volume to detach.
+	VolumeUUID string `yaml:"volume_uuid"`
+
+	// WorkloadAgentUUID identifies the node on which the instance is
+	// running.  This information is needed by the scheduler to route
+	// the command to the correct CN.
+	WorkloadAgentUUID string `yaml:"workload_agent_uuid"`
+}
+
+// DetachVolume represents the unmarshalled version of the contents of an
+// SSNTP DetachVolume payload.
+type DetachVolume struct {
+	// Detach contains information about the volume to detach.
+	Detach DetachVolumeCmd `yaml:"detach_volume"`
+}
@@ -0,0 +1,70 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+const volumeUUID = "67d86208-b46c-4465-9018-fe14087d415f"
+
+func TestAttachVolumeUnmarshal(t *testing.T) {
+	attachYaml := `attach_volume:
+  instance_uuid: 3390740c-dce9-48d6-b83a-a717417072ce
+  volume_uuid: 67d86208-b46c-4465-9018-fe14087d415f
+  workload_agent_uuid: 59460b8a-5f53-4e3e-b5ce-b71fed8c7e64
+  path: /var/lib/ciao/volumes/67d86208-b46c-4465-9018-fe14087d415f
+  format: qcow2
+`
+	var cmd AttachVolume
+	err := yaml.Unmarshal([]byte(attachYaml), &cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cmd.Attach.InstanceUUID != instanceUUID ||
+		cmd.Attach.VolumeUUID != volumeUUID ||
+		cmd.Attach.WorkloadAgentUUID != agentUUID ||
+		cmd.Attach.Path != "/var/lib/ciao/volumes/"+volumeUUID ||
+		cmd.Attach.Format != Qcow2Volume {
+		t.Errorf("Unexpected values in AttachVolume %v", cmd)
+	}
+}
+
+func TestDetachVolumeMarshal(t *testing.T) {
+	var cmd DetachVolume
+	cmd.Detach.InstanceUUID = instanceUUID
+	cmd.Detach.VolumeUUID = volumeUUID
+	cmd.Detach.WorkloadAgentUUID = agentUUID
+
+	y, err := yaml.Marshal(&cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cmd2 DetachVolume
+	err = yaml.Unmarshal(y, &cmd2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cmd2 != cmd {
+		t.Errorf("DetachVolume round trip mismatch %v != %v", cmd2, cmd)
+	}
+}
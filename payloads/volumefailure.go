@@ -0,0 +1,161 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// AttachVolumeFailureReason denotes the underlying error that prevented
+// an SSNTP AttachVolume command from attaching a volume to an instance.
+type AttachVolumeFailureReason string
+
+// DetachVolumeFailureReason denotes the underlying error that prevented
+// an SSNTP DetachVolume command from detaching a volume from an instance.
+type DetachVolumeFailureReason string
+
+const (
+	// AttachVolumeNoInstance indicates that a volume could not be
+	// attached as the instance does not exist on the node to which the
+	// AttachVolume command was sent.
+	AttachVolumeNoInstance AttachVolumeFailureReason = "no_instance"
+
+	// AttachVolumeInvalidPayload indicates that the payload of the SSNTP
+	// AttachVolume command was corrupt and could not be unmarshalled.
+	AttachVolumeInvalidPayload = "invalid_payload"
+
+	// AttachVolumeInvalidData is returned by ciao-launcher if the
+	// contents of the AttachVolume payload are incorrect, e.g., the
+	// volume_uuid is missing.
+	AttachVolumeInvalidData = "invalid_data"
+
+	// AttachVolumeNotRunning indicates that the instance is not running
+	// and volumes can only be hot plugged into running instances.
+	AttachVolumeNotRunning = "not_running"
+
+	// AttachVolumeAlreadyAttached indicates that the volume is already
+	// attached to the instance.
+	AttachVolumeAlreadyAttached = "already_attached"
+
+	// AttachVolumeNotSupported indicates that the instance's
+	// virtualizer, e.g., docker, does not support volumes.
+	AttachVolumeNotSupported = "not_supported"
+
+	// AttachVolumeAttachFailure indicates that the hypervisor failed to
+	// hot plug the volume.
+	AttachVolumeAttachFailure = "attach_failure"
+)
+
+const (
+	// DetachVolumeNoInstance indicates that a volume could not be
+	// detached as the instance does not exist on the node to which the
+	// DetachVolume command was sent.
+	DetachVolumeNoInstance DetachVolumeFailureReason = "no_instance"
+
+	// DetachVolumeInvalidPayload indicates that the payload of the SSNTP
+	// DetachVolume command was corrupt and could not be unmarshalled.
+	DetachVolumeInvalidPayload = "invalid_payload"
+
+	// DetachVolumeInvalidData is returned by ciao-launcher if the
+	// contents of the DetachVolume payload are incorrect, e.g., the
+	// volume_uuid is missing.
+	DetachVolumeInvalidData = "invalid_data"
+
+	// DetachVolumeNotRunning indicates that the instance is not running
+	// and volumes can only be unplugged from running instances.
+	DetachVolumeNotRunning = "not_running"
+
+	// DetachVolumeNotAttached indicates that the volume is not attached
+	// to the instance.
+	DetachVolumeNotAttached = "not_attached"
+
+	// DetachVolumeNotSupported indicates that the instance's
+	// virtualizer, e.g., docker, does not support volumes.
+	DetachVolumeNotSupported = "not_supported"
+
+	// DetachVolumeDetachFailure indicates that the hypervisor failed to
+	// unplug the volume.
+	DetachVolumeDetachFailure = "detach_failure"
+)
+
+// ErrorAttachVolumeFailure represents the unmarshalled version of the contents
+// of a SSNTP ERROR frame whose type is set to ssntp.AttachVolumeFailure.
+type ErrorAttachVolumeFailure struct {
+	// InstanceUUID is the UUID of the instance to which the volume
+	// could not be attached.
+	InstanceUUID string `yaml:"instance_uuid"`
+
+	// VolumeUUID is the UUID of the volume that could not be attached.
+	VolumeUUID string `yaml:"volume_uuid"`
+
+	// Reason provides the reason for the attach failure, e.g.,
+	// AttachVolumeNoInstance.
+	Reason AttachVolumeFailureReason `yaml:"reason"`
+}
+
+// ErrorDetachVolumeFailure represents the unmarshalled version of the contents
+// of a SSNTP ERROR frame whose type is set to ssntp.DetachVolumeFailure.
+type ErrorDetachVolumeFailure struct {
+	// InstanceUUID is the UUID of the instance from which the volume
+	// could not be detached.
+	InstanceUUID string `yaml:"instance_uuid"`
+
+	// VolumeUUID is the UUID of the volume that could not be detached.
+	VolumeUUID string `yaml:"volume_uuid"`
+
+	// Reason provides the reason for the detach failure, e.g.,
+	// DetachVolumeNotAttached.
+	Reason DetachVolumeFailureReason `yaml:"reason"`
+}
+
+func (r AttachVolumeFailureReason) String() string {
+	switch r {
+	case AttachVolumeNoInstance:
+		return "Instance does not exist"
+	case AttachVolumeInvalidPayload:
+		return "YAML payload is corrupt"
+	case AttachVolumeInvalidData:
+		return "Command section of YAML payload is corrupt or missing required information"
+	case AttachVolumeNotRunning:
+		return "Instance is not running"
+	case AttachVolumeAlreadyAttached:
+		return "Volume is already attached"
+	case AttachVolumeNotSupported:
+		return "Instance does not support volumes"
+	case AttachVolumeAttachFailure:
+		return "Failed to attach volume"
+	}
+
+	return ""
+}
+
+func (r DetachVolumeFailureReason) String() string {
+	switch r {
+	case DetachVolumeNoInstance:
+		return "Instance does not exist"
+	case DetachVolumeInvalidPayload:
+		return "YAML payload is corrupt"
+	case DetachVolumeInvalidData:
+		return "Command section of YAML payload is corrupt or missing required information"
+	case DetachVolumeNotRunning:
+		return "Instance is not running"
+	case DetachVolumeNotAttached:
+		return "Volume is not attached"
+	case DetachVolumeNotSupported:
+		return "Instance does not support volumes"
+	case DetachVolumeDetachFailure:
+		return "Failed to detach volume"
+	}
+
+	return ""
+}
@@ -0,0 +1,77 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestAttachVolumeFailureUnmarshal(t *testing.T) {
+	failureYaml := `instance_uuid: 3390740c-dce9-48d6-b83a-a717417072ce
+volume_uuid: 67d86208-b46c-4465-9018-fe14087d415f
+reason: already_attached
+`
+	var error ErrorAttachVolumeFailure
+	err := yaml.Unmarshal([]byte(failureYaml), &error)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if error.InstanceUUID != instanceUUID || error.VolumeUUID != volumeUUID {
+		t.Error("Wrong UUID field")
+	}
+
+	if error.Reason != AttachVolumeAlreadyAttached {
+		t.Error("Wrong Error field")
+	}
+}
+
+func TestVolumeFailureString(t *testing.T) {
+	var attachTests = []struct {
+		r        AttachVolumeFailureReason
+		expected string
+	}{
+		{AttachVolumeNoInstance, "Instance does not exist"},
+		{AttachVolumeNotRunning, "Instance is not running"},
+		{AttachVolumeAlreadyAttached, "Volume is already attached"},
+		{AttachVolumeAttachFailure, "Failed to attach volume"},
+	}
+	for _, test := range attachTests {
+		s := test.r.String()
+		if s != test.expected {
+			t.Errorf("expected \"%s\", got \"%s\"", test.expected, s)
+		}
+	}
+
+	var detachTests = []struct {
+		r        DetachVolumeFailureReason
+		expected string
+	}{
+		{DetachVolumeNoInstance, "Instance does not exist"},
+		{DetachVolumeNotAttached, "Volume is not attached"},
+		{DetachVolumeNotSupported, "Instance does not support volumes"},
+		{DetachVolumeDetachFailure, "Failed to detach volume"},
+	}
+	for _, test := range detachTests {
+		s := test.r.String()
+		if s != test.expected {
+			t.Errorf("expected \"%s\", got \"%s\"", test.expected, s)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package ssntp
+
+// FrameAuthorizationRule defines which SSNTP frames clients playing a
+// given role are allowed to send to an SSNTP server.
+// Clients playing several roles are allowed to send the frames of all
+// the rules matching any of their roles.
+type FrameAuthorizationRule struct {
+	// Role is the SSNTP role this rule applies to.
+	Role Role
+
+	// Commands is the list of COMMAND frames clients playing Role
+	// are allowed to send.
+	Commands []Command
+
+	// Statuses is the list of STATUS frames clients playing Role
+	// are allowed to send.
+	Statuses []Status
+
+	// Events is the list of EVENT frames clients playing Role are
+	// allowed to send.
+	Events []Event
+
+	// Errors is the list of ERROR frames clients playing Role are
+	// allowed to send.
+	Errors []Error
+}
+
+// frameAuthorization enforces the frame authorization rules. Without
+// any rule, all frames are authorized.
+type frameAuthorization struct {
+	rules []frameAuthorizationRule
+}
+
+type frameAuthorizationRule struct {
+	role     uint32
+	operands map[interface{}]bool
+}
+
+func (a *frameAuthorization) init(rules []FrameAuthorizationRule) {
+	a.rules = nil
+
+	for _, rule := range rules {
+		r := frameAuthorizationRule{
+			role:     uint32(rule.Role),
+			operands: make(map[interface{}]bool),
+		}
+
+		for _, command := range rule.Commands {
+			r.operands[command] = true
+		}
+
+		for _, status := range rule.Statuses {
+			r.operands[status] = true
+		}
+
+		for _, event := range rule.Events {
+			r.operands[event] = true
+		}
+
+		for _, error := range rule.Errors {
+			r.operands[error] = true
+		}
+
+		a.rules = append(a.rules, r)
+	}
+}
+
+// frameOperand returns the typed frame operand.
+func frameOperand(frame *Frame) interface{} {
+	switch frame.Type {
+	case COMMAND:
+		return (Command)(frame.Operand)
+	case STATUS:
+		return (Status)(frame.Operand)
+	case EVENT:
+		return (Event)(frame.Operand)
+	case ERROR:
+		return (Error)(frame.Operand)
+	}
+
+	return nil
+}
+
+// authorized tells if a client playing role is allowed to send the
+// operand frame. SSNTP protocol frames, i.e. heartbeats and
+// acknowledgements, are always authorized.
+func (a *frameAuthorization) authorized(role uint32, operand interface{}) bool {
+	if a.rules == nil || operand == nil {
+		return true
+	}
+
+	switch operand {
+	case PING, PONG, ACK:
+		return true
+	}
+
+	for _, rule := range a.rules {
+		if role&rule.role != 0 && rule.operands[operand] == true {
+			return true
+		}
+	}
+
+	return false
+}
@@ -19,7 +19,10 @@ package ssntp
 import (
 	"crypto/tls"
 	"fmt"
+	"github.com/01org/ciao/payloads"
 	"github.com/docker/distribution/uuid"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
 	"math/rand"
 	"sync"
 	"time"
@@ -66,9 +69,8 @@ type Client struct {
 	uris       []string
 	role       uint32
 	roleVerify bool
-	tls        *tls.Config
 	ntf        ClientNotifier
-	transport  string
+	transport  Transport
 	port       uint32
 	session    *session
 	status     connectionStatus
@@ -81,6 +83,28 @@ type Client struct {
 
 	trace *TraceConfig
 
+	heartbeat heartbeat
+
+	// legacyGob is set when the server only speaks the legacy,
+	// gob encoded, SSNTP framing.
+	legacyGob bool
+
+	// replay buffers the EVENT and ERROR frames sent to the server
+	// across reconnections. It is nil when replay is disabled.
+	replay *replay
+
+	// credentials are the reloadable TLS credentials. They are nil
+	// for custom transports.
+	credentials *credentials
+
+	// payload is the payload compression and size limit template for
+	// new sessions.
+	payload payloadConfig
+
+	// metrics accumulates the traffic statistics of all the client
+	// sessions.
+	metrics metrics
+
 	configuration clusterConfiguration
 }
 
@@ -110,12 +134,24 @@ func (client *Client) handleSSNTPServer() {
 	for {
 		client.ntf.ConnectNotify()
 
+		session := client.session
+		stopHeartbeats := make(chan struct{})
+		go session.sendHeartbeats(stopHeartbeats)
+
 		for {
 			client.log.Infof("Waiting for next frame\n")
 
 			var frame Frame
-			err := client.session.Read(&frame)
+			err := session.Read(&frame)
+			if tooLarge, ok := err.(payloadTooLargeError); ok {
+				client.sendPayloadTooLarge(&frame, tooLarge)
+				continue
+			}
+
 			if err != nil {
+				close(stopHeartbeats)
+				session.requests.abort()
+
 				client.status.Lock()
 				if client.status.status == ssntpClosed {
 					client.status.Unlock()
@@ -124,10 +160,17 @@ func (client *Client) handleSSNTPServer() {
 				client.status.Unlock()
 
 				client.log.Errorf("Read error: %s\n", err)
+				session.conn.Close()
 				client.ntf.DisconnectNotify()
 				break
 			}
 
+			if session.handleHeartbeat(&frame) == true {
+				continue
+			}
+
+			session.requests.reply(&frame)
+
 			client.frameWg.Add(1)
 			go client.processSSNTPFrame(&frame)
 		}
@@ -163,11 +206,36 @@ func (client *Client) sendConnect() (bool, error) {
 		if connected.Operand != (uint8)(CONNECTED) {
 			return true, fmt.Errorf("SSNTP Client: Invalid Connected frame")
 		}
+
+		if connected.Major&majorMask != client.session.major {
+			return false, fmt.Errorf("SSNTP Client: Unsupported server SSNTP version %d.%d",
+				connected.Major&majorMask, connected.Minor)
+		}
+
+		client.session.payload.compression = negotiateCompression(client.payload.compression, connected.Minor)
+		client.session.heartbeat = negotiateHeartbeat(client.heartbeat, connected.Minor)
 	case ERROR:
+		if connected.Operand == (uint8)(ConnectionAborted) {
+			var aborted payloads.ErrorConnectionAborted
+			if yaml.Unmarshal(connected.Payload, &aborted) == nil &&
+				aborted.Reason != "" {
+				return false, fmt.Errorf("SSNTP Client: Connection aborted: %s", aborted.Reason)
+			}
+
+			return false, fmt.Errorf("SSNTP Client: Connection aborted")
+		}
+
 		if connected.Operand != (uint8)(ConnectionFailure) {
 			return false, fmt.Errorf("SSNTP Client: Connection failure")
 		}
 
+		var failure payloads.ErrorConnectionFailure
+		if yaml.Unmarshal(connected.Payload, &failure) == nil &&
+			failure.Reason == payloads.UnsupportedVersion {
+			return false, fmt.Errorf("SSNTP Client: %s %s, server supports %v",
+				failure.Reason, failure.Version, failure.SupportedVersions)
+		}
+
 		return true, fmt.Errorf("SSNTP Client: Connection error %s\n", (Error)(connected.Operand))
 
 	default:
@@ -175,7 +243,15 @@ func (client *Client) sendConnect() (bool, error) {
 	}
 
 	client.session.setDest(connected.Source[:16])
-	if client.roleVerify == true {
+	if client.credentials != nil {
+		err := client.credentials.verifyPeer(client.session.conn)
+		if err != nil {
+			sendRevoked(client.session, err)
+			return false, fmt.Errorf("SSNTP Client: %s", err)
+		}
+	}
+
+	if _, ok := client.session.conn.(*tls.Conn); ok && client.roleVerify == true {
 		oidFound, err := verifyRole(client.session.conn, connected.Role)
 		if oidFound == false {
 			fmt.Printf("%s\n", err)
@@ -184,6 +260,19 @@ func (client *Client) sendConnect() (bool, error) {
 		}
 	}
 
+	if client.session.replay != nil {
+		replayed, lost, err := client.session.replay.resume(client.session, connected.Resume)
+		if err != nil {
+			return true, err
+		}
+
+		if lost > 0 {
+			client.log.Errorf("%d frames to the server lost\n", lost)
+		}
+
+		client.log.Infof("Replayed %d frames\n", replayed)
+	}
+
 	client.status.Lock()
 	client.status.status = ssntpConnected
 	client.status.Unlock()
@@ -214,11 +303,14 @@ func (client *Client) attemptDial() error {
 		for d := 0; ; d++ {
 			for _, uri := range client.uris {
 				client.log.Infof("%s connecting to %s\n", client.uuid, uri)
-				conn, err := tls.Dial(client.transport, uri, client.tls)
+				conn, err := client.transport.Dial(uri)
 
 				client.status.Lock()
 				if client.status.status == ssntpClosed {
 					client.status.Unlock()
+					if err == nil {
+						conn.Close()
+					}
 					return fmt.Errorf("Connection closed")
 				}
 				client.status.Unlock()
@@ -226,7 +318,14 @@ func (client *Client) attemptDial() error {
 				if err == nil {
 					client.log.Infof("Connected\n")
 					session := newSession(&client.uuid, client.role, 0, conn)
-					client.session = session
+					session.metrics.parent = &client.metrics
+					session.payload.maxSize = client.payload.maxSize
+					if client.legacyGob == true {
+						session.useGob()
+					} else {
+						session.replay = client.replay
+					}
+					client.setSession(session)
 
 					break URILoop
 				}
@@ -254,6 +353,15 @@ func (client *Client) attemptDial() error {
 		}
 
 		reconnect, err := client.sendConnect()
+		if err == errLegacyFraming && client.legacyGob == false {
+			// Legacy server, reconnect with the gob framing
+			client.log.Infof("Falling back to legacy SSNTP framing\n")
+			client.session.conn.Close()
+			client.setSession(nil)
+			client.legacyGob = true
+			continue
+		}
+
 		if err != nil {
 			// Dialed but could not connect, try again
 			client.log.Errorf("%s", err)
@@ -321,16 +429,6 @@ func (client *Client) Dial(config *Config, ntf ClientNotifier) error {
 		client.port = port
 	}
 
-	if len(config.Transport) == 0 {
-		client.transport = "tcp"
-	} else {
-		if config.Transport != "tcp" && config.Transport != "unix" {
-			client.transport = "tcp"
-		} else {
-			client.transport = config.Transport
-		}
-	}
-
 	client.role = config.Role
 	client.roleVerify = config.RoleVerification
 
@@ -349,43 +447,82 @@ func (client *Client) Dial(config *Config, ntf ClientNotifier) error {
 	}
 
 	client.trace = config.Trace
+	client.heartbeat = newHeartbeat(config)
+	client.replay = newReplay(replaySize(config))
+	client.payload = payloadConfig{
+		compression: config.Compression,
+		maxSize:     maxPayloadSize(config),
+	}
 	client.ntf = ntf
-	client.tls = prepareTLSConfig(config, false)
-
 	/* First we add the configured server URI */
 	if len(config.URI) != 0 {
 		client.uris = append(client.uris, fmt.Sprintf("%s:%d", config.URI, client.port))
 	}
 
-	/* Then we parse the CA certificate to find FQDNs and/or IPs to connect to */
-	ips, fqdns, err := parseCertificate(config)
-	if err != nil {
-		client.log.Warningf("%s", err)
+	if config.CustomTransport != nil {
+		client.transport = config.CustomTransport
 	} else {
-		/* We prefer IPs over FQDNs */
-		for _, ip := range ips {
-			client.uris = append(client.uris, fmt.Sprintf("%s:%d", ip, client.port))
+		client.credentials = newCredentials(config, false, client.log)
+		client.transport = &tlsTransport{
+			network:     transportNetwork(config),
+			credentials: client.credentials,
 		}
 
-		for _, fqdn := range fqdns {
-			client.uris = append(client.uris, fmt.Sprintf("%s:%d", fqdn, client.port))
+		/* Then we parse the CA certificate to find FQDNs and/or IPs to connect to */
+		ips, fqdns, err := parseCertificate(config)
+		if err != nil {
+			client.log.Warningf("%s", err)
+		} else {
+			/* We prefer IPs over FQDNs */
+			for _, ip := range ips {
+				client.uris = append(client.uris, fmt.Sprintf("%s:%d", ip, client.port))
+			}
+
+			for _, fqdn := range fqdns {
+				client.uris = append(client.uris, fmt.Sprintf("%s:%d", fqdn, client.port))
+			}
 		}
 	}
 
 	/* Last resort: localhost */
 	client.uris = append(client.uris, fmt.Sprintf("%s:%d", defaultURL, client.port))
 
-	err = client.attemptDial()
+	err := client.attemptDial()
 	if err != nil {
 		client.log.Errorf("%s", err)
 		return err
 	}
 
+	if client.credentials != nil {
+		go client.credentials.watch(reloadInterval(config), client.abortRevokedSession)
+	}
+
 	go client.handleSSNTPServer()
 
 	return nil
 }
 
+// abortRevokedSession disconnects from the server if its certificate
+// got revoked by newly loaded credentials. The reconnection attempt
+// will then be rejected.
+func (client *Client) abortRevokedSession() {
+	client.status.Lock()
+	session := client.session
+	connected := client.status.status == ssntpConnected
+	client.status.Unlock()
+
+	if connected == false || session == nil {
+		return
+	}
+
+	err := client.credentials.verifyPeer(session.conn)
+	if err != nil {
+		client.log.Errorf("Aborting server connection: %s\n", err)
+		sendRevoked(session, err)
+		session.conn.Close()
+	}
+}
+
 // Close terminates the client connection.
 func (client *Client) Close() {
 	client.status.Lock()
@@ -397,6 +534,9 @@ func (client *Client) Close() {
 	if client.session != nil {
 		client.session.conn.Close()
 	}
+	if client.credentials != nil {
+		client.credentials.close()
+	}
 	client.status.status = ssntpClosed
 	if client.closed != nil {
 		close(client.closed)
@@ -419,58 +559,69 @@ func (client *Client) Close() {
 	freeUUID(client.lUUID)
 }
 
-func (client *Client) sendCommand(cmd Command, payload []byte, trace *TraceConfig) (int, error) {
+func (client *Client) setSession(session *session) {
 	client.status.Lock()
-	if client.status.status == ssntpClosed {
-		client.status.Unlock()
-		return -1, fmt.Errorf("Client not connected")
-	}
+	client.session = session
 	client.status.Unlock()
+}
+
+// currentSession returns the session frames are to be sent through.
+// Frames sent through a broken session are replayed, if replayable,
+// once the client has reconnected.  The client has no session until
+// it first connects.
+func (client *Client) currentSession() (*session, error) {
+	client.status.Lock()
+	defer client.status.Unlock()
+
+	if client.status.status == ssntpClosed || client.session == nil {
+		return nil, fmt.Errorf("Client not connected")
+	}
+
+	return client.session, nil
+}
+
+func (client *Client) sendCommand(cmd Command, payload []byte, trace *TraceConfig) (int, error) {
+	session, err := client.currentSession()
+	if err != nil {
+		return -1, err
+	}
 
-	session := client.session
 	frame := session.commandFrame(cmd, payload, trace)
 
 	return session.Write(frame)
 }
 
-func (client *Client) sendStatus(status Status, payload []byte, trace *TraceConfig) (int, error) {
-	client.status.Lock()
-	if client.status.status == ssntpClosed {
-		client.status.Unlock()
-		return -1, fmt.Errorf("Client not connected")
+func (client *Client) sendStatus(status Status, payload []byte, trace *TraceConfig, requestID uint64) (int, error) {
+	session, err := client.currentSession()
+	if err != nil {
+		return -1, err
 	}
-	client.status.Unlock()
 
-	session := client.session
 	frame := session.statusFrame(status, payload, trace)
+	frame.RequestID = requestID
 
 	return session.Write(frame)
 }
 
 func (client *Client) sendEvent(event Event, payload []byte, trace *TraceConfig) (int, error) {
-	client.status.Lock()
-	if client.status.status == ssntpClosed {
-		client.status.Unlock()
-		return -1, fmt.Errorf("Client not connected")
+	session, err := client.currentSession()
+	if err != nil {
+		return -1, err
 	}
-	client.status.Unlock()
 
-	session := client.session
 	frame := session.eventFrame(event, payload, trace)
 
 	return session.Write(frame)
 }
 
-func (client *Client) sendError(error Error, payload []byte, trace *TraceConfig) (int, error) {
-	client.status.Lock()
-	if client.status.status == ssntpClosed {
-		client.status.Unlock()
-		return -1, fmt.Errorf("Client not connected")
+func (client *Client) sendError(error Error, payload []byte, trace *TraceConfig, requestID uint64) (int, error) {
+	session, err := client.currentSession()
+	if err != nil {
+		return -1, err
 	}
-	client.status.Unlock()
 
-	session := client.session
 	frame := session.errorFrame(error, payload, trace)
+	frame.RequestID = requestID
 
 	return session.Write(frame)
 }
@@ -482,7 +633,7 @@ func (client *Client) SendCommand(cmd Command, payload []byte) (int, error) {
 
 // SendStatus sends a specific status and its payload to the SSNTP server.
 func (client *Client) SendStatus(status Status, payload []byte) (int, error) {
-	return client.sendStatus(status, payload, client.trace)
+	return client.sendStatus(status, payload, client.trace, 0)
 }
 
 // SendEvent sends a specific status and its payload to the SSNTP server.
@@ -494,7 +645,42 @@ func (client *Client) SendEvent(event Event, payload []byte) (int, error) {
 // This is just for notification purposes, to let e.g. the server know that
 // it sent an unexpected frame.
 func (client *Client) SendError(error Error, payload []byte) (int, error) {
-	return client.sendError(error, payload, client.trace)
+	return client.sendError(error, payload, client.trace, 0)
+}
+
+// SendCommandAndWait sends a specific command and its payload to the SSNTP
+// server, and waits for the command recipient to reply. The reply is either
+// an ACK status frame or an ERROR frame, and is returned to the caller.
+// An error is returned if the command could not be sent, if the connection
+// was lost or if ctx expired before we got a reply.
+func (client *Client) SendCommandAndWait(ctx context.Context, cmd Command, payload []byte) (*Frame, error) {
+	client.status.Lock()
+	if client.status.status == ssntpClosed {
+		client.status.Unlock()
+		return nil, fmt.Errorf("Client not connected")
+	}
+	client.status.Unlock()
+
+	return client.session.sendCommandAndWait(ctx, cmd, payload, client.trace)
+}
+
+// SendAck acknowledges a command the SSNTP server sent with a request ID.
+func (client *Client) SendAck(requestID uint64) (int, error) {
+	return client.sendStatus(ACK, nil, client.trace, requestID)
+}
+
+// sendPayloadTooLarge rejects a frame whose payload is larger than
+// the client maximum payload size.
+func (client *Client) sendPayloadTooLarge(frame *Frame, err payloadTooLargeError) {
+	client.log.Errorf("%s %s frame: %s\n", (Type)(frame.Type), frameOperand(frame), err)
+
+	client.sendError(PayloadTooLarge, payloadTooLarge(frame, err), client.trace, frame.RequestID)
+}
+
+// SendErrorReply sends an error back to the SSNTP server, in reply to the
+// command it sent with a request ID.
+func (client *Client) SendErrorReply(requestID uint64, error Error, payload []byte) (int, error) {
+	return client.sendError(error, payload, client.trace, requestID)
 }
 
 // SendTracedCommand sends a specific command and its payload to the SSNTP server.
@@ -506,7 +692,7 @@ func (client *Client) SendTracedCommand(cmd Command, payload []byte, trace *Trac
 // SendTracedStatus sends a specific status and its payload to the SSNTP server.
 // The SSNTP status frame will be traced according to the trace argument.
 func (client *Client) SendTracedStatus(status Status, payload []byte, trace *TraceConfig) (int, error) {
-	return client.sendStatus(status, payload, trace)
+	return client.sendStatus(status, payload, trace, 0)
 }
 
 // SendTracedEvent sends a specific status and its payload to the SSNTP server.
@@ -520,7 +706,7 @@ func (client *Client) SendTracedEvent(event Event, payload []byte, trace *TraceC
 // it sent an unexpected frame.
 // The SSNTP error frame will be traced according to the trace argument.
 func (client *Client) SendTracedError(error Error, payload []byte, trace *TraceConfig) (int, error) {
-	return client.sendError(error, payload, trace)
+	return client.sendError(error, payload, trace, 0)
 }
 
 // UUID exports the SSNTP client Universally Unique ID.
@@ -528,6 +714,12 @@ func (client *Client) UUID() string {
 	return client.uuid.String()
 }
 
+// Stats returns the client SSNTP traffic statistics, accumulated over
+// all its connections to the server.
+func (client *Client) Stats() Stats {
+	return client.metrics.stats()
+}
+
 // ClusterConfiguration returns the latest cluster configuration
 // payload a client received. Client should use that payload to
 // configure themselves based on the information provided to them
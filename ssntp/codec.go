@@ -0,0 +1,550 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package ssntp
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// codec encodes and decodes SSNTP frames to and from a connection.
+// Frames are *Frame, *ConnectFrame or *ConnectedFrame pointers.
+type codec interface {
+	encode(frame interface{}) error
+	decode(frame interface{}) error
+}
+
+// gobCodec is the legacy SSNTP encoding, where frames are gob encoded
+// Go structures. It is only used with peers running SSNTP 0.x, and
+// will be removed in the next release.
+// Gob frames are not length prefixed, so their payload size limit is
+// only checked once they are fully decoded.
+type gobCodec struct {
+	encoder *gob.Encoder
+	decoder *gob.Decoder
+
+	// payload is the session payload size limit.
+	payload *payloadConfig
+}
+
+func newGobCodec(r io.Reader, w io.Writer) *gobCodec {
+	return &gobCodec{
+		encoder: gob.NewEncoder(w),
+		decoder: gob.NewDecoder(r),
+	}
+}
+
+func (c *gobCodec) encode(frame interface{}) error {
+	if f, ok := frame.(*Frame); ok && c.payload.tooLarge(uint64(len(f.Payload))) {
+		return payloadTooLargeError{c.payload.maxSize}
+	}
+
+	return c.encoder.Encode(frame)
+}
+
+func (c *gobCodec) decode(frame interface{}) error {
+	err := c.decoder.Decode(frame)
+	if err != nil {
+		return err
+	}
+
+	if f, ok := frame.(*Frame); ok && c.payload.tooLarge(uint64(len(f.Payload))) {
+		f.Payload = nil
+		return payloadTooLargeError{c.payload.maxSize}
+	}
+
+	return nil
+}
+
+// Binary frame flags, carried by the Major header byte together with
+// pathTraceEnabled.
+const (
+	requestIDPresent = 1 << 6
+	tracePresent     = 1 << 5
+	sequencePresent  = 1 << 4
+)
+
+const headerLength = 8
+const uuidLength = 16
+
+// isBinaryFraming tells if a connection's first byte starts a binary
+// CONNECT frame, i.e. an SSNTP major version, rather than a legacy gob
+// stream. Gob streams start with a message length, and the gob encoded
+// CONNECT frame type definition is always longer than 16 bytes.
+func isBinaryFraming(first byte) bool {
+	return first < 0x10
+}
+
+// errLegacyFraming is returned when a server replies to a binary
+// CONNECT frame with a legacy gob stream.
+var errLegacyFraming = errors.New("Legacy SSNTP framing")
+
+// versionError is returned when decoding a frame whose SSNTP major
+// version we do not support.
+type versionError struct {
+	major uint8
+	minor uint8
+}
+
+func (e versionError) Error() string {
+	return fmt.Sprintf("Unsupported SSNTP version %d.%d", e.major, e.minor)
+}
+
+// binaryCodec is the SSNTP binary framing. Each frame starts with an
+// 8 bytes header, where multi-bytes integers are big endian:
+//
+//	+----------------------------------------------------------------+
+//	|   Major  |   Minor  |   Type   | Operand  |  Payload Length    |
+//	| (1 byte) | (1 byte) | (1 byte) | (1 byte) |  or Role (4 bytes) |
+//	+----------------------------------------------------------------+
+//
+// The CONNECT and CONNECTED frames header is followed by the UUIDs, the
+// 8 bytes resume sequence number and, for CONNECTED, by the payload
+// length and the payload.
+// The other frames header is followed by an optional 8 bytes request
+// ID, an optional 8 bytes sequence number, an optional length prefixed
+// trace and the payload. The presence of the request ID, of the
+// sequence number and of the trace is flagged in the Major byte, and
+// the payload compression in the Minor byte.
+type binaryCodec struct {
+	reader io.Reader
+	writer io.Writer
+
+	// payload is the session payload compression and size limit.
+	payload *payloadConfig
+}
+
+func newBinaryCodec(r io.Reader, w io.Writer) *binaryCodec {
+	return &binaryCodec{
+		reader: r,
+		writer: w,
+	}
+}
+
+func (c *binaryCodec) encode(frame interface{}) error {
+	var buf []byte
+
+	switch f := frame.(type) {
+	case *Frame:
+		payload, compression, err := c.payload.compress(f.Payload)
+		if err != nil {
+			return err
+		}
+
+		buf = appendFrame(buf, f, payload, compression)
+	case *ConnectFrame:
+		buf = appendHeader(buf, major, f.Minor&minorMask, f.Type, f.Operand, f.Role)
+		buf = appendUUID(buf, f.Source)
+		buf = appendUUID(buf, f.Destination)
+		buf = appendUint64(buf, f.Resume)
+	case *ConnectedFrame:
+		buf = appendHeader(buf, major, f.Minor&minorMask, f.Type, f.Operand, f.Role)
+		buf = appendUUID(buf, f.Source)
+		buf = appendUUID(buf, f.Destination)
+		buf = appendUint64(buf, f.Resume)
+		buf = appendUint32(buf, uint32(len(f.Payload)))
+		buf = append(buf, f.Payload...)
+	default:
+		return fmt.Errorf("Unsupported frame type %T", frame)
+	}
+
+	_, err := c.writer.Write(buf)
+	return err
+}
+
+func (c *binaryCodec) decode(frame interface{}) error {
+	var header [headerLength]byte
+
+	_, err := io.ReadFull(c.reader, header[:])
+	if err != nil {
+		return err
+	}
+
+	// The CONNECTED frame version is checked by the client, so that
+	// it can tell a legacy server and a version mismatch apart.
+	if _, ok := frame.(*ConnectedFrame); ok {
+		if isBinaryFraming(header[0]) == false {
+			return errLegacyFraming
+		}
+	} else if header[0]&majorMask != major {
+		return versionError{header[0] & majorMask, header[1]}
+	}
+
+	t := (Type)(header[2])
+	operand := header[3]
+	length := binary.BigEndian.Uint32(header[4:])
+
+	switch f := frame.(type) {
+	case *Frame:
+		return c.decodeFrame(f, header)
+	case *ConnectFrame:
+		if t != COMMAND || (Command)(operand) != CONNECT {
+			return fmt.Errorf("Invalid CONNECT frame")
+		}
+
+		*f = ConnectFrame{
+			Major:   header[0],
+			Minor:   header[1],
+			Type:    t,
+			Operand: operand,
+			Role:    length,
+		}
+
+		f.Source, err = c.readBytes(uuidLength)
+		if err != nil {
+			return err
+		}
+
+		f.Destination, err = c.readBytes(uuidLength)
+		if err != nil {
+			return err
+		}
+
+		f.Resume, err = c.readUint64()
+		return err
+	case *ConnectedFrame:
+		*f = ConnectedFrame{
+			Major:   header[0],
+			Minor:   header[1],
+			Type:    t,
+			Operand: operand,
+		}
+
+		// The server may reply to CONNECT with a regular error frame.
+		if t != STATUS || (Status)(operand) != CONNECTED {
+			var errorFrame Frame
+			err = c.decodeFrame(&errorFrame, header)
+			f.PayloadLength = errorFrame.PayloadLength
+			f.Payload = errorFrame.Payload
+			return err
+		}
+
+		f.Role = length
+		f.Source, err = c.readBytes(uuidLength)
+		if err != nil {
+			return err
+		}
+
+		f.Destination, err = c.readBytes(uuidLength)
+		if err != nil {
+			return err
+		}
+
+		f.Resume, err = c.readUint64()
+		if err != nil {
+			return err
+		}
+
+		var payloadLength []byte
+		payloadLength, err = c.readBytes(4)
+		if err != nil {
+			return err
+		}
+
+		f.PayloadLength = binary.BigEndian.Uint32(payloadLength)
+		if c.payload.tooLarge(uint64(f.PayloadLength)) {
+			return c.discardPayload(uint64(f.PayloadLength))
+		}
+
+		f.Payload, err = c.readBytes(int(f.PayloadLength))
+		return err
+	}
+
+	return fmt.Errorf("Unsupported frame type %T", frame)
+}
+
+func (c *binaryCodec) decodeFrame(f *Frame, header [headerLength]byte) error {
+	var err error
+
+	*f = Frame{
+		Major:         header[0] &^ (requestIDPresent | tracePresent | sequencePresent),
+		Minor:         header[1] & minorMask,
+		Type:          (Type)(header[2]),
+		Operand:       header[3],
+		PayloadLength: binary.BigEndian.Uint32(header[4:]),
+	}
+
+	if header[0]&requestIDPresent == requestIDPresent {
+		var id []byte
+		id, err = c.readBytes(8)
+		if err != nil {
+			return err
+		}
+
+		f.RequestID = binary.BigEndian.Uint64(id)
+	}
+
+	if header[0]&sequencePresent == sequencePresent {
+		f.Sequence, err = c.readUint64()
+		if err != nil {
+			return err
+		}
+	}
+
+	if header[0]&tracePresent == tracePresent {
+		var length, trace []byte
+		length, err = c.readBytes(4)
+		if err != nil {
+			return err
+		}
+
+		// Traces are bounded by the payload size limit, oversized
+		// ones are skipped together with their frame payload.
+		traceLength := binary.BigEndian.Uint32(length)
+		if c.payload.tooLarge(uint64(traceLength)) {
+			return c.discardPayload(uint64(traceLength) + uint64(f.PayloadLength))
+		}
+
+		trace, err = c.readBytes(int(traceLength))
+		if err != nil {
+			return err
+		}
+
+		f.Trace, err = parseTrace(trace)
+		if err != nil {
+			return err
+		}
+	}
+
+	if f.PayloadLength == 0 {
+		return nil
+	}
+
+	// Oversized payloads are skipped before being allocated, so that
+	// the next frame can still be decoded.
+	if c.payload.tooLarge(uint64(f.PayloadLength)) {
+		return c.discardPayload(uint64(f.PayloadLength))
+	}
+
+	f.Payload, err = c.readBytes(int(f.PayloadLength))
+	if err != nil {
+		return err
+	}
+
+	compression := (Compression)(header[1] >> compressionShift)
+	if compression == NoCompression {
+		return nil
+	}
+
+	f.Payload, err = c.payload.decompress(f.Payload, compression)
+	f.PayloadLength = uint32(len(f.Payload))
+
+	return err
+}
+
+func (c *binaryCodec) discardPayload(length uint64) error {
+	_, err := io.CopyN(ioutil.Discard, c.reader, int64(length))
+	if err != nil {
+		return err
+	}
+
+	return payloadTooLargeError{c.payload.maxSize}
+}
+
+func (c *binaryCodec) readBytes(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	_, err := io.ReadFull(c.reader, buf)
+
+	return buf, err
+}
+
+func (c *binaryCodec) readUint64() (uint64, error) {
+	buf, err := c.readBytes(8)
+	if err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint64(buf), nil
+}
+
+func appendHeader(buf []byte, majorFlags uint8, minorVersion uint8, t Type, operand uint8, length uint32) []byte {
+	buf = append(buf, majorFlags, minorVersion, byte(t), operand)
+	return appendUint32(buf, length)
+}
+
+func appendFrame(buf []byte, f *Frame, payload []byte, compression Compression) []byte {
+	flags := f.Major & pathTraceEnabled
+
+	if f.RequestID != 0 {
+		flags |= requestIDPresent
+	}
+
+	if f.Sequence != 0 {
+		flags |= sequencePresent
+	}
+
+	if f.Trace != nil {
+		flags |= tracePresent
+	}
+
+	buf = append(buf, major|flags, minor|uint8(compression)<<compressionShift, byte(f.Type), f.Operand)
+	buf = appendUint32(buf, uint32(len(payload)))
+
+	if f.RequestID != 0 {
+		buf = appendUint64(buf, f.RequestID)
+	}
+
+	if f.Sequence != 0 {
+		buf = appendUint64(buf, f.Sequence)
+	}
+
+	if f.Trace != nil {
+		trace := appendTrace(nil, f.Trace)
+		buf = appendUint32(buf, uint32(len(trace)))
+		buf = append(buf, trace...)
+	}
+
+	return append(buf, payload...)
+}
+
+// A trace is made of the label length and the label, the start and
+// end timestamps, the path length and the path nodes. A path node is
+// made of its UUID, its role and its transmission and reception
+// timestamps. Timestamps are nanoseconds since the Unix epoch, and 0
+// for unset timestamps.
+func appendTrace(buf []byte, t *FrameTrace) []byte {
+	buf = appendUint32(buf, uint32(len(t.Label)))
+	buf = append(buf, t.Label...)
+	buf = appendTime(buf, t.StartTimestamp)
+	buf = appendTime(buf, t.EndTimestamp)
+	buf = append(buf, uint8(len(t.Path)))
+
+	for _, n := range t.Path {
+		buf = appendUUID(buf, n.UUID)
+		buf = appendUint32(buf, n.Role)
+		buf = appendTime(buf, n.TxTimestamp)
+		buf = appendTime(buf, n.RxTimestamp)
+	}
+
+	return buf
+}
+
+func parseTrace(buf []byte) (*FrameTrace, error) {
+	var t FrameTrace
+	p := traceParser{buf: buf}
+
+	t.Label = p.bytes(int(p.uint32()))
+	t.StartTimestamp = p.time()
+	t.EndTimestamp = p.time()
+	t.PathLength = p.uint8()
+
+	for i := uint8(0); i < t.PathLength; i++ {
+		var n Node
+
+		n.UUID = p.bytes(uuidLength)
+		n.Role = p.uint32()
+		n.TxTimestamp = p.time()
+		n.RxTimestamp = p.time()
+
+		t.Path = append(t.Path, n)
+	}
+
+	if p.short {
+		return nil, fmt.Errorf("Truncated frame trace")
+	}
+
+	if len(t.Label) == 0 {
+		t.Label = nil
+	}
+
+	return &t, nil
+}
+
+// traceParser reads a trace buffer, and records if the buffer
+// was too short instead of failing each read.
+type traceParser struct {
+	buf   []byte
+	short bool
+}
+
+func (p *traceParser) bytes(n int) []byte {
+	if p.short || n > len(p.buf) {
+		p.short = true
+		return nil
+	}
+
+	b := p.buf[:n]
+	p.buf = p.buf[n:]
+
+	return b
+}
+
+func (p *traceParser) uint8() uint8 {
+	b := p.bytes(1)
+	if b == nil {
+		return 0
+	}
+
+	return b[0]
+}
+
+func (p *traceParser) uint32() uint32 {
+	b := p.bytes(4)
+	if b == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint32(b)
+}
+
+func (p *traceParser) time() time.Time {
+	b := p.bytes(8)
+	if b == nil {
+		return time.Time{}
+	}
+
+	ns := int64(binary.BigEndian.Uint64(b))
+	if ns == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, ns)
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	var b [4]byte
+
+	binary.BigEndian.PutUint32(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var b [8]byte
+
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func appendUUID(buf []byte, uuid []byte) []byte {
+	var b [uuidLength]byte
+
+	copy(b[:], uuid)
+	return append(buf, b[:]...)
+}
+
+func appendTime(buf []byte, t time.Time) []byte {
+	if t.IsZero() {
+		return appendUint64(buf, 0)
+	}
+
+	return appendUint64(buf, uint64(t.UnixNano()))
+}
@@ -0,0 +1,203 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package ssntp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/01org/ciao/payloads"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+)
+
+// Compression is an SSNTP frame payload compression algorithm.
+type Compression uint8
+
+const (
+	// NoCompression sends payloads uncompressed.
+	NoCompression Compression = iota
+
+	// GzipCompression compresses payloads with gzip.
+	GzipCompression
+)
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case GzipCompression:
+		return "gzip"
+	}
+
+	return fmt.Sprintf("unknown (%d)", uint8(c))
+}
+
+// The binary frames Minor header byte carries the payload compression
+// algorithm in its 2 most significant bits, and the SSNTP minor version
+// in the other ones.
+const minorMask = 0x3f
+const compressionShift = 6
+
+// compressionMinor is the first SSNTP minor version supporting
+// compressed payloads. Payloads are never compressed for older peers.
+const compressionMinor = 1
+
+// compressionThreshold is the payload size under which compressing
+// is not worth it.
+const compressionThreshold = 1024
+
+const defaultMaxPayloadSize = 16 * 1024 * 1024
+
+func maxPayloadSize(config *Config) int {
+	if config.MaxPayloadSize == 0 {
+		return defaultMaxPayloadSize
+	}
+
+	if config.MaxPayloadSize < 0 {
+		return 0
+	}
+
+	return config.MaxPayloadSize
+}
+
+// negotiateCompression returns the compression algorithm to use for
+// the payloads we send to a peer speaking the peerMinor SSNTP version.
+func negotiateCompression(compression Compression, peerMinor uint8) Compression {
+	if peerMinor&minorMask < compressionMinor {
+		return NoCompression
+	}
+
+	return compression
+}
+
+// payloadTooLargeError is returned when sending or receiving a frame
+// whose payload is larger than the session maximum payload size.
+type payloadTooLargeError struct {
+	maxSize int
+}
+
+func (e payloadTooLargeError) Error() string {
+	return fmt.Sprintf("Payload larger than %d bytes", e.maxSize)
+}
+
+// payloadTooLarge builds the PayloadTooLarge error payload rejecting
+// frame.
+func payloadTooLarge(frame *Frame, err payloadTooLargeError) []byte {
+	tooLarge := payloads.ErrorPayloadTooLarge{
+		Type:    (Type)(frame.Type).String(),
+		MaxSize: err.maxSize,
+	}
+
+	if operand := frameOperand(frame); operand != nil {
+		tooLarge.Operand = fmt.Sprintf("%s", operand)
+	}
+
+	payload, yamlErr := yaml.Marshal(&tooLarge)
+	if yamlErr != nil {
+		return nil
+	}
+
+	return payload
+}
+
+// payloadConfig is the payload compression and size limit of a
+// session. A nil payloadConfig neither compresses nor limits payloads.
+type payloadConfig struct {
+	// compression is the algorithm negotiated with the peer for
+	// the payloads we send.
+	compression Compression
+
+	// maxSize is the maximum sent and received payload size, 0
+	// means unlimited.
+	maxSize int
+}
+
+func (p *payloadConfig) tooLarge(size uint64) bool {
+	return p != nil && p.maxSize > 0 && size > uint64(p.maxSize)
+}
+
+// compress returns the payload to send and how it is compressed.
+// Payloads are sent uncompressed when compression does not make them
+// smaller.
+func (p *payloadConfig) compress(payload []byte) ([]byte, Compression, error) {
+	if p.tooLarge(uint64(len(payload))) {
+		return nil, NoCompression, payloadTooLargeError{p.maxSize}
+	}
+
+	if p == nil || p.compression == NoCompression || len(payload) < compressionThreshold {
+		return payload, NoCompression, nil
+	}
+
+	var buf bytes.Buffer
+
+	switch p.compression {
+	case GzipCompression:
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(payload); err != nil {
+			return nil, NoCompression, err
+		}
+
+		if err := w.Close(); err != nil {
+			return nil, NoCompression, err
+		}
+	default:
+		return nil, NoCompression, fmt.Errorf("Unsupported payload compression %s", p.compression)
+	}
+
+	if buf.Len() >= len(payload) {
+		return payload, NoCompression, nil
+	}
+
+	return buf.Bytes(), p.compression, nil
+}
+
+// decompress decompresses a received payload, without ever allocating
+// more than the maximum payload size.
+func (p *payloadConfig) decompress(payload []byte, compression Compression) ([]byte, error) {
+	var r io.Reader
+
+	switch compression {
+	case NoCompression:
+		return payload, nil
+	case GzipCompression:
+		gz, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	default:
+		return nil, fmt.Errorf("Unsupported payload compression %s", compression)
+	}
+
+	if p != nil && p.maxSize > 0 {
+		r = io.LimitReader(r, int64(p.maxSize)+1)
+	}
+
+	decompressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.tooLarge(uint64(len(decompressed))) {
+		return nil, payloadTooLargeError{p.maxSize}
+	}
+
+	return decompressed, nil
+}
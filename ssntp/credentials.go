@@ -0,0 +1,285 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package ssntp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const defaultReloadInterval = 30 * time.Second
+
+func reloadInterval(config *Config) time.Duration {
+	if config.ReloadInterval == 0 {
+		return defaultReloadInterval
+	}
+
+	if config.ReloadInterval < 0 {
+		return 0
+	}
+
+	return config.ReloadInterval
+}
+
+// credentials holds the TLS configuration and the certificate
+// revocation list of an SSNTP client or server.
+// They are reloaded whenever the CA, certificate or CRL files change,
+// so that certificates can be rotated and revoked without restarting.
+// Reloaded credentials only apply to new connections.
+type credentials struct {
+	sync.RWMutex
+
+	caPath   string
+	certPath string
+	crlPath  string
+	server   bool
+	log      Logger
+
+	caPEM   []byte
+	certPEM []byte
+	crlData []byte
+
+	tls     *tls.Config
+	revoked map[string]bool
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// errRevoked is returned when a peer presents a revoked certificate.
+type errRevoked struct {
+	serial string
+}
+
+func (e errRevoked) Error() string {
+	return fmt.Sprintf("Certificate %s revoked", e.serial)
+}
+
+// newCredentials loads the config CA, certificate and CRL files.
+// As with the initial TLS configuration, unreadable files are fatal.
+func newCredentials(config *Config, server bool, logger Logger) *credentials {
+	c := &credentials{
+		caPath:   config.CAcert,
+		certPath: config.Cert,
+		crlPath:  config.CRL,
+		server:   server,
+		log:      logger,
+		stop:     make(chan struct{}),
+	}
+
+	caPEM, certPEM, crlData, err := c.read()
+	if err != nil {
+		log.Fatalf("SSNTP: %s", err)
+	}
+
+	err = c.load(caPEM, certPEM, crlData)
+	if err != nil {
+		logger.Errorf("%s\n", err)
+	}
+
+	return c
+}
+
+func (c *credentials) read() ([]byte, []byte, []byte, error) {
+	caPEM, err := ioutil.ReadFile(c.caPath)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Load CA certificate: %s", err)
+	}
+
+	certPEM, err := ioutil.ReadFile(c.certPath)
+	if err != nil {
+		return caPEM, nil, nil, fmt.Errorf("Load Certificate: %s", err)
+	}
+
+	if len(c.crlPath) == 0 {
+		return caPEM, certPEM, nil, nil
+	}
+
+	crlData, err := ioutil.ReadFile(c.crlPath)
+	if err != nil {
+		return caPEM, certPEM, nil, fmt.Errorf("Load CRL: %s", err)
+	}
+
+	return caPEM, certPEM, crlData, nil
+}
+
+// parseRevoked parses a PEM or DER encoded CRL, verifies it has been
+// signed by the CA and returns the set of revoked serial numbers.
+func parseRevoked(caPEM, crlData []byte) (map[string]bool, error) {
+	revoked := make(map[string]bool)
+	if crlData == nil {
+		return revoked, nil
+	}
+
+	caBlock, _ := pem.Decode(caPEM)
+	if caBlock == nil {
+		return nil, fmt.Errorf("Could not decode CA PEM")
+	}
+
+	ca, err := x509.ParseCertificate(caBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse CA certificate: %s", err)
+	}
+
+	crl, err := x509.ParseCRL(crlData)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse CRL: %s", err)
+	}
+
+	err = ca.CheckCRLSignature(crl)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid CRL signature: %s", err)
+	}
+
+	for _, cert := range crl.TBSCertList.RevokedCertificates {
+		revoked[cert.SerialNumber.String()] = true
+	}
+
+	return revoked, nil
+}
+
+// load builds new credentials from the files content. The current
+// credentials are kept when the new ones are not valid.
+func (c *credentials) load(caPEM, certPEM, crlData []byte) error {
+	revoked, err := parseRevoked(caPEM, crlData)
+	if err != nil {
+		return err
+	}
+
+	config := prepareTLS(caPEM, certPEM, c.server)
+	if config == nil {
+		return fmt.Errorf("Invalid CA or certificate")
+	}
+
+	c.Lock()
+	c.caPEM = caPEM
+	c.certPEM = certPEM
+	c.crlData = crlData
+	c.tls = config
+	c.revoked = revoked
+	c.Unlock()
+
+	return nil
+}
+
+// reload loads the credentials files again if any of them changed.
+// It returns true if new credentials have been loaded.
+func (c *credentials) reload() (bool, error) {
+	caPEM, certPEM, crlData, err := c.read()
+	if err != nil {
+		return false, err
+	}
+
+	c.RLock()
+	changed := !bytes.Equal(caPEM, c.caPEM) ||
+		!bytes.Equal(certPEM, c.certPEM) ||
+		!bytes.Equal(crlData, c.crlData)
+	c.RUnlock()
+
+	if changed == false {
+		return false, nil
+	}
+
+	err = c.load(caPEM, certPEM, crlData)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// watch checks for credentials changes every interval, until close is
+// called. reloaded is called after new credentials have been loaded.
+func (c *credentials) watch(interval time.Duration, reloaded func()) {
+	if interval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+
+		changed, err := c.reload()
+		if err != nil {
+			c.log.Errorf("Could not reload credentials: %s\n", err)
+			continue
+		}
+
+		if changed == false {
+			continue
+		}
+
+		c.log.Infof("Reloaded credentials\n")
+
+		if reloaded != nil {
+			reloaded()
+		}
+	}
+}
+
+func (c *credentials) close() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+}
+
+func (c *credentials) config() *tls.Config {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.tls
+}
+
+// verifyPeer checks that the TLS peer certificate has not been revoked.
+// Connections not going through TLS are not verified.
+func (c *credentials) verifyPeer(conn net.Conn) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return nil
+	}
+
+	serial := state.PeerCertificates[0].SerialNumber.String()
+
+	c.RLock()
+	revoked := c.revoked[serial]
+	c.RUnlock()
+
+	if revoked == true {
+		return errRevoked{serial: serial}
+	}
+
+	return nil
+}
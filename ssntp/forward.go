@@ -250,7 +250,14 @@ func (f *frameForward) deleteForwardDestination(dest *session) {
 	f.forwardMutex.Unlock()
 }
 
-func forwardDestination(destination ForwardDestination, server *Server, frame *Frame) {
+func forwardDestination(destination ForwardDestination, server *Server, source *session, frame *Frame) {
+	decision := destination.decision
+	if destination.recipientUUIDs == nil && decision == Forward {
+		decision = Discard
+	}
+
+	source.metrics.forwardDecision(decision)
+
 	/* TODO Handle queueing */
 	if destination.decision == Discard || destination.recipientUUIDs == nil {
 		return
@@ -268,28 +275,28 @@ func forwardDestination(destination ForwardDestination, server *Server, frame *F
 	server.sessionMutex.RUnlock()
 }
 
-func commandForward(uuid string, f CommandForwarder, cmd Command, server *Server, frame *Frame) {
+func commandForward(uuid string, f CommandForwarder, cmd Command, server *Server, source *session, frame *Frame) {
 	dest := f.CommandForward(uuid, cmd, frame)
 
-	forwardDestination(dest, server, frame)
+	forwardDestination(dest, server, source, frame)
 }
 
-func statusForward(uuid string, f StatusForwarder, status Status, server *Server, frame *Frame) {
+func statusForward(uuid string, f StatusForwarder, status Status, server *Server, source *session, frame *Frame) {
 	dest := f.StatusForward(uuid, status, frame)
 
-	forwardDestination(dest, server, frame)
+	forwardDestination(dest, server, source, frame)
 }
 
-func errorForward(uuid string, f ErrorForwarder, error Error, server *Server, frame *Frame) {
+func errorForward(uuid string, f ErrorForwarder, error Error, server *Server, source *session, frame *Frame) {
 	dest := f.ErrorForward(uuid, error, frame)
 
-	forwardDestination(dest, server, frame)
+	forwardDestination(dest, server, source, frame)
 }
 
-func eventForward(uuid string, f EventForwarder, event Event, server *Server, frame *Frame) {
+func eventForward(uuid string, f EventForwarder, event Event, server *Server, source *session, frame *Frame) {
 	dest := f.EventForward(uuid, event, frame)
 
-	forwardDestination(dest, server, frame)
+	forwardDestination(dest, server, source, frame)
 }
 
 func (f *frameForward) forwardFrame(server *Server, source *session, operand interface{}, frame *Frame) {
@@ -303,7 +310,7 @@ func (f *frameForward) forwardFrame(server *Server, source *session, operand int
 	case Command:
 		forwarder := f.forwardCommandFunc[op]
 		if forwarder != nil {
-			go commandForward(src, forwarder, op, server, frame)
+			go commandForward(src, forwarder, op, server, source, frame)
 			return
 		}
 
@@ -311,7 +318,7 @@ func (f *frameForward) forwardFrame(server *Server, source *session, operand int
 	case Status:
 		forwarder := f.forwardStatusFunc[op]
 		if forwarder != nil {
-			go statusForward(src, forwarder, op, server, frame)
+			go statusForward(src, forwarder, op, server, source, frame)
 			return
 		}
 
@@ -319,7 +326,7 @@ func (f *frameForward) forwardFrame(server *Server, source *session, operand int
 	case Error:
 		forwarder := f.forwardErrorFunc[op]
 		if forwarder != nil {
-			go errorForward(src, forwarder, op, server, frame)
+			go errorForward(src, forwarder, op, server, source, frame)
 			return
 		}
 
@@ -327,7 +334,7 @@ func (f *frameForward) forwardFrame(server *Server, source *session, operand int
 	case Event:
 		forwarder := f.forwardEventFunc[op]
 		if forwarder != nil {
-			go eventForward(src, forwarder, op, server, frame)
+			go eventForward(src, forwarder, op, server, source, frame)
 			return
 		}
 
@@ -340,6 +347,8 @@ func (f *frameForward) forwardFrame(server *Server, source *session, operand int
 		return
 	}
 
+	source.metrics.forwardDecision(Forward)
+
 	for _, s := range sessions {
 		if s == source {
 			continue
@@ -61,17 +61,28 @@ type FrameTrace struct {
 }
 
 // Frame represents an SSNTP frame structure.
+// RequestID is optional and set on commands sent through the
+// SendCommandAndWait APIs, and on the ACK or ERROR frames replying
+// to them.
+// Sequence is the sequence number of EVENT and ERROR frames, used for
+// replaying them after a reconnection. PING and PONG frames use it to
+// acknowledge the last EVENT or ERROR frame received. It is 0 for all
+// other frames and when replay is disabled.
 type Frame struct {
 	Major         uint8
 	Minor         uint8
 	Type          Type
 	Operand       uint8
+	RequestID     uint64
+	Sequence      uint64
 	PayloadLength uint32
 	Trace         *FrameTrace
 	Payload       []byte
 }
 
 // ConnectFrame is the SSNTP connection frame structure.
+// Resume is the sequence number of the last EVENT or ERROR frame the
+// client received from the server, if it is reconnecting.
 type ConnectFrame struct {
 	Major       uint8
 	Minor       uint8
@@ -80,9 +91,12 @@ type ConnectFrame struct {
 	Role        uint32
 	Source      []byte
 	Destination []byte
+	Resume      uint64
 }
 
 // ConnectedFrame is the SSNTP connected frame structure.
+// Resume is the sequence number of the last EVENT or ERROR frame the
+// server received from the client, if it is reconnecting.
 type ConnectedFrame struct {
 	Major         uint8
 	Minor         uint8
@@ -91,11 +105,12 @@ type ConnectedFrame struct {
 	Role          uint32
 	Source        []byte
 	Destination   []byte
+	Resume        uint64
 	PayloadLength uint32
 	Payload       []byte
 }
 
-const majorMask = 0x7f
+const majorMask = 0x0f
 const pathTraceEnabled = 1 << 7
 
 // PathTrace tells if an SSNTP frames contains tracing information or not.
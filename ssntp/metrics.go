@@ -0,0 +1,322 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package ssntp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FrameCounter counts the SSNTP frames of a given type and operand.
+type FrameCounter struct {
+	Type    string `json:"type"`
+	Operand string `json:"operand"`
+	Frames  uint64 `json:"frames"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// Stats are SSNTP traffic statistics.
+type Stats struct {
+	// Sent and Received count the frames per type and operand.
+	Sent     []FrameCounter `json:"sent"`
+	Received []FrameCounter `json:"received"`
+
+	// EncodeErrors and DecodeErrors count the frames that could not
+	// be sent or received.
+	EncodeErrors uint64 `json:"encode_errors"`
+	DecodeErrors uint64 `json:"decode_errors"`
+
+	// Forwarded, Discarded and Queued count the server forwarding
+	// decisions for received frames matching a forwarding rule.
+	Forwarded uint64 `json:"forwarded"`
+	Discarded uint64 `json:"discarded"`
+	Queued    uint64 `json:"queued"`
+
+	// TracedFrames is the number of received path traced frames.
+	// AverageLatency and MaxLatency are their average and maximum
+	// duration between their first transmission and their reception.
+	TracedFrames   uint64        `json:"traced_frames"`
+	AverageLatency time.Duration `json:"average_latency"`
+	MaxLatency     time.Duration `json:"max_latency"`
+}
+
+// SessionStats are the traffic statistics of an SSNTP server session.
+type SessionStats struct {
+	UUID          string `json:"uuid"`
+	Role          string `json:"role"`
+	RemoteAddress string `json:"remote_address"`
+	Stats
+}
+
+type frameKey struct {
+	frameType Type
+	operand   uint8
+}
+
+func (k frameKey) operandString() string {
+	switch k.frameType {
+	case COMMAND:
+		return (Command)(k.operand).String()
+	case STATUS:
+		return (Status)(k.operand).String()
+	case EVENT:
+		return (Event)(k.operand).String()
+	case ERROR:
+		return (Error)(k.operand).String()
+	}
+
+	return fmt.Sprintf("%d", k.operand)
+}
+
+func getFrameKey(frame interface{}) (frameKey, bool) {
+	switch f := frame.(type) {
+	case *Frame:
+		return frameKey{f.Type, f.Operand}, true
+	case *ConnectFrame:
+		return frameKey{f.Type, f.Operand}, true
+	case *ConnectedFrame:
+		return frameKey{f.Type, f.Operand}, true
+	}
+
+	return frameKey{}, false
+}
+
+type sortedFrameCounters []FrameCounter
+
+func (s sortedFrameCounters) Len() int {
+	return len(s)
+}
+
+func (s sortedFrameCounters) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s sortedFrameCounters) Less(i, j int) bool {
+	if s[i].Type != s[j].Type {
+		return s[i].Type < s[j].Type
+	}
+	return s[i].Operand < s[j].Operand
+}
+
+type sortedSessionStats []SessionStats
+
+func (s sortedSessionStats) Len() int {
+	return len(s)
+}
+
+func (s sortedSessionStats) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s sortedSessionStats) Less(i, j int) bool {
+	return s[i].UUID < s[j].UUID
+}
+
+type frameCount struct {
+	frames uint64
+	bytes  uint64
+}
+
+// metrics collects the traffic statistics of an SSNTP session, a
+// server or a client. Session metrics are also accounted to their
+// parent server or client metrics.
+type metrics struct {
+	sync.Mutex
+	parent *metrics
+
+	sent         map[frameKey]*frameCount
+	received     map[frameKey]*frameCount
+	encodeErrors uint64
+	decodeErrors uint64
+	forwarded    uint64
+	discarded    uint64
+	queued       uint64
+	traced       uint64
+	latency      time.Duration
+	maxLatency   time.Duration
+}
+
+func count(counts map[frameKey]*frameCount, frame interface{}, bytes uint64) map[frameKey]*frameCount {
+	key, ok := getFrameKey(frame)
+	if !ok {
+		return counts
+	}
+
+	if counts == nil {
+		counts = make(map[frameKey]*frameCount)
+	}
+
+	c := counts[key]
+	if c == nil {
+		c = &frameCount{}
+		counts[key] = c
+	}
+
+	c.frames++
+	c.bytes += bytes
+
+	return counts
+}
+
+func (m *metrics) frameSent(frame interface{}, bytes uint64, err error) {
+	for ; m != nil; m = m.parent {
+		m.Lock()
+		if err != nil {
+			m.encodeErrors++
+		} else {
+			m.sent = count(m.sent, frame, bytes)
+		}
+		m.Unlock()
+	}
+}
+
+func (m *metrics) frameReceived(frame interface{}, bytes uint64, err error) {
+	var latency time.Duration
+	var traced bool
+
+	if f, ok := frame.(*Frame); ok && err == nil {
+		d, durationErr := f.Duration()
+		latency, traced = d, durationErr == nil
+	}
+
+	// Failing to read from a closed connection is not a decode error.
+	if err != nil && bytes == 0 {
+		return
+	}
+
+	for ; m != nil; m = m.parent {
+		m.Lock()
+		if err != nil {
+			m.decodeErrors++
+			m.Unlock()
+			continue
+		}
+
+		m.received = count(m.received, frame, bytes)
+		if traced == true {
+			m.traced++
+			m.latency += latency
+			if latency > m.maxLatency {
+				m.maxLatency = latency
+			}
+		}
+		m.Unlock()
+	}
+}
+
+func (m *metrics) forwardDecision(decision ForwardDecision) {
+	for ; m != nil; m = m.parent {
+		m.Lock()
+		switch decision {
+		case Forward:
+			m.forwarded++
+		case Discard:
+			m.discarded++
+		case Queue:
+			m.queued++
+		}
+		m.Unlock()
+	}
+}
+
+func counters(counts map[frameKey]*frameCount) []FrameCounter {
+	var counters []FrameCounter
+
+	for key, c := range counts {
+		counters = append(counters, FrameCounter{
+			Type:    key.frameType.String(),
+			Operand: key.operandString(),
+			Frames:  c.frames,
+			Bytes:   c.bytes,
+		})
+	}
+
+	sort.Sort(sortedFrameCounters(counters))
+
+	return counters
+}
+
+func (m *metrics) stats() Stats {
+	m.Lock()
+	defer m.Unlock()
+
+	stats := Stats{
+		Sent:         counters(m.sent),
+		Received:     counters(m.received),
+		EncodeErrors: m.encodeErrors,
+		DecodeErrors: m.decodeErrors,
+		Forwarded:    m.forwarded,
+		Discarded:    m.discarded,
+		Queued:       m.queued,
+		TracedFrames: m.traced,
+		MaxLatency:   m.maxLatency,
+	}
+
+	if m.traced > 0 {
+		stats.AverageLatency = m.latency / time.Duration(m.traced)
+	}
+
+	return stats
+}
+
+func roleString(role uint32) string {
+	r := (Role)(role)
+	return strings.TrimSuffix(r.String(), "-")
+}
+
+// countingReader and countingWriter count the bytes going through an
+// SSNTP session, so that frames sizes can be accounted for.
+// countingReader is an io.ByteReader for the gob decoder not to buffer
+// it.
+type countingReader struct {
+	reader *bufio.Reader
+	count  uint64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += uint64(n)
+	return n, err
+}
+
+func (r *countingReader) ReadByte() (byte, error) {
+	b, err := r.reader.ReadByte()
+	if err == nil {
+		r.count++
+	}
+	return b, err
+}
+
+func (r *countingReader) Peek(n int) ([]byte, error) {
+	return r.reader.Peek(n)
+}
+
+type countingWriter struct {
+	writer io.Writer
+	count  uint64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.count += uint64(n)
+	return n, err
+}
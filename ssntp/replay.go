@@ -0,0 +1,194 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package ssntp
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultReplaySize = 256
+
+const defaultReplayTimeout = 10 * time.Minute
+
+// replaySize returns the configured replay buffer size, or 0 if
+// replay is disabled.
+func replaySize(config *Config) int {
+	switch {
+	case config.ReplaySize < 0:
+		return 0
+	case config.ReplaySize == 0:
+		return defaultReplaySize
+	}
+
+	return config.ReplaySize
+}
+
+// replayTimeout returns the configured replay buffer timeout.
+func replayTimeout(config *Config) time.Duration {
+	if config.ReplayTimeout <= 0 {
+		return defaultReplayTimeout
+	}
+
+	return config.ReplayTimeout
+}
+
+// replay keeps the EVENT and ERROR frames sent to a peer until it
+// acknowledges them, so that the ones it missed can be sent again
+// once it reconnects. A replay outlives sessions: clients keep one
+// for their server, and servers keep one per client UUID.
+type replay struct {
+	sync.Mutex
+
+	size int
+
+	// sequence is the sequence number of the last frame we sent.
+	sequence uint64
+
+	// frames are the sent and not yet acknowledged frames, ordered
+	// by sequence number.
+	frames []*Frame
+
+	// evicted is the sequence number of the last frame we dropped
+	// because the buffer was full.
+	evicted uint64
+
+	// received is the sequence number of the last frame we received
+	// from our peer.
+	received uint64
+
+	// touched is when a server replay buffer was last handed to, or
+	// released by, a session of its client. It is protected by the
+	// server sessionMutex.
+	touched time.Time
+}
+
+func newReplay(size int) *replay {
+	if size <= 0 {
+		return nil
+	}
+
+	return &replay{
+		size: size,
+	}
+}
+
+// isReplayable tells if frame must be kept for replay. Connection
+// errors only make sense on the connection they are sent through.
+func isReplayable(frame *Frame) bool {
+	switch frame.Type {
+	case EVENT:
+		return true
+	case ERROR:
+		error := (Error)(frame.Operand)
+		return error != ConnectionFailure && error != ConnectionAborted
+	}
+
+	return false
+}
+
+// write numbers frame, buffers it and sends it through session.
+// Write errors are not reported as the frame will be replayed once
+// our peer reconnects.
+func (r *replay) write(session *session, frame *Frame) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	// frame may be forwarded to several sessions
+	f := *frame
+	r.sequence++
+	f.Sequence = r.sequence
+
+	r.frames = append(r.frames, &f)
+	if len(r.frames) > r.size {
+		r.evicted = r.frames[0].Sequence
+		r.frames[0] = nil
+		r.frames = r.frames[1:]
+	}
+
+	session.writeFrame(&f)
+
+	return 0, nil
+}
+
+// acknowledge drops all frames up to sequence from the buffer.
+func (r *replay) acknowledge(sequence uint64) {
+	r.Lock()
+	r.ack(sequence)
+	r.Unlock()
+}
+
+func (r *replay) ack(sequence uint64) {
+	// Our peer may acknowledge frames we sent before restarting.
+	if sequence > r.sequence {
+		return
+	}
+
+	i := 0
+	for i < len(r.frames) && r.frames[i].Sequence <= sequence {
+		r.frames[i] = nil
+		i++
+	}
+
+	r.frames = r.frames[i:]
+}
+
+// resume acknowledges all frames up to received, the sequence number
+// of the last frame our peer got before reconnecting, and sends it
+// the frames it missed through session.
+// It returns the number of replayed frames and of frames that our
+// peer missed but that we could not keep.
+func (r *replay) resume(session *session, received uint64) (int, uint64, error) {
+	var lost uint64
+
+	r.Lock()
+	defer r.Unlock()
+
+	if received > r.sequence {
+		received = 0
+	}
+
+	r.ack(received)
+
+	if r.evicted > received {
+		lost = r.evicted - received
+	}
+
+	for i, f := range r.frames {
+		if _, err := session.writeFrame(f); err != nil {
+			return i, lost, err
+		}
+	}
+
+	return len(r.frames), lost, nil
+}
+
+// receive records the sequence number of a frame we received.
+func (r *replay) receive(sequence uint64) {
+	r.Lock()
+	r.received = sequence
+	r.Unlock()
+}
+
+// lastReceived returns the sequence number of the last frame we
+// received, to be acknowledged to our peer.
+func (r *replay) lastReceived() uint64 {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.received
+}
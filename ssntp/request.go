@@ -0,0 +1,137 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package ssntp
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var requestIDs = struct {
+	sync.Mutex
+	rand *rand.Rand
+}{
+	rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+}
+
+// newRequestID returns a random, non zero, request ID.
+// Request IDs are not sequential because replies to commands sent by
+// different SSNTP clients can come back through the same session, e.g.
+// when a server forwards commands to its clients.
+func newRequestID() uint64 {
+	requestIDs.Lock()
+	defer requestIDs.Unlock()
+
+	for {
+		id := uint64(requestIDs.rand.Int63())
+		if id != 0 {
+			return id
+		}
+	}
+}
+
+// requests tracks the commands sent through a session that are
+// waiting for a reply.
+type requests struct {
+	sync.Mutex
+	waiters map[uint64]chan *Frame
+}
+
+func (r *requests) add() (uint64, chan *Frame) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.waiters == nil {
+		r.waiters = make(map[uint64]chan *Frame)
+	}
+
+	id := newRequestID()
+	reply := make(chan *Frame, 1)
+	r.waiters[id] = reply
+
+	return id, reply
+}
+
+func (r *requests) remove(id uint64) {
+	r.Lock()
+	delete(r.waiters, id)
+	r.Unlock()
+}
+
+// reply hands frame over to the command waiting for it, if any.
+func (r *requests) reply(frame *Frame) {
+	if isReply(frame) == false {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	reply := r.waiters[frame.RequestID]
+	if reply == nil {
+		return
+	}
+
+	delete(r.waiters, frame.RequestID)
+	reply <- frame
+}
+
+// abort wakes all waiting commands up without a reply, e.g. because
+// the session is gone.
+func (r *requests) abort() {
+	r.Lock()
+	defer r.Unlock()
+
+	for id, reply := range r.waiters {
+		delete(r.waiters, id)
+		close(reply)
+	}
+}
+
+func isReply(frame *Frame) bool {
+	if frame.RequestID == 0 {
+		return false
+	}
+
+	return frame.Type == ERROR || (frame.Type == STATUS && (Status)(frame.Operand) == ACK)
+}
+
+func (session *session) sendCommandAndWait(ctx context.Context, cmd Command, payload []byte, trace *TraceConfig) (*Frame, error) {
+	id, reply := session.requests.add()
+	defer session.requests.remove(id)
+
+	frame := session.commandFrame(cmd, payload, trace)
+	frame.RequestID = id
+
+	_, err := session.Write(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case f, ok := <-reply:
+		if ok == false {
+			return nil, fmt.Errorf("Connection lost while waiting for %s reply", cmd)
+		}
+		return f, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
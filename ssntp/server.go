@@ -18,10 +18,14 @@ package ssntp
 
 import (
 	"crypto/tls"
-	"encoding/gob"
 	"fmt"
+	"github.com/01org/ciao/payloads"
 	"github.com/docker/distribution/uuid"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
 	"net"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -61,7 +65,8 @@ type ServerNotifier interface {
 type Server struct {
 	uuid         uuid.UUID
 	lUUID        lockedUUID
-	tls          *tls.Config
+	credentials  *credentials
+	transport    Transport
 	ntf          ServerNotifier
 	sessionMutex sync.RWMutex
 	sessions     map[string]*session
@@ -74,69 +79,159 @@ type Server struct {
 
 	forwardRules frameForward
 
+	authorization frameAuthorization
+
+	metrics metrics
+
 	log Logger
 
 	trace *TraceConfig
 
+	heartbeat heartbeat
+
+	// replays are the per client UUID replay buffers, protected by
+	// sessionMutex.
+	replays       map[string]*replay
+	replaySize    int
+	replayTimeout time.Duration
+
+	// payload is the payload compression and size limit template for
+	// new sessions.
+	payload payloadConfig
+
 	configuration clusterConfiguration
 }
 
-func sendConnectionFailure(conn net.Conn) *session {
-	var session session
-	encoder := gob.NewEncoder(conn)
-
-	frame := session.errorFrame(ConnectionFailure, nil, nil)
-	encoder.Encode(frame)
+func sendConnectionFailure(session *session, payload []byte) *session {
+	frame := session.errorFrame(ConnectionFailure, payload, nil)
+	session.Write(frame)
 
 	return nil
 }
 
-func sendConnectionAborted(conn net.Conn) *session {
-	var session session
-	encoder := gob.NewEncoder(conn)
+func sendConnectionAborted(session *session, aborted payloads.ErrorConnectionAborted) *session {
+	payload, err := yaml.Marshal(&aborted)
+	if err != nil {
+		payload = nil
+	}
 
-	frame := session.errorFrame(ConnectionAborted, nil, nil)
-	encoder.Encode(frame)
+	frame := session.errorFrame(ConnectionAborted, payload, nil)
+	session.Write(frame)
 
 	return nil
 }
 
+// sendRevoked aborts a connection from a peer presenting a revoked
+// certificate.
+func sendRevoked(session *session, err error) *session {
+	aborted := payloads.ErrorConnectionAborted{
+		Reason: payloads.CertificateRevoked,
+	}
+
+	if revoked, ok := err.(errRevoked); ok {
+		aborted.Serial = revoked.serial
+	}
+
+	return sendConnectionAborted(session, aborted)
+}
+
+// sendVersionFailure rejects a CONNECT frame carrying an SSNTP major
+// version we do not support.
+func sendVersionFailure(server *Server, session *session, peerMajor, peerMinor uint8) *session {
+	version := fmt.Sprintf("%d.%d", peerMajor, peerMinor)
+	server.log.Errorf("Unsupported SSNTP version %s\n", version)
+
+	failure := payloads.ErrorConnectionFailure{
+		Reason:  payloads.UnsupportedVersion,
+		Version: version,
+		SupportedVersions: []string{
+			fmt.Sprintf("%d.%d", legacyMajor, legacyMinor),
+			fmt.Sprintf("%d.%d", major, minor),
+		},
+	}
+
+	payload, err := yaml.Marshal(&failure)
+	if err != nil {
+		payload = nil
+	}
+
+	return sendConnectionFailure(session, payload)
+}
+
 func handleClientConnect(server *Server, conn net.Conn) *session {
 	var connect ConnectFrame
 
-	decoder := gob.NewDecoder(conn)
+	session := newSession(&server.uuid, server.role, 0, conn)
+	session.metrics.parent = &server.metrics
+	session.payload.maxSize = server.payload.maxSize
 
 	server.log.Infof("Waiting for CONNECT\n")
 	setReadTimeout(conn)
-	readErr := decoder.Decode(&connect)
+
+	// Legacy clients send gob encoded frames, binary ones start
+	// with their SSNTP major version.
+	first, readErr := session.reader.Peek(1)
+	if readErr == nil {
+		if isBinaryFraming(first[0]) == false {
+			session.useGob()
+		}
+
+		readErr = session.Read(&connect)
+	}
 	clearReadTimeout(conn)
+
+	if version, ok := readErr.(versionError); ok {
+		return sendVersionFailure(server, session, version.major, version.minor)
+	}
+
 	if readErr != nil {
 		server.log.Errorf("Connect error: %s\n", readErr)
-		return sendConnectionFailure(conn)
+		return sendConnectionFailure(session, nil)
 	}
 
 	server.log.Infof("Received CONNECT frame:\n%s\n", connect)
 
+	if connect.Major&majorMask != session.major {
+		return sendVersionFailure(server, session, connect.Major&majorMask, connect.Minor)
+	}
+
+	if server.credentials != nil {
+		err := server.credentials.verifyPeer(conn)
+		if err != nil {
+			server.log.Errorf("%s\n", err)
+			return sendRevoked(session, err)
+		}
+	}
+
 	if server.roleVerify == true {
 		tlscon, ok := conn.(*tls.Conn)
 		if ok {
 			oidFound, err := verifyRole(tlscon, connect.Role)
 			if oidFound == false {
 				server.log.Errorf("%s\n", err)
-				return sendConnectionAborted(conn)
+				return sendConnectionAborted(session,
+					payloads.ErrorConnectionAborted{
+						Reason: payloads.InvalidCertificateRole,
+					})
 			}
 		}
 	}
 
 	if connect.Type != COMMAND || connect.Operand != (uint8)(CONNECT) {
 		server.log.Errorf("Invalid Connect frame")
-		return sendConnectionFailure(conn)
+		return sendConnectionFailure(session, nil)
 	}
 
-	session := newSession(&server.uuid, server.role, connect.Role, conn)
+	session.destRole = connect.Role
 	session.setDest(connect.Source[:16])
+	session.heartbeat = negotiateHeartbeat(server.heartbeat, connect.Minor)
+	session.payload.compression = negotiateCompression(server.payload.compression, connect.Minor)
+
+	// Legacy clients do not acknowledge frames
+	if session.major != legacyMajor {
+		session.replay = server.getReplay(session.dest.String())
+	}
 
-	/* TODO Get the CONFIGURE payload from the config package */
 	server.configuration.RLock()
 	connected := session.connectedFrame(server.role, server.configuration.configuration)
 	server.configuration.RUnlock()
@@ -145,7 +240,21 @@ func handleClientConnect(server *Server, conn net.Conn) *session {
 	_, writeErr := session.Write(connected)
 	if writeErr != nil {
 		server.log.Errorf("Connected error: %s\n", writeErr)
-		return sendConnectionFailure(conn)
+		return sendConnectionFailure(session, nil)
+	}
+
+	if session.replay != nil {
+		replayed, lost, err := session.replay.resume(session, connect.Resume)
+		if err != nil {
+			server.log.Errorf("Replay error: %s\n", err)
+			return nil
+		}
+
+		if lost > 0 {
+			server.log.Errorf("%d frames to %s lost\n", lost, session.dest)
+		}
+
+		server.log.Infof("Replayed %d frames\n", replayed)
 	}
 
 	return session
@@ -166,23 +275,41 @@ func handleSSNTPClient(server *Server, conn net.Conn) {
 	server.forwardRules.addForwardDestination(session)
 	server.ntf.ConnectNotify(uuidString, session.destRole)
 
+	stopHeartbeats := make(chan struct{})
+	defer close(stopHeartbeats)
+	go session.sendHeartbeats(stopHeartbeats)
+
 	for {
 		var frame Frame
 		err := session.Read(&frame)
+		if tooLarge, ok := err.(payloadTooLargeError); ok {
+			server.sendPayloadTooLarge(uuidString, &frame, tooLarge)
+			continue
+		}
+
 		if err != nil {
 			server.log.Infof("Client disconnection: %s %d\n", err)
+			session.requests.abort()
 			server.ntf.DisconnectNotify(uuidString, session.destRole)
 			server.forwardRules.deleteForwardDestination(session)
 			server.removeSession(uuidString)
+			server.releaseReplay(uuidString, session.replay)
 			break
 		}
 
+		if session.handleHeartbeat(&frame) == true {
+			continue
+		}
+
+		if server.authorization.authorized(session.destRole, frameOperand(&frame)) == false {
+			server.sendUnauthorized(uuidString, session, &frame)
+			continue
+		}
+
+		session.requests.reply(&frame)
+
 		switch frame.Type {
 		case COMMAND:
-			if (Command)(frame.Operand) == CONFIGURE && session.destRole == Controller {
-				/* TODO Send the CONFIGURE payload to the config package */
-				server.configuration.setConfiguration(frame.Payload)
-			}
 			server.forwardRules.forwardFrame(server, session, (Command)(frame.Operand), &frame)
 			server.ntf.CommandNotify(uuidString, (Command)(frame.Operand), &frame)
 		case STATUS:
@@ -215,6 +342,109 @@ func (server *Server) removeSession(uuid string) {
 	server.sessionMutex.Unlock()
 }
 
+// getReplay returns the replay buffer for the client identified by
+// uuid, or nil if replay is disabled.
+func (server *Server) getReplay(uuid string) *replay {
+	server.sessionMutex.Lock()
+	defer server.sessionMutex.Unlock()
+
+	r := server.replays[uuid]
+	if r == nil {
+		r = newReplay(server.replaySize)
+		if r != nil {
+			server.replays[uuid] = r
+		}
+	}
+
+	if r != nil {
+		r.touched = time.Now()
+	}
+
+	return r
+}
+
+// releaseReplay schedules the expiry of the replay buffer r of the
+// client identified by uuid, which just disconnected. The buffer is
+// dropped unless the client reconnects within the replay timeout.
+func (server *Server) releaseReplay(uuid string, r *replay) {
+	if r == nil {
+		return
+	}
+
+	server.sessionMutex.Lock()
+	r.touched = time.Now()
+	server.sessionMutex.Unlock()
+
+	time.AfterFunc(server.replayTimeout, func() {
+		server.expireReplay(uuid, r)
+	})
+}
+
+// expireReplay drops the replay buffer r of the client identified by
+// uuid if no session of the client has used it since it was released.
+func (server *Server) expireReplay(uuid string, r *replay) {
+	server.sessionMutex.Lock()
+	defer server.sessionMutex.Unlock()
+
+	if server.replays[uuid] != r || server.sessions[uuid] != nil ||
+		time.Since(r.touched) < server.replayTimeout {
+		return
+	}
+
+	delete(server.replays, uuid)
+}
+
+// sendPayloadTooLarge rejects a frame whose payload is larger than
+// the server maximum payload size.
+func (server *Server) sendPayloadTooLarge(uuid string, frame *Frame, err payloadTooLargeError) {
+	server.log.Errorf("%s %s frame from client %s: %s\n",
+		(Type)(frame.Type), frameOperand(frame), uuid, err)
+
+	server.sendError(uuid, PayloadTooLarge, payloadTooLarge(frame, err), server.trace, frame.RequestID)
+}
+
+// sendUnauthorized rejects a frame the uuid client is not allowed to
+// send.
+func (server *Server) sendUnauthorized(uuid string, session *session, frame *Frame) {
+	role := (Role)(session.destRole)
+	unauthorized := payloads.ErrorUnauthorizedFrame{
+		Type:    (Type)(frame.Type).String(),
+		Operand: fmt.Sprintf("%s", frameOperand(frame)),
+		Role:    strings.TrimSuffix(role.String(), "-"),
+	}
+
+	server.log.Errorf("Unauthorized %s %s frame from %s client %s\n",
+		unauthorized.Type, unauthorized.Operand, unauthorized.Role, uuid)
+
+	payload, err := yaml.Marshal(&unauthorized)
+	if err != nil {
+		payload = nil
+	}
+
+	server.sendError(uuid, UnauthorizedFrame, payload, server.trace, frame.RequestID)
+}
+
+// abortRevokedSessions disconnects the clients whose certificate got
+// revoked by newly loaded credentials.
+func (server *Server) abortRevokedSessions() {
+	revoked := make(map[*session]error)
+
+	server.sessionMutex.RLock()
+	for _, session := range server.sessions {
+		err := server.credentials.verifyPeer(session.conn)
+		if err != nil {
+			revoked[session] = err
+		}
+	}
+	server.sessionMutex.RUnlock()
+
+	for session, err := range revoked {
+		server.log.Errorf("Aborting %s connection: %s\n", session.dest, err)
+		sendRevoked(session, err)
+		session.conn.Close()
+	}
+}
+
 func (server *Server) getSession(uuid string) *session {
 	server.sessionMutex.RLock()
 	session := server.sessions[uuid]
@@ -268,18 +498,6 @@ func (server *Server) Serve(config *Config, ntf ServerNotifier) error {
 		uri = config.URI
 	}
 
-	var transport string
-
-	if len(config.Transport) == 0 {
-		transport = "tcp"
-	} else {
-		if config.Transport != "tcp" && config.Transport != "unix" {
-			transport = "tcp"
-		} else {
-			transport = config.Transport
-		}
-	}
-
 	if config.Log == nil {
 		server.log = errLog
 	} else {
@@ -289,15 +507,32 @@ func (server *Server) Serve(config *Config, ntf ServerNotifier) error {
 	server.ntf = ntf
 	server.sessions = make(map[string]*session)
 	server.forwardRules.init(config.ForwardRules)
-	server.tls = prepareTLSConfig(config, true)
+	if config.CustomTransport != nil {
+		server.transport = config.CustomTransport
+	} else {
+		server.credentials = newCredentials(config, true, server.log)
+		server.transport = &tlsTransport{
+			network:     transportNetwork(config),
+			credentials: server.credentials,
+		}
+	}
 	server.forwardRules.forwardRules = config.ForwardRules
+	server.authorization.init(config.AuthorizationRules)
 	server.role = config.Role
 	server.roleVerify = config.RoleVerification
 	server.trace = config.Trace
+	server.heartbeat = newHeartbeat(config)
+	server.replays = make(map[string]*replay)
+	server.replaySize = replaySize(config)
+	server.replayTimeout = replayTimeout(config)
+	server.payload = payloadConfig{
+		compression: config.Compression,
+		maxSize:     maxPayloadSize(config),
+	}
 	server.stoppedChan = make(chan struct{})
 
 	service := fmt.Sprintf("%s:%d", uri, serverPort)
-	listener, err := tls.Listen(transport, service, server.tls)
+	listener, err := server.transport.Listen(service)
 	if err != nil {
 		server.log.Errorf("Failed to start listener (err=%s) on %s\n", err, service)
 		return err
@@ -307,6 +542,10 @@ func (server *Server) Serve(config *Config, ntf ServerNotifier) error {
 	server.listener = listener
 	defer listener.Close()
 
+	if server.credentials != nil {
+		go server.credentials.watch(reloadInterval(config), server.abortRevokedSessions)
+	}
+
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -340,6 +579,10 @@ func (server *Server) Stop() {
 		server.listener.Close()
 	}
 
+	if server.credentials != nil {
+		server.credentials.close()
+	}
+
 	server.sessionMutex.RLock()
 	for uuid, session := range server.sessions {
 		server.log.Infof("Closing connection for %s\n", uuid)
@@ -369,13 +612,14 @@ func (server *Server) sendCommand(uuid string, cmd Command, payload []byte, trac
 	return session.Write(frame)
 }
 
-func (server *Server) sendStatus(uuid string, status Status, payload []byte, trace *TraceConfig) (int, error) {
+func (server *Server) sendStatus(uuid string, status Status, payload []byte, trace *TraceConfig, requestID uint64) (int, error) {
 	session := server.getSession(uuid)
 	if session == nil {
 		return -1, fmt.Errorf("Unknown UUID %s", uuid)
 	}
 
 	frame := session.statusFrame(status, payload, trace)
+	frame.RequestID = requestID
 	return session.Write(frame)
 }
 
@@ -389,13 +633,14 @@ func (server *Server) sendEvent(uuid string, event Event, payload []byte, trace
 	return session.Write(frame)
 }
 
-func (server *Server) sendError(uuid string, error Error, payload []byte, trace *TraceConfig) (int, error) {
+func (server *Server) sendError(uuid string, error Error, payload []byte, trace *TraceConfig, requestID uint64) (int, error) {
 	session := server.getSession(uuid)
 	if session == nil {
 		return -1, fmt.Errorf("Unknown UUID %s", uuid)
 	}
 
 	frame := session.errorFrame(error, payload, trace)
+	frame.RequestID = requestID
 	return session.Write(frame)
 }
 
@@ -408,7 +653,7 @@ func (server *Server) SendCommand(uuid string, cmd Command, payload []byte) (int
 // SendStatus sends a specific status and its payload to a client.
 // The client is specified by its uuid
 func (server *Server) SendStatus(uuid string, status Status, payload []byte) (int, error) {
-	return server.sendStatus(uuid, status, payload, server.trace)
+	return server.sendStatus(uuid, status, payload, server.trace, 0)
 }
 
 // SendEvent sends a specific status and its payload to a client.
@@ -420,7 +665,34 @@ func (server *Server) SendEvent(uuid string, event Event, payload []byte) (int,
 // SendError sends an error back to a client.
 // The client is specified by its uuid
 func (server *Server) SendError(uuid string, error Error, payload []byte) (int, error) {
-	return server.sendError(uuid, error, payload, server.trace)
+	return server.sendError(uuid, error, payload, server.trace, 0)
+}
+
+// SendCommandAndWait sends a specific command and its payload to a client,
+// and waits for the command recipient to reply. The reply is either an ACK
+// status frame or an ERROR frame, and is returned to the caller.
+// An error is returned if the command could not be sent, if the client
+// disconnected or if ctx expired before we got a reply.
+// The client is specified by its uuid
+func (server *Server) SendCommandAndWait(ctx context.Context, uuid string, cmd Command, payload []byte) (*Frame, error) {
+	session := server.getSession(uuid)
+	if session == nil {
+		return nil, fmt.Errorf("Unknown UUID %s", uuid)
+	}
+
+	return session.sendCommandAndWait(ctx, cmd, payload, server.trace)
+}
+
+// SendAck acknowledges a command sent with a request ID to the server
+// by a client. The client is specified by its uuid.
+func (server *Server) SendAck(uuid string, requestID uint64) (int, error) {
+	return server.sendStatus(uuid, ACK, nil, server.trace, requestID)
+}
+
+// SendErrorReply sends an error to a client, in reply to the command
+// it sent with a request ID. The client is specified by its uuid.
+func (server *Server) SendErrorReply(uuid string, requestID uint64, error Error, payload []byte) (int, error) {
+	return server.sendError(uuid, error, payload, server.trace, requestID)
 }
 
 // SendTracedCommand sends a specific command and its payload to a client.
@@ -434,7 +706,7 @@ func (server *Server) SendTracedCommand(uuid string, cmd Command, payload []byte
 // The SSNTP status frame will be traced according to the trace argument.
 // The client is specified by its uuid
 func (server *Server) SendTracedStatus(uuid string, status Status, payload []byte, trace *TraceConfig) (int, error) {
-	return server.sendStatus(uuid, status, payload, trace)
+	return server.sendStatus(uuid, status, payload, trace, 0)
 }
 
 // SendTracedEvent sends a specific event and its payload to a client.
@@ -448,10 +720,58 @@ func (server *Server) SendTracedEvent(uuid string, event Event, payload []byte,
 // The SSNTP error frame will be traced according to the trace argument.
 // The client is specified by its uuid
 func (server *Server) SendTracedError(uuid string, error Error, payload []byte, trace *TraceConfig) (int, error) {
-	return server.sendError(uuid, error, payload, trace)
+	return server.sendError(uuid, error, payload, trace, 0)
 }
 
 // UUID exports the SSNTP server Universally Unique ID.
 func (server *Server) UUID() string {
 	return server.uuid.String()
 }
+
+// ClusterConfiguration returns the cluster configuration payload
+// the server sends to its clients in CONNECTED status frames.
+func (server *Server) ClusterConfiguration() (payload []byte) {
+	server.configuration.RLock()
+	defer server.configuration.RUnlock()
+
+	payload = server.configuration.configuration
+
+	return
+}
+
+// SetClusterConfiguration sets the cluster configuration payload
+// the server sends to its clients in CONNECTED status frames.
+// The server does not store CONFIGURE command payloads by itself,
+// it is up to the server implementation to validate them and then
+// call SetClusterConfiguration. The configuration can be set before
+// calling Serve.
+func (server *Server) SetClusterConfiguration(payload []byte) {
+	server.configuration.setConfiguration(payload)
+}
+
+// Stats returns the server SSNTP traffic statistics, accumulated over
+// all its client sessions.
+func (server *Server) Stats() Stats {
+	return server.metrics.stats()
+}
+
+// SessionStats returns the SSNTP traffic statistics of all currently
+// connected clients, sorted by client UUID.
+func (server *Server) SessionStats() []SessionStats {
+	var stats []SessionStats
+
+	server.sessionMutex.RLock()
+	for uuid, session := range server.sessions {
+		stats = append(stats, SessionStats{
+			UUID:          uuid,
+			Role:          roleString(session.destRole),
+			RemoteAddress: session.conn.RemoteAddr().String(),
+			Stats:         session.metrics.stats(),
+		})
+	}
+	server.sessionMutex.RUnlock()
+
+	sort.Sort(sortedSessionStats(stats))
+
+	return stats
+}
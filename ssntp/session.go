@@ -17,9 +17,10 @@
 package ssntp
 
 import (
-	"encoding/gob"
+	"bufio"
 	"github.com/docker/distribution/uuid"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -39,6 +40,52 @@ func clearWriteTimeout(conn net.Conn) {
 	conn.SetWriteDeadline(time.Time{})
 }
 
+// heartbeat is the PING/PONG keepalive configuration of a session.
+type heartbeat struct {
+	interval time.Duration
+	misses   int
+}
+
+const defaultHeartbeatMisses = 3
+
+// heartbeatMinor is the first SSNTP minor version supporting heartbeats.
+// Older peers neither send nor answer PING frames, heartbeats are thus
+// disabled on the sessions with them.
+const heartbeatMinor = 2
+
+func newHeartbeat(config *Config) heartbeat {
+	h := heartbeat{
+		interval: config.HeartbeatInterval,
+		misses:   config.HeartbeatMisses,
+	}
+
+	if h.misses <= 0 {
+		h.misses = defaultHeartbeatMisses
+	}
+
+	return h
+}
+
+func (h heartbeat) enabled() bool {
+	return h.interval > 0
+}
+
+// negotiateHeartbeat returns the heartbeat configuration to use with a
+// peer speaking the peerMinor SSNTP version.
+func negotiateHeartbeat(h heartbeat, peerMinor uint8) heartbeat {
+	if peerMinor&minorMask < heartbeatMinor {
+		return heartbeat{}
+	}
+
+	return h
+}
+
+// timeout is how long we wait for a frame from our peer before
+// considering it dead.
+func (h heartbeat) timeout() time.Duration {
+	return h.interval * time.Duration(h.misses)
+}
+
 type session struct {
 	src      uuid.UUID
 	dest     uuid.UUID
@@ -46,8 +93,23 @@ type session struct {
 	destRole uint32
 	conn     net.Conn
 
-	encoder *gob.Encoder
-	decoder *gob.Decoder
+	heartbeat heartbeat
+	requests  requests
+	replay    *replay
+
+	// major and minor are the SSNTP version spoken on this session.
+	major uint8
+	minor uint8
+
+	writeLock sync.Mutex
+	reader    *countingReader
+	writer    *countingWriter
+	codec     codec
+
+	// payload is the binary codec payload compression and size limit.
+	payload payloadConfig
+
+	metrics metrics
 }
 
 /*
@@ -64,25 +126,41 @@ func newSession(src *uuid.UUID, srcRole uint32, destRole uint32, netConn net.Con
 	session.destRole = destRole
 
 	session.conn = netConn
-	session.encoder = gob.NewEncoder(netConn)
-	session.decoder = gob.NewDecoder(netConn)
+	session.reader = &countingReader{reader: bufio.NewReader(netConn)}
+	session.writer = &countingWriter{writer: netConn}
+	codec := newBinaryCodec(session.reader, session.writer)
+	codec.payload = &session.payload
+	session.codec = codec
+	session.major = major
+	session.minor = minor
 
 	return &session
 }
 
+// useGob switches the session to the legacy gob encoding.
+// This must be done before any frame is sent or received.
+func (session *session) useGob() {
+	codec := newGobCodec(session.reader, session.writer)
+	codec.payload = &session.payload
+	session.codec = codec
+	session.major = legacyMajor
+	session.minor = legacyMinor
+}
+
 func (session *session) setDest(uuid []byte) {
 	copy(session.dest[:], uuid[:16])
 }
 
 func (session *session) connectedFrame(serverRole uint32, payload []byte) (f *ConnectedFrame) {
 	f = &ConnectedFrame{
-		Major:         major,
-		Minor:         minor,
+		Major:         session.major,
+		Minor:         session.minor,
 		Type:          STATUS,
 		Operand:       byte(CONNECTED),
 		Role:          serverRole,
 		Source:        session.src[:],
 		Destination:   session.dest[:],
+		Resume:        session.lastReceived(),
 		PayloadLength: (uint32)(len(payload)),
 		Payload:       payload,
 	}
@@ -92,13 +170,14 @@ func (session *session) connectedFrame(serverRole uint32, payload []byte) (f *Co
 
 func (session *session) connectFrame() (f *ConnectFrame) {
 	f = &ConnectFrame{
-		Major:       major,
-		Minor:       minor,
+		Major:       session.major,
+		Minor:       session.minor,
 		Type:        COMMAND,
 		Operand:     byte(CONNECT),
 		Role:        session.srcRole,
 		Source:      session.src[:],
 		Destination: session.dest[:],
+		Resume:      session.lastReceived(),
 	}
 
 	return
@@ -106,8 +185,8 @@ func (session *session) connectFrame() (f *ConnectFrame) {
 
 func (session *session) commandFrame(cmd Command, payload []byte, trace *TraceConfig) (f *Frame) {
 	f = &Frame{
-		Major:         major,
-		Minor:         minor,
+		Major:         session.major,
+		Minor:         session.minor,
 		Type:          COMMAND,
 		Operand:       byte(cmd),
 		PayloadLength: (uint32)(len(payload)),
@@ -122,8 +201,8 @@ func (session *session) commandFrame(cmd Command, payload []byte, trace *TraceCo
 
 func (session *session) statusFrame(status Status, payload []byte, trace *TraceConfig) (f *Frame) {
 	f = &Frame{
-		Major:         major,
-		Minor:         minor,
+		Major:         session.major,
+		Minor:         session.minor,
 		Type:          STATUS,
 		Operand:       byte(status),
 		PayloadLength: (uint32)(len(payload)),
@@ -138,8 +217,8 @@ func (session *session) statusFrame(status Status, payload []byte, trace *TraceC
 
 func (session *session) eventFrame(event Event, payload []byte, trace *TraceConfig) (f *Frame) {
 	f = &Frame{
-		Major:         major,
-		Minor:         minor,
+		Major:         session.major,
+		Minor:         session.minor,
 		Type:          EVENT,
 		Operand:       byte(event),
 		PayloadLength: (uint32)(len(payload)),
@@ -154,8 +233,8 @@ func (session *session) eventFrame(event Event, payload []byte, trace *TraceConf
 
 func (session *session) errorFrame(error Error, payload []byte, trace *TraceConfig) (f *Frame) {
 	f = &Frame{
-		Major:         major,
-		Minor:         minor,
+		Major:         session.major,
+		Minor:         session.minor,
 		Type:          ERROR,
 		Operand:       byte(error),
 		PayloadLength: (uint32)(len(payload)),
@@ -168,7 +247,25 @@ func (session *session) errorFrame(error Error, payload []byte, trace *TraceConf
 	return
 }
 
+// lastReceived returns the sequence number of the last EVENT or
+// ERROR frame received from our peer, or 0 if replay is disabled.
+func (session *session) lastReceived() uint64 {
+	if session.replay == nil {
+		return 0
+	}
+
+	return session.replay.lastReceived()
+}
+
 func (session *session) Write(frame interface{}) (int, error) {
+	if f, ok := frame.(*Frame); ok && session.replay != nil && isReplayable(f) {
+		return session.replay.write(session, f)
+	}
+
+	return session.writeFrame(frame)
+}
+
+func (session *session) writeFrame(frame interface{}) (int, error) {
 	switch f := frame.(type) {
 	case *Frame:
 		if f.PathTrace() == false {
@@ -178,18 +275,34 @@ func (session *session) Write(frame interface{}) (int, error) {
 		f.Trace.Path[f.Trace.PathLength-1].TxTimestamp = time.Now()
 	}
 
+	session.writeLock.Lock()
 	setWriteTimeout(session.conn)
-	err := session.encoder.Encode(frame)
+	written := session.writer.count
+	err := session.codec.encode(frame)
+	written = session.writer.count - written
 	clearWriteTimeout(session.conn)
+	session.writeLock.Unlock()
+
+	session.metrics.frameSent(frame, written, err)
 
 	return 0, err
 }
 
 func (session *session) Read(frame interface{}) error {
-	err := session.decoder.Decode(frame)
+	if session.heartbeat.enabled() {
+		session.conn.SetReadDeadline(time.Now().Add(session.heartbeat.timeout()))
+	}
+
+	read := session.reader.count
+	err := session.codec.decode(frame)
+	read = session.reader.count - read
 
 	switch f := frame.(type) {
 	case *Frame:
+		if err == nil && f.Sequence != 0 && session.replay != nil && isReplayable(f) {
+			session.replay.receive(f.Sequence)
+		}
+
 		if f.PathTrace() == false {
 			break
 		}
@@ -204,6 +317,60 @@ func (session *session) Read(frame interface{}) error {
 		f.Trace.PathLength++
 	}
 
+	session.metrics.frameReceived(frame, read, err)
+
 	return err
 
 }
+
+// sendHeartbeats periodically sends PING frames to our peer, until
+// stop is closed or the session can no longer be written to.
+func (session *session) sendHeartbeats(stop <-chan struct{}) {
+	if session.heartbeat.enabled() == false {
+		return
+	}
+
+	ticker := time.NewTicker(session.heartbeat.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ping := session.commandFrame(PING, nil, nil)
+			ping.Sequence = session.lastReceived()
+			if _, err := session.Write(ping); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleHeartbeat replies to PING frames and returns true if frame is
+// a heartbeat frame that should not be forwarded nor notified.
+// Heartbeat frames acknowledge the last EVENT or ERROR frame their
+// sender received through their sequence number.
+func (session *session) handleHeartbeat(frame *Frame) bool {
+	switch {
+	case frame.Type == COMMAND && (Command)(frame.Operand) == PING:
+		session.acknowledge(frame.Sequence)
+		pong := session.statusFrame(PONG, nil, nil)
+		pong.Sequence = session.lastReceived()
+		session.Write(pong)
+		return true
+	case frame.Type == STATUS && (Status)(frame.Operand) == PONG:
+		session.acknowledge(frame.Sequence)
+		return true
+	}
+
+	return false
+}
+
+func (session *session) acknowledge(sequence uint64) {
+	if session.replay == nil || sequence == 0 {
+		return
+	}
+
+	session.replay.acknowledge(sequence)
+}
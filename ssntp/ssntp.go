@@ -30,6 +30,7 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/docker/distribution/uuid"
 	"github.com/golang/glog"
@@ -41,11 +42,12 @@ type Type uint8
 
 // Command is the SSNTP Command operand.
 // It can be CONNECT, START, STOP, STATS, EVACUATE, DELETE, RESTART,
-// AssignPublicIP, ReleasePublicIP or CONFIGURE.
+// AssignPublicIP, ReleasePublicIP, CONFIGURE, AttachVolume, DetachVolume,
+// Snapshot, Resize or PING.
 type Command uint8
 
 // Status is the SSNTP Status operand.
-// It can be CONNECTED, READY, FULL, OFFLINE or MAINTENANCE
+// It can be CONNECTED, READY, FULL, OFFLINE, MAINTENANCE, PONG or ACK
 type Status uint8
 
 // Role describes the SSNTP role for the frame sender.
@@ -55,13 +57,15 @@ type Role uint32
 // Error is the SSNTP Error operand.
 // It can be InvalidFrameType Error, StartFailure,
 // StopFailure, ConnectionFailure, RestartFailure,
-// DeleteFailure, ConnectionAborted or InvalidConfiguration.
+// DeleteFailure, ConnectionAborted, InvalidConfiguration,
+// AttachVolumeFailure, DetachVolumeFailure, SnapshotFailure or
+// ResizeFailure or UnauthorizedFrame.
 type Error uint8
 
 // Event is the SSNTP Event operand.
 // It can be TenantAdded, TenantRemoval, InstanceDeleted,
 // ConcentratorInstanceAdded, PublicIPAssigned, TraceReport,
-// NodeConnected or NodeDisconnected
+// NodeConnected, NodeDisconnected, InstanceEvacuated or NodeEvacuated
 type Event uint8
 
 const (
@@ -95,10 +99,10 @@ const (
 	// frame:
 	//					   SSNTP CONNECT Command frame
 	//
-	//	+-------------------------------------------------------------+
-	//	| Major | Minor | Type  | Operand |          Role             |
-	//	|       |       | (0x0) |  (0x0)  | (bitmask of client roles) |
-	//	+-------------------------------------------------------------+
+	//	+-------------------------------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |          Role             | Client UUID | Nil UUID | Resume   |
+	//	|       |       | (0x0) |  (0x0)  | (bitmask of client roles) |             |          | Sequence |
+	//	+-------------------------------------------------------------------------------------------------+
 	CONNECT Command = iota
 
 	// START is a command that should reach CIAO agents for scheduling a new
@@ -228,6 +232,82 @@ const (
 	//	|       |       | (0x0) |  (0x9)  |                 |                         |
 	//	+-----------------------------------------------------------------------------+
 	CONFIGURE
+
+	// AttachVolume is sent by the Controller to hot plug a block storage
+	// volume into a running instance.
+	// The Scheduler forwards it to the CIAO agent running the instance,
+	// as specified in the payload.
+	//
+	// The AttachVolume YAML payload schema is made of the instance,
+	// volume and workload agent UUIDs, and of the volume path and format.
+	//
+	//                                       SSNTP AttachVolume Command frame
+	//	+-----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload  |
+	//	|       |       | (0x0) |  (0xa)  |                 |                         |
+	//	+-----------------------------------------------------------------------------+
+	AttachVolume
+
+	// DetachVolume is sent by the Controller to unplug a block storage
+	// volume from a running instance.
+	// The Scheduler forwards it to the CIAO agent running the instance,
+	// as specified in the payload.
+	//
+	// The DetachVolume YAML payload schema is made of the instance,
+	// volume and workload agent UUIDs.
+	//
+	//                                       SSNTP DetachVolume Command frame
+	//	+-----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload  |
+	//	|       |       | (0x0) |  (0xb)  |                 |                         |
+	//	+-----------------------------------------------------------------------------+
+	DetachVolume
+
+	// Snapshot is sent by the Controller to copy the root disk of a
+	// running instance into a new image.
+	// The Scheduler forwards it to the CIAO agent running the instance,
+	// as specified in the payload.  The agent uploads the copy to the
+	// image service, under the image UUID given in the payload.
+	//
+	// The Snapshot YAML payload schema is made of the instance, image
+	// and workload agent UUIDs.
+	//
+	//                                       SSNTP Snapshot Command frame
+	//	+-----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload  |
+	//	|       |       | (0x0) |  (0xc)  |                 |                         |
+	//	+-----------------------------------------------------------------------------+
+	Snapshot
+
+	// Resize is sent by the Controller to change the vcpus, memory and
+	// disk size of a stopped instance.
+	// The Scheduler checks that the node hosting the instance can
+	// accommodate the new resources and forwards the command to it.  If
+	// the node cannot, the Scheduler fails the resize with a
+	// ResizeFailure error and the instance is left untouched.
+	//
+	// The Resize YAML payload schema is made of the instance and
+	// workload agent UUIDs and the requested and current resources.
+	//
+	//                                       SSNTP Resize Command frame
+	//	+-----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload  |
+	//	|       |       | (0x0) |  (0xd)  |                 |                         |
+	//	+-----------------------------------------------------------------------------+
+	Resize
+
+	// PING is the SSNTP heartbeat command. When heartbeats are enabled,
+	// SSNTP clients and servers periodically send PING frames to their
+	// peer, which must reply with a PONG status frame. PING frames are
+	// handled by the SSNTP package itself and are never forwarded nor
+	// notified to the SSNTP users.
+	//
+	//                SSNTP PING Command frame
+	//	+---------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length |
+	//	|       |       | (0x0) |  (0xe)  |       (0x0)     |
+	//	+---------------------------------------------------+
+	PING
 )
 
 const (
@@ -239,10 +319,10 @@ const (
 	//
 	//					 SSNTP CONNECTED Status frame
 	//
-	//	+--------------------------------------------------------------------------------------------------------------------+
-	//	| Major | Minor | Type  | Operand |         Role              | Server UUID | Client UUID | Payload | YAML formatted |
-	//	|       |       | (0x1) |  (0x0)  | (bitmask of server roles) |             |             |  Length |      payload   |
-	//	+--------------------------------------------------------------------------------------------------------------------+
+	//	+-------------------------------------------------------------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |         Role              | Server UUID | Client UUID | Resume   | Payload | YAML formatted |
+	//	|       |       | (0x1) |  (0x0)  | (bitmask of server roles) |             |             | Sequence |  Length |      payload   |
+	//	+-------------------------------------------------------------------------------------------------------------------------------+
 	CONNECTED Status = iota
 
 	// READY is a status command CIAO agents send to the scheduler to notify them about
@@ -292,6 +372,32 @@ const (
 	//	|       |       | (0x1) |  (0x4)  |       (0x0)     |
 	//	+---------------------------------------------------+
 	MAINTENANCE
+
+	// PONG is the SSNTP heartbeat reply, sent back to the peer that sent
+	// a PING command frame. Like PING, it is never forwarded nor notified
+	// to the SSNTP users.
+	//
+	//					 SSNTP PONG Status frame
+	//
+	//	+---------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length |
+	//	|       |       | (0x1) |  (0x5)  |       (0x0)     |
+	//	+---------------------------------------------------+
+	PONG
+
+	// ACK is sent by the recipient of a command frame carrying a request
+	// ID, to let the command sender know that it successfully processed
+	// it. The ACK frame carries the same request ID as the acknowledged
+	// command. Failures are reported through the command specific
+	// ERROR frames, carrying the command request ID as well.
+	//
+	//					 SSNTP ACK Status frame
+	//
+	//	+---------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length |
+	//	|       |       | (0x1) |  (0x6)  |       (0x0)     |
+	//	+---------------------------------------------------+
+	ACK
 )
 
 const (
@@ -413,6 +519,38 @@ const (
 	//	|       |       | (0x3) |  (0x7)  |                 |                        |
 	//	+----------------------------------------------------------------------------+
 	NodeDisconnected
+
+	// InstanceEvacuated events are sent by workload agents while they are
+	// evacuating their compute node, once for every instance they have
+	// stopped and removed from it.
+	// The Scheduler must forward those events to the Controllers, which are
+	// expected to restart the evacuated instance on another node, reusing
+	// its UUID and network configuration.
+	// The InstanceEvacuated event payload contains the instance UUID, the
+	// node UUID and the number of instances left to evacuate.
+	//
+	//					 SSNTP InstanceEvacuated Event frame
+	//
+	//	+----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload |
+	//	|       |       | (0x3) |  (0x8)  |                 |                        |
+	//	+----------------------------------------------------------------------------+
+	InstanceEvacuated
+
+	// NodeEvacuated events are sent by workload agents when the last instance
+	// has left their compute node after an EVACUATE command. The agent
+	// enters MAINTENANCE right after sending this event.
+	// The Scheduler must forward those events to the Controllers.
+	// The NodeEvacuated event payload contains the node UUID and the next
+	// state requested by the EVACUATE command.
+	//
+	//					 SSNTP NodeEvacuated Event frame
+	//
+	//	+----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload |
+	//	|       |       | (0x3) |  (0x9)  |                 |                        |
+	//	+----------------------------------------------------------------------------+
+	NodeEvacuated
 )
 
 // SSNTP clients and servers can have one or several roles and are expected to declare their
@@ -472,7 +610,8 @@ const (
 	StopFailure
 
 	// ConnectionFailure is sent to report an SSNTP connection failure.
-	// It can be sent by servers and clients.
+	// It can be sent by servers and clients. Servers rejecting a client
+	// SSNTP version send a payloads.ErrorConnectionFailure payload.
 	ConnectionFailure
 
 	// RestartFailure is sent by launcher agents to report a workload re-start failure.
@@ -482,7 +621,8 @@ const (
 	DeleteFailure
 
 	// ConnectionAborted is sent to report an SSNTP connection abortion.
-	// This is used for example when receiving bad certificates.
+	// This is used for example when receiving bad or revoked certificates,
+	// with a payloads.ErrorConnectionAborted payload.
 	ConnectionAborted
 
 	// InvalidConfiguration is either sent by the Scheduler to report an invalid
@@ -492,10 +632,43 @@ const (
 	// When the scheduler receives such error back from any client it should revert
 	// back to the previous valid configuration.
 	InvalidConfiguration
+
+	// AttachVolumeFailure is sent by launcher agents to report a failure
+	// to attach a volume to an instance.
+	AttachVolumeFailure
+
+	// DetachVolumeFailure is sent by launcher agents to report a failure
+	// to detach a volume from an instance.
+	DetachVolumeFailure
+
+	// SnapshotFailure is sent by launcher agents to report a failure
+	// to snapshot an instance or to upload its snapshot.
+	SnapshotFailure
+
+	// ResizeFailure is sent by launcher agents or by the Scheduler to
+	// report a failure to resize an instance.
+	ResizeFailure
+
+	// UnauthorizedFrame is sent by SSNTP servers to reject a frame
+	// the client role is not allowed to send, as defined by the
+	// server frame authorization rules.
+	UnauthorizedFrame
+
+	// PayloadTooLarge is sent to reject a frame whose payload is larger
+	// than the receiver maximum payload size, with a
+	// payloads.ErrorPayloadTooLarge payload.
+	PayloadTooLarge
 )
 
-const major = 0
-const minor = 1
+// major and minor are the SSNTP version of the binary framing.
+// SSNTP 1.1 adds payload compression and SSNTP 1.2 heartbeats.
+const major = 1
+const minor = 2
+
+// legacyMajor and legacyMinor are the SSNTP version of the legacy,
+// gob encoded, framing.
+const legacyMajor = 0
+const legacyMinor = 1
 const defaultURL = "localhost"
 const port = 8888
 const readTimeout = 30
@@ -544,6 +717,16 @@ func (command Command) String() string {
 		return "Release public IP"
 	case CONFIGURE:
 		return "CONFIGURE"
+	case AttachVolume:
+		return "ATTACH_VOLUME"
+	case DetachVolume:
+		return "DETACH_VOLUME"
+	case Snapshot:
+		return "SNAPSHOT"
+	case Resize:
+		return "RESIZE"
+	case PING:
+		return "PING"
 	}
 
 	return ""
@@ -561,6 +744,10 @@ func (status Status) String() string {
 		return "OFFLINE"
 	case MAINTENANCE:
 		return "MAINTENANCE"
+	case PONG:
+		return "PONG"
+	case ACK:
+		return "ACK"
 	}
 
 	return ""
@@ -584,6 +771,10 @@ func (status Event) String() string {
 		return "Node Connected"
 	case NodeDisconnected:
 		return "Node Disconnected"
+	case InstanceEvacuated:
+		return "Instance Evacuated"
+	case NodeEvacuated:
+		return "Node Evacuated"
 	}
 
 	return ""
@@ -607,6 +798,18 @@ func (error Error) String() string {
 		return "SSNTP Connection aborted"
 	case InvalidConfiguration:
 		return "Cluster configuration is invalid"
+	case AttachVolumeFailure:
+		return "Could not attach volume"
+	case DetachVolumeFailure:
+		return "Could not detach volume"
+	case SnapshotFailure:
+		return "Could not snapshot instance"
+	case ResizeFailure:
+		return "Could not resize instance"
+	case UnauthorizedFrame:
+		return "Unauthorized SSNTP frame"
+	case PayloadTooLarge:
+		return "SSNTP payload too large"
 	}
 
 	return ""
@@ -698,13 +901,40 @@ type Config struct {
 	// will be used for SSNTP clients and server, respectively.
 	Cert string
 
+	// CRL is the optional certificate revocation list path. The list
+	// can be PEM or DER encoded and must be signed by the CAcert
+	// authority. Peers presenting a revoked certificate are sent a
+	// ConnectionAborted error and disconnected.
+	CRL string
+
+	// ReloadInterval is the period at which the CAcert, Cert and CRL
+	// files are checked for changes. Changed files are reloaded and
+	// apply to new connections, without dropping established ones
+	// unless their peer certificate got revoked.
+	// This is optional, the default is 30 seconds. Reloading is
+	// disabled when it is negative.
+	ReloadInterval time.Duration
+
 	// Transport is the underlying transport protocol. Only "tcp" and "unix"
 	// transports are supported. The default is "tcp".
 	Transport string
 
+	// CustomTransport is optional and overrides Transport. When set,
+	// connections go through it instead of TLS, and neither the CAcert
+	// nor the Cert certificates are used.
+	CustomTransport Transport
+
 	// ForwardRules is optional and contains a list of frame forwarding rules.
 	ForwardRules []FrameForwardRule
 
+	// AuthorizationRules is optional and contains the list of frames
+	// each client role is allowed to send to the server. When set,
+	// frames not authorized by any rule matching the client roles are
+	// answered with an UnauthorizedFrame error and dropped, i.e. they
+	// are neither forwarded nor notified. All frames are authorized
+	// when it is empty.
+	AuthorizationRules []FrameAuthorizationRule
+
 	// Log is the SSNTP logging interface.
 	// If not set, only error messages will be logged.
 	// The SSNTP Log implementation provides a default logger.
@@ -721,6 +951,44 @@ type Config struct {
 
 	// Trace configures the desired level of SSNTP frame tracing.
 	Trace *TraceConfig
+
+	// HeartbeatInterval is the period at which PING frames are sent
+	// to the peer. Heartbeats are disabled when it is 0.
+	HeartbeatInterval time.Duration
+
+	// HeartbeatMisses is the number of heartbeat intervals without
+	// receiving any frame from the peer after which the connection is
+	// considered dead and closed, triggering a DisconnectNotify.
+	// This is optional, the default is 3.
+	HeartbeatMisses int
+
+	// ReplaySize is the maximum number of sent EVENT and ERROR frames
+	// kept until the peer acknowledges them, and replayed to it when
+	// it reconnects. This is optional, the default is 256. Replay is
+	// disabled when it is negative.
+	ReplaySize int
+
+	// ReplayTimeout is how long a server keeps the replay buffer of a
+	// disconnected client, waiting for it to reconnect. This is
+	// optional, the default is 10 minutes.
+	ReplayTimeout time.Duration
+
+	// Compression is the algorithm used to compress the payloads sent
+	// to peers supporting it, i.e. speaking SSNTP 1.1 or later.
+	// Payloads smaller than 1KB are never compressed. Compressed
+	// payloads are always accepted. This is optional, the default is
+	// NoCompression.
+	Compression Compression
+
+	// MaxPayloadSize is the maximum size, in bytes, of the frame
+	// payloads sent and received, once decompressed. Received frames
+	// with larger payloads are answered with a PayloadTooLarge error
+	// and dropped, and sending them fails. Frame traces are bounded
+	// by the same limit. Legacy SSNTP 0.x frames are not length
+	// prefixed and are only checked once fully received.
+	// This is optional, the default is 16MB. The size is not limited
+	// when it is negative.
+	MaxPayloadSize int
 }
 
 // Logger is an interface for SSNTP users to define their own
@@ -801,20 +1069,6 @@ func (conf *clusterConfiguration) setConfiguration(configuration []byte) {
 	conf.Unlock()
 }
 
-func prepareTLSConfig(config *Config, server bool) *tls.Config {
-	caPEM, err := ioutil.ReadFile(config.CAcert)
-	if err != nil {
-		log.Fatalf("SSNTP: Load CA certificate: %s", err)
-	}
-
-	certPEM, err := ioutil.ReadFile(config.Cert)
-	if err != nil {
-		log.Fatalf("SSNTP: Load Certificate: %s", err)
-	}
-
-	return prepareTLS(caPEM, certPEM, server)
-}
-
 func prepareTLS(caPEM, certPEM []byte, server bool) *tls.Config {
 	cert, err := tls.X509KeyPair(certPEM, certPEM)
 	if err != nil {
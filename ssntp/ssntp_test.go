@@ -17,16 +17,31 @@
 package ssntp
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/asn1"
+	"encoding/pem"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"os"
 	"path"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/01org/ciao/payloads"
+	"github.com/docker/distribution/uuid"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
 )
 
 type ssntpEchoServer struct {
@@ -36,6 +51,14 @@ type ssntpEchoServer struct {
 	roleConnectChannel    chan string
 	roleDisconnectChannel chan string
 	majorChannel          chan struct{}
+
+	// requestReply is the reply to commands carrying a request ID,
+	// either ACK or StopFailure. No reply is sent when it is empty.
+	requestReply string
+
+	// evtChannel receives the event payloads instead of echoing
+	// them back, when set.
+	evtChannel chan string
 }
 
 func (server *ssntpEchoServer) ConnectNotify(uuid string, role uint32) {
@@ -57,6 +80,16 @@ func (server *ssntpEchoServer) StatusNotify(uuid string, status Status, frame *F
 }
 
 func (server *ssntpEchoServer) CommandNotify(uuid string, command Command, frame *Frame) {
+	if frame.RequestID != 0 {
+		switch server.requestReply {
+		case ACK.String():
+			server.ssntp.SendAck(uuid, frame.RequestID)
+		case StopFailure.String():
+			server.ssntp.SendErrorReply(uuid, frame.RequestID, StopFailure, frame.Payload)
+		}
+		return
+	}
+
 	if server.majorChannel != nil {
 		if frame.major() == major {
 			close(server.majorChannel)
@@ -67,6 +100,11 @@ func (server *ssntpEchoServer) CommandNotify(uuid string, command Command, frame
 }
 
 func (server *ssntpEchoServer) EventNotify(uuid string, event Event, frame *Frame) {
+	if server.evtChannel != nil {
+		server.evtChannel <- string(frame.Payload)
+		return
+	}
+
 	server.ssntp.SendEvent(uuid, event, frame.Payload)
 }
 
@@ -211,6 +249,11 @@ func (client *ssntpClient) StatusNotify(status Status, frame *Frame) {
 }
 
 func (client *ssntpClient) CommandNotify(command Command, frame *Frame) {
+	if frame.RequestID != 0 {
+		client.ssntp.SendAck(frame.RequestID)
+		return
+	}
+
 	if client.typeChannel != nil {
 		client.typeChannel <- COMMAND.String()
 	}
@@ -2094,6 +2137,1999 @@ var (
 	payloadSize = flag.Int("payload", 1<<11, "Frames payload size")
 )
 
+const testHeartbeatInterval = 50 * time.Millisecond
+
+// pipeServer sets up an SSNTP server that serves a single client
+// over one end of an in-memory net.Pipe connection.
+func pipeServer(server *ssntpEchoServer, conn net.Conn) {
+	server.ssntp.uuid = uuid.Generate()
+	server.ssntp.role = (uint32)(SERVER)
+	server.ssntp.log = errLog
+	server.ssntp.ntf = server
+	server.ssntp.sessions = make(map[string]*session)
+	server.ssntp.forwardRules.init(nil)
+	server.ssntp.heartbeat = heartbeat{interval: testHeartbeatInterval, misses: 3}
+	server.ssntp.replays = make(map[string]*replay)
+	server.ssntp.replaySize = defaultReplaySize
+	server.ssntp.replayTimeout = defaultReplayTimeout
+	server.roleConnectChannel = make(chan string, 1)
+
+	server.ssntp.clientWg.Add(1)
+	go handleSSNTPClient(&server.ssntp, conn)
+}
+
+// pipeClient sets up an SSNTP client that talks to its server over
+// one end of an in-memory net.Pipe connection.
+func pipeClient(client *ssntpClient, conn net.Conn) {
+	client.ssntp.uuid = uuid.Generate()
+	client.ssntp.lUUID.lockFd = -1
+	client.ssntp.role = (uint32)(AGENT)
+	client.ssntp.log = errLog
+	client.ssntp.ntf = client
+	client.ssntp.heartbeat = heartbeat{interval: testHeartbeatInterval, misses: 3}
+	client.ssntp.replay = newReplay(defaultReplaySize)
+	pipeSession(client, conn)
+}
+
+// pipeSession gives a pipeClient a new session, e.g. to reconnect.
+func pipeSession(client *ssntpClient, conn net.Conn) {
+	client.ssntp.session = newSession(&client.ssntp.uuid, client.ssntp.role, 0, conn)
+	client.ssntp.session.replay = client.ssntp.replay
+}
+
+// pipeConnect connects a pipeClient to its pipeServer.
+// pipeHandle starts the client frame handler. The handler holds a
+// frameWg reference until it returns, so that the frames it adds to
+// frameWg never race with Close waiting for it.
+func pipeHandle(client *ssntpClient) {
+	client.ssntp.frameWg.Add(1)
+	go func() {
+		defer client.ssntp.frameWg.Done()
+		client.ssntp.handleSSNTPServer()
+	}()
+}
+
+func pipeConnect(t *testing.T, server *ssntpEchoServer, client *ssntpClient) {
+	if _, err := client.ssntp.sendConnect(); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	pipeHandle(client)
+
+	select {
+	case <-server.roleConnectChannel:
+	case <-time.After(time.Second):
+		t.Fatalf("Did not receive the connection notification")
+	}
+}
+
+// Test SSNTP heartbeats between a healthy client and server.
+//
+// Test that a client and a server exchanging heartbeats over an
+// otherwise idle connection stay connected for several heartbeat
+// periods, and that PING and PONG frames are not notified.
+//
+// Test is expected to pass.
+func TestHeartbeat(t *testing.T) {
+	var server ssntpEchoServer
+	var client ssntpClient
+
+	server.t = t
+	server.roleDisconnectChannel = make(chan string)
+	client.t = t
+	client.disconnected = make(chan struct{})
+	client.typeChannel = make(chan string)
+
+	serverConn, clientConn := net.Pipe()
+	pipeServer(&server, serverConn)
+	pipeClient(&client, clientConn)
+
+	pipeConnect(t, &server, &client)
+
+	select {
+	case <-server.roleDisconnectChannel:
+		t.Fatalf("Server disconnected from a live client")
+	case <-client.disconnected:
+		t.Fatalf("Client disconnected from a live server")
+	case frameType := <-client.typeChannel:
+		t.Fatalf("Client notified of a %s heartbeat frame", frameType)
+	case <-time.After(10 * testHeartbeatInterval):
+	}
+
+	client.ssntp.Close()
+
+	select {
+	case <-server.roleDisconnectChannel:
+	case <-time.After(time.Second):
+		t.Fatalf("Did not receive the disconnection notification")
+	}
+}
+
+// Test SSNTP server dead client detection.
+//
+// Test that a server closes the connection to a client that
+// stopped sending and receiving frames, and notifies its
+// disconnection.
+//
+// Test is expected to pass.
+func TestHeartbeatStalledClient(t *testing.T) {
+	var server ssntpEchoServer
+
+	server.t = t
+	server.roleDisconnectChannel = make(chan string)
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	pipeServer(&server, serverConn)
+
+	clientUUID := uuid.Generate()
+	clientSession := newSession(&clientUUID, (uint32)(AGENT), 0, clientConn)
+	if _, err := clientSession.Write(clientSession.connectFrame()); err != nil {
+		t.Fatalf("Could not send CONNECT: %s", err)
+	}
+
+	var connected ConnectedFrame
+	if err := clientSession.Read(&connected); err != nil {
+		t.Fatalf("Could not receive CONNECTED: %s", err)
+	}
+
+	// From now on the client neither reads nor writes.
+	select {
+	case clientRole := <-server.roleDisconnectChannel:
+		agentRole := (Role)(AGENT)
+		if clientRole != agentRole.String() {
+			t.Fatalf("Wrong role")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Stalled client was not disconnected")
+	}
+
+	server.ssntp.clientWg.Wait()
+}
+
+// Test SSNTP client dead server detection.
+//
+// Test that a client closes the connection to a server that
+// stopped sending and receiving frames, and notifies its
+// disconnection.
+//
+// Test is expected to pass.
+func TestHeartbeatStalledServer(t *testing.T) {
+	var client ssntpClient
+
+	client.t = t
+	client.disconnected = make(chan struct{})
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	pipeClient(&client, clientConn)
+
+	serverUUID := uuid.Generate()
+	serverSession := newSession(&serverUUID, (uint32)(SERVER), (uint32)(AGENT), serverConn)
+	go func() {
+		var connect ConnectFrame
+		if serverSession.Read(&connect) != nil {
+			return
+		}
+		serverSession.Write(serverSession.connectedFrame((uint32)(SERVER), nil))
+
+		// From now on the server neither reads nor writes.
+	}()
+
+	if _, err := client.ssntp.sendConnect(); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	pipeHandle(&client)
+
+	select {
+	case <-client.disconnected:
+	case <-time.After(time.Second):
+		t.Fatalf("Stalled server was not disconnected")
+	}
+
+	client.ssntp.Close()
+}
+
+// Test SSNTP heartbeats negotiation with a pre heartbeats client.
+//
+// Test that a server does not disconnect an idle client that
+// advertised an SSNTP version without heartbeats support.
+//
+// Test is expected to pass.
+func TestHeartbeatLegacyClient(t *testing.T) {
+	var server ssntpEchoServer
+
+	server.t = t
+	server.roleDisconnectChannel = make(chan string)
+
+	serverConn, clientConn := net.Pipe()
+	pipeServer(&server, serverConn)
+
+	clientUUID := uuid.Generate()
+	clientSession := newSession(&clientUUID, (uint32)(AGENT), 0, clientConn)
+	clientSession.minor = heartbeatMinor - 1
+	if _, err := clientSession.Write(clientSession.connectFrame()); err != nil {
+		t.Fatalf("Could not send CONNECT: %s", err)
+	}
+
+	var connected ConnectedFrame
+	if err := clientSession.Read(&connected); err != nil {
+		t.Fatalf("Could not receive CONNECTED: %s", err)
+	}
+
+	// The client neither reads nor writes, as a pre heartbeats
+	// client would do between two STATS frames.
+	select {
+	case <-server.roleDisconnectChannel:
+		t.Fatalf("Server disconnected a legacy client")
+	case <-time.After(10 * testHeartbeatInterval):
+	}
+
+	clientConn.Close()
+
+	select {
+	case <-server.roleDisconnectChannel:
+	case <-time.After(time.Second):
+		t.Fatalf("Did not receive the disconnection notification")
+	}
+
+	server.ssntp.clientWg.Wait()
+}
+
+// Test SSNTP heartbeats negotiation with a pre heartbeats server.
+//
+// Test that a client does not disconnect from an idle server that
+// advertised an SSNTP version without heartbeats support.
+//
+// Test is expected to pass.
+func TestHeartbeatLegacyServer(t *testing.T) {
+	var client ssntpClient
+
+	client.t = t
+	client.disconnected = make(chan struct{})
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	pipeClient(&client, clientConn)
+
+	serverUUID := uuid.Generate()
+	serverSession := newSession(&serverUUID, (uint32)(SERVER), (uint32)(AGENT), serverConn)
+	serverSession.minor = heartbeatMinor - 1
+	go func() {
+		var connect ConnectFrame
+		if serverSession.Read(&connect) != nil {
+			return
+		}
+		serverSession.Write(serverSession.connectedFrame((uint32)(SERVER), nil))
+	}()
+
+	if _, err := client.ssntp.sendConnect(); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	pipeHandle(&client)
+
+	select {
+	case <-client.disconnected:
+		t.Fatalf("Client disconnected from a legacy server")
+	case <-time.After(10 * testHeartbeatInterval):
+	}
+
+	client.ssntp.Close()
+}
+
+// Test SSNTP heartbeats negotiation.
+//
+// Test that heartbeats are only enabled with peers advertising
+// at least SSNTP 1.2, whatever the flags set on the minor version.
+//
+// Test is expected to pass.
+func TestNegotiateHeartbeat(t *testing.T) {
+	h := heartbeat{interval: testHeartbeatInterval, misses: 3}
+
+	if negotiateHeartbeat(h, heartbeatMinor-1).enabled() {
+		t.Fatalf("Heartbeats enabled with a legacy peer")
+	}
+
+	if negotiateHeartbeat(h, legacyMinor).enabled() {
+		t.Fatalf("Heartbeats enabled with a gob peer")
+	}
+
+	if negotiateHeartbeat(h, heartbeatMinor) != h {
+		t.Fatalf("Heartbeats not negotiated")
+	}
+
+	if negotiateHeartbeat(h, minor|^uint8(minorMask)) != h {
+		t.Fatalf("Heartbeats not negotiated with minor flags set")
+	}
+}
+
+func testCommandAndWait(t *testing.T, requestReply string) (*Frame, error) {
+	var server ssntpEchoServer
+	var client ssntpClient
+
+	server.t = t
+	server.requestReply = requestReply
+	client.t = t
+
+	serverConn, clientConn := net.Pipe()
+	pipeServer(&server, serverConn)
+	pipeClient(&client, clientConn)
+	pipeConnect(t, &server, &client)
+	defer client.ssntp.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	return client.ssntp.SendCommandAndWait(ctx, STOP, []byte("payload"))
+}
+
+// Test SSNTP acknowledged commands.
+//
+// Test that a client sending a command with SendCommandAndWait
+// gets the ACK status frame the server replied with.
+//
+// Test is expected to pass.
+func TestCommandAndWaitAck(t *testing.T) {
+	reply, err := testCommandAndWait(t, ACK.String())
+	if err != nil {
+		t.Fatalf("No reply to command: %s", err)
+	}
+
+	if reply.Type != STATUS || (Status)(reply.Operand) != ACK {
+		t.Fatalf("Expected ACK, got %s", reply)
+	}
+
+	if reply.RequestID == 0 {
+		t.Fatalf("Reply does not carry a request ID")
+	}
+}
+
+// Test SSNTP failed commands.
+//
+// Test that a client sending a command with SendCommandAndWait
+// gets the ERROR frame, and its payload, the server replied with.
+//
+// Test is expected to pass.
+func TestCommandAndWaitError(t *testing.T) {
+	reply, err := testCommandAndWait(t, StopFailure.String())
+	if err != nil {
+		t.Fatalf("No reply to command: %s", err)
+	}
+
+	if reply.Type != ERROR || (Error)(reply.Operand) != StopFailure {
+		t.Fatalf("Expected StopFailure, got %s", reply)
+	}
+
+	if string(reply.Payload) != "payload" {
+		t.Fatalf("Wrong error payload %s", reply.Payload)
+	}
+}
+
+// Test SSNTP unanswered commands.
+//
+// Test that SendCommandAndWait returns an error when the
+// command recipient does not reply in time.
+//
+// Test is expected to pass.
+func TestCommandAndWaitTimeout(t *testing.T) {
+	_, err := testCommandAndWait(t, "")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected a timeout, got %v", err)
+	}
+}
+
+// Test SSNTP commands interrupted by a disconnection.
+//
+// Test that SendCommandAndWait returns as soon as the connection
+// to the server is lost.
+//
+// Test is expected to pass.
+func TestCommandAndWaitDisconnect(t *testing.T) {
+	var server ssntpEchoServer
+	var client ssntpClient
+
+	server.t = t
+	client.t = t
+
+	serverConn, clientConn := net.Pipe()
+	pipeServer(&server, serverConn)
+	pipeClient(&client, clientConn)
+	pipeConnect(t, &server, &client)
+	defer client.ssntp.Close()
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		serverConn.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := client.ssntp.SendCommandAndWait(ctx, STOP, nil)
+	if err == nil || err == context.DeadlineExceeded {
+		t.Fatalf("Expected a connection error, got %v", err)
+	}
+}
+
+// Test SSNTP server acknowledged commands.
+//
+// Test that a server sending a command to a client with
+// SendCommandAndWait gets the ACK status frame the client
+// replied with.
+//
+// Test is expected to pass.
+func TestServerCommandAndWait(t *testing.T) {
+	var server ssntpEchoServer
+	var client ssntpClient
+
+	server.t = t
+	client.t = t
+
+	serverConn, clientConn := net.Pipe()
+	pipeServer(&server, serverConn)
+	pipeClient(&client, clientConn)
+	pipeConnect(t, &server, &client)
+	defer client.ssntp.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	reply, err := server.ssntp.SendCommandAndWait(ctx, client.ssntp.uuid.String(), RESTART, nil)
+	if err != nil {
+		t.Fatalf("No reply to command: %s", err)
+	}
+
+	if reply.Type != STATUS || (Status)(reply.Operand) != ACK {
+		t.Fatalf("Expected ACK, got %s", reply)
+	}
+}
+
+// Test SSNTP binary framing of regular frames.
+//
+// Test that a traced frame carrying a request ID is identical
+// once encoded and decoded with the binary codec.
+//
+// Test is expected to pass.
+func TestBinaryCodecFrame(t *testing.T) {
+	var buf bytes.Buffer
+	var decoded Frame
+
+	now := time.Now()
+	frame := Frame{
+		Major:         major | pathTraceEnabled,
+		Minor:         minor,
+		Type:          COMMAND,
+		Operand:       (uint8)(START),
+		RequestID:     newRequestID(),
+		PayloadLength: 4,
+		Payload:       []byte("ciao"),
+		Trace: &FrameTrace{
+			Label:          []byte("label"),
+			StartTimestamp: now,
+			PathLength:     1,
+			Path: []Node{
+				{
+					UUID:        []byte(uuid.Generate().String()[:16]),
+					Role:        (uint32)(AGENT),
+					TxTimestamp: now,
+				},
+			},
+		},
+	}
+
+	codec := newBinaryCodec(bufio.NewReader(&buf), &buf)
+	if err := codec.encode(&frame); err != nil {
+		t.Fatalf("Could not encode frame: %s", err)
+	}
+
+	if err := codec.decode(&decoded); err != nil {
+		t.Fatalf("Could not decode frame: %s", err)
+	}
+
+	if decoded.Major != frame.Major || decoded.Minor != frame.Minor ||
+		decoded.Type != frame.Type || decoded.Operand != frame.Operand ||
+		decoded.RequestID != frame.RequestID ||
+		bytes.Equal(decoded.Payload, frame.Payload) == false {
+		t.Fatalf("Frame mismatch: %s vs %s", decoded, frame)
+	}
+
+	trace := decoded.Trace
+	if trace == nil || bytes.Equal(trace.Label, frame.Trace.Label) == false ||
+		trace.StartTimestamp.Equal(now) == false || trace.EndTimestamp.IsZero() == false ||
+		trace.PathLength != 1 || len(trace.Path) != 1 {
+		t.Fatalf("Trace mismatch: %v", trace)
+	}
+
+	node := trace.Path[0]
+	if bytes.Equal(node.UUID, frame.Trace.Path[0].UUID) == false ||
+		node.Role != (uint32)(AGENT) || node.TxTimestamp.Equal(now) == false ||
+		node.RxTimestamp.IsZero() == false {
+		t.Fatalf("Path node mismatch: %v", node)
+	}
+}
+
+// Test SSNTP binary framing of compressed payloads.
+//
+// Test that a compressible payload is sent gzip compressed, and that
+// it is identical once decoded.
+//
+// Test is expected to pass.
+func TestBinaryCodecCompression(t *testing.T) {
+	var buf bytes.Buffer
+	var decoded Frame
+
+	payload := []byte(strings.Repeat("ciao ", 1024))
+	frame := Frame{
+		Major:         major,
+		Minor:         minor,
+		Type:          COMMAND,
+		Operand:       (uint8)(START),
+		PayloadLength: (uint32)(len(payload)),
+		Payload:       payload,
+	}
+
+	codec := newBinaryCodec(bufio.NewReader(&buf), &buf)
+	codec.payload = &payloadConfig{compression: GzipCompression}
+	if err := codec.encode(&frame); err != nil {
+		t.Fatalf("Could not encode frame: %s", err)
+	}
+
+	if buf.Len() >= len(payload) {
+		t.Fatalf("Payload not compressed, %d encoded bytes", buf.Len())
+	}
+
+	if (Compression)(buf.Bytes()[1]>>compressionShift) != GzipCompression {
+		t.Fatalf("Compression not flagged")
+	}
+
+	if err := codec.decode(&decoded); err != nil {
+		t.Fatalf("Could not decode frame: %s", err)
+	}
+
+	if decoded.Minor != minor || decoded.PayloadLength != frame.PayloadLength ||
+		bytes.Equal(decoded.Payload, payload) == false {
+		t.Fatalf("Frame mismatch: %s vs %s", decoded, frame)
+	}
+}
+
+// Test SSNTP binary framing of oversized payloads.
+//
+// Test that frames whose payload, compressed or not, is larger than
+// the maximum payload size fail to be decoded with their header fields
+// set, and that the following frame can still be decoded.
+//
+// Test is expected to pass.
+func TestBinaryCodecPayloadTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+
+	payload := []byte(strings.Repeat("ciao ", 1024))
+	frames := []Frame{
+		{
+			Type:      COMMAND,
+			Operand:   (uint8)(START),
+			RequestID: newRequestID(),
+			Payload:   payload,
+		},
+		{
+			Type:    STATUS,
+			Operand: (uint8)(READY),
+			Payload: []byte("ciao"),
+		},
+	}
+
+	encoder := newBinaryCodec(nil, &buf)
+	decoder := newBinaryCodec(bufio.NewReader(&buf), nil)
+	decoder.payload = &payloadConfig{maxSize: 1024}
+
+	for _, compression := range []Compression{NoCompression, GzipCompression} {
+		var decoded Frame
+
+		encoder.payload = &payloadConfig{compression: compression}
+		for i := range frames {
+			if err := encoder.encode(&frames[i]); err != nil {
+				t.Fatalf("Could not encode frame: %s", err)
+			}
+		}
+
+		err := decoder.decode(&decoded)
+		if _, ok := err.(payloadTooLargeError); !ok {
+			t.Fatalf("Oversized %s payload decoded: %v", compression, err)
+		}
+
+		if decoded.Type != COMMAND || decoded.Operand != (uint8)(START) ||
+			decoded.RequestID != frames[0].RequestID {
+			t.Fatalf("Header mismatch: %s", decoded)
+		}
+
+		if err := decoder.decode(&decoded); err != nil {
+			t.Fatalf("Could not decode frame: %s", err)
+		}
+
+		if decoded.Type != STATUS || bytes.Equal(decoded.Payload, frames[1].Payload) == false {
+			t.Fatalf("Frame mismatch: %s", decoded)
+		}
+	}
+
+	if err := decoder.encode(&frames[0]); err == nil {
+		t.Fatalf("Oversized payload encoded")
+	}
+}
+
+// Test SSNTP binary framing of oversized traces.
+//
+// Test that a frame whose trace is larger than the maximum payload
+// size is rejected before its trace is allocated, and that the next
+// frame can still be decoded.
+//
+// Test is expected to pass.
+func TestBinaryCodecTraceTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	var decoded Frame
+
+	frames := []Frame{
+		{
+			Major:     major | pathTraceEnabled,
+			Type:      COMMAND,
+			Operand:   (uint8)(START),
+			RequestID: newRequestID(),
+			Payload:   []byte("ciao"),
+			Trace: &FrameTrace{
+				Label:          []byte(strings.Repeat("ciao ", 1024)),
+				StartTimestamp: time.Now(),
+			},
+		},
+		{
+			Type:    STATUS,
+			Operand: (uint8)(READY),
+			Payload: []byte("ciao"),
+		},
+	}
+
+	encoder := newBinaryCodec(nil, &buf)
+	decoder := newBinaryCodec(bufio.NewReader(&buf), nil)
+	decoder.payload = &payloadConfig{maxSize: 1024}
+
+	for i := range frames {
+		if err := encoder.encode(&frames[i]); err != nil {
+			t.Fatalf("Could not encode frame: %s", err)
+		}
+	}
+
+	err := decoder.decode(&decoded)
+	if _, ok := err.(payloadTooLargeError); !ok {
+		t.Fatalf("Oversized trace decoded: %v", err)
+	}
+
+	if decoded.RequestID != frames[0].RequestID || decoded.Trace != nil {
+		t.Fatalf("Header mismatch: %s", decoded)
+	}
+
+	if err := decoder.decode(&decoded); err != nil {
+		t.Fatalf("Could not decode frame: %s", err)
+	}
+
+	if decoded.Type != STATUS || bytes.Equal(decoded.Payload, frames[1].Payload) == false {
+		t.Fatalf("Frame mismatch: %s", decoded)
+	}
+}
+
+// Test SSNTP legacy framing of oversized payloads.
+//
+// Test that a gob encoded frame whose payload is larger than the
+// maximum payload size is rejected once decoded, that the next
+// frame can still be decoded, and that sending it fails.
+//
+// Test is expected to pass.
+func TestGobCodecPayloadTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	var decoded Frame
+
+	frames := []Frame{
+		{
+			Type:      COMMAND,
+			Operand:   (uint8)(START),
+			RequestID: newRequestID(),
+			Payload:   []byte(strings.Repeat("ciao ", 1024)),
+		},
+		{
+			Type:    STATUS,
+			Operand: (uint8)(READY),
+			Payload: []byte("ciao"),
+		},
+	}
+
+	encoder := newGobCodec(nil, &buf)
+	decoder := newGobCodec(&buf, nil)
+	decoder.payload = &payloadConfig{maxSize: 1024}
+
+	for i := range frames {
+		if err := encoder.encode(&frames[i]); err != nil {
+			t.Fatalf("Could not encode frame: %s", err)
+		}
+	}
+
+	err := decoder.decode(&decoded)
+	if _, ok := err.(payloadTooLargeError); !ok {
+		t.Fatalf("Oversized payload decoded: %v", err)
+	}
+
+	if decoded.RequestID != frames[0].RequestID || decoded.Payload != nil {
+		t.Fatalf("Header mismatch: %s", decoded)
+	}
+
+	decoded = Frame{}
+	if err := decoder.decode(&decoded); err != nil {
+		t.Fatalf("Could not decode frame: %s", err)
+	}
+
+	if decoded.Type != STATUS || bytes.Equal(decoded.Payload, frames[1].Payload) == false {
+		t.Fatalf("Frame mismatch: %s", decoded)
+	}
+
+	encoder.payload = decoder.payload
+	if err := encoder.encode(&frames[0]); err == nil {
+		t.Fatalf("Oversized payload encoded")
+	}
+}
+
+// Test SSNTP binary framing of the connection frames.
+//
+// Test that CONNECT and CONNECTED frames are identical once
+// encoded and decoded with the binary codec.
+//
+// Test is expected to pass.
+func TestBinaryCodecConnect(t *testing.T) {
+	var buf bytes.Buffer
+	var connect ConnectFrame
+	var connected ConnectedFrame
+
+	src := uuid.Generate()
+	dest := uuid.Generate()
+	session := newSession(&src, (uint32)(AGENT), (uint32)(SERVER), nil)
+	session.setDest(dest[:])
+
+	codec := newBinaryCodec(bufio.NewReader(&buf), &buf)
+	if err := codec.encode(session.connectFrame()); err != nil {
+		t.Fatalf("Could not encode CONNECT: %s", err)
+	}
+
+	if err := codec.decode(&connect); err != nil {
+		t.Fatalf("Could not decode CONNECT: %s", err)
+	}
+
+	if connect.Major != major || connect.Role != (uint32)(AGENT) ||
+		bytes.Equal(connect.Source, src[:]) == false ||
+		bytes.Equal(connect.Destination, dest[:]) == false {
+		t.Fatalf("CONNECT mismatch: %s", connect)
+	}
+
+	if err := codec.encode(session.connectedFrame((uint32)(SERVER), []byte("configuration"))); err != nil {
+		t.Fatalf("Could not encode CONNECTED: %s", err)
+	}
+
+	if err := codec.decode(&connected); err != nil {
+		t.Fatalf("Could not decode CONNECTED: %s", err)
+	}
+
+	if connected.Type != STATUS || connected.Operand != (uint8)(CONNECTED) ||
+		connected.Role != (uint32)(SERVER) ||
+		bytes.Equal(connected.Source, src[:]) == false ||
+		string(connected.Payload) != "configuration" {
+		t.Fatalf("CONNECTED mismatch: %s", connected)
+	}
+}
+
+// Test SSNTP binary framing of a legacy server reply.
+//
+// Test that decoding a gob encoded CONNECTED frame with the
+// binary codec tells the client it is talking to a legacy server.
+//
+// Test is expected to pass.
+func TestBinaryCodecLegacyServer(t *testing.T) {
+	var buf bytes.Buffer
+	var connected ConnectedFrame
+
+	src := uuid.Generate()
+	session := newSession(&src, (uint32)(SERVER), (uint32)(AGENT), nil)
+	session.useGob()
+
+	if err := newGobCodec(&buf, &buf).encode(session.connectedFrame((uint32)(SERVER), nil)); err != nil {
+		t.Fatalf("Could not encode CONNECTED: %s", err)
+	}
+
+	err := newBinaryCodec(bufio.NewReader(&buf), &buf).decode(&connected)
+	if err != errLegacyFraming {
+		t.Fatalf("Expected a legacy framing error, got %v", err)
+	}
+}
+
+// Test SSNTP legacy gob clients.
+//
+// Test that a server accepts a client speaking the legacy gob
+// encoded framing, and that both can exchange frames.
+//
+// Test is expected to pass.
+func TestLegacyClient(t *testing.T) {
+	var server ssntpEchoServer
+	var client ssntpClient
+
+	server.t = t
+	client.t = t
+
+	serverConn, clientConn := net.Pipe()
+	pipeServer(&server, serverConn)
+	pipeClient(&client, clientConn)
+	client.ssntp.session.useGob()
+	pipeConnect(t, &server, &client)
+	defer client.ssntp.Close()
+
+	session := server.ssntp.getSession(client.ssntp.uuid.String())
+	if session == nil || session.major != legacyMajor {
+		t.Fatalf("Client session is not a legacy one")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	reply, err := server.ssntp.SendCommandAndWait(ctx, client.ssntp.uuid.String(), RESTART, nil)
+	if err != nil {
+		t.Fatalf("No reply to command: %s", err)
+	}
+
+	if reply.Type != STATUS || (Status)(reply.Operand) != ACK {
+		t.Fatalf("Expected ACK, got %s", reply)
+	}
+}
+
+// Test SSNTP major version mismatch.
+//
+// Test that a server rejects a CONNECT frame with an unsupported
+// SSNTP major version, with a ConnectionFailure error frame that
+// describes the supported versions.
+//
+// Test is expected to pass.
+func TestUnsupportedVersion(t *testing.T) {
+	var server ssntpEchoServer
+	var failure payloads.ErrorConnectionFailure
+	var reply ConnectedFrame
+
+	server.t = t
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	pipeServer(&server, serverConn)
+
+	src := uuid.Generate()
+	connect := appendHeader(nil, major+1, minor, COMMAND, (uint8)(CONNECT), (uint32)(AGENT))
+	connect = appendUUID(connect, src[:])
+	connect = appendUUID(connect, src[:])
+
+	go clientConn.Write(connect)
+
+	err := newBinaryCodec(bufio.NewReader(clientConn), clientConn).decode(&reply)
+	if err != nil {
+		t.Fatalf("Could not read the CONNECT reply: %s", err)
+	}
+
+	if reply.Type != ERROR || reply.Operand != (uint8)(ConnectionFailure) {
+		t.Fatalf("Expected a ConnectionFailure, got %s", reply)
+	}
+
+	err = yaml.Unmarshal(reply.Payload, &failure)
+	if err != nil {
+		t.Fatalf("Invalid ConnectionFailure payload: %s", err)
+	}
+
+	expected := fmt.Sprintf("%d.%d", major+1, minor)
+	if failure.Reason != payloads.UnsupportedVersion || failure.Version != expected ||
+		len(failure.SupportedVersions) == 0 {
+		t.Fatalf("Unexpected ConnectionFailure payload: %v", failure)
+	}
+}
+
+// Test SSNTP client major version mismatch.
+//
+// Test that a client connecting with an SSNTP major version the
+// server does not support gets a non recoverable error.
+//
+// Test is expected to pass.
+func TestClientUnsupportedVersion(t *testing.T) {
+	var server ssntpEchoServer
+	var client ssntpClient
+
+	server.t = t
+	client.t = t
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	pipeServer(&server, serverConn)
+	pipeClient(&client, clientConn)
+	client.ssntp.session.useGob()
+	client.ssntp.session.major = legacyMajor + 2
+
+	reconnect, err := client.ssntp.sendConnect()
+	if err == nil {
+		t.Fatalf("Client connected with an unsupported version")
+	}
+
+	if reconnect == true {
+		t.Fatalf("Client would reconnect with an unsupported version")
+	}
+}
+
+// replayPipe returns a session writing to one end of a net.Pipe, and
+// a channel receiving the frames read from the other end.
+func replayPipe(t *testing.T) (*session, chan *Frame) {
+	frames := make(chan *Frame, 16)
+	src := uuid.Generate()
+	local, remote := net.Pipe()
+
+	peer := newSession(&src, (uint32)(SERVER), (uint32)(AGENT), remote)
+	go func() {
+		for {
+			var frame Frame
+			if err := peer.Read(&frame); err != nil {
+				close(frames)
+				return
+			}
+			frames <- &frame
+		}
+	}()
+
+	return newSession(&src, (uint32)(AGENT), (uint32)(SERVER), local), frames
+}
+
+func expectSequences(t *testing.T, frames chan *Frame, sequences ...uint64) {
+	for _, sequence := range sequences {
+		select {
+		case f := <-frames:
+			if f.Sequence != sequence {
+				t.Fatalf("Expected frame %d, got %d", sequence, f.Sequence)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Did not receive frame %d", sequence)
+		}
+	}
+}
+
+// Test SSNTP replay buffer.
+//
+// Test that EVENT and ERROR frames are numbered and buffered, that
+// acknowledged frames are dropped from the buffer, and that resuming
+// sends all unacknowledged frames again and reports the ones that
+// were dropped because the buffer was full.
+//
+// Test is expected to pass.
+func TestReplayBuffer(t *testing.T) {
+	session, frames := replayPipe(t)
+	defer session.conn.Close()
+
+	session.replay = newReplay(3)
+
+	session.Write(session.statusFrame(READY, nil, nil))
+	expectSequences(t, frames, 0)
+
+	for i := 0; i < 4; i++ {
+		session.Write(session.eventFrame(TenantAdded, nil, nil))
+	}
+	session.Write(session.errorFrame(StartFailure, nil, nil))
+	expectSequences(t, frames, 1, 2, 3, 4, 5)
+
+	session.replay.acknowledge(4)
+
+	replayed, lost, err := session.replay.resume(session, 1)
+	if err != nil {
+		t.Fatalf("Could not resume: %s", err)
+	}
+
+	if replayed != 1 || lost != 1 {
+		t.Fatalf("Expected 1 replayed and 1 lost frames, got %d and %d", replayed, lost)
+	}
+	expectSequences(t, frames, 5)
+}
+
+// Test SSNTP frames replay after a reconnection.
+//
+// Test that the EVENT frames a client sends while disconnected from
+// its server are sent to the server once the client reconnects, and
+// that the frames the server already got are not sent again.
+//
+// Test is expected to pass.
+func TestReplayReconnect(t *testing.T) {
+	var server ssntpEchoServer
+	var client ssntpClient
+
+	server.t = t
+	server.roleDisconnectChannel = make(chan string, 1)
+	server.evtChannel = make(chan string, 8)
+	client.t = t
+
+	serverConn, clientConn := net.Pipe()
+	pipeServer(&server, serverConn)
+	pipeClient(&client, clientConn)
+	if _, err := client.ssntp.sendConnect(); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	<-server.roleConnectChannel
+
+	expectEvents := func(events ...string) {
+		for _, event := range events {
+			select {
+			case e := <-server.evtChannel:
+				if e != event {
+					t.Fatalf("Expected event %s, got %s", event, e)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Did not receive event %s", event)
+			}
+		}
+	}
+
+	client.ssntp.SendEvent(TenantAdded, []byte("1"))
+	expectEvents("1")
+
+	clientConn.Close()
+	<-server.roleDisconnectChannel
+
+	client.ssntp.SendEvent(TenantAdded, []byte("2"))
+	client.ssntp.SendEvent(TenantRemoved, []byte("3"))
+
+	serverConn, clientConn = net.Pipe()
+	defer clientConn.Close()
+	server.ssntp.clientWg.Add(1)
+	go handleSSNTPClient(&server.ssntp, serverConn)
+	pipeSession(&client, clientConn)
+
+	if _, err := client.ssntp.sendConnect(); err != nil {
+		t.Fatalf("Failed to reconnect: %s", err)
+	}
+
+	expectEvents("2", "3")
+
+	select {
+	case e := <-server.evtChannel:
+		t.Fatalf("Unexpected event %s", e)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+// Test SSNTP replay buffer expiry.
+//
+// Test that a server drops the replay buffer of a client which did
+// not reconnect within the replay timeout.
+//
+// Test is expected to pass.
+func TestReplayExpiry(t *testing.T) {
+	var server ssntpEchoServer
+	var client ssntpClient
+
+	server.t = t
+	server.roleDisconnectChannel = make(chan string, 1)
+	client.t = t
+
+	serverConn, clientConn := net.Pipe()
+	pipeServer(&server, serverConn)
+	server.ssntp.replayTimeout = 10 * time.Millisecond
+	pipeClient(&client, clientConn)
+	if _, err := client.ssntp.sendConnect(); err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	<-server.roleConnectChannel
+
+	clientConn.Close()
+	<-server.roleDisconnectChannel
+
+	for i := 0; ; i++ {
+		server.ssntp.sessionMutex.Lock()
+		_, found := server.ssntp.replays[client.ssntp.uuid.String()]
+		server.ssntp.sessionMutex.Unlock()
+
+		if !found {
+			break
+		}
+
+		if i == 100 {
+			t.Fatal("Replay buffer did not expire")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Test SSNTP frames acknowledgement.
+//
+// Test that heartbeats acknowledge the EVENT frames a client and a
+// server exchanged, so that they are no longer buffered for replay.
+//
+// Test is expected to pass.
+func TestReplayAcknowledge(t *testing.T) {
+	var server ssntpEchoServer
+	var client ssntpClient
+
+	server.t = t
+	client.t = t
+	client.payload = []byte("ack")
+	client.evtChannel = make(chan string)
+
+	serverConn, clientConn := net.Pipe()
+	pipeServer(&server, serverConn)
+	pipeClient(&client, clientConn)
+	pipeConnect(t, &server, &client)
+	defer client.ssntp.Close()
+
+	client.ssntp.SendEvent(TenantAdded, client.payload)
+
+	select {
+	case <-client.evtChannel:
+	case <-time.After(time.Second):
+		t.Fatalf("Did not receive the echoed event")
+	}
+
+	buffered := func(r *replay) int {
+		r.Lock()
+		defer r.Unlock()
+		return len(r.frames)
+	}
+
+	serverReplay := server.ssntp.getReplay(client.ssntp.uuid.String())
+	for i := 0; i < 10; i++ {
+		if buffered(client.ssntp.replay) == 0 && buffered(serverReplay) == 0 {
+			return
+		}
+		time.Sleep(testHeartbeatInterval)
+	}
+
+	t.Fatalf("Frames were not acknowledged")
+}
+
+// Test SSNTP in-process transport.
+//
+// Test that an SSNTP client and server sharing a MemoryTransport can
+// connect and exchange frames without any certificate, even with
+// role verification enabled.
+//
+// Test is expected to pass.
+func TestMemoryTransport(t *testing.T) {
+	var server ssntpEchoServer
+	var client ssntpClient
+
+	transport := NewMemoryTransport()
+	serverConfig := Config{
+		Role:             SERVER,
+		CAcert:           "/nonexistent/CAcert",
+		Cert:             "/nonexistent/Cert",
+		RoleVerification: true,
+		CustomTransport:  transport,
+	}
+	clientConfig := Config{
+		Role:             AGENT,
+		CAcert:           "/nonexistent/CAcert",
+		Cert:             "/nonexistent/Cert",
+		RoleVerification: true,
+		CustomTransport:  transport,
+	}
+
+	server.t = t
+	server.roleConnectChannel = make(chan string, 1)
+	client.t = t
+	client.cmdChannel = make(chan string)
+
+	go server.ssntp.Serve(&serverConfig, &server)
+	time.Sleep(100 * time.Millisecond)
+	err := client.ssntp.Dial(&clientConfig, &client)
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+
+	defer func() {
+		client.ssntp.Close()
+		server.ssntp.Stop()
+	}()
+
+	agentRole := (Role)(AGENT)
+	select {
+	case role := <-server.roleConnectChannel:
+		if role != agentRole.String() {
+			t.Fatalf("Wrong client role %s", role)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Did not receive the connection notification")
+	}
+
+	client.payload = []byte("memory")
+	client.ssntp.SendCommand(START, client.payload)
+
+	select {
+	case cmd := <-client.cmdChannel:
+		if cmd != START.String() {
+			t.Fatalf("Wrong command %s", cmd)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Did not receive the echoed command")
+	}
+}
+
+// Test SSNTP in-process transport addressing.
+//
+// Test that dialing an address nobody listens on fails, that two
+// listeners can not share an address, that host less listeners accept
+// connections to any host, and that a closed listener frees its
+// address and no longer accepts connections.
+//
+// Test is expected to pass.
+func TestMemoryTransportAddress(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	if _, err := transport.Dial("server:8888"); err == nil {
+		t.Fatalf("Connected to a non existing server")
+	}
+
+	listener, err := transport.Listen("server:8888")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+
+	if _, err := transport.Listen("server:8888"); err == nil {
+		t.Fatalf("Two listeners share the same address")
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	conn, err := transport.Dial("server:8888")
+	if err != nil {
+		t.Fatalf("Could not connect: %s", err)
+	}
+	conn.Close()
+
+	if _, err := transport.Dial("localhost:8888"); err == nil {
+		t.Fatalf("Connected to the wrong host")
+	}
+
+	wildcard, err := transport.Listen(":8889")
+	if err != nil {
+		t.Fatalf("Could not listen on all hosts: %s", err)
+	}
+
+	go func() {
+		conn, err := wildcard.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err = transport.Dial("localhost:8889")
+	if err != nil {
+		t.Fatalf("Could not connect to a host less listener: %s", err)
+	}
+	conn.Close()
+	wildcard.Close()
+
+	listener.Close()
+
+	if _, err := listener.Accept(); err == nil {
+		t.Fatalf("Closed listener accepted a connection")
+	}
+
+	if _, err := transport.Dial("server:8888"); err == nil {
+		t.Fatalf("Connected to a closed listener")
+	}
+
+	relistener, err := transport.Listen("server:8888")
+	if err != nil {
+		t.Fatalf("Could not listen again: %s", err)
+	}
+	relistener.Close()
+}
+
+// Test SSNTP frame authorization rules.
+//
+// Test that frames are authorized according to the rules matching any
+// of the client roles, that protocol frames are always authorized and
+// that all frames are authorized without rules.
+//
+// Test is expected to pass.
+func TestFrameAuthorizationRules(t *testing.T) {
+	var none, auth frameAuthorization
+
+	none.init(nil)
+	auth.init([]FrameAuthorizationRule{
+		{
+			Role:     AGENT,
+			Commands: []Command{STATS},
+			Statuses: []Status{READY},
+			Events:   []Event{InstanceDeleted},
+			Errors:   []Error{StartFailure},
+		},
+		{
+			Role:   NETAGENT,
+			Events: []Event{ConcentratorInstanceAdded},
+		},
+		{
+			Role:     Controller,
+			Commands: []Command{START, STOP},
+		},
+	})
+
+	var authorizationTests = []struct {
+		role       uint32
+		operand    interface{}
+		authorized bool
+	}{
+		{AGENT, STATS, true},
+		{AGENT, OFFLINE, false},
+		{AGENT, START, false},
+		{AGENT, READY, true},
+		{AGENT, StartFailure, true},
+		{AGENT, InstanceDeleted, true},
+		{AGENT, ConcentratorInstanceAdded, false},
+		{AGENT | NETAGENT, ConcentratorInstanceAdded, true},
+		{AGENT | NETAGENT, STATS, true},
+		{Controller, START, true},
+		{Controller, STATS, false},
+		{SCHEDULER, STATS, false},
+		{SCHEDULER, PING, true},
+		{SCHEDULER, PONG, true},
+		{SCHEDULER, ACK, true},
+	}
+
+	for _, test := range authorizationTests {
+		role := (Role)(test.role)
+		if auth.authorized(test.role, test.operand) != test.authorized {
+			t.Errorf("%s authorization for %s should be %v", test.operand, role.String(), test.authorized)
+		}
+
+		if none.authorized(test.role, test.operand) == false {
+			t.Errorf("%s should be authorized for %s without rules", test.operand, role.String())
+		}
+	}
+}
+
+// Test SSNTP frame authorization enforcement.
+//
+// Test that a server with frame authorization rules answers frames the
+// client role is not allowed to send with an UnauthorizedFrame error,
+// without notifying them, and still accepts the authorized ones.
+//
+// Test is expected to pass.
+func TestFrameAuthorization(t *testing.T) {
+	var server ssntpEchoServer
+	var client ssntpClient
+
+	transport := NewMemoryTransport()
+	serverConfig := Config{
+		Role:            SERVER,
+		CustomTransport: transport,
+		AuthorizationRules: []FrameAuthorizationRule{
+			{
+				Role:     AGENT,
+				Commands: []Command{STATS},
+			},
+		},
+	}
+	clientConfig := Config{
+		Role:            AGENT,
+		CustomTransport: transport,
+	}
+
+	unauthorized := payloads.ErrorUnauthorizedFrame{
+		Type:    COMMAND.String(),
+		Operand: START.String(),
+		Role:    "CNAgent",
+	}
+
+	var err error
+	server.t = t
+	client.t = t
+	client.cmdChannel = make(chan string)
+	client.errChannel = make(chan string)
+	client.payload, err = yaml.Marshal(&unauthorized)
+	if err != nil {
+		t.Fatalf("Could not marshal payload: %s", err)
+	}
+
+	go server.ssntp.Serve(&serverConfig, &server)
+	time.Sleep(100 * time.Millisecond)
+	err = client.ssntp.Dial(&clientConfig, &client)
+	if err != nil {
+		server.ssntp.Stop()
+		t.Fatalf("Failed to connect: %s", err)
+	}
+
+	defer func() {
+		client.ssntp.Close()
+		server.ssntp.Stop()
+	}()
+
+	client.ssntp.SendCommand(START, client.payload)
+
+	select {
+	case e := <-client.errChannel:
+		if e != UnauthorizedFrame.String() {
+			t.Fatalf("Wrong error %s", e)
+		}
+	case cmd := <-client.cmdChannel:
+		t.Fatalf("Unauthorized %s command was accepted", cmd)
+	case <-time.After(time.Second):
+		t.Fatalf("Unauthorized command was not rejected")
+	}
+
+	client.ssntp.SendCommand(STATS, client.payload)
+
+	select {
+	case cmd := <-client.cmdChannel:
+		if cmd != STATS.String() {
+			t.Fatalf("Wrong command %s", cmd)
+		}
+	case e := <-client.errChannel:
+		t.Fatalf("Authorized command was rejected: %s", e)
+	case <-time.After(time.Second):
+		t.Fatalf("Did not receive the echoed command")
+	}
+}
+
+func findFrameCounter(counters []FrameCounter, frameType Type, operand fmt.Stringer) *FrameCounter {
+	for i := range counters {
+		if counters[i].Type == frameType.String() && counters[i].Operand == operand.String() {
+			return &counters[i]
+		}
+	}
+
+	return nil
+}
+
+// Test SSNTP frame statistics.
+//
+// Test that a client sending a traced STATS command to an echo server
+// and receiving it back accounts for the sent and received frames and
+// their size, and that the server exports the client session counters,
+// including the traced frame latency.
+//
+// Test is expected to pass.
+func TestStats(t *testing.T) {
+	var server ssntpEchoServer
+	var client ssntpClient
+
+	transport := NewMemoryTransport()
+	serverConfig := Config{
+		Role:            SERVER,
+		CustomTransport: transport,
+	}
+	clientConfig := Config{
+		Role:            AGENT,
+		CustomTransport: transport,
+	}
+
+	server.t = t
+	client.t = t
+	client.cmdChannel = make(chan string)
+	client.payload = []byte{'s', 't', 'a', 't', 's'}
+
+	go server.ssntp.Serve(&serverConfig, &server)
+	time.Sleep(100 * time.Millisecond)
+	err := client.ssntp.Dial(&clientConfig, &client)
+	if err != nil {
+		server.ssntp.Stop()
+		t.Fatalf("Failed to connect: %s", err)
+	}
+
+	defer func() {
+		client.ssntp.Close()
+		server.ssntp.Stop()
+	}()
+
+	client.ssntp.SendTracedCommand(STATS, client.payload, &TraceConfig{PathTrace: true})
+
+	select {
+	case <-client.cmdChannel:
+	case <-time.After(time.Second):
+		t.Fatalf("Did not receive the echoed command")
+	}
+
+	stats := client.ssntp.Stats()
+	sent := findFrameCounter(stats.Sent, COMMAND, STATS)
+	if sent == nil || sent.Frames != 1 || sent.Bytes <= uint64(len(client.payload)) {
+		t.Fatalf("Wrong sent STATS counter %v", sent)
+	}
+
+	received := findFrameCounter(stats.Received, COMMAND, STATS)
+	if received == nil || received.Frames != 1 || received.Bytes <= uint64(len(client.payload)) {
+		t.Fatalf("Wrong received STATS counter %v", received)
+	}
+
+	if findFrameCounter(stats.Received, STATUS, CONNECTED) == nil {
+		t.Fatalf("CONNECTED frame not accounted for")
+	}
+
+	sessions := server.ssntp.SessionStats()
+	if len(sessions) != 1 {
+		t.Fatalf("Wrong number of sessions %d", len(sessions))
+	}
+
+	if sessions[0].UUID != client.ssntp.UUID() || sessions[0].Role != "CNAgent" {
+		t.Fatalf("Wrong session %s %s", sessions[0].UUID, sessions[0].Role)
+	}
+
+	received = findFrameCounter(sessions[0].Received, COMMAND, STATS)
+	if received == nil || received.Frames != 1 {
+		t.Fatalf("Wrong session STATS counter %v", received)
+	}
+
+	stats = sessions[0].Stats
+	if stats.TracedFrames != 1 || stats.MaxLatency <= 0 || stats.AverageLatency != stats.MaxLatency {
+		t.Fatalf("Wrong latency statistics %v", stats)
+	}
+
+	if findFrameCounter(server.ssntp.Stats().Received, COMMAND, CONNECT) == nil {
+		t.Fatalf("CONNECT frame not accounted for")
+	}
+}
+
+// Test SSNTP payload compression.
+//
+// Test that a client and a server configured for gzip compression
+// exchange a compressible STATS command compressed, by checking the
+// client traffic statistics.
+//
+// Test is expected to pass.
+func TestCompression(t *testing.T) {
+	var server ssntpEchoServer
+	var client ssntpClient
+
+	transport := NewMemoryTransport()
+	serverConfig := Config{
+		Role:            SERVER,
+		CustomTransport: transport,
+		Compression:     GzipCompression,
+	}
+	clientConfig := Config{
+		Role:            AGENT,
+		CustomTransport: transport,
+		Compression:     GzipCompression,
+	}
+
+	server.t = t
+	client.t = t
+	client.cmdChannel = make(chan string)
+	client.payload = []byte(strings.Repeat("ciao ", 1024))
+
+	go server.ssntp.Serve(&serverConfig, &server)
+	time.Sleep(100 * time.Millisecond)
+	err := client.ssntp.Dial(&clientConfig, &client)
+	if err != nil {
+		server.ssntp.Stop()
+		t.Fatalf("Failed to connect: %s", err)
+	}
+
+	defer func() {
+		client.ssntp.Close()
+		server.ssntp.Stop()
+	}()
+
+	client.ssntp.SendCommand(STATS, client.payload)
+
+	select {
+	case <-client.cmdChannel:
+	case <-time.After(time.Second):
+		t.Fatalf("Did not receive the echoed command")
+	}
+
+	stats := client.ssntp.Stats()
+	for _, counters := range [][]FrameCounter{stats.Sent, stats.Received} {
+		c := findFrameCounter(counters, COMMAND, STATS)
+		if c == nil || c.Frames != 1 || c.Bytes >= uint64(len(client.payload)) {
+			t.Fatalf("STATS payload not compressed: %v", c)
+		}
+	}
+}
+
+// Test SSNTP maximum payload size.
+//
+// Test that a server answers a frame whose payload is larger than its
+// maximum payload size with a PayloadTooLarge error, without notifying
+// it, and that the client session remains usable.
+//
+// Test is expected to pass.
+func TestPayloadTooLarge(t *testing.T) {
+	var server ssntpEchoServer
+	var client ssntpClient
+
+	transport := NewMemoryTransport()
+	serverConfig := Config{
+		Role:            SERVER,
+		CustomTransport: transport,
+		MaxPayloadSize:  1024,
+	}
+	clientConfig := Config{
+		Role:            AGENT,
+		CustomTransport: transport,
+	}
+
+	tooLarge := payloads.ErrorPayloadTooLarge{
+		Type:    COMMAND.String(),
+		Operand: START.String(),
+		MaxSize: serverConfig.MaxPayloadSize,
+	}
+
+	var err error
+	server.t = t
+	client.t = t
+	client.cmdChannel = make(chan string)
+	client.errChannel = make(chan string)
+	client.payload, err = yaml.Marshal(&tooLarge)
+	if err != nil {
+		t.Fatalf("Could not marshal payload: %s", err)
+	}
+
+	go server.ssntp.Serve(&serverConfig, &server)
+	time.Sleep(100 * time.Millisecond)
+	err = client.ssntp.Dial(&clientConfig, &client)
+	if err != nil {
+		server.ssntp.Stop()
+		t.Fatalf("Failed to connect: %s", err)
+	}
+
+	defer func() {
+		client.ssntp.Close()
+		server.ssntp.Stop()
+	}()
+
+	client.ssntp.SendCommand(START, make([]byte, 2*serverConfig.MaxPayloadSize))
+
+	select {
+	case e := <-client.errChannel:
+		if e != PayloadTooLarge.String() {
+			t.Fatalf("Wrong error %s", e)
+		}
+	case cmd := <-client.cmdChannel:
+		t.Fatalf("Oversized %s command was accepted", cmd)
+	case <-time.After(time.Second):
+		t.Fatalf("Oversized command was not rejected")
+	}
+
+	client.ssntp.SendCommand(STATS, client.payload)
+
+	select {
+	case cmd := <-client.cmdChannel:
+		if cmd != STATS.String() {
+			t.Fatalf("Wrong command %s", cmd)
+		}
+	case e := <-client.errChannel:
+		t.Fatalf("Command was rejected: %s", e)
+	case <-time.After(time.Second):
+		t.Fatalf("Did not receive the echoed command")
+	}
+}
+
+// testPKI is a throw away certification authority, issuing
+// certificates and revocation lists for the credentials tests.
+type testPKI struct {
+	t    *testing.T
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+	der  []byte
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate CA key: %s", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "SSNTP test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Could not create CA certificate: %s", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Could not parse CA certificate: %s", err)
+	}
+
+	return &testPKI{
+		t:    t,
+		key:  key,
+		cert: cert,
+		der:  der,
+	}
+}
+
+func (pki *testPKI) caPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pki.der})
+}
+
+// issue returns a PEM encoded certificate and private key, signed by
+// the CA and valid for localhost.
+func (pki *testPKI) issue(serial int64) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		pki.t.Fatalf("Could not generate key: %s", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "SSNTP test peer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, pki.cert, &key.PublicKey, pki.key)
+	if err != nil {
+		pki.t.Fatalf("Could not create certificate: %s", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		pki.t.Fatalf("Could not marshal key: %s", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	return append(certPEM, keyPEM...)
+}
+
+// crl returns a PEM encoded CRL revoking the serials certificates.
+func (pki *testPKI) crl(serials ...int64) []byte {
+	var revoked []pkix.RevokedCertificate
+
+	for _, serial := range serials {
+		revoked = append(revoked, pkix.RevokedCertificate{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now(),
+		})
+	}
+
+	der, err := pki.cert.CreateCRL(rand.Reader, pki.key, revoked, time.Now(), time.Now().Add(time.Hour))
+	if err != nil {
+		pki.t.Fatalf("Could not create CRL: %s", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+func writeTestFile(t *testing.T, dir, name string, data []byte) string {
+	filePath := path.Join(dir, name)
+
+	err := ioutil.WriteFile(filePath, data, 0600)
+	if err != nil {
+		t.Fatalf("Unable to write %s: %s", filePath, err)
+	}
+
+	return filePath
+}
+
+// Test SSNTP certificate revocation.
+//
+// Test that a client presenting a certificate listed in the server
+// CRL is sent a ConnectionAborted error and fails to connect.
+//
+// Test is expected to pass.
+func TestCRLRevokedClient(t *testing.T) {
+	var server ssntpEchoServer
+	var client ssntpClient
+
+	tmpDir, err := ioutil.TempDir("", "ssntp-test-crl")
+	if err != nil {
+		t.Fatalf("Unable to create temporary dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	pki := newTestPKI(t)
+	caPath := writeTestFile(t, tmpDir, "ca.crt", pki.caPEM())
+
+	serverConfig := Config{
+		Transport: *transport,
+		Role:      SERVER,
+		CAcert:    caPath,
+		Cert:      writeTestFile(t, tmpDir, "server.pem", pki.issue(2)),
+		CRL:       writeTestFile(t, tmpDir, "crl.pem", pki.crl(3)),
+	}
+	clientConfig := Config{
+		Transport: *transport,
+		Role:      AGENT,
+		UUID:      uuid.Generate().String(),
+		CAcert:    caPath,
+		Cert:      writeTestFile(t, tmpDir, "client.pem", pki.issue(3)),
+	}
+
+	server.t = t
+	client.t = t
+
+	go server.ssntp.Serve(&serverConfig, &server)
+	time.Sleep(500 * time.Millisecond)
+	defer server.ssntp.Stop()
+
+	err = client.ssntp.Dial(&clientConfig, &client)
+	if err == nil {
+		client.ssntp.Close()
+		t.Fatalf("Revoked client should not connect")
+	}
+
+	if strings.Contains(err.Error(), payloads.CertificateRevoked.String()) == false {
+		t.Fatalf("Unexpected connection error %s", err)
+	}
+}
+
+// Test SSNTP CRL reloading.
+//
+// Test that when the server CRL file is updated to revoke a connected
+// client certificate, that client is sent a ConnectionAborted error
+// carrying the revoked certificate serial number.
+//
+// Test is expected to pass.
+func TestCRLReload(t *testing.T) {
+	var server ssntpEchoServer
+	var client ssntpClient
+
+	tmpDir, err := ioutil.TempDir("", "ssntp-test-crl")
+	if err != nil {
+		t.Fatalf("Unable to create temporary dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	pki := newTestPKI(t)
+	caPath := writeTestFile(t, tmpDir, "ca.crt", pki.caPEM())
+
+	serverConfig := Config{
+		Transport:      *transport,
+		Role:           SERVER,
+		CAcert:         caPath,
+		Cert:           writeTestFile(t, tmpDir, "server.pem", pki.issue(2)),
+		CRL:            writeTestFile(t, tmpDir, "crl.pem", pki.crl()),
+		ReloadInterval: 100 * time.Millisecond,
+	}
+	clientConfig := Config{
+		Transport: *transport,
+		Role:      AGENT,
+		UUID:      uuid.Generate().String(),
+		CAcert:    caPath,
+		Cert:      writeTestFile(t, tmpDir, "client.pem", pki.issue(3)),
+	}
+
+	aborted := payloads.ErrorConnectionAborted{
+		Reason: payloads.CertificateRevoked,
+		Serial: "3",
+	}
+
+	server.t = t
+	client.t = t
+	client.errChannel = make(chan string, 1)
+	client.payload, err = yaml.Marshal(&aborted)
+	if err != nil {
+		t.Fatalf("Could not marshal payload: %s", err)
+	}
+
+	go server.ssntp.Serve(&serverConfig, &server)
+	time.Sleep(500 * time.Millisecond)
+
+	err = client.ssntp.Dial(&clientConfig, &client)
+	if err != nil {
+		server.ssntp.Stop()
+		t.Fatalf("Failed to connect: %s", err)
+	}
+
+	defer func() {
+		client.ssntp.Close()
+		server.ssntp.Stop()
+	}()
+
+	writeTestFile(t, tmpDir, "crl.pem", pki.crl(3))
+
+	select {
+	case e := <-client.errChannel:
+		if e != ConnectionAborted.String() {
+			t.Fatalf("Wrong error %s", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Revoked client connection was not aborted")
+	}
+}
+
+// Test SSNTP certificate rotation.
+//
+// Test that when the server CA and certificate files are replaced,
+// clients signed by the new CA can connect while the sessions
+// established with the previous credentials are kept.
+//
+// Test is expected to pass.
+func TestCertRotation(t *testing.T) {
+	var server ssntpEchoServer
+	var client1, client2 ssntpClient
+
+	tmpDir, err := ioutil.TempDir("", "ssntp-test-rotation")
+	if err != nil {
+		t.Fatalf("Unable to create temporary dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	oldPKI := newTestPKI(t)
+	newPKI := newTestPKI(t)
+
+	serverConfig := Config{
+		Transport:      *transport,
+		Role:           SERVER,
+		CAcert:         writeTestFile(t, tmpDir, "ca.crt", oldPKI.caPEM()),
+		Cert:           writeTestFile(t, tmpDir, "server.pem", oldPKI.issue(2)),
+		ReloadInterval: 100 * time.Millisecond,
+	}
+	client1Config := Config{
+		Transport: *transport,
+		Role:      AGENT,
+		UUID:      uuid.Generate().String(),
+		CAcert:    writeTestFile(t, tmpDir, "ca1.crt", oldPKI.caPEM()),
+		Cert:      writeTestFile(t, tmpDir, "client1.pem", oldPKI.issue(3)),
+	}
+	client2Config := Config{
+		Transport: *transport,
+		Role:      AGENT,
+		UUID:      uuid.Generate().String(),
+		CAcert:    writeTestFile(t, tmpDir, "ca2.crt", newPKI.caPEM()),
+		Cert:      writeTestFile(t, tmpDir, "client2.pem", newPKI.issue(3)),
+	}
+
+	server.t = t
+	client1.t = t
+	client1.cmdChannel = make(chan string)
+	client1.payload = []byte("rotation")
+	client2.t = t
+
+	go server.ssntp.Serve(&serverConfig, &server)
+	time.Sleep(500 * time.Millisecond)
+
+	err = client1.ssntp.Dial(&client1Config, &client1)
+	if err != nil {
+		server.ssntp.Stop()
+		t.Fatalf("Failed to connect: %s", err)
+	}
+
+	defer func() {
+		client1.ssntp.Close()
+		server.ssntp.Stop()
+	}()
+
+	writeTestFile(t, tmpDir, "ca.crt", newPKI.caPEM())
+	writeTestFile(t, tmpDir, "server.pem", newPKI.issue(2))
+	time.Sleep(500 * time.Millisecond)
+
+	err = client2.ssntp.Dial(&client2Config, &client2)
+	if err != nil {
+		t.Fatalf("Failed to connect with the new credentials: %s", err)
+	}
+	client2.ssntp.Close()
+
+	client1.ssntp.SendCommand(START, client1.payload)
+
+	select {
+	case cmd := <-client1.cmdChannel:
+		if cmd != START.String() {
+			t.Fatalf("Wrong command %s", cmd)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Session established with the old credentials was dropped")
+	}
+}
+
 func TestMain(m *testing.M) {
 	flag.Parse()
 
@@ -0,0 +1,184 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package ssntp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Transport is the SSNTP connection layer. Servers listen for client
+// connections through it, and clients dial servers through it.
+// SSNTP uses TLS over TCP or unix sockets by default, see the Config
+// Transport field. Callers can provide their own Transport through
+// the Config CustomTransport field, e.g. a MemoryTransport to run
+// SSNTP clients and servers in a single process.
+type Transport interface {
+	// Listen announces on the local address.
+	Listen(address string) (net.Listener, error)
+
+	// Dial connects to the server listening on address.
+	Dial(address string) (net.Conn, error)
+}
+
+// tlsTransport is the default TLS based transport, over a TCP or unix
+// socket network. Each new connection uses the current, possibly
+// reloaded, credentials.
+type tlsTransport struct {
+	network     string
+	credentials *credentials
+}
+
+func (t *tlsTransport) Listen(address string) (net.Listener, error) {
+	config := &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return t.credentials.config(), nil
+		},
+	}
+
+	return tls.Listen(t.network, address, config)
+}
+
+func (t *tlsTransport) Dial(address string) (net.Conn, error) {
+	config := t.credentials.config()
+	if config == nil {
+		return nil, fmt.Errorf("No valid TLS credentials")
+	}
+
+	return tls.Dial(t.network, address, config)
+}
+
+// transportNetwork returns the network for the TLS transport, as
+// configured by the Config Transport field.
+func transportNetwork(config *Config) string {
+	if config.Transport != "tcp" && config.Transport != "unix" {
+		return "tcp"
+	}
+
+	return config.Transport
+}
+
+// MemoryTransport is an in-process Transport. Clients and servers
+// sharing a MemoryTransport are connected through net.Pipe
+// connections, without any TLS layer. Certificates are not used, and
+// neither are role verifications.
+// A MemoryTransport is safe for concurrent use.
+type MemoryTransport struct {
+	sync.Mutex
+	listeners map[string]*memoryListener
+}
+
+// NewMemoryTransport creates a new, empty, in-process transport.
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{
+		listeners: make(map[string]*memoryListener),
+	}
+}
+
+// Listen announces on the in-process address. Addresses are free form
+// strings, but as for TCP, listening on a host less "host:port" address
+// accepts connections to that port on any host.
+func (t *MemoryTransport) Listen(address string) (net.Listener, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.listeners[address] != nil {
+		return nil, fmt.Errorf("Address %s already in use", address)
+	}
+
+	l := &memoryListener{
+		transport: t,
+		address:   memoryAddr(address),
+		conns:     make(chan net.Conn),
+		closed:    make(chan struct{}),
+	}
+	t.listeners[address] = l
+
+	return l, nil
+}
+
+// Dial connects to the in-process server listening on address.
+func (t *MemoryTransport) Dial(address string) (net.Conn, error) {
+	t.Lock()
+	l := t.listeners[address]
+	if l == nil {
+		if _, port, err := net.SplitHostPort(address); err == nil {
+			l = t.listeners[net.JoinHostPort("", port)]
+		}
+	}
+	t.Unlock()
+
+	if l == nil {
+		return nil, fmt.Errorf("Connection to %s refused", address)
+	}
+
+	server, client := net.Pipe()
+
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		server.Close()
+		client.Close()
+		return nil, fmt.Errorf("Connection to %s refused", address)
+	}
+}
+
+type memoryAddr string
+
+func (a memoryAddr) Network() string {
+	return "memory"
+}
+
+func (a memoryAddr) String() string {
+	return string(a)
+}
+
+type memoryListener struct {
+	transport *MemoryTransport
+	address   memoryAddr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("Listener on %s closed", l.address)
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.transport.Lock()
+		delete(l.transport.listeners, string(l.address))
+		l.transport.Unlock()
+
+		close(l.closed)
+	})
+
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return l.address
+}